@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/quantumghost/borg-tm/internal"
+)
+
+// printArchives prints the result of -list-archives.
+func printArchives(archives []internal.ListedArchive, jsonOutput bool) error {
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(archives)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ARCHIVE\tSTART\tID")
+	for _, a := range archives {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", a.Name, a.Start.Format("2006-01-02 15:04:05"), a.ID)
+	}
+	return w.Flush()
+}
+
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirmDelete asks on the terminal whether archive should be deleted.
+func confirmDelete(archive string, repo string) bool {
+	fmt.Fprintf(os.Stderr, "Delete archive %s from %s? This can't be undone. [y/N] ", archive, repo)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
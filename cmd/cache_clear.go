@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/quantumghost/borg-tm/internal"
+)
+
+func cacheClear(args []string) {
+	flags := flag.NewFlagSet("cache-clear", flag.ExitOnError)
+	baseDir := flags.String("borg-base-dir", "", "borg base dir whose cache is deleted, as given to the backup with -borg-base-dir")
+	lockFile := flags.String("lock-file", "", "lock file of borg-tm, the cache is not touched while it is held. By default the locks of all repositories are taken.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s cache-clear
+
+Deletes borg's cache below the borg base dir. borg rebuilds it on the next
+run, which can take a while for large repositories. The keys and config
+below the base dir are kept.
+
+Arguments:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *baseDir == "" {
+		invalidFlags("Need -borg-base-dir")
+	}
+	if os.Getuid() != 0 {
+		log.Fatalln("requires root privileges.")
+	}
+	if err := internal.ClearBorgCache(*baseDir, *lockFile); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/quantumghost/borg-tm/internal"
+)
+
+// exit codes of check-freshness
+const (
+	freshnessOK      = 0
+	freshnessStale   = 2
+	freshnessUnknown = 3
+)
+
+func checkFreshness(args []string) {
+	flags := flag.NewFlagSet("check-freshness", flag.ExitOnError)
+	maxAge := flags.Duration("max-age", 36*time.Hour, "maximum age of the newest successful backup")
+	stateFile := flags.String("state-file", "", "state file of the backups, by default the one of BORG_REPO")
+	hostname := flags.String("hostname", "", "hostname used in the archive names, as given to the backups")
+	backupName := flags.String("backup-name", internal.DefaultArchiveTemplate, "-backup-name as given to the backups")
+	var sources arrayFlags
+	flags.Var(&sources, "source", "with -separate-archives, a source whose archives count, as given to the backups. Can be used multiple times, by default all count.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s check-freshness
+
+Checks that the newest successful backup of this host is at most -max-age
+old, for use by monitoring. Exits with %d if it is, %d if it is older and %d
+if no backup could be found. Uses the state file, falling back to
+`+"`borg list`"+` (with BORG_REPO and BORG_PASSPHRASE) if that is missing or stale.
+Doesn't need root and doesn't take the lock.
+
+Arguments:
+`, os.Args[0], freshnessOK, freshnessStale, freshnessUnknown)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *stateFile == "" {
+		*stateFile = internal.DefaultStateFile(os.Getenv("BORG_REPO"))
+	}
+
+	found, err := internal.CheckFreshness(context.Background(), internal.FreshnessOptions{
+		StateFile:  *stateFile,
+		MaxAge:     *maxAge,
+		Hostname:   *hostname,
+		BackupName: *backupName,
+		Sources:    sources,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "UNKNOWN: %v\n", err)
+		os.Exit(freshnessUnknown)
+	}
+	age := time.Since(found.Time).Round(time.Second)
+	if age > *maxAge {
+		fmt.Printf("STALE: newest backup %s is %s old (from %s), more than %s\n", found.Archive, age, found.Source, *maxAge)
+		os.Exit(freshnessStale)
+	}
+	fmt.Printf("OK: newest backup %s is %s old (from %s)\n", found.Archive, age, found.Source)
+}
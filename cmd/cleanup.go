@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/quantumghost/borg-tm/internal"
+)
+
+func cleanupCommand(args []string) {
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	journalFile := flags.String("journal-file", "", "journal of the backups, as given to them. By default it is derived from BORG_REPO.")
+	lockFile := flags.String("lock-file", "", "lock file for borg-tm, as given to the backups. By default it is derived from BORG_REPO.")
+	snapUtilPath := flags.String("snaputil-path", "", "(optional) location of snapUtil, as for backups")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s cleanup
+
+Recovers from a crashed or killed run. Every backup records the snapshots it
+created and the mountpoints it mounted in a journal; this unmounts what is
+still mounted, removes the snapshots and clears the journal. It waits for
+nothing: while a backup holds the lock, it fails. Running it when nothing was
+left behind does nothing.
+
+Environment variables: BORG_REPO, to find the journal and lock file by
+default, and BORG_TM_SNAPUTIL, as for backups.
+
+Arguments:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if os.Getuid() != 0 {
+		log.Fatalln("requires root privileges.")
+	}
+
+	err := internal.Cleanup(context.Background(), internal.CleanupOptions{
+		JournalFile:  *journalFile,
+		LockFile:     *lockFile,
+		SnapUtilPath: *snapUtilPath,
+	})
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
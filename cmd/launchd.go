@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/quantumghost/borg-tm/internal"
+)
+
+// flags of the launchd modes, which the LaunchDaemon doesn't get
+var launchdFlags = map[string]bool{
+	"install-launchd":   true,
+	"uninstall-launchd": true,
+	"launchd-status":    true,
+	"print-plist":       true,
+	"schedule":          true,
+	"launchd-log":       true,
+}
+
+func isBoolFlag(name string) bool {
+	f := flag.Lookup(name)
+	if f == nil {
+		return false
+	}
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// launchdArgs returns the flags borg-tm was started with, as the
+// LaunchDaemon runs it: without the launchd flags, and with -config as an
+// absolute path. The plist is readable by everyone, so -ping-url, which
+// may contain a token, has to be in the config file.
+func launchdArgs(args []string) ([]string, error) {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" || arg == "--" {
+			kept = append(kept, arg)
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		value, hasValue := "", false
+		if idx := strings.Index(name, "="); idx >= 0 {
+			name, value, hasValue = name[:idx], name[idx+1:], true
+		}
+		if !hasValue && !isBoolFlag(name) && i+1 < len(args) {
+			i++
+			value, hasValue = args[i], true
+		}
+		switch {
+		case launchdFlags[name]:
+			continue
+		case name == "ping-url":
+			return nil, errors.New("-ping-url would be readable by everyone in the plist, give ping-url in the -config file instead")
+		case name == "config":
+			abs, err := filepath.Abs(value)
+			if err != nil {
+				return nil, errors.Wrap(err, "error while resolving -config")
+			}
+			value = abs
+		}
+		if hasValue {
+			kept = append(kept, "-"+name+"="+value)
+		} else {
+			kept = append(kept, "-"+name)
+		}
+	}
+	return kept, nil
+}
+
+// launchdJob builds the LaunchDaemon for this invocation.
+func launchdJob(schedules []string, logPath string) (internal.LaunchdJob, error) {
+	var job internal.LaunchdJob
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return job, errors.Wrap(err, "error while finding the borg-tm binary")
+	}
+	args, err := launchdArgs(os.Args[1:])
+	if err != nil {
+		return job, err
+	}
+	job.ProgramArguments = append([]string{exe}, args...)
+	for _, s := range schedules {
+		t, err := internal.ParseLaunchdTime(s)
+		if err != nil {
+			return job, err
+		}
+		job.Schedule = append(job.Schedule, t)
+	}
+	// relative paths among the flags keep working
+	job.WorkingDirectory, err = os.Getwd()
+	if err != nil {
+		return job, errors.Wrap(err, "error while finding the working directory")
+	}
+	job.LogPath, err = filepath.Abs(logPath)
+	if err != nil {
+		return job, errors.Wrap(err, "error while resolving -launchd-log")
+	}
+	return job, nil
+}
+
+// printLaunchdStatus prints the result of -launchd-status.
+func printLaunchdStatus() error {
+	status, err := internal.GetLaunchdStatus()
+	if err != nil {
+		return err
+	}
+	if !status.Installed {
+		fmt.Printf("%s isn't installed\n", internal.LaunchdPlistPath)
+	} else {
+		fmt.Printf("Installed: %s\n", internal.LaunchdPlistPath)
+	}
+	if !status.Loaded {
+		fmt.Printf("%s isn't loaded\n", internal.LaunchdLabel)
+		return nil
+	}
+	fmt.Printf("Loaded: %s, state %s, %d runs", internal.LaunchdLabel, status.State, status.Runs)
+	if status.LastExitCode != "" {
+		fmt.Printf(", last exit code %s", status.LastExitCode)
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/quantumghost/borg-tm/internal"
+)
+
+func listMounts(args []string) {
+	flags := flag.NewFlagSet("list-mounts", flag.ExitOnError)
+	var mountpoints arrayFlags
+	flags.Var(&mountpoints, "mountpoint", "configured mountpoint, anything mounted there is listed and considered owned by borg-tm. Can be used multiple times.")
+	jsonOutput := flags.Bool("json", false, "print the mounts as JSON")
+	unmount := flags.Bool("unmount", false, "unmount the listed mounts owned by borg-tm, asking for confirmation for each")
+	yes := flags.Bool("yes", false, "with -unmount, don't ask for confirmation")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s list-mounts
+
+Lists mounted APFS snapshots and anything mounted on the given mountpoints,
+and whether borg-tm considers the mount its own.
+
+Arguments:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	mounts, err := internal.ListSnapshotMounts(mountpoints)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(mounts); err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DEVICE\tSNAPSHOT\tMOUNTPOINT\tOWNED")
+		for _, m := range mounts {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%v\n", m.Device, m.Snapshot, m.Mountpoint, m.Owned)
+		}
+		w.Flush()
+	}
+	if !*unmount {
+		return
+	}
+
+	if os.Getuid() != 0 {
+		log.Fatalln("requires root privileges.")
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	failed := false
+	for _, m := range mounts {
+		if !m.Owned {
+			continue
+		}
+		if !*yes {
+			fmt.Fprintf(os.Stderr, "Unmount %s (%s)? [y/N] ", m.Mountpoint, m.Snapshot)
+			answer, _ := stdin.ReadString('\n')
+			if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+				continue
+			}
+		}
+		if err := internal.Unmount(m.Mountpoint); err != nil {
+			fmt.Fprintf(os.Stderr, "unmount %s failed: %v\n", m.Mountpoint, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Unmounted %s\n", m.Mountpoint)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
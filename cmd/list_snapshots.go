@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/quantumghost/borg-tm/internal"
+)
+
+// printSnapshotLists prints the result of -list-snapshots.
+func printSnapshotLists(lists []internal.SourceSnapshots, jsonOutput bool) error {
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(lists)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tSNAPSHOT\tCREATED\tKIND\tBORG-TM\tSELECTED")
+	for _, l := range lists {
+		for _, s := range l.Snapshots {
+			created := "-"
+			if s.Created != nil {
+				created = s.Created.Format("2006-01-02 15:04:05")
+			}
+			selected := ""
+			if s.Selected {
+				selected = "*"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%s\n", l.Source, s.Name, created, s.Kind, s.BorgTM, selected)
+		}
+		if l.NoneSelected != "" {
+			fmt.Fprintf(w, "%s\t(none selected: %s)\t\t\t\t\n", l.Source, l.NoneSelected)
+		}
+	}
+	return w.Flush()
+}
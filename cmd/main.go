@@ -7,11 +7,16 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/quantumghost/borg-tm/consts"
 	"github.com/quantumghost/borg-tm/internal"
+	"github.com/quantumghost/borg-tm/internal/config"
 )
 
 // https://stackoverflow.com/questions/28322997/how-to-get-a-list-of-values-into-a-flag-in-golang
@@ -26,21 +31,261 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
+// dayDuration is a duration flag that also accepts whole days, e.g. 30d.
+type dayDuration time.Duration
+
+func (d *dayDuration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *dayDuration) Set(value string) error {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return errors.Errorf("invalid duration %q", value)
+		}
+		*d = dayDuration(time.Duration(days) * 24 * time.Hour)
+		return nil
+	}
+	v, err := time.ParseDuration(value)
+	*d = dayDuration(v)
+	return err
+}
+
+// invalidFlags logs like log.Fatalln and exits with internal.ExitValidation,
+// for flags that are invalid or don't go together.
+func invalidFlags(v ...interface{}) {
+	log.Println(v...)
+	os.Exit(internal.ExitValidation)
+}
+
+// invalidFlagsf is invalidFlags with a format.
+func invalidFlagsf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	os.Exit(internal.ExitValidation)
+}
+
+// parseMapping splits a -map value into source and mountpoint at the last =,
+// so that sources may contain = themselves.
+func parseMapping(value string) (string, string, error) {
+	idx := strings.LastIndex(value, "=")
+	if idx <= 0 || idx == len(value)-1 {
+		return "", "", errors.Errorf("invalid -map %q, expected source=mountpoint", value)
+	}
+	return value[:idx], value[idx+1:], nil
+}
+
+// configRepoTarget turns a [repos.NAME] table of -config into a repository
+// to back up to. Its keychain item is looked up for -keychain-user.
+func configRepoTarget(r config.Repo, keychainUser string) (internal.RepoTarget, error) {
+	t := internal.RepoTarget{Name: r.Name, Repo: r.Repo}
+	sources := 0
+	if r.OpItem != "" {
+		t.PassphraseSource = internal.NewOnePasswordSource(r.OpItem)
+		sources++
+	}
+	if r.PassphraseFile != "" {
+		t.PassphraseSource = internal.NewPassphraseFileSource(r.PassphraseFile)
+		sources++
+	}
+	if r.KeychainItem != "" {
+		t.PassphraseSource = internal.NewKeychainSource(r.KeychainItem, keychainUser)
+		sources++
+	}
+	if sources > 1 {
+		return t, errors.Errorf("repo %s: only one of op-item, passphrase-file and keychain-item can be given", r.Name)
+	}
+	if r.BorgArgs != "" {
+		args, err := internal.SplitShellWords(r.BorgArgs)
+		if err != nil {
+			return t, errors.Errorf("repo %s: invalid borg-args %q: %v", r.Name, r.BorgArgs, err)
+		}
+		t.BorgArgs = args
+	}
+	return t, nil
+}
+
 func main() {
-	var borgArgs, lockFile, backupName string
-	var mountpoints, sources, snapshotsToUse arrayFlags
-	var useExistingSnapshots, dryRun bool
-	flag.StringVar(&borgArgs, "borg-args", "", "argument passed to `borg create`")
+	var doctor bool
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "selftest-metadata":
+			selfTestMetadata(os.Args[2:])
+			return
+		case "prune-snapshots":
+			pruneSnapshots(os.Args[2:])
+			return
+		case "list-mounts":
+			listMounts(os.Args[2:])
+			return
+		case "unmount":
+			unmountCommand(os.Args[2:])
+			return
+		case "cache-clear":
+			cacheClear(os.Args[2:])
+			return
+		case "recreate":
+			recreate(os.Args[2:])
+			return
+		case "check-freshness":
+			checkFreshness(os.Args[2:])
+			return
+		case "cleanup":
+			cleanupCommand(os.Args[2:])
+			return
+		case "doctor":
+			// takes the same flags as a backup
+			doctor = true
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
+	var borgArgs, lockFile, backupName, label, historyFile, envFile, opItem, umaskFlag, chunkerParams, stateFile, hostname, ioPolicy, snapshotSpreadPolicy, pprofAddr, cpuProfile, memProfile, progressFifo, borgBaseDir, snapshotListTool, artifactsDir, keepWithin, configFile, profile, pruneArgs, snapshotTool, snapUtilPath, logLevel, reportFile, pingURL, journalFile, snapshotPrefix, excludeFrom, passphraseFile, keychainItem, keychainUser, checkMode, initEncryption, keyExportPath, keyExportFormat, deleteArchive, restore, restoreTarget, changeDetection, preSnapshotHook, postSnapshotHook, preBorgHook, postRunHook, launchdLog string
+	var mountpoints, sources, snapshotsToUse, onMount, excludeSources, excludes, fullfsyncPaths, quiesce, unquiesce, mappings, repos, schedules arrayFlags
+	var useExistingSnapshots, dryRun, sparseFlag, ejectAfter, thermalAware, keepSnapshots, consistentSnapshots, continueOnError, recordChanges, pruneArchives, pruneAllHosts, sshControlMaster, noSync, reportChanged, noAutoExcludeRepo, noAutoExcludeNested, acceptRepoChanges, acceptNewRepo, compact, statsSummary, failOnWarnings, logJSON, pingStart, notify, forceMountpoint, noAutoRecover, listSnapshots, jsonOutput, separateArchives, storeOriginalPaths, excludeCaches, honorTMExclusions, allowUnencrypted, keychainStore, check, initIfMissing, keyExportOverwrite, listArchives, yes, restoreMount, force, verifyAfterBackup, skipIfUnchanged, showProgress, installLaunchd, uninstallLaunchd, launchdStatus, printPlist bool
+	var onMountDebounce, thermalInterval, thermalCooldown, snapshotRetentionWithin, consistencyWindow, maxSnapshotSpread, quiesceTimeout, unmountRetryDelay, lockWait, borgLockWait, borgRetryDelay, hookTimeout time.Duration
+	var snapshotRetention, snapshotRetries, unmountRetries, borgRetries, verifySample, keepDaily, keepWeekly, keepMonthly, tmExclusionDepth int
+	var thermalMaxLoad float64
+	var quotaWarnPercent, quotaAbortPercent, sizeAnomalyFactor float64
+	flag.StringVar(&borgArgs, "borg-args", "", "arguments passed to `borg create`, split into words like a shell does (e.g. --comment 'nightly run')")
 	// flag.StringVar(&mountpoint, "mountpoint", "/tmp/snapshot",
 	// 	"mountpoint for snapshot, should be kept the same across backups")
 	flag.Var(&mountpoints, "mountpoint", "mountpoint(s) for snapshot(s), should be kept the same across backups")
-	flag.StringVar(&lockFile, "lock-file", "/var/run/borg.lock", "lock file for borg-tm")
+	flag.Var(&repos, "repo", "repository to back up to. Can be repeated to back up to several repositories in one run, from the same snapshots. Takes precedence over repo of -config, which takes precedence over BORG_REPO. borg gets it as BORG_REPO in its own environment only.")
+	flag.StringVar(&lockFile, "lock-file", "", "lock file for borg-tm. By default it is /var/run/borg-tm-<hash of BORG_REPO>.lock, so that backups to different repositories can run at the same time.")
 	// flag.StringVar(&source, "source", "/", "source to back up")
-	flag.Var(&sources, "source", "source(s) to back up. if any of these are the same as the mountpoint parameter corresponding to them, they will not be mounted, but the folder will be used as if it were already mounted.")
-	flag.Var(&snapshotsToUse, "snapshotToUse", "(optional) snapshot(s) to force as the source for the back up instead of creating snapshots or using the latest snapshot. Leave arguments empty strings to use the latest snapshot for a corresponding source and mountpoint. Provide `--use-existing-snapshots` when using this, or it is an error.")
-	flag.StringVar(&backupName, "backup-name", "", "use a specific backup name instead of an auto-generated one.")
+	flag.Var(&sources, "source", "source(s) to back up, either a path or `uuid:<APFS volume UUID>` for a volume wherever it is currently mounted. if any of these are the same as the mountpoint parameter corresponding to them, they will not be mounted, but the folder will be used as if it were already mounted. A directory inside a volume (e.g. /Users) snapshots and mounts the volume and backs up only the directory; directories on the same volume share its snapshot and the mountpoint of the first of them.")
+	flag.Var(&snapshotsToUse, "snapshot", "(optional) snapshot to back up instead of creating one, given once per -source in the same order. An empty string picks the latest snapshot of that source. Implies -use-existing-snapshots.")
+	flag.Var(&snapshotsToUse, "snapshotToUse", "same as -snapshot")
+	flag.Var(&mappings, "map", "`source=mountpoint` pair, e.g. /System/Volumes/Data=/tmp/snapshot-data, instead of separate -source and -mountpoint flags. Split at the last =. Can be used multiple times.")
+	flag.StringVar(&backupName, "backup-name", internal.DefaultArchiveTemplate, "`template` for the archive name. Placeholders: {hostname}, {now} or {now:LAYOUT} with a Go time layout (e.g. {now:2006-01-02}), {snapshot} (the snapshot of the first source) and {source} (the last element of the first source, root for /).")
 	flag.BoolVar(&useExistingSnapshots, "use-existing-snapshots", false, "use the latest existing snapshot on the source(s) to back up from. If not provided, will create a snapshot.")
 	flag.BoolVar(&dryRun, "dry-run", false, "create and remove snapshots, but don't run borg, only print the borg command that would have been executed.")
+	flag.Float64Var(&quotaWarnPercent, "quota-warn-percent", 0, "warn when the repository's storage quota utilization (as reported by `borg info`) reaches this percentage. 0 disables the warning.")
+	flag.Float64Var(&quotaAbortPercent, "quota-abort-percent", 0, "abort before creating any snapshot when the repository's storage quota utilization reaches this percentage. 0 disables the check.")
+	flag.StringVar(&label, "label", "default", "label for this kind of backup (e.g. `nightly`). Size anomaly detection only compares runs with the same label.")
+	flag.StringVar(&historyFile, "history-file", "", "file recording the archive sizes of previous runs. By default it is /var/db/borg-tm/history-<hash of BORG_REPO>.json.")
+	flag.Float64Var(&sizeAnomalyFactor, "size-anomaly-factor", 0, "warn when the archive's original or deduplicated size is larger or smaller than the median of recent runs with the same label by more than this factor (e.g. 3). 0 disables the check.")
+	flag.StringVar(&envFile, "env-file", "", "file with KEY=VALUE lines (e.g. BORG_REPO and BORG_PASSPHRASE) applied to the environment before anything else. Must be owned by root with mode 0600.")
+	flag.StringVar(&opItem, "op-item", "", "read the repository passphrase with the 1Password CLI (`op read`) from this secret reference, e.g. `op://Vault/borg/passphrase`. Takes precedence over BORG_PASSPHRASE.")
+	flag.StringVar(&passphraseFile, "passphrase-file", "", "read the repository passphrase from this file, without surrounding whitespace. It is only passed to borg and must not be accessible by group or others. Takes precedence over BORG_PASSPHRASE.")
+	flag.StringVar(&keychainItem, "keychain-item", "", "read the repository passphrase from the generic password with this service name in the macOS keychain. Takes precedence over BORG_PASSPHRASE.")
+	flag.StringVar(&keychainUser, "keychain-user", "", "with -keychain-item, use the login keychain of this user instead of root's keychain. The keychain must be unlocked, i.e. the user logged in.")
+	flag.BoolVar(&keychainStore, "keychain-store", false, "ask for the passphrase and store it in -keychain-item (of -keychain-user), then exit")
+	flag.BoolVar(&allowUnencrypted, "allow-unencrypted", false, "run without any passphrase, for repositories with encryption none or a key without passphrase")
+	flag.StringVar(&umaskFlag, "umask", "", "octal umask (e.g. `077`) passed to every borg invocation via --umask and applied to files created by borg-tm itself")
+	flag.BoolVar(&sparseFlag, "sparse", false, "pass --sparse to `borg create` (requires borg 1.2+). Enabled automatically when a source contains Docker, Parallels or UTM data; use -sparse=false to disable.")
+	flag.StringVar(&chunkerParams, "chunker-params", "", "chunker params passed to `borg create`: `default`, `fixed:4M`, `fixed,BLOCK[,HEADER]` or `MIN_EXP,MAX_EXP,MASK_BITS,WINDOW_SIZE` (e.g. 19,23,21,4095). Changing it breaks deduplication against existing archives.")
+	flag.StringVar(&stateFile, "state-file", "", "file recording settings of the previous run, used to warn about changes. By default it is /var/db/borg-tm/state-<hash of BORG_REPO>.json.")
+	flag.BoolVar(&noAutoRecover, "no-auto-recover", false, "don't clean up what an interrupted run left in the journal before backing up, e.g. to inspect it first. See the cleanup subcommand.")
+	flag.StringVar(&snapshotPrefix, "snapshot-prefix", internal.DefaultSnapshotPrefix, "start of the names of the snapshots borg-tm creates, followed by the Unix time. Only snapshots named with it are pruned and cleaned up, so give it to prune-snapshots as well.")
+	flag.StringVar(&journalFile, "journal-file", "", "file recording the snapshots and mounts of the running backup, read by the cleanup subcommand after a crash. By default it is /var/db/borg-tm/journal-<hash of BORG_REPO>.json.")
+	flag.StringVar(&hostname, "hostname", "", "hostname used in archive names. Defaults to the system hostname, lowercased and without a `.local` suffix.")
+	flag.Var(&onMount, "on-mount", "(optional) wait until this volume (e.g. `/Volumes/BackupDisk`) is mounted before starting the backup. Can be repeated, the first volume to appear triggers the run.")
+	flag.DurationVar(&onMountDebounce, "on-mount-debounce", 30*time.Second, "how long a volume given with -on-mount must stay mounted before the backup starts")
+	flag.BoolVar(&ejectAfter, "eject-after", false, "eject the -on-mount volume with `diskutil eject` after a successful backup")
+	flag.BoolVar(&thermalAware, "thermal-aware", false, "pause borg for -thermal-cooldown whenever `pmset -g therm` reports serious thermal pressure or the load exceeds -thermal-max-load. Useful on fanless laptops.")
+	flag.DurationVar(&thermalInterval, "thermal-interval", 30*time.Second, "how often -thermal-aware samples thermal pressure and load")
+	flag.DurationVar(&thermalCooldown, "thermal-cooldown", 2*time.Minute, "how long -thermal-aware pauses borg")
+	flag.Float64Var(&thermalMaxLoad, "thermal-max-load", float64(2*runtime.NumCPU()), "1 minute load average at which -thermal-aware pauses borg. 0 only considers thermal pressure.")
+	flag.StringVar(&ioPolicy, "io-policy", internal.IOPolicyStandard, "disk I/O policy for borg: `standard` or `throttle` (runs borg through `taskpolicy -d throttle` so interactive apps keep their disk bandwidth)")
+	flag.BoolVar(&keepSnapshots, "keep-snapshot", false, "keep the snapshots created for the backup instead of removing them afterwards")
+	flag.IntVar(&snapshotRetention, "snapshot-retention", 0, "after a successful backup, remove all but this many of the snapshots borg-tm created on each source (see the prune-snapshots subcommand)")
+	flag.DurationVar(&snapshotRetentionWithin, "snapshot-retention-within", 0, "with -snapshot-retention, additionally keep the snapshots created within this duration")
+	flag.BoolVar(&consistentSnapshots, "consistent-snapshots", false, "with -use-existing-snapshots, pick the newest set of snapshots that were taken within -consistency-window of each other on all sources, instead of each source's latest snapshot")
+	flag.DurationVar(&consistencyWindow, "consistency-window", 5*time.Minute, "maximum time between the snapshots picked by -consistent-snapshots")
+	flag.DurationVar(&maxSnapshotSpread, "max-snapshot-spread", 0, "maximum time between the creation of the first and the last snapshot when snapshotting multiple sources. 0 disables the check.")
+	flag.StringVar(&snapshotSpreadPolicy, "snapshot-spread-policy", internal.SpreadPolicyRetry, "what to do when -max-snapshot-spread is exceeded: `retry` the snapshots once, or `fail`")
+	flag.BoolVar(&reportChanged, "report-changed-since-snapshot", false, "after the backup, report how many files on the live sources were modified after their snapshot was taken (and thus aren't in the archive). Informational only.")
+	flag.BoolVar(&noAutoExcludeRepo, "no-auto-exclude-repo", false, "don't exclude a local BORG_REPO and the borg cache directory from the archive when they are on one of the sources")
+	flag.BoolVar(&noAutoExcludeNested, "no-auto-exclude-nested", false, "don't exclude sources and mountpoints that lie inside another source from that source's tree in the archive")
+	flag.Var(&excludeSources, "exclude-source", "(optional) exclude this path on the live filesystem (e.g. `/Users/shared/scratch`) from the archive. It is rewritten to an anchored pattern below the mountpoint of the source containing it, so unlike a borg --exclude pattern it never matches similarly named paths elsewhere. Can be repeated.")
+	flag.StringVar(&pprofAddr, "pprof-addr", "", "(optional) serve net/http/pprof on this address (e.g. `127.0.0.1:6060`) while running")
+	flag.StringVar(&cpuProfile, "cpuprofile", "", "(optional) write a CPU profile of borg-tm itself to this file")
+	flag.StringVar(&memProfile, "memprofile", "", "(optional) write a heap profile of borg-tm itself to this file when the run ends")
+	flag.BoolVar(&installLaunchd, "install-launchd", false, "instead of backing up, install "+internal.LaunchdPlistPath+" to back up with the other flags given at every -schedule, and load it with launchctl bootstrap. Give the settings with -config, the plist is readable by everyone.")
+	flag.BoolVar(&uninstallLaunchd, "uninstall-launchd", false, "unload and remove the LaunchDaemon of -install-launchd")
+	flag.BoolVar(&launchdStatus, "launchd-status", false, "show whether the LaunchDaemon is installed and loaded, and how its last run exited")
+	flag.BoolVar(&printPlist, "print-plist", false, "print the plist -install-launchd would install, without installing it")
+	flag.Var(&schedules, "schedule", "time of day for -install-launchd to start the backup at, e.g. `02:30`. Can be repeated.")
+	flag.StringVar(&launchdLog, "launchd-log", internal.DefaultLaunchdLog, "file the LaunchDaemon of -install-launchd writes its output to")
+	flag.BoolVar(&showProgress, "progress", false, "show the progress of borg create: one updating line on a terminal, otherwise a log entry with borg's counters every 30 seconds (also with -log-json)")
+	flag.StringVar(&progressFifo, "progress-fifo", "", "(optional) write progress as JSON lines (phase changes, borg's counters and a final summary) to this named pipe, e.g. `/var/run/borg-tm.progress`. It is created if absent and removed afterwards. Events are dropped while nobody reads.")
+	flag.StringVar(&borgBaseDir, "borg-base-dir", "", "(optional) directory (e.g. `/var/lib/borg-tm/borg`) used as BORG_BASE_DIR for every borg invocation, instead of root's home. Root's existing borg cache and config are moved there when it is created.")
+	flag.BoolVar(&acceptRepoChanges, "accept-repo-changes", false, "answer yes when borg asks whether to access a relocated repository or an unknown unencrypted one (e.g. after a server rebuild). Without it, borg may ask on a terminal and is told no otherwise.")
+	flag.StringVar(&snapshotListTool, "snapshot-list-tool", internal.SnapshotListAuto, "how snapshots are listed: `diskutil` (diskutil apfs listSnapshots), `tmutil` (tmutil listlocalsnapshots) or `auto` (diskutil, falling back to tmutil)")
+	flag.StringVar(&snapshotTool, "snapshot-tool", internal.SnapshotToolAuto, "how snapshots are created: `snaputil` (./apfs/snapUtil, needs the com.apple.developer.vfs.snapshot entitlement), `tmutil` (tmutil localsnapshot, which snapshots all local volumes and names them itself) or `auto` (snapUtil, falling back to tmutil when it is missing or lacks the entitlement)")
+	flag.StringVar(&snapUtilPath, "snaputil-path", "", "(optional) location of snapUtil. Also settable with BORG_TM_SNAPUTIL. By default it is looked up next to the borg-tm executable, in an apfs directory next to it, in PATH and in ./apfs.")
+	flag.IntVar(&snapshotRetries, "snapshot-retries", 3, "how often creating a snapshot is retried when it fails because another snapshot operation (e.g. Time Machine) is busy with the volume")
+	flag.BoolVar(&continueOnError, "continue-on-error", false, "when the snapshot or mount of a source fails, leave that source out and back up the others. The run then exits with status 2 and lists the failed sources.")
+	flag.BoolVar(&recordChanges, "record-changes", false, "record the files borg added, modified or failed to read (borg create --list --filter=AME) in a compressed listing below -artifacts-dir, and their counts in the history file")
+	flag.StringVar(&artifactsDir, "artifacts-dir", "/var/db/borg-tm/runs", "directory in which every run with -record-changes gets its own directory for the listing")
+	flag.BoolVar(&pruneArchives, "prune", false, "after a successful backup, run `borg prune` with -keep-within, -keep-daily, -keep-weekly and -keep-monthly on this host's archives. If the backup succeeds but pruning fails, the run exits with status 4. With -dry-run the prune command is only printed.")
+	flag.StringVar(&keepWithin, "keep-within", "", "with -prune, keep all archives within this interval (e.g. `7d`)")
+	flag.IntVar(&keepDaily, "keep-daily", 0, "with -prune, number of daily archives to keep")
+	flag.IntVar(&keepWeekly, "keep-weekly", 0, "with -prune, number of weekly archives to keep")
+	flag.IntVar(&keepMonthly, "keep-monthly", 0, "with -prune, number of monthly archives to keep")
+	flag.StringVar(&pruneArgs, "prune-args", "", "(optional) arguments passed to `borg prune`, e.g. \"--keep-daily 7 --keep-weekly 4\". Implies -prune. Selecting archives (--glob-archives, -a, --prefix) needs -prune-all-hosts.")
+	checkInterval := dayDuration(30 * 24 * time.Hour)
+	flag.BoolVar(&initIfMissing, "init-if-missing", false, "run borg init during the preflight if borg reports that the repository doesn't exist yet. Other failures of borg info, e.g. of ssh, never create one.")
+	flag.StringVar(&initEncryption, "init-encryption", internal.DefaultInitEncryption, "encryption mode of the repository -init-if-missing creates, passed to borg init --encryption. The passphrase is set up as for the backups.")
+	flag.StringVar(&keyExportPath, "key-export-path", "", "(optional) export the repository key with borg key export to this file (mode 0600) when it doesn't exist yet, e.g. right after -init-if-missing")
+	flag.StringVar(&keyExportFormat, "key-export-format", internal.KeyExportBinary, "format of the -key-export-path file: binary (for borg key import) or paper (borg key export --paper)")
+	flag.BoolVar(&keyExportOverwrite, "key-export-overwrite", false, "export the key to -key-export-path on every run, replacing the file")
+	flag.BoolVar(&verifyAfterBackup, "verify-after-backup", false, "after borg create, while the snapshots are still mounted, compare -verify-sample random files of the archive (borg extract --stdout) with the snapshots by size and SHA-256. Mismatches are listed and exit with status 13.")
+	flag.IntVar(&verifySample, "verify-sample", internal.DefaultVerifySample, "how many files -verify-after-backup compares")
+	flag.BoolVar(&skipIfUnchanged, "skip-if-unchanged", false, "after mounting the snapshots, skip borg create if nothing changed since the last archive (see -change-detection). The run counts as a success and pings as one; the report says \"skipped, unchanged\".")
+	flag.StringVar(&changeDetection, "change-detection", internal.ChangeDetectionDryRun, "how -skip-if-unchanged finds changes: borg-dry-run (borg create --dry-run --list --filter=AME, uses borg's files cache but doesn't notice deleted files) or manifest (sizes and mtimes of all files compared with the previous run, notices deleted files but also counts changes of excluded ones)")
+	flag.BoolVar(&check, "check", false, "after a successful backup, run `borg check` if the last one that passed is older than -check-interval. A failed check exits with status 12.")
+	flag.Var(&checkInterval, "check-interval", "time between -check runs, as a duration or in days (e.g. 30d)")
+	flag.StringVar(&checkMode, "check-mode", internal.CheckModeRepository, "what -check checks: repository (borg check --repository-only) or archives (--archives-only --last 1)")
+	flag.BoolVar(&compact, "compact", false, "after a successful backup and -prune, run `borg compact` to free the space of deleted archives. Skipped for borg older than 1.2, which doesn't need it.")
+	flag.BoolVar(&pruneAllHosts, "prune-all-hosts", false, "with -prune, apply the rules to the archives of every host in the repository instead of only this host's, as told apart by -backup-name")
+	flag.BoolVar(&sshControlMaster, "ssh-control-master", false, "share one OpenSSH connection (ControlMaster) between all borg invocations of a run, so key exchange and 2FA happen only once")
+	flag.BoolVar(&noSync, "no-sync", false, "don't call sync(2) before creating the snapshots")
+	flag.Var(&fullfsyncPaths, "fullfsync-path", "(optional) file (e.g. a database) flushed with F_FULLFSYNC before creating the snapshots, so its contents are on the disk itself. Can be repeated.")
+	flag.Var(&quiesce, "quiesce", "(optional) `source=command` run with sh right before the snapshot of source is created, e.g. to pause a VM. Needs a matching -unquiesce. Can be repeated for different sources.")
+	flag.Var(&unquiesce, "unquiesce", "(optional) `source=command` run right after the snapshot of source was created, even if that failed")
+	flag.DurationVar(&quiesceTimeout, "quiesce-timeout", time.Minute, "after how long -quiesce and -unquiesce commands are killed")
+	flag.StringVar(&preSnapshotHook, "pre-snapshot-hook", "", "(optional) command run with sh right before the snapshots are created, e.g. to stop a database. If it fails, the run stops before anything is created. Not run with -use-existing-snapshots.")
+	flag.StringVar(&postSnapshotHook, "post-snapshot-hook", "", "(optional) command run right after the snapshots were created, even if that failed. A failure is logged, the backup goes on.")
+	flag.StringVar(&preBorgHook, "pre-borg-hook", "", "(optional) command run right before borg create. If it fails, the run stops.")
+	flag.StringVar(&postRunHook, "post-run-hook", "", "(optional) command run at the end of every run, also a failed one, with BORG_TM_STATUS (success or failure), BORG_TM_ARCHIVE and BORG_TM_ERROR in its environment")
+	flag.DurationVar(&hookTimeout, "hook-timeout", internal.DefaultHookTimeout, "after how long the -*-hook commands are killed. Their output is logged once they finish.")
+	flag.BoolVar(&acceptNewRepo, "accept-new-repo", false, "back up even if BORG_REPO is a different repository than the one previous runs used, and remember the new one. Without it, such a run exits with status 3.")
+	flag.StringVar(&configFile, "config", "", "(optional) TOML file (e.g. `/etc/borg-tm.toml`) with the keys source, mountpoint, borg-args, lock-file, dry-run, repo, env-file, op-item and ping-url, and [repos.NAME] tables for more repositories. Flags given on the command line override it, repo overrides BORG_REPO.")
+	flag.StringVar(&profile, "profile", "", "with -config, also apply the settings of the table [profiles.NAME]")
+	flag.BoolVar(&statsSummary, "stats-summary", false, "run borg create with --json and print the size, deduplication ratio, file count and duration of the archive at the end")
+	flag.BoolVar(&failOnWarnings, "fail-on-warnings", false, "fail when borg exits with warnings (status 1, e.g. a file changed while it was read). By default those runs count as successful.")
+	flag.StringVar(&logLevel, "log-level", "info", "minimum level of the messages logged: debug, info, warn or error. Debug also shows the commands run for snapshots and mounts.")
+	flag.BoolVar(&logJSON, "log-json", false, "log one JSON object per line (time, level, msg, phase, source, snapshot, duration) instead of plain text. borg's own output is not affected.")
+	flag.StringVar(&reportFile, "report-file", "", "(optional) write a JSON report of the run to this file (e.g. `/var/log/borg-tm/last-run.json`), also when it fails: start and end time, snapshot per source, archive name, borg exit status, archive stats (with -stats-summary) and the error")
+	flag.StringVar(&pingURL, "ping-url", "", "(optional) monitoring URL (e.g. healthchecks.io) fetched when a run succeeds. Failures POST the error to `URL`/fail. Also settable with BORG_TM_PING_URL or ping-url in -config, which keeps it out of ps.")
+	flag.BoolVar(&pingStart, "ping-start", false, "also fetch the -ping-url with /start appended when a run begins")
+	flag.BoolVar(&notify, "notify", false, "show a notification to the user logged in at the console when the backup finishes or fails. Nothing is shown without a console session.")
+	flag.IntVar(&unmountRetries, "unmount-retries", 4, "how often unmounting a busy snapshot mount (e.g. Spotlight still indexing it) is retried before it is forced with diskutil")
+	flag.DurationVar(&unmountRetryDelay, "unmount-retry-delay", time.Second, "delay before the first -unmount-retries retry, doubled for every further one")
+	flag.DurationVar(&lockWait, "lock-wait", 0, "(optional) wait up to this long (e.g. `10m`) for a lock held by another run instead of failing right away")
+	flag.DurationVar(&borgLockWait, "borg-lock-wait", 0, "(optional) passed to borg as --lock-wait (rounded up to seconds): how long borg waits for a repository lock held by another borg, e.g. a prune from another machine. By default borg waits 1s.")
+	flag.IntVar(&borgRetries, "borg-retries", 0, "how often borg create is run again when it still couldn't get the repository lock, with the snapshots kept mounted")
+	flag.DurationVar(&borgRetryDelay, "borg-retry-delay", time.Minute, "delay between the -borg-retries attempts")
+	flag.BoolVar(&forceMountpoint, "force-mountpoint", false, "mount snapshots over mountpoints that aren't empty. Missing mountpoints are always created.")
+	flag.BoolVar(&listSnapshots, "list-snapshots", false, "list the local snapshots of each -source, whether borg-tm created them and which one -use-existing-snapshots would back up, then exit")
+	flag.BoolVar(&listArchives, "list-archives", false, "with the flags of a backup, list the archives in the repository with borg list, then exit. Waits for the lock like a backup.")
+	flag.StringVar(&deleteArchive, "delete-archive", "", "with the flags of a backup, delete this archive from the repository with borg delete (and borg compact with -compact), then exit. Asks for confirmation unless -yes is given. Waits for the lock like a backup.")
+	flag.BoolVar(&yes, "yes", false, "don't ask before -delete-archive")
+	flag.StringVar(&restore, "restore", "", "with the flags of a backup, restore from an archive into -restore-target, then exit. Given as `archive::path`, where path is a path as it was on the sources or a borg pattern (e.g. sh:Users/*/Documents) and ::path can be left out for the whole archive. Paths of archives made without -store-original-paths are found below the mountpoint and extracted without it.")
+	flag.StringVar(&restoreTarget, "restore-target", "", "directory -restore extracts into (or mounts on, with -restore-mount). Extracting into / needs -force.")
+	flag.BoolVar(&restoreMount, "restore-mount", false, "with -restore, borg mount the archive on -restore-target until Ctrl-C instead of extracting it. As long as it is mounted, borg holds the repository lock.")
+	flag.BoolVar(&force, "force", false, "allow -restore into /")
+	flag.BoolVar(&jsonOutput, "json", false, "with -list-snapshots or -list-archives, print JSON instead of columns")
+	flag.BoolVar(&separateArchives, "separate-archives", false, "create one archive per source, named after -backup-name and the source (e.g. `...@host-data`), instead of one archive of all sources. Each snapshot is only mounted while its archive is created, and a failing source doesn't stop the others. -prune prunes the archives of each source on their own.")
+	flag.BoolVar(&storeOriginalPaths, "store-original-paths", true, "archive the files under the paths of the sources (e.g. System/Volumes/Data/Users) instead of the mountpoints. The snapshot of a source is then mounted at <mountpoint>/<source>. Needs borg 1.2 or newer, older versions archive the mountpoint paths.")
+	flag.Var(&excludes, "exclude", "(optional) exclude this path relative to each source (e.g. `Users/me/Library/Caches`) from the archive. Absolute paths work like -exclude-source, and borg patterns with a style prefix (e.g. sh:**/node_modules) are passed to borg as they are. Can be repeated.")
+	flag.StringVar(&excludeFrom, "exclude-from", "", "(optional) file with one -exclude per line, lines starting with # are skipped")
+	flag.BoolVar(&excludeCaches, "exclude-caches", false, "leave out directories with a CACHEDIR.TAG, passing --exclude-caches to borg")
+	flag.BoolVar(&honorTMExclusions, "honor-tm-exclusions", false, "leave out what Time Machine leaves out: the paths of its exclusion lists (including tmutil addexclusion -p) and items with the sticky exclusion attribute of tmutil addexclusion, found with tmutil isexcluded on the mounted snapshot. The number applied is part of the summary.")
+	flag.IntVar(&tmExclusionDepth, "tm-exclusion-depth", internal.DefaultTMExclusionDepth, "with -honor-tm-exclusions, how many directory levels below each source are checked for the exclusion attribute. The results are cached per snapshot. 0 only honors the exclusion lists.")
 	var printVersion bool
 	flag.BoolVar(&printVersion, "V", false, "print version")
 	flag.Usage = func() {
@@ -48,9 +293,46 @@ func main() {
 
 This program must be run as root.
 
+Subcommands:
+- selftest-metadata: check which macOS metadata survives a backup round-trip
+- prune-snapshots: apply a retention policy to the snapshots created by borg-tm
+- list-mounts: list mounted snapshots and optionally unmount leftovers
+- unmount: unmount the given snapshot mountpoints after a crash
+- cleanup: unmount and remove what a crashed run left behind, as recorded in its journal
+- cache-clear: delete borg's cache below -borg-base-dir
+- recreate: apply new exclusions to existing archives with borg recreate
+- check-freshness: check that the newest backup isn't older than -max-age, for monitoring
+- doctor: with the flags of a backup, run its preflight checks (root, borg, sources, mountpoints, snapUtil, repository) and exit
+
+Exit codes:
+- 0: success
+- 1: any other failure
+- 2: some sources failed (-continue-on-error) or some of several
+  repositories failed, the others were backed up
+- 3: BORG_REPO is a different repository than before (-accept-new-repo)
+- 4: the backup succeeded, but pruning failed
+- 5: invalid flags
+- 6: the lock is held by another run
+- 7: a preflight check failed
+- 8: a snapshot couldn't be created
+- 9: a snapshot couldn't be found or mounted
+- 10: borg create failed
+- 11: a snapshot couldn't be unmounted or removed, needs manual cleanup
+- 12: the backup succeeded, but borg check failed (-check)
+- 13: files of the archive don't match the snapshot (-verify-after-backup)
+
 Environment variables:
-- BORG_REPO: repository to backup to
-- BORG_PASSPHRASE: passphrase for borg repository
+- BORG_REPO: repository to backup to, unless given with -repo or as repo
+  of -config
+- BORG_PASSPHRASE: passphrase for borg repository (not needed with -op-item,
+  -passphrase-file, -keychain-item or -allow-unencrypted)
+- BORG_PASSCOMMAND: command printing the passphrase, run by borg itself, used
+  when BORG_PASSPHRASE isn't set
+- BORG_TM_SNAPUTIL: (optional) location of snapUtil, like -snaputil-path
+- BORG_TM_PING_URL: (optional) monitoring URL, like -ping-url
+
+All of them can also be provided through -env-file, BORG_REPO also through
+-config.
 
 Arguments:
 `, os.Args[0])
@@ -58,49 +340,237 @@ Arguments:
 		flag.PrintDefaults()
 		// fmt.Fprintf(os.Stderr, "...And then put sources in a list which will be backed up. For example: `/ /System/Volumes/Data`")
 
-		fmt.Fprintf(os.Stderr, "\nNote: %s\n", "`-mountpoint` and `-source` can be used multiple times to set more mountpoints and sources (respective of the order provided for each). For example, use `-source / -source /System/Volumes/Data -mountpoint /tmp/snapshot -mountpoint /tmp/snapshot-data` to set two sources each with their corresponding mountpoint.")
+		fmt.Fprintf(os.Stderr, "\nNote: %s\n", "`-mountpoint` and `-source` can be used multiple times to set more mountpoints and sources (respective of the order provided for each). For example, use `-source / -source /System/Volumes/Data -mountpoint /tmp/snapshot -mountpoint /tmp/snapshot-data` to set two sources each with their corresponding mountpoint, or the equivalent `-map /=/tmp/snapshot -map /System/Volumes/Data=/tmp/snapshot-data`.")
+		fmt.Fprintf(os.Stderr, "\nWhile borg is running, SIGTSTP (Ctrl-Z) pauses it and SIGCONT resumes it, keeping the snapshots mounted and the lock held. borg-tm itself stays in the foreground, so resume with `kill -CONT <pid>` rather than `fg`.\n")
+	}
+	// exit with ExitValidation rather than flag's 2, which is ExitPartial
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(internal.ExitValidation)
 	}
-	flag.Parse()
 	// sources = flag.Args() // https://stackoverflow.com/questions/28322997/how-to-get-a-list-of-values-into-a-flag-in-golang
 	if printVersion {
 		consts.PrintVersion()
 		os.Exit(0)
 	}
-	if len(mountpoints) == 0 {
-		log.Fatalln("Need at least one mountpoint, such as `-mountpoint /tmp/snapshot`")
-		os.Exit(1)
+	if launchdStatus {
+		if err := printLaunchdStatus(); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if uninstallLaunchd {
+		if os.Getuid() != 0 {
+			log.Fatalln("requires root privileges.")
+		}
+		if err := internal.UninstallLaunchd(); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(mappings) > 0 {
+		if len(sources) > 0 || len(mountpoints) > 0 {
+			invalidFlags("-map can't be combined with -source and -mountpoint, give every source as -map source=mountpoint")
+		}
+		for _, m := range mappings {
+			source, mountpoint, err := parseMapping(m)
+			if err != nil {
+				invalidFlags(err)
+			}
+			sources = append(sources, source)
+			mountpoints = append(mountpoints, mountpoint)
+		}
+	}
+	var configPingURL string
+	var configRepos []string
+	var configRepoTables []config.Repo
+	if configFile != "" {
+		cfg, err := config.Load(configFile, profile)
+		if err != nil {
+			invalidFlags(err)
+		}
+		given := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) {
+			given[f.Name] = true
+		})
+		if !given["source"] && !given["map"] && cfg.Sources != nil {
+			sources = cfg.Sources
+		}
+		if !given["mountpoint"] && !given["map"] && cfg.Mountpoints != nil {
+			mountpoints = cfg.Mountpoints
+		}
+		if !given["borg-args"] && cfg.BorgArgs != "" {
+			borgArgs = cfg.BorgArgs
+		}
+		if !given["lock-file"] && cfg.LockFile != "" {
+			lockFile = cfg.LockFile
+		}
+		if !given["dry-run"] && cfg.DryRun != nil {
+			dryRun = *cfg.DryRun
+		}
+		if !given["env-file"] && cfg.EnvFile != "" {
+			envFile = cfg.EnvFile
+		}
+		if !given["op-item"] && cfg.OpItem != "" {
+			opItem = cfg.OpItem
+		}
+		configRepos = cfg.Repos
+		configRepoTables = cfg.RepoTables
+		configPingURL = cfg.PingURL
+	} else if profile != "" {
+		invalidFlags("-profile requires -config")
+	}
+	if len(snapshotsToUse) > 0 {
+		// a named snapshot wins over the latest one
+		useExistingSnapshots = true
+	}
+	if chunkerParams != "" {
+		var err error
+		chunkerParams, err = internal.ParseChunkerParams(chunkerParams)
+		if err != nil {
+			invalidFlags(err)
+		}
+	}
+	var retention *internal.SnapshotRetention
+	if snapshotRetention < 0 || snapshotRetentionWithin < 0 {
+		invalidFlags("-snapshot-retention and -snapshot-retention-within must not be negative")
+	}
+	if snapshotRetention > 0 || snapshotRetentionWithin > 0 {
+		retention = &internal.SnapshotRetention{Keep: snapshotRetention, KeepWithin: snapshotRetentionWithin}
+	}
+	verifySamples := 0
+	if verifyAfterBackup {
+		verifySamples = verifySample
+	}
+	if !skipIfUnchanged {
+		changeDetection = ""
+	}
+	var checkOptions *internal.CheckOptions
+	if check {
+		checkOptions = &internal.CheckOptions{Interval: time.Duration(checkInterval), Mode: checkMode}
+	}
+	var prune *internal.PruneOptions
+	extraPruneArgs, err := internal.SplitShellWords(pruneArgs)
+	if err != nil {
+		invalidFlagsf("Invalid -prune-args %q: %v\n", pruneArgs, err)
+	}
+	if pruneArchives || len(extraPruneArgs) > 0 {
+		if keepWithin == "" && keepDaily <= 0 && keepWeekly <= 0 && keepMonthly <= 0 && len(extraPruneArgs) == 0 {
+			invalidFlags("-prune needs -prune-args or at least one of -keep-within, -keep-daily, -keep-weekly and -keep-monthly")
+		}
+		prune = &internal.PruneOptions{KeepWithin: keepWithin, KeepDaily: keepDaily, KeepWeekly: keepWeekly, KeepMonthly: keepMonthly, AllHosts: pruneAllHosts, Args: extraPruneArgs}
+	} else if pruneAllHosts {
+		invalidFlags("-prune-all-hosts requires -prune")
+	}
+	var thermal *internal.ThermalOptions
+	if thermalAware {
+		if thermalInterval <= 0 || thermalCooldown <= 0 {
+			invalidFlags("-thermal-interval and -thermal-cooldown must be positive")
+		}
+		thermal = &internal.ThermalOptions{Interval: thermalInterval, Cooldown: thermalCooldown, MaxLoad: thermalMaxLoad}
 	}
-	if len(sources) == 0 {
-		log.Fatalln("Need at least one source, such as `-source /`")
-		os.Exit(1)
+	var sparse *bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "sparse" {
+			sparse = &sparseFlag
+		}
+	})
+	umask := -1
+	if umaskFlag != "" {
+		parsed, err := strconv.ParseUint(umaskFlag, 8, 32)
+		if err != nil || parsed > 0777 {
+			invalidFlagsf("Invalid -umask %q, expected an octal value between 000 and 777\n", umaskFlag)
+		}
+		umask = int(parsed)
 	}
-	if len(mountpoints) != len(sources) {
-		log.Fatalln("The number of mountpoints provided (%d) is not the same as the number of sources provided (%d)", len(mountpoints), len(sources))
-		os.Exit(1)
+	level, err := internal.ParseLogLevel(logLevel)
+	if err != nil {
+		invalidFlags(err)
 	}
-	if !useExistingSnapshots && len(snapshotsToUse) > 0 {
-		log.Fatalln("Need --use-existing-snapshots when providing at least one --snapshotToUse")
-		os.Exit(1)
+	logger := internal.NewTextLogger(os.Stdout, level)
+	if logJSON {
+		logger = internal.NewJSONLogger(os.Stdout, level)
 	}
-	if len(snapshotsToUse) > 0 && len(sources) != len(snapshotsToUse) {
-		log.Fatalln("The number of sources and mountpoints provided (%d) is not the same as the number of snapshots to use (`--snapshotToUse`) provided (%d)", len(sources), len(snapshotsToUse))
-		os.Exit(1)
+	sources, sourceUUIDs, err := internal.ResolveVolumeUUIDs(sources, logger)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	quiesceHooks, err := internal.ParseQuiesceHooks(quiesce, unquiesce, sources)
+	if err != nil {
+		invalidFlags(err)
+	}
+	if ejectAfter && len(onMount) == 0 {
+		invalidFlags("-eject-after requires -on-mount")
+	}
+	if excludeFrom != "" {
+		fromFile, err := internal.ReadExcludeFile(excludeFrom)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		excludes = append(excludes, fromFile...)
 	}
 
-	repo := os.Getenv("BORG_REPO")
-	if repo == "" {
-		log.Fatalln("BORG_REPO not specified")
+	if envFile != "" {
+		if err := internal.LoadEnvFile(envFile); err != nil {
+			log.Fatalf("error while loading env file: %v\n", err)
+		}
 	}
-	if pass := os.Getenv("BORG_PASSPHRASE"); pass == "" {
-		log.Fatalln("BORG_PASSPHRASE not specified")
+	// -repo, then the config file, then BORG_REPO
+	var repoTargets []internal.RepoTarget
+	for _, r := range repos {
+		repoTargets = append(repoTargets, internal.RepoTarget{Repo: r})
 	}
-	parts := strings.Split(borgArgs, " ")
-	args := make([]string, 0, len(parts))
-	for _, v := range parts {
-		if v != "" {
-			args = append(args, v)
+	if len(repos) == 0 {
+		for _, r := range configRepos {
+			repoTargets = append(repoTargets, internal.RepoTarget{Repo: r})
+		}
+		for _, r := range configRepoTables {
+			t, err := configRepoTarget(r, keychainUser)
+			if err != nil {
+				invalidFlags(err)
+			}
+			repoTargets = append(repoTargets, t)
 		}
 	}
+	if pingURL == "" {
+		pingURL = os.Getenv("BORG_TM_PING_URL")
+	}
+	if pingURL == "" {
+		pingURL = configPingURL
+	}
+	if keychainStore {
+		if keychainItem == "" {
+			invalidFlags("-keychain-store needs -keychain-item")
+		}
+		if err := internal.StoreKeychainPassphrase(context.Background(), keychainItem, keychainUser); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		return
+	}
+	var passphraseSource internal.PassphraseSource
+	if opItem != "" {
+		passphraseSource = internal.NewOnePasswordSource(opItem)
+	}
+	if passphraseFile != "" {
+		if passphraseSource != nil {
+			invalidFlags("-passphrase-file can't be used with -op-item")
+		}
+		passphraseSource = internal.NewPassphraseFileSource(passphraseFile)
+	}
+	if keychainItem != "" {
+		if passphraseSource != nil {
+			invalidFlags("-keychain-item can't be used with -op-item or -passphrase-file")
+		}
+		passphraseSource = internal.NewKeychainSource(keychainItem, keychainUser)
+	} else if keychainUser != "" {
+		invalidFlags("-keychain-user needs -keychain-item")
+	}
+	args, err := internal.SplitShellWords(borgArgs)
+	if err != nil {
+		invalidFlagsf("Invalid -borg-args %q: %v\n", borgArgs, err)
+	}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
@@ -110,12 +580,213 @@ Arguments:
 		cancelFn()
 	}()
 
-	if os.Getuid() != 0 {
+	if os.Getuid() != 0 && !doctor && !listSnapshots && !printPlist {
 		log.Fatalln("requires root privileges.")
 	}
-	backup := internal.NewBackup(mountpoints, lockFile, useExistingSnapshots, sources, snapshotsToUse, backupName, args, dryRun)
-	err := backup.Run(ctx)
+	if borgBaseDir != "" {
+		if err := internal.PrepareBorgBaseDir(borgBaseDir, logger); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	}
+	opts := []internal.Option{
+		internal.WithMountpoints(mountpoints...),
+		internal.WithSources(sources...),
+		internal.WithSourceUUIDs(sourceUUIDs...),
+		internal.WithRepos(repoTargets...),
+		internal.WithLockFile(lockFile),
+		internal.WithUseExistingSnapshots(useExistingSnapshots),
+		internal.WithSnapshotsToUse(snapshotsToUse...),
+		internal.WithBackupName(backupName),
+		internal.WithBorgArgs(args...),
+		internal.WithDryRun(dryRun),
+		internal.WithQuota(quotaWarnPercent, quotaAbortPercent),
+		internal.WithLabel(label),
+		internal.WithHistoryFile(historyFile),
+		internal.WithSizeAnomalyFactor(sizeAnomalyFactor),
+		internal.WithPassphraseSource(passphraseSource),
+		internal.WithAllowUnencrypted(allowUnencrypted),
+		internal.WithUmask(umask),
+		internal.WithSparse(sparse),
+		internal.WithChunkerParams(chunkerParams),
+		internal.WithStateFile(stateFile),
+		internal.WithJournalFile(journalFile),
+		internal.WithAutoRecover(!noAutoRecover),
+		internal.WithSnapshotPrefix(snapshotPrefix),
+		internal.WithSeparateArchives(separateArchives),
+		internal.WithStoreOriginalPaths(storeOriginalPaths),
+		internal.WithHostname(hostname),
+		internal.WithThermal(thermal),
+		internal.WithIOPolicy(ioPolicy),
+		internal.WithKeepSnapshots(keepSnapshots),
+		internal.WithSnapshotRetention(retention),
+		internal.WithMaxSnapshotSpread(maxSnapshotSpread, snapshotSpreadPolicy),
+		internal.WithReportChanged(reportChanged),
+		internal.WithAutoExcludes(!noAutoExcludeRepo, !noAutoExcludeNested),
+		internal.WithExcludeSources(excludeSources...),
+		internal.WithExcludes(excludes...),
+		internal.WithExcludeCaches(excludeCaches),
+		internal.WithTMExclusions(honorTMExclusions, tmExclusionDepth),
+		internal.WithProgressFifo(progressFifo),
+		internal.WithProgress(showProgress),
+		internal.WithAcceptRepoChanges(acceptRepoChanges),
+		internal.WithSnapshotListTool(snapshotListTool),
+		internal.WithSnapshotTool(snapshotTool),
+		internal.WithSnapUtilPath(snapUtilPath),
+		internal.WithSnapshotRetries(snapshotRetries),
+		internal.WithUnmountRetries(unmountRetries, unmountRetryDelay),
+		internal.WithLockWait(lockWait),
+		internal.WithBorgLockWait(borgLockWait),
+		internal.WithBorgRetries(borgRetries, borgRetryDelay),
+		internal.WithForceMountpoint(forceMountpoint),
+		internal.WithContinueOnError(continueOnError),
+		internal.WithPrune(prune),
+		internal.WithSSHControlMaster(sshControlMaster),
+		internal.WithSync(!noSync, fullfsyncPaths...),
+		internal.WithQuiesceHooks(quiesceHooks, quiesceTimeout),
+		internal.WithHooks(internal.Hooks{PreSnapshot: preSnapshotHook, PostSnapshot: postSnapshotHook, PreBorg: preBorgHook, PostRun: postRunHook, Timeout: hookTimeout}),
+		internal.WithAcceptNewRepo(acceptNewRepo),
+		internal.WithCompact(compact),
+		internal.WithCheck(checkOptions),
+		internal.WithVerify(verifySamples),
+		internal.WithSkipIfUnchanged(changeDetection),
+		internal.WithInitIfMissing(initIfMissing, initEncryption),
+		internal.WithKeyExport(keyExportPath, keyExportFormat, keyExportOverwrite),
+		internal.WithStatsSummary(statsSummary),
+		internal.WithFailOnWarnings(failOnWarnings),
+		internal.WithLogger(logger),
+		internal.WithReportFile(reportFile),
+		internal.WithPing(pingURL, pingStart),
+		internal.WithNotify(notify),
+	}
+	if consistentSnapshots {
+		opts = append(opts, internal.WithConsistentSnapshots(consistencyWindow))
+	}
+	if recordChanges {
+		opts = append(opts, internal.WithRecordChanges(artifactsDir))
+	}
+	backup, err := internal.NewBackup(opts...)
 	if err != nil {
-		log.Fatalf("error while backup: %+v\n", err)
+		log.Println(err)
+		os.Exit(internal.ExitValidation)
+	}
+	internal.WarnNestedPaths(sources, mountpoints, logger)
+	if installLaunchd || printPlist {
+		// after NewBackup, so that a configuration that can't run isn't
+		// installed
+		job, err := launchdJob(schedules, launchdLog)
+		if err != nil {
+			invalidFlags(err)
+		}
+		if envFile == "" {
+			// not secrets, unlike BORG_PASSPHRASE, which is left out
+			job.Environment = map[string]string{}
+			if repo := os.Getenv("BORG_REPO"); repo != "" && len(repoTargets) == 0 {
+				job.Environment["BORG_REPO"] = repo
+			}
+			if passcommand := os.Getenv("BORG_PASSCOMMAND"); passcommand != "" {
+				job.Environment["BORG_PASSCOMMAND"] = passcommand
+			}
+			if os.Getenv("BORG_PASSPHRASE") != "" && opItem == "" && passphraseFile == "" && keychainItem == "" {
+				log.Println("Warning: BORG_PASSPHRASE isn't copied into the plist, give the passphrase with -keychain-item, -passphrase-file, -op-item or -env-file")
+			}
+		}
+		if printPlist {
+			os.Stdout.Write(job.Plist())
+			return
+		}
+		if err := internal.InstallLaunchd(job); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if doctor {
+		if err := backup.Doctor(ctx); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if listSnapshots {
+		lists, err := backup.ListSnapshots(ctx)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		if err := printSnapshotLists(lists, jsonOutput); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if listArchives {
+		archives, err := backup.ListArchives(ctx)
+		if err != nil {
+			log.Printf("%+v\n", err)
+			os.Exit(internal.ExitCode(err))
+		}
+		if err := printArchives(archives, jsonOutput); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if restore != "" {
+		archive, path, err := internal.ParseRestoreSpec(restore)
+		if err != nil {
+			invalidFlags(err)
+		}
+		if restoreTarget == "" {
+			invalidFlags("-restore needs -restore-target")
+		}
+		err = backup.Restore(ctx, internal.RestoreOptions{Archive: archive, Path: path, Target: restoreTarget, Mount: restoreMount, Force: force})
+		if err != nil {
+			log.Printf("%+v\n", err)
+			os.Exit(internal.ExitCode(err))
+		}
+		return
+	}
+	if deleteArchive != "" {
+		if !yes {
+			if !stdinIsTerminal() {
+				invalidFlags("-delete-archive needs -yes when not run on a terminal")
+			}
+			repo := os.Getenv("BORG_REPO")
+			if len(repoTargets) > 0 {
+				repo = repoTargets[0].Repo
+			}
+			if !confirmDelete(deleteArchive, repo) {
+				log.Fatalln("Not deleting anything")
+			}
+		}
+		if err := backup.DeleteArchive(ctx, deleteArchive); err != nil {
+			log.Printf("%+v\n", err)
+			os.Exit(internal.ExitCode(err))
+		}
+		return
+	}
+	var mounted string
+	if len(onMount) > 0 {
+		var err error
+		mounted, err = internal.WaitForMount(ctx, onMount, onMountDebounce, logger)
+		if err != nil {
+			log.Fatalf("error while waiting for mount: %+v\n", err)
+		}
+	}
+	stopProfiling := startProfiling(pprofAddr, cpuProfile, memProfile)
+	_, err = backup.Run(ctx)
+	stopProfiling()
+	if borgBaseDir != "" {
+		internal.PrintBorgBaseDirSize(logger)
+	}
+	switch code := internal.ExitCode(err); code {
+	case 0:
+	case internal.ExitRepoMismatch, internal.ExitPrune, internal.ExitPartial, internal.ExitCheck, internal.ExitVerify:
+		log.Println(errors.Cause(err))
+		os.Exit(code)
+	default:
+		log.Printf("error while backup: %+v\n", err)
+		os.Exit(code)
+	}
+	if mounted != "" && ejectAfter {
+		if err := internal.EjectVolume(mounted); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		fmt.Printf("Ejected %s, it is safe to unplug it now.\n", mounted)
 	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/quantumghost/borg-tm/internal"
+)
+
+// run as borg-tm when the test binary runs itself
+const mainEnv = "BORG_TM_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) != "" {
+		os.Args = append([]string{"borg-tm"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestInvalidFlagsExitWithValidation(t *testing.T) {
+	tests := [][]string{
+		{"-map", "/=/tmp/snapshot", "-source", "/"},
+		{"-map", "/=/tmp/snapshot", "-mountpoint", "/tmp/snapshot"},
+		{"-source", "/", "-map", "/System/Volumes/Data=/tmp/snapshot-data", "-mountpoint", "/tmp/snapshot"},
+		{"-map", "/tmp/snapshot"},
+		{"-profile", "work"},
+		{"-chunker-params", "nonsense"},
+		{"-snapshot-retention", "-1"},
+		{"-prune"},
+		{"-prune-all-hosts"},
+		{"-thermal-aware", "-thermal-interval", "0"},
+		{"-umask", "999"},
+		{"-log-level", "loud"},
+		{"-eject-after"},
+		{"-keychain-user", "root"},
+		{"-borg-args", `--one-file-system "unterminated`},
+		{"-prune-args", `--keep-daily 7 --keep-yearly 'unterminated`},
+		{"-no-such-flag"},
+	}
+	for _, args := range tests {
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), mainEnv+"=1")
+		out, err := cmd.CombinedOutput()
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.ExitCode() != internal.ExitValidation {
+			t.Errorf("borg-tm %q exited with %v, want exit status %d:\n%s", args, err, internal.ExitValidation, out)
+		}
+	}
+}
+
+func TestParseMapping(t *testing.T) {
+	tests := []struct {
+		value      string
+		source     string
+		mountpoint string
+		ok         bool
+	}{
+		{"/=/tmp/snapshot", "/", "/tmp/snapshot", true},
+		{"/System/Volumes/Data=/tmp/snapshot-data", "/System/Volumes/Data", "/tmp/snapshot-data", true},
+		{"/Volumes/a=b=/tmp/snapshot", "/Volumes/a=b", "/tmp/snapshot", true},
+		{"/Volumes/a==/tmp/snapshot", "/Volumes/a=", "/tmp/snapshot", true},
+		{"/Volumes/My Disk=/tmp/my disk", "/Volumes/My Disk", "/tmp/my disk", true},
+		{"/tmp/snapshot", "", "", false},
+		{"", "", "", false},
+		{"=/tmp/snapshot", "", "", false},
+		{"/=", "", "", false},
+		{"/Volumes/a=/tmp/snapshot=", "", "", false},
+	}
+	for _, tt := range tests {
+		source, mountpoint, err := parseMapping(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseMapping(%q): got error %v, want ok %v", tt.value, err, tt.ok)
+			continue
+		}
+		if source != tt.source || mountpoint != tt.mountpoint {
+			t.Errorf("parseMapping(%q) = %q, %q, want %q, %q", tt.value, source, mountpoint, tt.source, tt.mountpoint)
+		}
+	}
+}
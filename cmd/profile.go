@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling serves net/http/pprof on pprofAddr and starts a CPU profile,
+// as requested. The returned function stops the CPU profile and writes the
+// heap profile; it must be called before exiting.
+func startProfiling(pprofAddr, cpuProfile, memProfile string) func() {
+	if pprofAddr != "" {
+		go func() {
+			fmt.Printf("Serving pprof on http://%s/debug/pprof/\n", pprofAddr)
+			if err := http.ListenAndServe(pprofAddr, nil); err != nil {
+				fmt.Printf("Warning: pprof server stopped: %v\n", err)
+			}
+		}()
+	}
+	var cpuFile *os.File
+	if cpuProfile != "" {
+		var err error
+		cpuFile, err = os.Create(cpuProfile)
+		if err != nil {
+			log.Fatalf("error while creating CPU profile: %v\n", err)
+		}
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			log.Fatalf("error while starting CPU profile: %v\n", err)
+		}
+	}
+	return func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+		}
+		if memProfile != "" {
+			f, err := os.Create(memProfile)
+			if err != nil {
+				fmt.Printf("Warning: error while creating memory profile: %v\n", err)
+				return
+			}
+			defer f.Close()
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				fmt.Printf("Warning: error while writing memory profile: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/quantumghost/borg-tm/internal"
+)
+
+func pruneSnapshots(args []string) {
+	flags := flag.NewFlagSet("prune-snapshots", flag.ExitOnError)
+	var sources arrayFlags
+	flags.Var(&sources, "source", "source volume whose snapshots are pruned. Can be used multiple times.")
+	keep := flags.Int("keep", 0, "number of most recent snapshots to keep per source")
+	keepWithin := flags.Duration("keep-within", 0, "additionally keep all snapshots created within this duration (e.g. `48h`)")
+	dryRun := flags.Bool("dry-run", false, "only list the snapshots that would be removed")
+	prefix := flags.String("snapshot-prefix", internal.DefaultSnapshotPrefix, "-snapshot-prefix as given to the backups")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s prune-snapshots
+
+Removes local snapshots created by borg-tm according to a retention policy.
+Snapshots created by anything else (e.g. Time Machine) are never touched.
+
+Arguments:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if len(sources) == 0 {
+		invalidFlags("Need at least one source, such as `-source /`")
+	}
+	if *keep < 0 || *keepWithin < 0 {
+		invalidFlags("-keep and -keep-within must not be negative")
+	}
+	if *keep == 0 && *keepWithin == 0 {
+		invalidFlags("Need -keep or -keep-within, refusing to remove every snapshot")
+	}
+	if err := internal.ValidateSnapshotPrefix(*prefix); err != nil {
+		invalidFlags(err)
+	}
+	if os.Getuid() != 0 {
+		log.Fatalln("requires root privileges.")
+	}
+	policy := internal.SnapshotRetention{Keep: *keep, KeepWithin: *keepWithin}
+	if err := internal.PruneSnapshots(context.Background(), sources, policy, *prefix, *dryRun); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/quantumghost/borg-tm/internal"
+)
+
+func recreate(args []string) {
+	flags := flag.NewFlagSet("recreate", flag.ExitOnError)
+	var sources, mountpoints, excludeSources, excludes arrayFlags
+	flags.Var(&sources, "source", "source as given to the backups, used to translate -exclude-source. Can be used multiple times.")
+	flags.Var(&mountpoints, "mountpoint", "mountpoint of the corresponding -source as given to the backups, only needed with -store-original-paths=false. Can be used multiple times.")
+	flags.Var(&excludeSources, "exclude-source", "path on the live filesystem to remove from the archives, like -exclude-source of a backup. Can be used multiple times.")
+	flags.Var(&excludes, "exclude", "borg exclude pattern to remove from the archives. Can be used multiple times.")
+	glob := flags.String("archive", "", "only recreate the archives matching this glob (e.g. `2024-*`)")
+	last := flags.Int("last", 0, "only recreate the last N of the selected archives")
+	hostname := flags.String("hostname", "", "hostname used in the archive names, as given to the backups")
+	lockFile := flags.String("lock-file", "", "lock file for borg-tm, as given to the backups. By default it is derived from BORG_REPO.")
+	umaskFlag := flags.String("umask", "", "octal umask passed to borg via --umask")
+	storeOriginalPaths := flags.Bool("store-original-paths", true, "-store-original-paths as given to the backups")
+	yes := flags.Bool("yes", false, "recreate after the preview without asking for confirmation")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s recreate
+
+Applies new exclusions to existing archives of this host with
+`+"`borg recreate`"+`. A preview of what each archive loses is always shown
+first. Archives that are rewritten lose their old contents for good.
+
+Environment variables: BORG_REPO and BORG_PASSPHRASE, as for backups.
+
+Arguments:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if !*storeOriginalPaths && len(mountpoints) != len(sources) {
+		invalidFlagsf("The number of mountpoints provided (%d) is not the same as the number of sources provided (%d)", len(mountpoints), len(sources))
+	}
+	if *last < 0 {
+		invalidFlags("-last must not be negative")
+	}
+	umask := -1
+	if *umaskFlag != "" {
+		parsed, err := strconv.ParseUint(*umaskFlag, 8, 32)
+		if err != nil || parsed > 0777 {
+			invalidFlagsf("Invalid -umask %q, expected an octal value between 000 and 777\n", *umaskFlag)
+		}
+		umask = int(parsed)
+	}
+	if os.Getenv("BORG_REPO") == "" {
+		invalidFlags("BORG_REPO not specified")
+	}
+	if os.Getuid() != 0 {
+		log.Fatalln("requires root privileges.")
+	}
+
+	r, err := internal.NewRecreate(internal.RecreateOptions{
+		Sources:            sources,
+		Mountpoints:        mountpoints,
+		ExcludeSources:     excludeSources,
+		Excludes:           excludes,
+		Hostname:           *hostname,
+		LockFile:           *lockFile,
+		Umask:              umask,
+		StoreOriginalPaths: *storeOriginalPaths,
+	})
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	ctx := context.Background()
+	archives, err := r.Archives(ctx, *glob, *last)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	if len(archives) == 0 {
+		fmt.Println("No archives selected")
+		return
+	}
+
+	var affected []string
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ARCHIVE\tSIZE\tEXCLUDED\tFILES")
+	for _, archive := range archives {
+		p, err := r.Preview(ctx, archive)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		fmt.Fprintf(w, "%s\t%.1f MiB\t-%.1f MiB\t-%d\n", p.Archive, float64(p.Size)/(1<<20), float64(p.ExcludedSize)/(1<<20), p.ExcludedFiles)
+		if p.ExcludedSize > 0 || p.ExcludedFiles > 0 {
+			affected = append(affected, archive)
+		}
+	}
+	w.Flush()
+	if len(affected) == 0 {
+		fmt.Println("The exclusions don't match anything, nothing to recreate")
+		return
+	}
+	if !*yes {
+		fmt.Fprintf(os.Stderr, "Recreate %d archive(s)? [y/N] ", len(affected))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return
+		}
+	}
+	if err := r.Run(ctx, affected); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
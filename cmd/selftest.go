@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/quantumghost/borg-tm/internal"
+)
+
+func selfTestMetadata(args []string) {
+	flags := flag.NewFlagSet("selftest-metadata", flag.ExitOnError)
+	dir := flags.String("dir", os.TempDir(), "directory to create the test files in. It must be on the volume that will be snapshotted.")
+	noSnapshot := flags.Bool("no-snapshot", false, "back up the test files directly instead of from a snapshot (faster, but doesn't exercise the snapshot mount)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s selftest-metadata
+
+Backs up files carrying extended attributes, resource forks, file flags and
+birth times to a throwaway repository, restores them and reports which
+metadata was preserved. Requires root unless -no-snapshot is given.
+
+Arguments:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if !*noSnapshot && os.Getuid() != 0 {
+		log.Fatalln("requires root privileges (or -no-snapshot).")
+	}
+	if err := internal.RunMetadataSelfTest(context.Background(), *dir, *noSnapshot); err != nil {
+		log.Fatalf("selftest failed: %+v\n", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/quantumghost/borg-tm/internal"
+)
+
+func unmountCommand(args []string) {
+	flags := flag.NewFlagSet("unmount", flag.ExitOnError)
+	force := flags.Bool("force", false, "unmount the targets even if they aren't APFS snapshot mounts")
+	yes := flags.Bool("yes", false, "without targets, don't ask for confirmation")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s unmount [-force] [mountpoint...]
+
+Unmounts snapshots left behind by an interrupted run. Every target must be
+an APFS snapshot mount unless -force is given. Without targets, offers to
+unmount every snapshot mount created by borg-tm (see list-mounts).
+
+Arguments:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if os.Getuid() != 0 {
+		log.Fatalln("requires root privileges.")
+	}
+
+	targets := flags.Args()
+	if len(targets) == 0 {
+		mounts, err := internal.ListSnapshotMounts(nil)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		stdin := bufio.NewReader(os.Stdin)
+		for _, m := range mounts {
+			if !m.Owned {
+				continue
+			}
+			if !*yes {
+				fmt.Fprintf(os.Stderr, "Unmount %s (%s)? [y/N] ", m.Mountpoint, m.Snapshot)
+				answer, _ := stdin.ReadString('\n')
+				if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+					continue
+				}
+			}
+			targets = append(targets, m.Mountpoint)
+		}
+		if len(targets) == 0 {
+			fmt.Println("Nothing to unmount")
+			return
+		}
+	}
+
+	failed := false
+	for _, target := range targets {
+		if err := internal.CheckSnapshotMount(target); err != nil {
+			if !*force {
+				fmt.Fprintf(os.Stderr, "%s: skipped: %v (use -force to unmount anyway)\n", target, err)
+				failed = true
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "%s: %v, unmounting anyway (-force)\n", target, err)
+		}
+		if err := internal.Unmount(target); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: unmount failed: %v\n", target, err)
+		}
+		if internal.IsMountpoint(target) {
+			fmt.Fprintf(os.Stderr, "%s: still mounted\n", target)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: unmounted\n", target)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
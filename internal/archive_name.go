@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultArchiveTemplate names archives <snapshot>@<host>, which is what
+// prune, recreate and check-freshness expect.
+const DefaultArchiveTemplate = "{snapshot}@{hostname}"
+
+// borg rejects longer archive names
+const maxArchiveNameLength = 200
+
+var archivePlaceholderRegexp = regexp.MustCompile(`\{([a-z]+)(?::([^}]*))?\}`)
+
+// archiveNameVars are the values of the placeholders of -backup-name.
+type archiveNameVars struct {
+	hostname string
+	now      time.Time
+	snapshot string // archive part of the snapshot of source, empty if none
+	source   string // first source that is backed up
+}
+
+// validateArchiveTemplate checks that template only uses known placeholders.
+func validateArchiveTemplate(template string) error {
+	for _, m := range archivePlaceholderRegexp.FindAllStringSubmatch(template, -1) {
+		switch m[1] {
+		case "hostname", "snapshot", "source":
+			if m[2] != "" {
+				return errors.Errorf("-backup-name placeholder %s doesn't take a format", m[0])
+			}
+		case "now":
+		default:
+			return errors.Errorf("unknown -backup-name placeholder %s, expected {hostname}, {now}, {now:LAYOUT}, {snapshot} or {source}", m[0])
+		}
+	}
+	return nil
+}
+
+// expandArchiveName replaces the placeholders of template and checks that
+// the result is usable as a borg archive name.
+func expandArchiveName(template string, vars archiveNameVars) (string, error) {
+	name := archivePlaceholderRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		m := archivePlaceholderRegexp.FindStringSubmatch(placeholder)
+		switch m[1] {
+		case "hostname":
+			return vars.hostname
+		case "now":
+			layout := m[2]
+			if layout == "" {
+				layout = snapshotNameFormat
+			}
+			return vars.now.Format(layout)
+		case "snapshot":
+			if vars.snapshot == "" {
+				// the source isn't mounted from a snapshot
+				return vars.now.Format(snapshotNameFormat)
+			}
+			return vars.snapshot
+		case "source":
+			if vars.source == "/" {
+				return "root"
+			}
+			return filepath.Base(vars.source)
+		}
+		return placeholder
+	})
+	switch {
+	case strings.TrimSpace(name) == "":
+		return "", errors.Errorf("-backup-name %q expands to an empty archive name", template)
+	case strings.TrimSpace(name) != name:
+		return "", errors.Errorf("archive name %q (from -backup-name %q) starts or ends with whitespace", name, template)
+	case strings.Contains(name, "/"):
+		return "", errors.Errorf("archive name %q (from -backup-name %q) contains a slash", name, template)
+	case strings.Contains(name, "::"):
+		return "", errors.Errorf("archive name %q (from -backup-name %q) contains ::", name, template)
+	case len(name) > maxArchiveNameLength:
+		return "", errors.Errorf("archive name %q (from -backup-name %q) is longer than %d bytes", name, template, maxArchiveNameLength)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", errors.Errorf("archive name %q (from -backup-name %q) contains a control character", name, template)
+		}
+	}
+	return name, nil
+}
+
+// archiveGlob is the borg pattern matching the names template gives the
+// archives of host. {snapshot}, {now} and {source}, which change from run to
+// run or source to source, become *.
+func archiveGlob(template string, host string) string {
+	var glob strings.Builder
+	last := 0
+	for _, m := range archivePlaceholderRegexp.FindAllStringSubmatchIndex(template, -1) {
+		glob.WriteString(escapeGlob(template[last:m[0]]))
+		if template[m[2]:m[3]] == "hostname" {
+			glob.WriteString(escapeGlob(host))
+		} else if !strings.HasSuffix(glob.String(), "*") {
+			glob.WriteString("*")
+		}
+		last = m[1]
+	}
+	glob.WriteString(escapeGlob(template[last:]))
+	return glob.String()
+}
+
+// escapeGlob quotes the characters of s that borg's shell patterns treat
+// specially.
+func escapeGlob(s string) string {
+	return strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]").Replace(s)
+}
+
+// warnArchiveTemplate warns when archives named with template won't be
+// matched by the *@host glob recreate uses.
+func (b BorgBackup) warnArchiveTemplate(template string) {
+	if !strings.HasSuffix(template, "@{hostname}") {
+		b.logf(LevelWarn, "-backup-name %q doesn't end in @{hostname}, recreate won't find these archives", template)
+	}
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveGlob(t *testing.T) {
+	tests := []struct {
+		template string
+		host     string
+		glob     string
+		matches  []string
+		others   []string
+	}{
+		{DefaultArchiveTemplate, "mac", "*@mac",
+			[]string{"com.apple.TimeMachine.2024-01-01-000000@mac"},
+			[]string{"com.apple.TimeMachine.2024-01-01-000000@mac-mini", "com.apple.TimeMachine.2024-01-01-000000@nas", "com.apple.TimeMachine.2024-01-01-000000@mac-root"}},
+		{"{hostname}-{now:2006-01-02T15:04}", "mac", "mac-*", []string{"mac-2024-01-01T00:00"}, []string{"nas-2024-01-01T00:00"}},
+		{"{snapshot}@{hostname}-work", "mac", "*@mac-work", []string{"2024-01-01-000000@mac-work"}, []string{"2024-01-01-000000@mac"}},
+		{"{source}-{snapshot}@{hostname}", "mac", "*-*@mac", []string{"root-2024-01-01-000000@mac"}, []string{"root@mac"}},
+		{"{snapshot}{now}@{hostname}", "mac", "*@mac", []string{"2024-01-01-0000002024-01-01-000000@mac"}, nil},
+		{"backup[{hostname}]", "mac", "backup[[]mac]", []string{"backup[mac]"}, []string{"backupm"}},
+		{"{snapshot}@{hostname}", "mac*", "*@mac[*]", []string{"a@mac*"}, []string{"a@macbook"}},
+		{"daily?", "mac", "daily[?]", []string{"daily?"}, []string{"daily1"}},
+	}
+	for _, tt := range tests {
+		glob := archiveGlob(tt.template, tt.host)
+		if glob != tt.glob {
+			t.Errorf("archiveGlob(%q, %q) = %q, want %q", tt.template, tt.host, glob, tt.glob)
+			continue
+		}
+		for _, name := range tt.matches {
+			if ok, err := path.Match(glob, name); !ok || err != nil {
+				t.Errorf("%q doesn't match %q: %v", glob, name, err)
+			}
+		}
+		for _, name := range tt.others {
+			if ok, _ := path.Match(glob, name); ok {
+				t.Errorf("%q matches %q", glob, name)
+			}
+		}
+	}
+}
+
+func TestExpandArchiveName(t *testing.T) {
+	now := time.Date(2024, 1, 15, 9, 30, 0, 0, time.UTC)
+	vars := archiveNameVars{hostname: "mac", now: now, snapshot: "2024-01-15-093000", source: "/System/Volumes/Data"}
+	tests := []struct {
+		template string
+		vars     archiveNameVars
+		want     string
+		err      string // empty for none
+	}{
+		{DefaultArchiveTemplate, vars, "2024-01-15-093000@mac", ""},
+		{"{hostname}-{now:2006-01-02}", vars, "mac-2024-01-15", ""},
+		{"{now}", vars, "2024-01-15 09:30:00", ""},
+		{"{source}-{snapshot}", vars, "Data-2024-01-15-093000", ""},
+		{"{source}", archiveNameVars{source: "/"}, "root", ""},
+		{"{source}", archiveNameVars{source: "/Volumes/My Disk"}, "My Disk", ""},
+		// not mounted from a snapshot
+		{"{snapshot}@{hostname}", archiveNameVars{hostname: "mac", now: now}, "2024-01-15 09:30:00@mac", ""},
+		{"plain", vars, "plain", ""},
+		{"{unknown}", vars, "{unknown}", ""},
+		{"{hostname}", archiveNameVars{}, "", "expands to an empty archive name"},
+		{"{hostname} ", archiveNameVars{}, "", "expands to an empty archive name"},
+		{" {hostname}", vars, "", "whitespace"},
+		{"{now:2006/01/02}", vars, "", "contains a slash"},
+		{"{hostname}::{snapshot}", vars, "", "contains ::"},
+		{"backup\t{hostname}", vars, "", "control character"},
+		{"{hostname}", archiveNameVars{hostname: strings.Repeat("m", maxArchiveNameLength+1)}, "", "longer than"},
+	}
+	for _, tt := range tests {
+		got, err := expandArchiveName(tt.template, tt.vars)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expandArchiveName(%q) = %q, %v, want an error with %q", tt.template, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("expandArchiveName(%q) = %q, %v, want %q", tt.template, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidateArchiveTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		ok       bool
+	}{
+		{DefaultArchiveTemplate, true},
+		{"{hostname}-{now:2006-01-02}-{source}", true},
+		{"{now}", true},
+		{"no placeholders", true},
+		{"{host}", false},
+		{"{hostname:short}", false},
+		{"{snapshot:2006}", false},
+		{"{source:base}", false},
+	}
+	for _, tt := range tests {
+		if err := validateArchiveTemplate(tt.template); (err == nil) != tt.ok {
+			t.Errorf("validateArchiveTemplate(%q) = %v, want ok %v", tt.template, err, tt.ok)
+		}
+	}
+}
+
+func TestRunNamesTheArchive(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string // prefix of the archive, empty if refused
+	}{
+		{"{hostname}-{source}-{now:2006}", fmt.Sprintf("::mac-source1-%d", time.Now().Year())},
+		{"{hostname}::{source}", ""},
+	}
+	for _, tt := range tests {
+		b, env := newFakeBackup(t, nil, WithHostname("mac"), WithBackupName(tt.template))
+		_, err := b.Run(context.Background())
+		create := env.runner.find("borg", "create")
+		if tt.want == "" {
+			if err == nil || create != nil {
+				t.Errorf("-backup-name %q: got %v, want the archive name refused before borg create", tt.template, err)
+			}
+			if !hasCall(env.runner, "snapUtil", "-d", env.source) {
+				t.Errorf("-backup-name %q: the snapshot wasn't removed", tt.template)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("-backup-name %q: %v", tt.template, err)
+		}
+		if !strings.Contains(create.String(), " "+tt.want+" ") {
+			t.Errorf("-backup-name %q: ran %s, want archive %s", tt.template, create, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ListedArchive is an archive in the repository, as listed by ListArchives.
+type ListedArchive struct {
+	Name  string    `json:"name"`
+	ID    string    `json:"id"`
+	Start time.Time `json:"start"`
+}
+
+// underLock takes the lock of the backups and reads the passphrase like Run
+// does, then calls f, so that maintenance never runs at the same time as a
+// backup.
+func (b BorgBackup) underLock(ctx context.Context, f func(b BorgBackup) error) error {
+	if b.multiRepo() {
+		return errors.New("several repositories given, pick one with -repo")
+	}
+	releaseLock, err := b.getFileLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer releaseLock()
+	if b.passphraseSource != nil {
+		b.logf(LevelInfo, "Reading passphrase from %s", b.passphraseSource.Name())
+		b.passphrase, err = b.passphraseSource.Passphrase(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return f(b)
+}
+
+// borgError turns the failure of a borg command into a *BorgError.
+func borgError(err error, what string) error {
+	code, ok := exitCode(err)
+	if !ok {
+		code = -1
+	}
+	return &BorgError{ExitCode: code, Err: errors.Wrapf(err, "error while %s", what)}
+}
+
+// ListArchives lists the archives in the repository with borg list, oldest
+// first.
+func (b BorgBackup) ListArchives(ctx context.Context) ([]ListedArchive, error) {
+	archives := []ListedArchive{}
+	err := b.underLock(ctx, func(b BorgBackup) error {
+		out, err := b.borgOutput(ctx, append([]string{"list", "--json"}, b.borgCommonArgs()...)...)
+		if err != nil {
+			return borgError(err, "listing the archives")
+		}
+		var list struct {
+			Archives []struct {
+				Name  string `json:"name"`
+				ID    string `json:"id"`
+				Start string `json:"start"`
+			} `json:"archives"`
+		}
+		if err := json.Unmarshal(out, &list); err != nil {
+			return errors.Wrap(err, "error while parsing borg list output")
+		}
+		for _, a := range list.Archives {
+			start, err := time.ParseInLocation(borgTimeFormat, a.Start, time.Local)
+			if err != nil {
+				return errors.Wrapf(err, "error while parsing the start of archive %s", a.Name)
+			}
+			archives = append(archives, ListedArchive{Name: a.Name, ID: a.ID, Start: start})
+		}
+		return nil
+	})
+	return archives, err
+}
+
+// DeleteArchive deletes the archive name with borg delete, and with
+// -compact frees its space with borg compact.
+func (b BorgBackup) DeleteArchive(ctx context.Context, name string) error {
+	return b.underLock(ctx, func(b BorgBackup) error {
+		args := append([]string{"delete"}, b.borgCommonArgs()...)
+		args = append(args, "::"+name)
+		b.logf(LevelInfo, "borg %v", args)
+		if !b.dryRun {
+			if err := b.runBorgInterruptible(ctx, args); err != nil {
+				return borgError(err, "deleting archive "+name)
+			}
+			b.logf(LevelInfo, "Deleted archive %s", name)
+		}
+		if b.compact {
+			return b.compactRepository(ctx)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,153 @@
+//go:build integration
+// +build integration
+
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// Run with `go test -tags integration ./internal`, needs borg in PATH.
+
+const integrationPassphrase = "correct horse battery staple"
+
+// newTestRepo creates an encrypted repository with the archives names, each
+// of a small directory, and returns a backup using it.
+func newTestRepo(t *testing.T, names ...string) BorgBackup {
+	t.Helper()
+	if _, err := exec.LookPath("borg"); err != nil {
+		t.Skip("borg isn't installed")
+	}
+	dir, err := ioutil.TempDir("", "borg-tm-integration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	repo := filepath.Join(dir, "repo")
+	data := filepath.Join(dir, "data")
+	if err := os.Mkdir(data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(data, "file"), []byte("borg-tm"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	passphraseFile := filepath.Join(dir, "passphrase")
+	if err := ioutil.WriteFile(passphraseFile, []byte(integrationPassphrase+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// keep borg's cache, config and keys in dir
+	oldBaseDir, hadBaseDir := os.LookupEnv("BORG_BASE_DIR")
+	os.Setenv("BORG_BASE_DIR", dir)
+	t.Cleanup(func() {
+		if hadBaseDir {
+			os.Setenv("BORG_BASE_DIR", oldBaseDir)
+		} else {
+			os.Unsetenv("BORG_BASE_DIR")
+		}
+	})
+
+	borg := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("borg", args...)
+		cmd.Dir = data
+		cmd.Env = append(os.Environ(), "BORG_REPO="+repo, "BORG_PASSPHRASE="+integrationPassphrase)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("borg %v: %v\n%s", args, err, out)
+		}
+	}
+	borg("init", "--encryption", "repokey")
+	for _, name := range names {
+		borg("create", "::"+name, ".")
+	}
+
+	b, err := NewBackup(
+		WithSources(data),
+		WithMountpoints(data),
+		WithRepo(repo),
+		WithPassphraseSource(NewPassphraseFileSource(passphraseFile)),
+		WithLockFile(filepath.Join(dir, "backup.lock")),
+		WithLogger(NewTextLogger(ioutil.Discard, LevelError)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func archiveNames(t *testing.T, b BorgBackup) []string {
+	t.Helper()
+	archives, err := b.ListArchives(context.Background())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	names := []string{}
+	for _, a := range archives {
+		if a.ID == "" || a.Start.IsZero() {
+			t.Errorf("archive %+v has no ID or start", a)
+		}
+		names = append(names, a.Name)
+	}
+	return names
+}
+
+func TestListAndDeleteArchives(t *testing.T) {
+	b := newTestRepo(t, "2024-01-01-000000@mac", "2024-01-02-000000@mac", "2024-01-03-000000@mac")
+	want := []string{"2024-01-01-000000@mac", "2024-01-02-000000@mac", "2024-01-03-000000@mac"}
+	if got := archiveNames(t, b); !reflect.DeepEqual(got, want) {
+		t.Fatalf("listed %v, want %v", got, want)
+	}
+	if err := b.DeleteArchive(context.Background(), "2024-01-02-000000@mac"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	want = []string{"2024-01-01-000000@mac", "2024-01-03-000000@mac"}
+	if got := archiveNames(t, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("listed %v after the delete, want %v", got, want)
+	}
+}
+
+func TestDeleteMissingArchive(t *testing.T) {
+	b := newTestRepo(t, "2024-01-01-000000@mac")
+	err := b.DeleteArchive(context.Background(), "2024-01-02-000000@mac")
+	var borgErr *BorgError
+	if !errors.As(err, &borgErr) || borgErr.ExitCode == 0 {
+		t.Fatalf("got %v, want a *BorgError", err)
+	}
+	if got := archiveNames(t, b); !reflect.DeepEqual(got, []string{"2024-01-01-000000@mac"}) {
+		t.Errorf("listed %v, want the archive to be left alone", got)
+	}
+}
+
+func TestDryRunDeleteKeepsTheArchive(t *testing.T) {
+	b := newTestRepo(t, "2024-01-01-000000@mac")
+	b.dryRun = true
+	if err := b.DeleteArchive(context.Background(), "2024-01-01-000000@mac"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got := archiveNames(t, b); !reflect.DeepEqual(got, []string{"2024-01-01-000000@mac"}) {
+		t.Errorf("listed %v after a dry run, want the archive to be kept", got)
+	}
+}
+
+func TestMaintenanceWaitsForTheBackup(t *testing.T) {
+	b := newTestRepo(t, "2024-01-01-000000@mac")
+	// as a running backup holds it
+	release, err := b.getFileLock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := b.ListArchives(context.Background()); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("listing got %v, want ErrLockHeld", err)
+	}
+	if err := b.DeleteArchive(context.Background(), "2024-01-01-000000@mac"); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("deleting got %v, want ErrLockHeld", err)
+	}
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// PrepareBorgBaseDir creates dir and sets BORG_BASE_DIR to it for every borg
+// invocation. When dir is created, root's existing borg cache and config
+// (which holds the keys of keyfile repositories) are moved into it, which is
+// logged to logger.
+func PrepareBorgBaseDir(dir string, logger Logger) error {
+	log := newRunLog(logger)
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return errors.Wrap(err, "error while resolving -borg-base-dir")
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return errors.Wrapf(err, "error while creating borg base dir %s", dir)
+		}
+		log.logf(LevelInfo, "Created borg base dir %s", dir)
+		migrateBorgDirs(dir, log)
+	} else if err != nil {
+		return errors.Wrapf(err, "error while checking borg base dir %s", dir)
+	}
+	return errors.Wrap(os.Setenv("BORG_BASE_DIR", dir), "error while setting BORG_BASE_DIR")
+}
+
+// migrateBorgDirs moves ~/.cache/borg and ~/.config/borg below dir. Failures
+// only cost a cache rebuild, so they are reported but not fatal.
+func migrateBorgDirs(dir string, log *runLog) {
+	if os.Getenv("BORG_BASE_DIR") != "" {
+		return
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return
+	}
+	for _, sub := range []string{".cache", ".config"} {
+		from := filepath.Join(home, sub, "borg")
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		to := filepath.Join(dir, sub, "borg")
+		if err := os.MkdirAll(filepath.Dir(to), 0700); err == nil {
+			err = os.Rename(from, to)
+		}
+		if err != nil {
+			log.logf(LevelWarn, "could not move %s to %s, move it manually: %v", from, to, err)
+			continue
+		}
+		log.logf(LevelInfo, "Moved %s to %s", from, to)
+	}
+}
+
+// dirSize returns the total size of the regular files below dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// PrintBorgBaseDirSize logs how much space the borg base dir takes up.
+func PrintBorgBaseDirSize(logger Logger) {
+	if dir := os.Getenv("BORG_BASE_DIR"); dir != "" {
+		newRunLog(logger).logf(LevelInfo, "borg base dir %s uses %.1f MiB", dir, float64(dirSize(dir))/(1<<20))
+	}
+}
+
+// ClearBorgCache deletes the borg cache below dir. It takes the lock first,
+// so it never runs while a backup is using the cache. The cache is shared
+// by all repositories, so without lockFile the default locks of all of them
+// are taken.
+func ClearBorgCache(dir string, lockFile string) error {
+	lockFiles := []string{lockFile}
+	if lockFile == "" {
+		var err error
+		lockFiles, err = allLockFiles()
+		if err != nil {
+			return err
+		}
+	}
+	for _, path := range lockFiles {
+		b := BorgBackup{lockFile: path}
+		releaseLock, err := b.getFileLock(context.Background())
+		if err != nil {
+			return err
+		}
+		defer releaseLock()
+	}
+	cache := filepath.Join(dir, ".cache", "borg")
+	fmt.Printf("Removing %s (%.1f MiB)\n", cache, float64(dirSize(cache))/(1<<20))
+	return errors.Wrapf(os.RemoveAll(cache), "error while removing %s", cache)
+}
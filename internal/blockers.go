@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const lsofTimeout = 10 * time.Second
+
+// Spotlight processes that commonly keep snapshot mounts busy
+var spotlightProcesses = map[string]bool{
+	"mds":        true,
+	"mds_stores": true,
+	"mdworker":   true,
+	"mdworker_s": true, // lsof truncates mdworker_shared
+}
+
+type blockingProcess struct {
+	pid     string
+	command string
+}
+
+// parseLsofFields parses the output of `lsof -F pc`, which prints one field
+// per line prefixed with its type: p<pid>, then c<command>.
+func parseLsofFields(output string) []blockingProcess {
+	var procs []blockingProcess
+	for _, line := range strings.Split(output, "\n") {
+		if len(line) < 2 {
+			continue
+		}
+		switch line[0] {
+		case 'p':
+			procs = append(procs, blockingProcess{pid: line[1:]})
+		case 'c':
+			if len(procs) > 0 {
+				procs[len(procs)-1].command = line[1:]
+			}
+		}
+	}
+	return procs
+}
+
+// describeBlockers lists the processes with open files below mountpoint, for
+// explaining why an unmount failed. Returns "" if none could be found, or
+// if ctx expires first.
+func describeBlockers(ctx context.Context, mountpoint string) string {
+	ctx, cancel := context.WithTimeout(ctx, lsofTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "lsof", "-F", "pc", "+D", mountpoint)
+	buf := new(bytes.Buffer)
+	cmd.Stdout = buf
+	cmd.Env = safeEnvs()
+	// lsof exits non-zero when nothing has files open, so only the output matters
+	_ = cmd.Run()
+	procs := parseLsofFields(buf.String())
+	if len(procs) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(procs))
+	spotlight := false
+	for _, p := range procs {
+		names = append(names, fmt.Sprintf("%s (pid %s)", p.command, p.pid))
+		spotlight = spotlight || spotlightProcesses[p.command]
+	}
+	desc := "in use by " + strings.Join(names, ", ")
+	if spotlight {
+		desc += "; Spotlight is indexing the mount, consider `mdutil -i off " + mountpoint + "` or adding it to Spotlight's privacy list"
+	}
+	return desc
+}
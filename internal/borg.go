@@ -5,11 +5,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"log"
+	"math"
 	"os"
-	"os/exec"
+	"runtime/debug"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -18,9 +18,12 @@ import (
 
 const tmUtilCmd = "tmutil"
 
-const (
-	unrecognizedSnapshotName backupErr = "unrecognized snapshot format"
-)
+// name format of the snapshots created by borg-tm
+const snapshotNameFormat = "2006-01-02 15:04:05"
+
+// header tmutil prints before the snapshots on newer macOS releases, e.g.
+// "Snapshots for volume group containing disk /:"
+const tmutilListHeader = "Snapshots for "
 
 type backupErr string
 
@@ -29,6 +32,8 @@ func (b backupErr) Error() string {
 }
 
 type BorgBackup struct {
+	repo                 string       // BORG_REPO unless given with WithRepo
+	repos                []RepoTarget // more than one to back up to several
 	lockFile             string
 	borgArgs             []string
 	mountpoints          []string
@@ -37,153 +42,563 @@ type BorgBackup struct {
 	snapshotsToUse       []string
 	backupName           string
 	dryRun               bool
-}
+	quotaWarnPercent     float64
+	quotaAbortPercent    float64
+	label                string
+	historyFile          string
+	sizeAnomalyFactor    float64
+	passphraseSource     PassphraseSource
+	allowUnencrypted     bool
+	umask                int
+	sparse               *bool // nil means auto-detect
+	chunkerParams        string
+	stateFile            string
+	journalFile          string
+	separateArchives     bool
+	storeOriginalPaths   bool
+	mountBases           []string   // -mountpoint values with -store-original-paths
+	subpaths             [][]string // directories of each source to back up, nil for all of it
+	subdirWarnings       []string   // about directory sources, logged by Run
+	snapshotPrefix       string
+	noAutoRecover        bool
+	hostname             string
+	thermal              *ThermalOptions // nil disables thermal throttling
+	ioPolicy             string
+	keepSnapshots        bool
+	snapshotRetention    *SnapshotRetention // nil disables pruning after the backup
+	consistentSnapshots  bool
+	consistencyWindow    time.Duration
+	maxSnapshotSpread    time.Duration
+	snapshotSpreadPolicy string
+	snapshotRetries      int
+	continueOnError      bool
+	recordChanges        bool
+	artifactsDir         string
+	prune                *PruneOptions // nil disables borg prune
+	sshControlMaster     bool
+	noSync               bool
+	fullfsyncPaths       []string
+	quiesceHooks         map[string]QuiesceHooks
+	quiesceTimeout       time.Duration
+	lockWait             time.Duration // 0 fails right away when the lock is busy
+	borgLockWait         time.Duration // --lock-wait of borg, 0 for its default
+	check                *CheckOptions
+	initIfMissing        bool
+	initEncryption       string
+	keyExportPath        string
+	keyExportFormat      string
+	keyExportOverwrite   bool
+	verifySample         int    // files compared after the backup, 0 for none
+	changeDetection      string // -change-detection, empty without -skip-if-unchanged
+	hooks                Hooks
+	callbacks            *callbacks // OnPhase and OnProgress
+	borgRetries          int
+	borgRetryDelay       time.Duration
+	forceMountpoint      bool
+	unmountRetries       int
+	unmountRetryDelay    time.Duration
+	acceptNewRepo        bool
+	statsSummary         bool
+	failOnWarnings       bool
+	compact              bool
+	reportChanged        bool
+	noAutoExcludeRepo    bool
+	noAutoExcludeNested  bool
+	excludeSources       []string
+	excludeArgs          []string // -exclude values, resolved by NewBackup
+	excludePatterns      []string // borg patterns among them
+	excludeCaches        bool
+	honorTMExclusions    bool
+	tmExclusionDepth     int
+	tmExclusionCacheFile string
+	progressFifoPath     string
+	showProgress         bool
+	acceptRepoChanges    bool
+	snapshotListTool     string
+	snapshotTool         string
+	snapUtilPath         string // -snaputil-path, empty to look it up
+	runner               Runner // nil runs the commands with os/exec
+	logger               Logger // nil logs plain text to stdout
+	reportFile           string
+	pingURL              string
+	pingStart            bool
+	notifyCompletion     bool
+	sourceUUIDs          []string // volume UUID per source given as uuid:..., empty otherwise
 
-func NewBackup(mountpoints []string, lockfile string, useExistingSnapshots bool, sources []string, snapshotsToUse []string, backupName string, borgArgs []string, dryRun bool) BorgBackup {
-	return BorgBackup{
-		lockFile:             lockfile,
-		borgArgs:             borgArgs,
-		mountpoints:          mountpoints,
-		useExistingSnapshots: useExistingSnapshots,
-		sources:              sources,
-		snapshotsToUse:       snapshotsToUse,
-		backupName:           backupName,
-		dryRun:               dryRun,
-	}
+	// resolved at the start of Run
+	passphrase string
+	useSparse  bool
+	excludes   []string
+	prefixes   []string // log prefix per source, nil for a single source
+	snapUtil   string   // found snapUtil, empty with tmutil
+
+	// set while running
+	archiveComment string
+	usage          *usageTracker
+	log            *runLog
+	borgExit       *int // exit status of borg create, -1 until it ran
+	progress       *progressFifo
+	failures       *sourceFailures // nil without -continue-on-error
+	changes        *changeRecorder // nil without -record-changes
+	journal        *runJournal
+	tmExclusions   *tmExclusions // nil without -honor-tm-exclusions
+	repoCreated    *bool         // by -init-if-missing
 }
 
-func (b BorgBackup) getFileLock() error {
-	file, err := os.OpenFile(b.lockFile, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return errors.Wrap(err, "error while opening lockfile")
+// Run creates the snapshots and the archive. The report is filled in as far
+// as the backup got.
+func (b BorgBackup) Run(ctx context.Context) (report Report, finalErr error) {
+	var snapshots []snapshotRecord
+	cleanup := newCleanupFailures()
+	b.usage = newUsageTracker()
+	b.log = newRunLog(b.logger)
+	report.Start = time.Now()
+	b.borgExit = new(int)
+	*b.borgExit = -1
+	b.repoCreated = new(bool)
+	defer func() {
+		// after the cleanup, to include its errors
+		if b.tmExclusions != nil {
+			applied := b.tmExclusions.applied
+			report.TMExclusions = &applied
+		}
+		report.Usage = b.usage.summary()
+		report.finish(b.sources, snapshots, b.borgExit, finalErr)
+		if b.reportFile == "" {
+			return
+		}
+		if err := report.write(b.reportFile); err != nil {
+			b.logf(LevelWarn, "%v", err)
+		}
+	}()
+	if b.pingStart {
+		b.ping("start", nil)
 	}
-	for {
-		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
-		if err != syscall.EINTR {
-			break
+	defer func() { b.notify(report, finalErr) }()
+	defer func() {
+		if finalErr != nil {
+			b.ping("fail", finalErr)
+		} else {
+			b.ping("success", nil)
 		}
+	}()
+	// after the cleanup, so that it sees all of it
+	defer func() { b.runPostRunHook(report, finalErr) }()
+	if b.continueOnError || b.separateArchives {
+		// separate archives always go on with the other sources
+		b.continueOnError = true
+		b.failures = newSourceFailures()
+	}
+	if b.progressFifoPath != "" {
+		var err error
+		b.progress, err = openProgressFifo(b.progressFifoPath)
+		if err != nil {
+			return report, err
+		}
+		defer func() { b.progress.close(finalErr) }()
+	}
+	if len(b.sources) > 1 {
+		b.prefixes = sourcePrefixes(b.sources)
+		b.printPrefixes()
+	}
+	b.printSubdirectorySources()
+	if b.backupName != DefaultArchiveTemplate {
+		b.warnArchiveTemplate(b.backupName)
+	}
+	// the log and the FIFO are fed like any other callback
+	var fifoProgress func(ProgressEvent)
+	if b.progress != nil {
+		fifoProgress = b.progress.progress
+	}
+	b.callbacks = b.callbacks.with(b.logPhase, fifoProgress)
+	defer func() { b.logUsage(b.usage.summary()) }()
+	if b.umask >= 0 {
+		// also covers the lock file, history file and anything else we create
+		b.logf(LevelInfo, "Using umask %04o", b.umask)
+		syscall.Umask(b.umask)
 	}
-	err = errors.Wrap(err, "error while acquiring file lock (maybe another process running?)")
-	return err
-}
-
-func (b BorgBackup) Run(ctx context.Context) (finalErr error) {
-	var snapshots []string
 	innerFunc := func() error {
-		err := b.getFileLock()
+		releaseLock, err := b.getFileLock(ctx)
+		if err != nil {
+			return err
+		}
+		defer releaseLock()
+		b.journal, err = loadJournal(b.journalFile, b.log)
 		if err != nil {
 			return err
 		}
+		if !b.journal.empty() {
+			if b.noAutoRecover {
+				b.logf(LevelWarn, "%s, leaving it alone (-no-auto-recover), see `borg-tm cleanup`", b.journal.describe())
+			} else {
+				b.enterPhase("recover")
+				b.logf(LevelWarn, "%s, recovering before this backup", b.journal.describe())
+				if err := b.recoverJournal(ctx); err != nil {
+					// the mountpoints are checked again before mounting
+					b.logf(LevelError, "%v", err)
+				}
+			}
+		}
+		b.journal.start()
+		if b.sshControlMaster {
+			master, err := b.startSSHMaster()
+			if err != nil {
+				return err
+			}
+			defer master.stop()
+		}
+		if b.passphraseSource != nil {
+			b.logf(LevelInfo, "Reading passphrase from %s", b.passphraseSource.Name())
+			b.passphrase, err = b.passphraseSource.Passphrase(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		if !b.dryRun {
+			if err := b.adoptLegacyFiles(); err != nil {
+				return err
+			}
+		}
+		st, err := loadState(b.stateFile)
+		if err != nil {
+			return err
+		}
+		info, err := b.preflight(ctx, false)
+		if err != nil {
+			return err
+		}
+		if b.keyExportPath != "" {
+			exported, err := b.exportKey(ctx)
+			if err != nil {
+				// the backup itself doesn't need it
+				b.logf(LevelError, "%v", err)
+			}
+			if exported {
+				report.KeyExport = b.keyExportPath
+			}
+		}
+		if !b.multiRepo() {
+			if err := b.checkRepoID(info, &st); err != nil {
+				return err
+			}
+			if b.quotaWarnPercent > 0 || b.quotaAbortPercent > 0 {
+				if err := b.checkQuota(info); err != nil {
+					return err
+				}
+			}
+		}
+		b.checkChunkerParams(st)
+		hostName, err := b.resolveHostname(st)
+		if err != nil {
+			return err
+		}
+		b.logf(LevelInfo, "I/O policy for borg: %s", b.ioPolicy)
+		b.storeOriginalPaths, err = b.resolveOriginalPaths(ctx)
+		if err != nil {
+			return err
+		}
+		b.useSparse, err = b.resolveSparse(ctx)
+		if err != nil {
+			return err
+		}
+		b.excludes = append(b.autoExcludes(), b.nestedExcludes()...)
+		sourceExcludes, err := b.sourceExcludes()
+		if err != nil {
+			return err
+		}
+		b.excludes = append(b.excludes, sourceExcludes...)
+		for _, pattern := range b.excludePatterns {
+			b.logf(LevelInfo, "Excluding pattern %s from the archive", pattern)
+		}
+		b.excludes = append(b.excludes, b.excludePatterns...)
+		if b.honorTMExclusions {
+			b.tmExclusions = b.loadTMExclusions(ctx)
+		}
+		if err := b.checkSnapshotsToUse(ctx); err != nil {
+			return err
+		}
+		releaseMountpoints, err := b.lockMountpoints(ctx)
+		if err != nil {
+			return err
+		}
+		// after the deferred unmounts
+		defer releaseMountpoints()
+		if err := b.prepareMountpoints(ctx); err != nil {
+			return err
+		}
+		// names of the snapshots created for this run, indexed like b.sources
+		var created []string
 		if !b.useExistingSnapshots {
-			// https://www.tutorialspoint.com/how-to-handle-errors-within-waitgroups-in-golang , https://medium.com/swlh/using-goroutines-and-wait-groups-for-concurrency-in-golang-78ca7a069d28
-			fatalErrorChannel := make(chan error)
-			wgDone := make(chan bool)
-			var wg sync.WaitGroup
-			wg.Add(len(b.sources))
-
-			for i := 0; i < len(b.sources); i++ {
-				source := b.sources[i]
-
-				go func(source string) {
-					fmt.Printf("Creating snapshot for source %s\n", source)
-					err = b.createSnapshot(source)
-					if err != nil {
-						err = errors.Wrapf(err, "error while creating snapshot for source %s", source)
-
-						// return err
-						fatalErrorChannel <- err
-					} else {
-						fmt.Printf("Created snapshot for source %s\n", source)
-					}
-					wg.Done()
-				}(source)
-			}
-			go func() {
-				wg.Wait()
-				close(wgDone)
+			b.snapshotTool, b.snapUtil, err = b.resolveSnapshotTool()
+			if err != nil {
+				return err
+			}
+			if err := b.runPhaseHook(ctx, "pre-snapshot", b.hooks.PreSnapshot); err != nil {
+				return err
+			}
+			if !b.noSync {
+				if err := b.flushBeforeSnapshot(); err != nil {
+					return err
+				}
+			}
+			b.enterPhase("snapshot")
+			var spread time.Duration
+			created, spread, err = b.createSnapshotSet(ctx)
+			if herr := b.runPhaseHook(context.Background(), "post-snapshot", b.hooks.PostSnapshot); herr != nil {
+				// the snapshots are there, the backup still goes on
+				b.logf(LevelError, "%v", herr)
+			}
+			if err != nil {
+				// let the cleanup remove the snapshots that were created
+				snapshots = make([]snapshotRecord, len(created))
+				for i, name := range created {
+					snapshots[i] = snapshotRecord{Name: name}
+				}
+				return err
+			}
+			// a source that fails or panics before it gets its entry in
+			// snapshots leaves the snapshots of it and the later sources to
+			// the cleanup
+			defer func() {
+				for j := len(snapshots); j < len(created); j++ {
+					snapshots = append(snapshots, snapshotRecord{Name: created[j]})
+				}
 			}()
-
-			// "The select statement is used for listening to errors or the WaitGroup to complete." ( https://www.tutorialspoint.com/how-to-handle-errors-within-waitgroups-in-golang )
-			select {
-			case <-wgDone:
-				break
-			case err := <-fatalErrorChannel:
-				close(fatalErrorChannel)
-				// log.Fatal("Error encountered: ", err)
+			if len(b.sources) > 1 {
+				b.archiveComment = fmt.Sprintf("snapshot creation spread: %s", spread)
+			}
+		}
+		var volumes []string
+		for i, uuid := range b.sourceUUIDs {
+			if uuid != "" {
+				volumes = append(volumes, fmt.Sprintf("%s=%s", b.sources[i], uuid))
+			}
+		}
+		if len(volumes) > 0 {
+			if b.archiveComment != "" {
+				b.archiveComment += "; "
+			}
+			// lets restores identify the volume whatever it is mounted as
+			b.archiveComment += "volume UUIDs: " + strings.Join(volumes, ", ")
+		}
+		if !b.multiRepo() {
+			b.archiveComment = appendComment(b.archiveComment, "repository ID: "+info.Repository.ID)
+		}
+		var consistent []string
+		if b.useExistingSnapshots && b.consistentSnapshots {
+			consistent, err = b.getConsistentSnapshots(ctx)
+			if err != nil {
 				return err
 			}
+			for i, name := range consistent {
+				if name != "" {
+					b.sourceLogf(i, "Consistent snapshot for source %s: %s\n", b.sources[i], name)
+				}
+			}
 		}
-		snapshots = []string{}
+		if b.separateArchives {
+			if err := b.runPhaseHook(ctx, "pre-borg", b.hooks.PreBorg); err != nil {
+				return err
+			}
+			b.enterPhase("borg")
+			snapshots = make([]snapshotRecord, len(b.sources))
+			report.Archives = b.backUpSeparately(ctx, hostName, created, consistent, snapshots, cleanup)
+			partial := b.failures.partialError(b.sources)
+			if allFailed(report.Archives) {
+				return errors.Errorf("all sources failed, no archive was created: %v", partial)
+			}
+			if b.reportChanged && !b.dryRun {
+				b.reportChangedSinceSnapshot(snapshotNames(snapshots))
+			}
+			if !b.dryRun {
+				st.ChunkerParams = b.effectiveChunkerParams()
+				st.Hostname = hostName
+				st.LastSuccess = time.Now()
+				st.LastArchive = lastCreated(report.Archives)
+				err = st.save(b.stateFile)
+			}
+			if err == nil && b.prune != nil {
+				b.enterPhase("prune")
+				err = b.pruneSeparately(ctx, hostName, report.Archives)
+			}
+			if err == nil && b.compact {
+				b.enterPhase("compact")
+				err = b.compactRepository(ctx)
+			}
+			if err == nil && partial != nil {
+				return partial
+			}
+			return err
+		}
+		b.enterPhase("mount")
+		snapshots = []snapshotRecord{}
+		var paths []string
+		// the first source that is backed up, which names the archive
+		first := -1
 		for i := 0; i < len(b.sources); i++ {
 			source := b.sources[i]
 			mountpoint := b.mountpoints[i]
+			if b.failures.has(i) {
+				// the snapshot couldn't be created
+				snapshots = append(snapshots, snapshotRecord{})
+				continue
+			}
 
-			fmt.Printf("source: %s\n", source)
-			fmt.Printf("mountpoint: %s\n", mountpoint)
+			idx := i
+			b.sourceLogf(idx, "source: %s\n", source)
+			b.sourceLogf(idx, "mountpoint: %s\n", mountpoint)
 			shouldMount := source != mountpoint
-			var snapshot string = ""
-			var err error = nil
-			if shouldMount && (len(b.snapshotsToUse) == 0 || b.snapshotsToUse[i] == "") {
-				snapshot, err = b.getLatestSnapshot(source)
-			} else if len(b.snapshotsToUse) > 0 {
-				snapshot = b.snapshotsToUse[i]
-			}
-			if err != nil {
-				return err
+			snapshot, err := b.selectSnapshot(ctx, i, created, consistent)
+			if err == nil && shouldMount {
+				err = b.mountSnapshot(ctx, idx, snapshot, source, mountpoint)
 			}
-			if shouldMount {
-				err = b.mountSnapshot(snapshot, source, mountpoint)
+			if err != nil && b.continueOnError {
+				b.logEntryf(b.sourceEntry(idx, LevelWarn), "Leaving out source %s (-continue-on-error): %v", source, err)
+				b.failures.add(idx, err)
+				// still remove the snapshot if we created one
+				snapshots = append(snapshots, snapshot)
+				continue
 			}
 			if err != nil {
-				return err
+				return &MountError{Source: source, Mountpoint: mountpoint, Err: err}
 			}
 			defer func() { // "defer will move the execution of the statement to the very end" [of] "a function." ( https://www.educative.io/answers/what-is-the-defer-keyword-in-golang#:~:text=In%20Golang%2C%20the%20defer%20keyword,very%20end%20inside%20a%20function. )
 				if shouldMount {
-					fmt.Printf("Unmounting %s\n", mountpoint)
-					err := unmount(mountpoint)
-					if err != nil {
-						log.Fatalf("unmount %s failed, need manual cleanup.\n", mountpoint)
-					} else {
-						fmt.Printf("Unmounted %s\n", mountpoint)
-					}
+					b.unmountSource(idx, cleanup)
 				}
 			}()
 			snapshots = append(snapshots, snapshot)
-		}
-		partsArray := [][]string{}
-		var now string = time.Now().Format("2006-01-02 15:04:05")
-		for i := 0; i < len(snapshots); i++ {
-			snapshot := snapshots[i]
-			if snapshot == "" {
-				snapshot = now // just using `snapshot` variable as a backup display name at this point, since the snapshot is already mounted
-				parts := []string{"", "", "", snapshot, ""}
-				fmt.Printf("Parts for %s: %s\n", snapshot, strings.Join(parts, `', '`))
-				partsArray = append(partsArray, parts)
-				continue
+			if sourcePaths := b.borgPaths(idx); len(sourcePaths) > 0 {
+				if first < 0 {
+					first = idx
+				}
+				paths = append(paths, sourcePaths...)
 			}
-			
-			// parts := strings.Split(snapshot, ".")
-			// if len(parts) != 5 {
-			// 	return errors.WithStack(unrecognizedSnapshotName)
-			// }
-			parts := strings.Split(snapshot, ".")
-			if len(parts) != 5 {
-				parts = []string{"", "", "", parts[0], ""}
-				// return errors.WithStack(unrecognizedSnapshotName)
+			b.excludes = append(b.excludes, b.sourceTMExclusions(ctx, idx, snapshot.Name)...)
+		}
+		if len(paths) == 0 {
+			return errors.New("all sources failed, nothing to back up")
+		}
+		vars := archiveNameVars{hostname: hostName, now: time.Now(), source: b.sources[first]}
+		if snapshots[first].Name != "" {
+			// the snapshot is already mounted, so its name is only used for display
+			name, err := b.parseSnapshotName(snapshots[first].Name)
+			if err != nil {
+				return err
 			}
-			fmt.Printf("Parts for %s: %s\n", snapshot, strings.Join(parts, `', '`))
-			partsArray = append(partsArray, parts)
+			vars.snapshot = name.archivePart()
 		}
-		hostName, err := os.Hostname()
+		backupName, err := expandArchiveName(b.backupName, vars)
 		if err != nil {
-			return errors.Wrap(err, "error while getting hostname")
+			return err
 		}
-
-		var backupName string = b.backupName
-		if backupName == "" {
-			backupName = partsArray[0][3]+"@"+hostName
+		b.logf(LevelInfo, "Archive name: %s", backupName)
+		var manifests map[string]string
+		if b.changeDetection != "" {
+			b.enterPhase("changes")
+			unchanged, m, err := b.sourcesUnchanged(ctx, backupName, paths, st)
+			if err != nil {
+				return err
+			}
+			manifests = m
+			if unchanged {
+				b.logf(LevelInfo, "Nothing changed since archive %s, skipping borg create (-skip-if-unchanged)", st.LastArchive)
+				report.Skipped = SkippedUnchanged
+				if b.dryRun {
+					return nil
+				}
+				// the sources are as fresh as if the archive was created
+				st.LastSuccess = time.Now()
+				return st.save(b.stateFile)
+			}
+		}
+		if err := b.runPhaseHook(ctx, "pre-borg", b.hooks.PreBorg); err != nil {
+			return err
+		}
+		if b.recordChanges && !b.dryRun {
+			b.changes, err = newChangeRecorder(b.artifactsDir)
+			if err != nil {
+				return err
+			}
+		}
+		b.enterPhase("borg")
+		if b.multiRepo() {
+			report.Repos = b.backUpToRepos(ctx, hostName, backupName, paths, &st)
+			partial := repoPartialError(report.Repos)
+			if allReposFailed(report.Repos) {
+				return errors.Errorf("all repositories failed, no archive was created: %v", partial)
+			}
+			report.Archive = backupName
+			if b.reportChanged && !b.dryRun {
+				b.reportChangedSinceSnapshot(snapshotNames(snapshots))
+			}
+			if !b.dryRun {
+				st.ChunkerParams = b.effectiveChunkerParams()
+				st.Hostname = hostName
+				st.LastSuccess = time.Now()
+				st.LastArchive = backupName
+				if err := st.save(b.stateFile); err != nil {
+					return err
+				}
+			}
+			if partial != nil {
+				return partial
+			}
+			if partial := b.failures.partialError(b.sources); partial != nil {
+				return partial
+			}
+			return nil
+		}
+		stats, duration, err := b.invokeBorg(ctx, backupName, paths)
+		if err == nil {
+			report.Archive = backupName
+			if stats != nil {
+				report.Stats = newArchiveStats(*stats, duration)
+			}
+		}
+		var changes *changeCounts
+		if b.changes != nil {
+			counts, cerr := b.changes.close()
+			if cerr != nil {
+				b.logf(LevelWarn, "%v", cerr)
+			} else {
+				b.logf(LevelInfo, "Changed files: %d added, %d modified, %d errors (listing in %s)", counts.Added, counts.Modified, counts.Errors, b.changes.path)
+			}
+			changes = &counts
+		}
+		if err == nil && (stats != nil || changes != nil) {
+			err = b.recordArchiveSize(backupName, stats, changes)
+		}
+		if err == nil && b.reportChanged && !b.dryRun {
+			b.reportChangedSinceSnapshot(snapshotNames(snapshots))
+		}
+		if err == nil && b.verifySample > 0 {
+			// while the snapshots are still mounted, and before a suspect
+			// archive counts as the last success or older ones are pruned
+			b.enterPhase("verify")
+			err = b.verifyArchive(ctx, backupName)
+		}
+		if err == nil && !b.dryRun {
+			st.ChunkerParams = b.effectiveChunkerParams()
+			st.Hostname = hostName
+			st.LastSuccess = time.Now()
+			st.LastArchive = backupName
+			if manifests != nil {
+				st.Manifests = manifests
+			}
+			err = st.save(b.stateFile)
+		}
+		if err == nil && b.prune != nil {
+			b.enterPhase("prune")
+			err = b.pruneArchives(ctx, b.hostArchiveGlob(hostName, ""), backupName)
+		}
+		if err == nil && b.compact {
+			b.enterPhase("compact")
+			err = b.compactRepository(ctx)
+		}
+		if partial := b.failures.partialError(b.sources); err == nil && partial != nil {
+			return partial
 		}
-		err = b.invokeBorg(ctx, backupName)
 		// if err != nil {
 		// 	err2 := removeSnapshots()
 		// 	return errors.Errorf("Failed to invoke Borg and also to delete snapshots: %w ; %w", err, err2)
@@ -193,133 +608,549 @@ func (b BorgBackup) Run(ctx context.Context) (finalErr error) {
 		return err
 	}
 
-	removeSnapshots := func() error {
+	removeSnapshots := func() {
 		if b.useExistingSnapshots {
-			return nil
+			return
+		}
+		if b.keepSnapshots {
+			b.logf(LevelInfo, "Keeping the created snapshots (-keep-snapshot)")
+			return
 		}
+		b.enterPhase("cleanup")
 
 		for i := 0; i < len(snapshots); i++ {
-			snapshot := snapshots[i]
+			snapshot := snapshots[i].Name
 			source := b.sources[i]
+			if snapshot == "" {
+				// not mounted from a snapshot, or its creation failed
+				continue
+			}
+			if cleanup.stillMounted[i] {
+				cleanup.leftover(snapshot, source, nil)
+				continue
+			}
 
-			fmt.Printf("Removing snapshot %s for source %s\n", snapshot, source)
-			err := b.removeSnapshot(snapshot, source)
+			entry := b.sourceEntry(i, LevelInfo)
+			entry.Snapshot = snapshot
+			b.logEntryf(entry, "Removing snapshot %s for source %s", snapshot, source)
+			start := time.Now()
+			cleanupCtx, cancel := cleanupContext()
+			err := b.removeSnapshot(cleanupCtx, snapshot, source)
+			cancel()
 			if err != nil {
-				err = errors.Wrapf(err, "error while removing snapshot %s", snapshot)
-				if finalErr != nil {
-					finalErr = errors.Wrapf(err, "previous error: %w", finalErr)
-					return finalErr
-				}
-				finalErr = err
-				return err
-			} else {
-				fmt.Printf("Removed snapshot %s for source %s\n", snapshot, source)
+				// still try the others
+				cleanup.leftover(snapshot, source, errors.Wrapf(err, "error while removing snapshot %s", snapshot))
+				continue
 			}
+			b.phaseDone(PhaseSnapshotRemoved, PhaseInfo{Source: source, Snapshot: snapshot}, start)
 		}
-		return nil
 	}
 
-	defer removeSnapshots() // Sets `finalErr` if needed
-	finalErr = innerFunc()
+	if b.statsSummary {
+		// after the cleanup, so that it's the last thing logged
+		defer func() { b.logReport(report) }()
+	}
+	defer func() {
+		removeSnapshots()
+		b.journal.finish(b.keepSnapshots)
+		if err := cleanup.err(); err != nil {
+			if finalErr != nil {
+				finalErr = errors.Wrapf(err, "previous error: %v", finalErr)
+			} else {
+				finalErr = err
+			}
+		}
+	}()
+	finalErr = func() (err error) {
+		// the deferred unmounts in innerFunc have run by the time we recover,
+		// removeSnapshots runs when Run returns
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.Errorf("panic during backup: %v\n%s", r, debug.Stack())
+			}
+		}()
+		return innerFunc()
+	}()
+	if finalErr == nil && b.snapshotRetention != nil {
+		b.enterPhase("prune")
+		finalErr = b.pruneSnapshots(ctx, b.sources, *b.snapshotRetention, b.dryRun)
+	}
+	if finalErr == nil && b.check != nil {
+		b.enterPhase("check")
+		finalErr = b.checkRepositoryIfDue(ctx)
+	}
 	return // (returns `finalErr` -- https://stackoverflow.com/questions/37248898/how-does-defer-and-named-return-value-work )
 }
 
-func (b BorgBackup) createSnapshot(source string) error {
-	// cmd := exec.Command(tmUtilCmd, "localsnapshot")
-	// cmd := exec.Command(tmUtilCmd, "snapshot", source)
-	cmd := exec.Command("./apfs/snapUtil", "-c", time.Now().Format("2006-01-02 15:04:05"), source) // Need "com.apple.developer.vfs.snapshot" entitlement
-	cmd.Env = safeEnvs()
-	err := errors.Wrap(cmd.Run(), "error while creating snapshot")
-	return err
+// selectSnapshot returns the snapshot the i-th source is backed up from:
+// the one created for this run, the -snapshotToUse of the source, the one
+// of the consistent set, or the newest. Sources that aren't mounted only get
+// the snapshot created for them, so that it gets removed.
+func (b BorgBackup) selectSnapshot(ctx context.Context, i int, created []string, consistent []string) (snapshotRecord, error) {
+	source := b.sources[i]
+	shouldMount := source != b.mountpoints[i]
+	switch {
+	case created != nil:
+		// exactly the snapshot we created, not whatever is the latest
+		// one by now
+		return b.findSnapshot(ctx, source, created[i]), nil
+	case shouldMount && (len(b.snapshotsToUse) == 0 || b.snapshotsToUse[i] == ""):
+		if consistent != nil {
+			return b.findSnapshot(ctx, source, consistent[i]), nil
+		}
+		snapshot, err := b.getLatestSnapshot(ctx, source)
+		if errors.Cause(err) == ErrNoSnapshots {
+			err = errors.Wrapf(ErrNoSnapshots, "source %s has nothing to back up, leave out -use-existing-snapshots to create a snapshot", source)
+		}
+		return snapshot, err
+	case len(b.snapshotsToUse) > 0:
+		return b.findSnapshot(ctx, source, b.snapshotsToUse[i]), nil
+	}
+	return snapshotRecord{}, nil
+}
+
+// unmountSource unmounts the mountpoint of the i-th source. A failure is
+// recorded in cleanup, the snapshot then stays as it is still mounted.
+func (b BorgBackup) unmountSource(i int, cleanup *cleanupFailures) {
+	mountpoint := b.mountpoints[i]
+	b.sourceLogf(i, "Unmounting %s\n", mountpoint)
+	start := time.Now()
+	cleanupCtx, cancel := cleanupContext()
+	err := b.unmountRetrying(cleanupCtx, i, mountpoint)
+	cancel()
+	if err != nil {
+		// keep going with the other mountpoints
+		b.logEntryf(b.sourceEntry(i, LevelError), "Unmounting %s failed, needs manual cleanup: %v", mountpoint, err)
+		cleanup.unmountFailed(i, mountpoint, err)
+		return
+	}
+	b.phaseDone(PhaseUnmounted, PhaseInfo{Source: b.sources[i], Mountpoint: mountpoint}, start)
+}
+
+// createSnapshot creates a snapshot called name on source and returns the
+// name of the created snapshot, which differs from name for tmutil.
+func (b BorgBackup) createSnapshot(ctx context.Context, name string, source string) (string, error) {
+	var created string
+	var err error
+	if b.snapshotTool == SnapshotToolTmutil {
+		created, err = b.createSnapshotTmutil(ctx, source)
+	} else {
+		created, err = b.createSnapshotSnapUtil(ctx, name, source)
+	}
+	if err == nil {
+		b.journal.snapshotCreated(source, created)
+	}
+	return created, err
 }
 
-func (b BorgBackup) getLatestSnapshot(source string) (string, error) {
-	cmd := exec.Command(tmUtilCmd, "listlocalsnapshots", source)
-	buf := new(bytes.Buffer)
-	cmd.Stdout = buf
-	cmd.Env = safeEnvs()
-	err := errors.Wrap(cmd.Run(), "error while getting latest snapshot")
+func (b BorgBackup) listSnapshots(ctx context.Context, source string) ([]string, error) {
+	records, err := b.listSnapshotRecords(ctx, source)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	var lastSnapshotName string
-	sc := bufio.NewScanner(buf)
+	return snapshotNames(records), nil
+}
+
+func (b BorgBackup) listSnapshotsTmutil(ctx context.Context, source string) ([]string, error) {
+	out, _, err := b.run(ctx, tmUtilCmd, []string{"listlocalsnapshots", source}, RunOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error while listing snapshots")
+	}
+	var names []string
+	sc := bufio.NewScanner(bytes.NewReader(out))
 	for sc.Scan() {
-		lastSnapshotName = sc.Text()
+		name := strings.TrimSpace(sc.Text())
+		if name == "" || strings.HasPrefix(name, tmutilListHeader) {
+			continue
+		}
+		names = append(names, name)
 	}
 	if err := sc.Err(); err != nil {
-		return "", errors.Wrap(err, "error while finding latest snapshot")
+		return nil, errors.Wrap(err, "error while listing snapshots")
 	}
-	if lastSnapshotName == "" {
-		return "", errors.New("no available snapshots")
+	return names, nil
+}
+
+// getLatestSnapshot returns the newest snapshot of source by the timestamp in
+// its name, see latestSnapshot. Without any snapshot, the cause of the error
+// is ErrNoSnapshots.
+func (b BorgBackup) getLatestSnapshot(ctx context.Context, source string) (snapshotRecord, error) {
+	records, err := b.listSnapshotRecords(ctx, source)
+	if err != nil {
+		return snapshotRecord{}, errors.Wrap(err, "error while getting latest snapshot")
 	}
-	return lastSnapshotName, nil
+	latest, ok := b.latestSnapshot(snapshotNames(records))
+	if !ok {
+		return snapshotRecord{}, errors.Wrapf(ErrNoSnapshots, "error while getting latest snapshot of %s", source)
+	}
+	for _, r := range records {
+		if r.Name == latest.Raw {
+			return r, nil
+		}
+	}
+	return snapshotRecord{Name: latest.Raw}, nil
 }
 
-func (b BorgBackup) mountSnapshot(snapshot string, source string, mountpoint string) error {
+func (b BorgBackup) mountSnapshot(ctx context.Context, i int, snapshot snapshotRecord, source string, mountpoint string) error {
 	// there'is no unix.Mount for Darwin, so we have to
 	// use exec to invoke mount.
 	// cmd := exec.Command("mount", "-t", "apfs", "-r", "-o", "-s="+snapshot, b.source, mountpoint)
-	args := []string{"mount_apfs", "-o", "ro,nobrowse", "-s", snapshot, source, mountpoint}
-	fmt.Println(strings.Join(args, `', '`))
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	cmd.Env = safeEnvs()
-	return errors.Wrap(cmd.Run(), "error while mounting snapshot")
+	start := time.Now()
+	args := []string{"mount_apfs", "-o", "ro,nobrowse", "-s", snapshot.Name, source, mountpoint}
+	if snapshot.XID > 0 {
+		// the XID is unique and avoids any trouble with the characters in the name
+		if info, err := b.getVolumeInfo(ctx, source); err == nil && info.DeviceNode != "" {
+			args = []string{"mount_apfs", "-o", "ro,nobrowse", "-x", strconv.FormatUint(snapshot.XID, 10), info.DeviceNode, mountpoint}
+		} else {
+			b.sourceLogf(i, "Cannot find the device of %s, mounting snapshot %s by name: %v\n", source, snapshot.Name, err)
+		}
+	}
+	b.sourceLogf(i, "%s\n", strings.Join(args, `', '`))
+	_, _, err := b.run(ctx, args[0], args[1:], RunOptions{Passthrough: true})
+	if err != nil {
+		return errors.Wrap(err, "error while mounting snapshot")
+	}
+	b.journal.mounted(mountpoint)
+	b.phaseDone(PhaseMounted, PhaseInfo{Source: source, Snapshot: snapshot.Name, Mountpoint: mountpoint}, start)
+	return nil
 }
 
-func (b BorgBackup) removeSnapshot(name string, source string) error {
-	// parts := strings.Split(name, ".")
-	// if len(parts) != 5 {
-	// 	//parts = []string{"", "", "", parts[0], ""}
-	// 	return errors.WithStack(unrecognizedSnapshotName)
-	// }
-	// cmd := exec.Command(tmUtilCmd, "deletelocalsnapshots", parts[3])
-	cmd := exec.Command("./apfs/snapUtil", "-d" /*parts[3]*/, name, source)
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	cmd.Env = safeEnvs()
-	return errors.Wrap(cmd.Run(), "error while removing snapshot "+name)
+func (b BorgBackup) removeSnapshot(ctx context.Context, name string, source string) (err error) {
+	if !b.ownsSnapshot(name, source) {
+		return errors.Errorf("refusing to remove snapshot %s of %s, it wasn't created by borg-tm", name, source)
+	}
+	defer func() {
+		if err == nil {
+			b.journal.snapshotRemoved(source, name)
+		}
+	}()
+	if parsed, err := b.parseSnapshotName(name); err == nil && parsed.Kind == SnapshotTimeMachine {
+		// created by tmutil
+		return b.removeSnapshotTmutil(ctx, parsed, source)
+	}
+	snapUtil, err := b.snapUtilCmd()
+	if err != nil {
+		return errors.Wrapf(err, "error while removing snapshot %s", name)
+	}
+	_, _, err = b.run(ctx, snapUtil, []string{"-d", name, source}, RunOptions{Passthrough: true})
+	return errors.Wrap(err, "error while removing snapshot "+name)
 }
 
+// ownsSnapshot reports whether borg-tm may remove the snapshot: its name
+// carries the snapshot prefix, or the journal has it as created by this or
+// an interrupted run, which covers the Time Machine snapshots of tmutil.
+func (b BorgBackup) ownsSnapshot(name string, source string) bool {
+	if parsed, err := b.parseSnapshotName(name); err == nil && parsed.Kind == SnapshotBorgTM {
+		return true
+	}
+	return b.journal.has(source, name)
+}
+
+// unmountFS unmounts a filesystem, replaced by the tests
+var unmountFS = syscall.Unmount
+
 func unmount(mountpoint string) error {
-	err := syscall.Unmount(mountpoint, 0)
+	err := unmountFS(mountpoint, 0)
+	if err == syscall.EBUSY {
+		if blockers := describeBlockers(context.Background(), mountpoint); blockers != "" {
+			return errors.Wrapf(err, "error while unmounting (%s)", blockers)
+		}
+	}
+	return errors.Wrap(err, "error while unmounting")
+}
+
+// default retries of a busy unmount, see WithUnmountRetries
+const (
+	defaultUnmountRetries    = 4
+	defaultUnmountRetryDelay = time.Second
+)
+
+// unmountRetrying unmounts mountpoint. While it is busy, e.g. because
+// Spotlight still has files open after borg exited, the unmount is retried
+// with exponential backoff, and finally forced with diskutil. The error
+// names the processes keeping it busy. ctx bounds all of it.
+func (b BorgBackup) unmountRetrying(ctx context.Context, i int, mountpoint string) (err error) {
+	defer func() {
+		if err == nil {
+			b.journal.unmounted(mountpoint)
+		}
+	}()
+	delay := b.unmountRetryDelay
+retry:
+	for retries := 0; ; retries++ {
+		err = unmountFS(mountpoint, 0)
+		if err != syscall.EBUSY || retries >= b.unmountRetries {
+			break
+		}
+		b.sourceLogf(i, "%s is busy, retrying to unmount it in %s (%d/%d)\n", mountpoint, delay, retries+1, b.unmountRetries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			break retry
+		}
+		delay *= 2
+	}
+	if err != syscall.EBUSY {
+		return errors.Wrap(err, "error while unmounting")
+	}
+	if ctx.Err() == nil {
+		b.sourceLogf(i, "%s is still busy, forcing the unmount with diskutil\n", mountpoint)
+		_, stderr, ferr := b.run(ctx, "diskutil", []string{"unmount", "force", mountpoint}, RunOptions{})
+		if ferr == nil {
+			return nil
+		}
+		b.logEntryf(b.sourceEntry(i, LevelWarn), "diskutil unmount force %s failed: %v: %s", mountpoint, ferr, strings.TrimSpace(string(stderr)))
+	}
+	if blockers := describeBlockers(ctx, mountpoint); blockers != "" {
+		return errors.Wrapf(err, "error while unmounting (%s)", blockers)
+	}
 	return errors.Wrap(err, "error while unmounting")
 }
 
-func (b BorgBackup) invokeBorg(ctx context.Context, archiveName string) error {
+// invokeBorg runs `borg create`, again up to -borg-retries times while
+// another borg holds the repository lock. The snapshots stay mounted in
+// between. The archive stats are only collected (and returned) when size
+// anomaly detection is enabled, otherwise nil is returned.
+func (b BorgBackup) invokeBorg(ctx context.Context, archiveName string, paths []string) (*archiveStats, time.Duration, error) {
+	for retries := 0; ; retries++ {
+		stats, duration, err := b.createArchive(ctx, archiveName, paths)
+		borgErr, ok := err.(*BorgError)
+		if !ok || !borgErr.LockTimeout || retries >= b.borgRetries {
+			return stats, duration, err
+		}
+		b.logf(LevelWarn, "The repository is locked by another borg, retrying borg create in %s (%d/%d)", b.borgRetryDelay, retries+1, b.borgRetries)
+		select {
+		case <-time.After(b.borgRetryDelay):
+		case <-ctx.Done():
+			b.logf(LevelInfo, "Interrupted, not retrying borg create")
+			return nil, 0, err
+		}
+	}
+}
+
+func (b BorgBackup) createArchive(ctx context.Context, archiveName string, paths []string) (*archiveStats, time.Duration, error) {
+	var line *progressLine
+	if b.showProgress {
+		line = b.newProgressLine(os.Stderr)
+		b.callbacks = b.callbacks.with(nil, line.update)
+	}
+	collectStats := b.sizeAnomalyFactor > 0 || b.statsSummary
 	args := []string{"create"}
+	args = append(args, b.borgCommonArgs()...)
+	if collectStats {
+		args = append(args, "--json")
+	}
+	if b.useSparse {
+		args = append(args, "--sparse")
+	}
+	if b.chunkerParams != "" {
+		args = append(args, "--chunker-params", b.chunkerParams)
+	}
+	if b.archiveComment != "" {
+		args = append(args, "--comment", b.archiveComment)
+	}
+	if b.callbacks.wantsProgress() {
+		args = append(args, "--progress")
+	}
+	if b.recordChanges {
+		args = append(args, "--list", "--filter=AME")
+	}
+	if b.callbacks.wantsProgress() || b.recordChanges {
+		args = append(args, "--log-json")
+	}
+	if b.excludeCaches {
+		args = append(args, "--exclude-caches")
+	}
+	for _, pattern := range b.excludes {
+		args = append(args, "--exclude", pattern)
+	}
 	args = append(args, b.borgArgs...)
 	args = append(args, "::"+archiveName)
-	args = append(args, b.mountpoints...)
-	fmt.Println("borg", args)
+	args = append(args, paths...)
+	b.logf(LevelInfo, "borg %v", args)
 	if b.dryRun {
-		return nil
+		return nil, 0, nil
 	}
-	cmd := exec.Command("borg", args...)
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	err := cmd.Start()
+	argv := b.wrapIOPolicy("borg", args)
+	var opts RunOptions
+	closePassphrase, err := b.setBorgEnv(&opts)
 	if err != nil {
-		return errors.Wrap(err, "error while starting borg")
+		return nil, 0, err
 	}
-	var interrupted bool
-	go func() {
-		<-ctx.Done()
-		cmd.Process.Signal(syscall.SIGINT)
-		interrupted = true
-	}()
-	err = cmd.Wait()
-	if err != nil && !interrupted {
-		return errors.Wrap(err, "error while running borg")
+	stdout := new(bytes.Buffer)
+	if collectStats {
+		opts.Stdout = stdout
+	} else {
+		opts.Stdout = os.Stderr
 	}
-	return nil
+	prompts := &promptWatcher{out: os.Stderr, log: b.log}
+	if line != nil {
+		// borg's messages and questions clear the progress line first
+		prompts.out = line
+	}
+	opts.Stderr = prompts
+	var logWriter *borgLogWriter
+	if b.callbacks.wantsProgress() || b.changes != nil {
+		logWriter = &borgLogWriter{archive: archiveName, callbacks: b.callbacks, progressMessages: line != nil, changes: b.changes, out: prompts}
+		opts.Stderr = logWriter
+	}
+	if !b.acceptRepoChanges && isTerminal(os.Stdin) {
+		// let the user answer borg's questions
+		opts.Stdin = os.Stdin
+	}
+	process, err := b.start(argv[0], argv[1:], opts)
+	closePassphrase()
+	if err != nil {
+		return nil, 0, &BorgError{ExitCode: -1, Err: errors.Wrap(err, "error while starting borg")}
+	}
+	start := time.Now()
+	b.callbacks.firePhase(PhaseBorgStarted, PhaseInfo{Archive: archiveName, Start: start})
+	// a paused borg only handles SIGINT once it runs again
+	stopSignalling := signalOnCancel(ctx, process, syscall.SIGINT, syscall.SIGCONT)
+	susp := suspendOnSignals("borg", process, b.log)
+	throttleDone := make(chan struct{})
+	if b.thermal != nil {
+		go b.thermal.throttle(susp, throttleDone)
+	}
+	err = process.Wait()
+	stopSignalling()
+	// a borg that finished before it got the signal still created the
+	// archive
+	interrupted := err != nil && ctx.Err() != nil
+	if logWriter != nil {
+		logWriter.flush()
+	}
+	if line != nil {
+		line.finish()
+	}
+	prompts.explain(b.acceptRepoChanges)
+	if b.borgExit != nil {
+		*b.borgExit = process.ExitCode()
+	}
+	close(throttleDone)
+	for reason, paused := range susp.stop() {
+		b.logEntryf(LogEntry{Level: LevelInfo, Duration: paused}, "borg was paused for %s in total (%s)", paused.Round(time.Second), reason)
+	}
+	if !interrupted && b.isBorgWarning(err) {
+		if logWriter != nil {
+			b.logf(LevelWarn, "borg finished with %d warning(s), see above", logWriter.warnings)
+		} else {
+			b.logf(LevelWarn, "borg finished with warnings, see above")
+		}
+		err = nil
+	}
+	var borgErr *BorgError
+	switch {
+	case interrupted:
+		// no archive was created, so nothing may count as a success
+		borgErr = &BorgError{ExitCode: process.ExitCode(), Err: errors.Wrap(ctx.Err(), "borg create was interrupted")}
+	case err != nil:
+		borgErr = &BorgError{ExitCode: process.ExitCode(), Err: errors.Wrap(err, "error while running borg"), LockTimeout: prompts.lockTimeout}
+	}
+	finished := PhaseInfo{Archive: archiveName}
+	if borgErr != nil {
+		finished.Err = borgErr
+	}
+	b.phaseDone(PhaseBorgFinished, finished, start)
+	if borgErr != nil {
+		return nil, 0, borgErr
+	}
+	if !collectStats {
+		return nil, 0, nil
+	}
+	stats, duration, err := parseCreateOutput(stdout.Bytes())
+	if err != nil {
+		return nil, 0, err
+	}
+	return &stats, duration, nil
+}
+
+// borgCommonArgs returns the options passed to every borg subcommand.
+func (b BorgBackup) borgCommonArgs() []string {
+	var args []string
+	if b.umask >= 0 {
+		args = append(args, "--umask", fmt.Sprintf("%04o", b.umask))
+	}
+	if b.borgLockWait > 0 {
+		// borg takes whole seconds
+		args = append(args, "--lock-wait", strconv.Itoa(int(math.Ceil(b.borgLockWait.Seconds()))))
+	}
+	return args
+}
+
+// cleanupTimeout bounds the cleanup commands, which run with their own
+// context so that they still run after the backup was cancelled
+const cleanupTimeout = time.Minute
+
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
+}
+
+// isBorgWarning reports whether err is borg's exit status 1, which it uses
+// for warnings like files that changed while they were read. Unless
+// -fail-on-warnings is given, those runs count as successful.
+func (b BorgBackup) isBorgWarning(err error) bool {
+	code, ok := exitCode(err)
+	return ok && code == 1 && !b.failOnWarnings
 }
 
-// remove borg related environment variables
+// runBorgInterruptible runs a borg subcommand with its output on stderr. When
+// ctx is cancelled, borg gets SIGINT so that it can stop cleanly, as it does
+// during borg create.
+func (b BorgBackup) runBorgInterruptible(ctx context.Context, args []string) error {
+	return b.runBorgIn(ctx, "", args)
+}
+
+// runBorgIn is runBorgInterruptible in the working directory dir, the
+// current one if it is empty.
+func (b BorgBackup) runBorgIn(ctx context.Context, dir string, args []string) error {
+	opts := RunOptions{Dir: dir, Stdout: os.Stderr, Stderr: os.Stderr}
+	closePassphrase, err := b.setBorgEnv(&opts)
+	if err != nil {
+		return err
+	}
+	process, err := b.start("borg", args, opts)
+	closePassphrase()
+	if err != nil {
+		return errors.Wrapf(err, "error while starting borg %s", args[0])
+	}
+	// a paused borg only handles SIGINT once it runs again
+	stop := signalOnCancel(ctx, process, syscall.SIGINT, syscall.SIGCONT)
+	err = process.Wait()
+	stop()
+	if ctx.Err() != nil {
+		return errors.Wrapf(ctx.Err(), "borg %s was interrupted", args[0])
+	}
+	if b.isBorgWarning(err) {
+		b.logf(LevelWarn, "borg %s finished with warnings, see above", args[0])
+		return nil
+	}
+	return err
+}
+
+// borgOutput runs a borg subcommand and returns its stdout.
+func (b BorgBackup) borgOutput(ctx context.Context, args ...string) ([]byte, error) {
+	opts := RunOptions{Stderr: os.Stderr}
+	closePassphrase, err := b.setBorgEnv(&opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closePassphrase()
+	out, _, err := b.run(ctx, "borg", args, opts)
+	return out, err
+}
+
+// safeEnvs returns the environment for commands other than borg: ours
+// without any BORG_ variable and without SSH_AUTH_SOCK, so that helpers and
+// hooks never see the passphrase or get at the keys of the repository.
 func safeEnvs() []string {
-	envs := os.Environ()
-	envs = append(envs, "BORG_PASSPHRASE=", "BORG_REPO=")
+	var envs []string
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if strings.HasPrefix(name, "BORG_") || name == "SSH_AUTH_SOCK" {
+			continue
+		}
+		envs = append(envs, env)
+	}
 	return envs
 }
@@ -0,0 +1,678 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const fakeVolumeInfo = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>DeviceIdentifier</key>
+	<string>disk3s5</string>
+	<key>DeviceNode</key>
+	<string>/dev/disk3s5</string>
+	<key>FilesystemType</key>
+	<string>apfs</string>
+</dict>
+</plist>
+`
+
+const fakeRepoInfo = `{"repository": {"id": "0123456789abcdef", "location": "/backups/repo"}, "encryption": {"mode": "repokey"}}`
+
+// backupResponses answers the commands of a backup as a Mac with borg 1.2
+// would. Anything else fails.
+func backupResponses(call *fakeCall) fakeResult {
+	switch {
+	case call.has("diskutil", "info"):
+		return fakeResult{stdout: fakeVolumeInfo}
+	case call.has("borg", "--version"):
+		return fakeResult{stdout: "borg 1.2.8\n"}
+	case call.has("borg", "info"):
+		return fakeResult{stdout: fakeRepoInfo}
+	case call.has("snapUtil", "-c"), call.has("snapUtil", "-d"), call.has("mount_apfs"), call.has("borg", "create"):
+		return fakeResult{}
+	}
+	return fakeResult{stderr: "not faked: " + call.String(), exit: 1}
+}
+
+// fakeBackupEnv is the temporary directory a faked backup runs in.
+type fakeBackupEnv struct {
+	dir         string
+	source      string // the first of sources
+	mountpoint  string // the first of mountpoints
+	sources     []string
+	mountpoints []string
+	runner      *fakeRunner
+}
+
+// newFakeBackup sets up a backup of one source whose commands are answered
+// by override, if it returns true, or else by backupResponses. Unmounts are
+// recorded as "unmount <mountpoint>" events.
+func newFakeBackup(t *testing.T, override func(call *fakeCall) (fakeResult, bool), opts ...Option) (BorgBackup, *fakeBackupEnv) {
+	t.Helper()
+	return newFakeBackupOf(t, 1, override, opts...)
+}
+
+// newFakeBackupOf is newFakeBackup of n sources, each a volume of its own.
+func newFakeBackupOf(t *testing.T, n int, override func(call *fakeCall) (fakeResult, bool), opts ...Option) (BorgBackup, *fakeBackupEnv) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &fakeBackupEnv{dir: dir}
+	for i := 1; i <= n; i++ {
+		env.sources = append(env.sources, filepath.Join(dir, fmt.Sprintf("source%d", i)))
+		env.mountpoints = append(env.mountpoints, filepath.Join(dir, fmt.Sprintf("mnt%d", i)))
+	}
+	env.source, env.mountpoint = env.sources[0], env.mountpoints[0]
+	env.runner = &fakeRunner{respond: func(call *fakeCall) fakeResult {
+		if override != nil {
+			if res, ok := override(call); ok {
+				return res
+			}
+		}
+		return backupResponses(call)
+	}}
+	// the preflight looks for borg in PATH
+	bin := filepath.Join(dir, "bin")
+	for _, path := range append([]string{bin}, env.sources...) {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, "borg"), []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	snapUtil := filepath.Join(dir, "snapUtil")
+	if err := ioutil.WriteFile(snapUtil, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldPath, oldLockDir, oldGetuid, oldUnmount, oldLookupVolume := os.Getenv("PATH"), lockDir, getuid, unmountFS, lookupVolume
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+oldPath)
+	lockDir = dir
+	getuid = func() int { return 0 }
+	lookupVolume = func(path string) (string, string, error) { return path, ".", nil }
+	unmountFS = func(target string, flags int) error {
+		env.runner.event("unmount %s", target)
+		return nil
+	}
+	t.Cleanup(func() {
+		os.Setenv("PATH", oldPath)
+		lockDir, getuid, unmountFS, lookupVolume = oldLockDir, oldGetuid, oldUnmount, oldLookupVolume
+		os.RemoveAll(dir)
+	})
+	all := append([]Option{
+		WithSources(env.sources...),
+		WithMountpoints(env.mountpoints...),
+		WithRepo("/backups/repo"),
+		WithAllowUnencrypted(true),
+		WithSnapUtilPath(snapUtil),
+		WithSync(false),
+		WithLockFile(filepath.Join(dir, "backup.lock")),
+		WithJournalFile(filepath.Join(dir, "journal.json")),
+		WithStateFile(filepath.Join(dir, "state.json")),
+		WithHistoryFile(filepath.Join(dir, "history.json")),
+		WithLogger(NewTextLogger(ioutil.Discard, LevelError)),
+		WithRunner(env.runner),
+	}, opts...)
+	b, err := NewBackup(all...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, env
+}
+
+// flow is the part of the log that shows the order of a backup.
+func (env *fakeBackupEnv) flow() []string {
+	var flow []string
+	for _, e := range env.runner.log("snapUtil -c", "snapUtil -d", "mount_apfs", "borg create", "unmount", "signal") {
+		flow = append(flow, strings.Fields(e)[0]+" "+strings.Fields(e)[1])
+	}
+	return flow
+}
+
+func TestRunOrder(t *testing.T) {
+	b, env := newFakeBackup(t, nil)
+	report, err := b.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	want := []string{"snapUtil -c", "mount_apfs -o", "borg create", "unmount " + b.mountpoints[0], "snapUtil -d"}
+	if got := env.flow(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands were\n  %v\nwant\n  %v", got, want)
+	}
+	if report.Archive == "" {
+		t.Error("the report has no archive")
+	}
+	create := env.runner.find("snapUtil", "-c")
+	remove := env.runner.find("snapUtil", "-d")
+	if create.args[1] != remove.args[1] {
+		t.Errorf("created snapshot %s but removed %s", create.args[1], remove.args[1])
+	}
+	st, err := loadState(b.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.LastArchive != report.Archive {
+		t.Errorf("the state has last archive %q, want %q", st.LastArchive, report.Archive)
+	}
+}
+
+func TestRunLogsThroughTheLogger(t *testing.T) {
+	log := new(bytes.Buffer)
+	b, _ := newFakeBackup(t, nil, WithLogger(NewTextLogger(log, LevelInfo)))
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	_, err = b.Run(context.Background())
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	out, _ := ioutil.ReadAll(r)
+	if len(out) > 0 {
+		t.Errorf("Run printed\n%s\nwhich belongs in the log", out)
+	}
+	for _, want := range []string{"Using hostname", "Recording repository ID", "Creating snapshots with"} {
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("the log has no %q:\n%s", want, log)
+		}
+	}
+}
+
+func TestRunCleansUpAfterBorgFails(t *testing.T) {
+	b, env := newFakeBackup(t, func(call *fakeCall) (fakeResult, bool) {
+		return fakeResult{stderr: "Repository is locked", exit: 2}, call.has("borg", "create")
+	})
+	_, err := b.Run(context.Background())
+	var borgErr *BorgError
+	if !errors.As(err, &borgErr) || borgErr.ExitCode != 2 {
+		t.Fatalf("Run returned %v, want a BorgError with exit code 2", err)
+	}
+	if code := ExitCode(err); code != ExitBorg {
+		t.Errorf("exit code %d, want %d", code, ExitBorg)
+	}
+	want := []string{"snapUtil -c", "mount_apfs -o", "borg create", "unmount " + b.mountpoints[0], "snapUtil -d"}
+	if got := env.flow(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands were\n  %v\nwant\n  %v", got, want)
+	}
+	st, err := loadState(b.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.LastArchive != "" || !st.LastSuccess.IsZero() {
+		t.Errorf("a failed backup recorded archive %q at %s", st.LastArchive, st.LastSuccess)
+	}
+}
+
+func TestRunCleansUpAfterMountFails(t *testing.T) {
+	b, env := newFakeBackup(t, func(call *fakeCall) (fakeResult, bool) {
+		return fakeResult{stderr: "mount_apfs: volume could not be mounted", exit: 75}, call.has("mount_apfs")
+	})
+	_, err := b.Run(context.Background())
+	var mountErr *MountError
+	if !errors.As(err, &mountErr) {
+		t.Fatalf("Run returned %v, want a MountError", err)
+	}
+	// nothing was mounted, but the snapshot is still removed
+	want := []string{"snapUtil -c", "mount_apfs -o", "snapUtil -d"}
+	if got := env.flow(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands were\n  %v\nwant\n  %v", got, want)
+	}
+	j, err := loadJournal(b.journalFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.empty() {
+		t.Errorf("the journal still has %s", j.describe())
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	b, env := newFakeBackup(t, nil, WithDryRun(true))
+	if _, err := b.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	// the snapshots are still created and mounted, but borg doesn't run
+	want := []string{"snapUtil -c", "mount_apfs -o", "unmount " + b.mountpoints[0], "snapUtil -d"}
+	if got := env.flow(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands were\n  %v\nwant\n  %v", got, want)
+	}
+	st, err := loadState(b.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.LastArchive != "" || !st.LastSuccess.IsZero() {
+		t.Errorf("a dry run recorded archive %q at %s", st.LastArchive, st.LastSuccess)
+	}
+}
+
+func TestRunCancelledDuringBorgCreate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b, env := newFakeBackup(t, func(call *fakeCall) (fakeResult, bool) {
+		// borg runs until it gets SIGINT
+		return fakeResult{release: make(chan struct{}), during: cancel}, call.has("borg", "create")
+	})
+	report, err := b.Run(ctx)
+	var borgErr *BorgError
+	if !errors.As(err, &borgErr) {
+		t.Fatalf("Run returned %v, want a BorgError", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("the BorgError wraps %v, want %v", borgErr.Err, context.Canceled)
+	}
+	if report.Archive != "" {
+		t.Errorf("the report has archive %q", report.Archive)
+	}
+	want := []string{"snapUtil -c", "mount_apfs -o", "borg create", "signal borg", "signal borg", "unmount " + b.mountpoints[0], "snapUtil -d"}
+	if got := env.flow(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands were\n  %v\nwant\n  %v", got, want)
+	}
+	if got := env.runner.log("signal borg"); len(got) == 0 || got[0] != "signal borg interrupt" {
+		t.Errorf("borg got the signals %v, want SIGINT first", got)
+	}
+	st, err := loadState(b.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.LastArchive != "" || !st.LastSuccess.IsZero() {
+		t.Errorf("a cancelled backup recorded archive %q at %s", st.LastArchive, st.LastSuccess)
+	}
+}
+
+func TestRunCancelledBeforeBorgCreate(t *testing.T) {
+	tests := []struct {
+		name  string
+		point func(env *fakeBackupEnv, call *fakeCall) bool
+		// the mountpoints that were mounted, by source index
+		mounted []int
+		// the sources whose snapshot was created, nil for all
+		created []int
+	}{
+		{"creating the second snapshot", func(env *fakeBackupEnv, call *fakeCall) bool {
+			return call.has("snapUtil", "-c") && call.args[len(call.args)-1] == env.sources[1]
+		}, nil, []int{0}},
+		{"mounting the first source", func(env *fakeBackupEnv, call *fakeCall) bool {
+			return call.has("mount_apfs", env.sources[0])
+		}, nil, nil},
+		{"mounting the second source", func(env *fakeBackupEnv, call *fakeCall) bool {
+			return call.has("mount_apfs", env.sources[1])
+		}, []int{0}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var env *fakeBackupEnv
+			b, env := newFakeBackupOf(t, 2, func(call *fakeCall) (fakeResult, bool) {
+				if tt.point(env, call) {
+					// the command hangs until it's killed
+					return fakeResult{release: make(chan struct{}), during: func() {
+						time.AfterFunc(50*time.Millisecond, cancel)
+					}}, true
+				}
+				return fakeResult{}, false
+			})
+			done := make(chan error, 1)
+			go func() {
+				_, err := b.Run(ctx)
+				done <- err
+			}()
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(time.Second):
+				t.Fatal("Run didn't return within 1s of the cancel")
+			}
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("Run returned %v, want %v", err, context.Canceled)
+			}
+			if hasCall(env.runner, "borg", "create") {
+				t.Error("borg create ran after the cancel")
+			}
+			unmounted := env.runner.log("unmount")
+			if len(unmounted) != len(tt.mounted) {
+				t.Errorf("unmounted %v, want the mountpoints of the sources %v", unmounted, tt.mounted)
+			}
+			for _, i := range tt.mounted {
+				if !containsString(unmounted, "unmount "+b.mountpoints[i]) {
+					t.Errorf("%s wasn't unmounted", b.mountpoints[i])
+				}
+			}
+			for i, source := range env.sources {
+				created := tt.created == nil
+				for _, c := range tt.created {
+					created = created || c == i
+				}
+				remove := env.runner.find("snapUtil", "-d", source)
+				if removed := remove != nil; removed != created {
+					t.Errorf("the snapshot of %s: removed %v, want %v", source, removed, created)
+				}
+				// with the cleanup context, not the cancelled one
+				if remove != nil && remove.cancelled {
+					t.Errorf("the snapshot of %s was removed with a cancelled context", source)
+				}
+			}
+			j, err := loadJournal(b.journalFile, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !j.empty() {
+				t.Errorf("the journal still has %s", j.describe())
+			}
+		})
+	}
+}
+
+// createPaths returns the paths borg create got, after the archive.
+func createPaths(t *testing.T, r *fakeRunner) []string {
+	t.Helper()
+	create := r.find("borg", "create")
+	if create == nil {
+		t.Fatal("borg create didn't run")
+	}
+	for i, arg := range create.args {
+		if strings.HasPrefix(arg, "::") {
+			return create.args[i+1:]
+		}
+	}
+	t.Fatalf("borg create got no archive: %v", create.args)
+	return nil
+}
+
+func TestRunNamesTheArchiveAfterABackedUpSource(t *testing.T) {
+	var env *fakeBackupEnv
+	b, env := newFakeBackupOf(t, 2, func(call *fakeCall) (fakeResult, bool) {
+		return fakeResult{stderr: "mount_apfs: volume could not be mounted", exit: 75}, call.has("mount_apfs", env.sources[0])
+	}, WithContinueOnError(true), WithBackupName("{source}-{snapshot}"))
+	if _, err := b.Run(context.Background()); err == nil {
+		t.Fatal("Run returned no error, want the failure of the first source")
+	}
+	create := env.runner.find("snapUtil", "-c", env.sources[1])
+	if create == nil {
+		t.Fatalf("the snapshot of %s wasn't created", env.sources[1])
+	}
+	snapshot, err := b.parseSnapshotName(create.args[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first source isn't in the archive
+	want := "::" + filepath.Base(env.sources[1]) + "-" + snapshot.archivePart()
+	if archive := createPaths(t, env.runner); !hasCall(env.runner, "borg", "create", want) || len(archive) != 1 {
+		t.Errorf("borg create got %v, want archive %s with only %s", env.runner.find("borg", "create").args, want, env.sources[1])
+	}
+}
+
+func TestRunPairsSourcesWithMountpoints(t *testing.T) {
+	b, env := newFakeBackupOf(t, 3, nil, WithStoreOriginalPaths(false))
+	if _, err := b.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for i, source := range env.sources {
+		mount := env.runner.find("mount_apfs", source)
+		if mount == nil {
+			t.Fatalf("%s wasn't mounted", source)
+		}
+		if got := mount.args[len(mount.args)-1]; got != env.mountpoints[i] {
+			t.Errorf("%s was mounted on %s, want %s", source, got, env.mountpoints[i])
+		}
+	}
+	if got := createPaths(t, env.runner); !reflect.DeepEqual(got, env.mountpoints) {
+		t.Errorf("borg create got %v, want %v", got, env.mountpoints)
+	}
+}
+
+// secretEnvs are variables of ours no command but borg may see.
+var secretEnvs = map[string]string{
+	"BORG_PASSPHRASE":     "secret",
+	"BORG_PASSCOMMAND":    "cat /etc/secret",
+	"BORG_NEW_PASSPHRASE": "new secret",
+	"BORG_RSH":            "ssh -i /etc/borg-key",
+	"BORG_REPO":           "ssh://backup@nas/repo",
+	"SSH_AUTH_SOCK":       "/tmp/agent.sock",
+}
+
+// setenvs sets the variables envs until the test ends.
+func setenvs(t *testing.T, envs map[string]string) {
+	t.Helper()
+	for name, value := range envs {
+		old, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		name := name
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func TestSafeEnvs(t *testing.T) {
+	setenvs(t, secretEnvs)
+	setenvs(t, map[string]string{"LANG": "en_US.UTF-8", "BORGTM_UNRELATED": "kept"})
+	envs := safeEnvs()
+	for _, env := range envs {
+		name := strings.SplitN(env, "=", 2)[0]
+		if strings.HasPrefix(name, "BORG_") || name == "SSH_AUTH_SOCK" {
+			t.Errorf("got %s", env)
+		}
+	}
+	for _, want := range []string{"LANG=en_US.UTF-8", "BORGTM_UNRELATED=kept", "PATH=" + os.Getenv("PATH")} {
+		if !containsString(envs, want) {
+			t.Errorf("%s is missing from %v", want, envs)
+		}
+	}
+}
+
+func TestRunKeepsSecretsFromOtherCommands(t *testing.T) {
+	setenvs(t, secretEnvs)
+	b, env := newFakeBackup(t, nil)
+	if _, err := b.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	names := map[string]bool{}
+	for _, call := range env.runner.calls {
+		names[call.name] = true
+		// borg --version doesn't open the repository
+		if call.name == "borg" && !call.has("borg", "--version") {
+			if !containsString(call.opts.Env, "BORG_REPO=/backups/repo") || !containsString(call.opts.Env, "BORG_RSH="+secretEnvs["BORG_RSH"]) {
+				t.Errorf("%s got %v, want the repository and BORG_RSH", call, call.opts.Env)
+			}
+			continue
+		}
+		// nil is safeEnvs(), see RunOptions
+		if call.opts.Env != nil {
+			t.Errorf("%s got the environment %v, want safeEnvs()", call, call.opts.Env)
+		}
+		if len(call.opts.ExtraFiles) > 0 {
+			t.Errorf("%s got %d extra files", call, len(call.opts.ExtraFiles))
+		}
+	}
+	for _, name := range []string{"snapUtil", "mount_apfs", "diskutil", "tmutil", "borg"} {
+		if !names[name] {
+			t.Errorf("%s didn't run", name)
+		}
+	}
+}
+
+func TestRunCleansUpAfterAPanic(t *testing.T) {
+	tests := []struct {
+		name  string
+		point func(env *fakeBackupEnv, call *fakeCall) bool
+		// the mountpoints that were mounted, by source index
+		mounted []int
+		// the sources whose snapshot was created, nil for all
+		created []int
+	}{
+		{"creating the second snapshot", func(env *fakeBackupEnv, call *fakeCall) bool {
+			return call.has("snapUtil", "-c") && call.args[len(call.args)-1] == env.sources[1]
+		}, nil, []int{0}},
+		{"mounting the first source", func(env *fakeBackupEnv, call *fakeCall) bool {
+			return call.has("mount_apfs", env.sources[0])
+		}, nil, nil},
+		{"mounting the second source", func(env *fakeBackupEnv, call *fakeCall) bool {
+			return call.has("mount_apfs", env.sources[1])
+		}, []int{0}, nil},
+		{"borg create", func(env *fakeBackupEnv, call *fakeCall) bool {
+			return call.has("borg", "create")
+		}, []int{0, 1}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var env *fakeBackupEnv
+			b, env := newFakeBackupOf(t, 2, func(call *fakeCall) (fakeResult, bool) {
+				if tt.point(env, call) {
+					return fakeResult{during: func() { panic("injected") }}, true
+				}
+				return fakeResult{}, false
+			})
+			_, err := b.Run(context.Background())
+			if err == nil || !strings.Contains(err.Error(), "panic") || !strings.Contains(err.Error(), ": injected") {
+				t.Fatalf("Run returned %v, want the panic", err)
+			}
+			unmounted := env.runner.log("unmount")
+			if len(unmounted) != len(tt.mounted) {
+				t.Errorf("unmounted %v, want the mountpoints of the sources %v", unmounted, tt.mounted)
+			}
+			for _, i := range tt.mounted {
+				if !containsString(unmounted, "unmount "+b.mountpoints[i]) {
+					t.Errorf("%s wasn't unmounted", b.mountpoints[i])
+				}
+			}
+			for i, source := range env.sources {
+				created := tt.created == nil
+				for _, c := range tt.created {
+					created = created || c == i
+				}
+				if removed := hasCall(env.runner, "snapUtil", "-d", source); removed != created {
+					t.Errorf("the snapshot of %s: removed %v, want %v", source, removed, created)
+				}
+			}
+			j, err := loadJournal(b.journalFile, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !j.empty() {
+				t.Errorf("the journal still has %s", j.describe())
+			}
+		})
+	}
+}
+
+func TestRunGoesOnAfterAnUnmountFails(t *testing.T) {
+	b, env := newFakeBackupOf(t, 2, nil)
+	unmountFS = func(target string, flags int) error {
+		env.runner.event("unmount %s", target)
+		if target == b.mountpoints[1] {
+			return syscall.EINVAL
+		}
+		return nil
+	}
+	_, err := b.Run(context.Background())
+	var cleanupErr *CleanupError
+	if !errors.As(err, &cleanupErr) {
+		t.Fatalf("Run returned %v, want a *CleanupError", err)
+	}
+	// the second source was mounted last, so it's unmounted first
+	want := []string{"unmount " + b.mountpoints[1], "unmount " + b.mountpoints[0]}
+	if got := env.runner.log("unmount"); !reflect.DeepEqual(got, want) {
+		t.Errorf("unmounted %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(cleanupErr.Mountpoints, []string{b.mountpoints[1]}) {
+		t.Errorf("still mounted %v, want %s", cleanupErr.Mountpoints, b.mountpoints[1])
+	}
+	// a mounted snapshot can't be removed
+	if len(cleanupErr.Leftovers) != 1 || !strings.Contains(cleanupErr.Leftovers[0], env.sources[1]) {
+		t.Errorf("leftovers %v, want the snapshot of %s", cleanupErr.Leftovers, env.sources[1])
+	}
+	if !hasCall(env.runner, "snapUtil", "-d", env.sources[0]) || hasCall(env.runner, "snapUtil", "-d", env.sources[1]) {
+		t.Errorf("removed the snapshots %v, want only the one of %s", env.runner.log("snapUtil -d"), env.sources[0])
+	}
+	for _, want := range []string{b.mountpoints[1], env.sources[1]} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("the error %q doesn't name %s", err, want)
+		}
+	}
+	if code := ExitCode(err); code != ExitCleanup {
+		t.Errorf("exit code %d, want %d", code, ExitCleanup)
+	}
+	// for the next run to clean up
+	j, err := loadJournal(b.journalFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := env.runner.find("snapUtil", "-c").args[1]
+	if !j.has(env.sources[1], snapshot) || !strings.Contains(j.describe(), "1 snapshot(s) and 1 mount(s)") {
+		t.Errorf("the journal has %s, want the mount and snapshot of %s", j.describe(), env.sources[1])
+	}
+}
+
+func TestRunPanicBecomesAnError(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"one archive", nil},
+		{"separate archives", []Option{WithSeparateArchives(true)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var env *fakeBackupEnv
+			b, env := newFakeBackupOf(t, 2, func(call *fakeCall) (fakeResult, bool) {
+				if call.has("borg", "create") && strings.HasSuffix(call.args[len(call.args)-1], "source2") {
+					return fakeResult{during: func() {
+						var parts []string
+						_ = parts[3]
+					}}, true
+				}
+				return fakeResult{}, false
+			}, tt.opts...)
+			report, err := b.Run(context.Background())
+			if err == nil || !strings.Contains(err.Error(), "panic during backup: runtime error: index out of range") {
+				t.Fatalf("Run returned %v, want the panic", err)
+			}
+			// with the stack of the panic
+			if !strings.Contains(err.Error(), "goroutine ") || !strings.Contains(err.Error(), "borg_test.go") {
+				t.Errorf("the error has no stack:\n%v", err)
+			}
+			if report.Archive != "" {
+				t.Errorf("the report has archive %q", report.Archive)
+			}
+			for i, source := range env.sources {
+				if !containsString(env.runner.log("unmount"), "unmount "+b.mountpoints[i]) {
+					t.Errorf("%s wasn't unmounted", b.mountpoints[i])
+				}
+				if !hasCall(env.runner, "snapUtil", "-d", source) {
+					t.Errorf("the snapshot of %s wasn't removed", source)
+				}
+			}
+			st, err := loadState(b.stateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.LastArchive != "" || !st.LastSuccess.IsZero() {
+				t.Errorf("a panicked backup recorded archive %q at %s", st.LastArchive, st.LastSuccess)
+			}
+		})
+	}
+}
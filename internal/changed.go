@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// bounds for the scan of files changed during the backup
+const (
+	changedScanLimit  = 200000
+	changedSampleSize = 10
+)
+
+type changedFiles struct {
+	count     int
+	sample    []string
+	truncated bool
+}
+
+// findChangedSince walks root on a single filesystem and counts the files
+// modified after since. skip holds directories not to descend into (the
+// mountpoints, which contain the frozen snapshot).
+func findChangedSince(root string, since time.Time, skip map[string]bool) changedFiles {
+	var result changedFiles
+	var rootDev uint64
+	if info, err := os.Lstat(root); err == nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			rootDev = uint64(st.Dev)
+		}
+	}
+	scanned := 0
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// unreadable entries are just skipped, this is informational only
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		scanned++
+		if scanned > changedScanLimit {
+			result.truncated = true
+			return errStopWalk
+		}
+		if info.IsDir() {
+			if path != root && skip[path] {
+				return filepath.SkipDir
+			}
+			if st, ok := info.Sys().(*syscall.Stat_t); ok && uint64(st.Dev) != rootDev {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.ModTime().After(since) {
+			result.count++
+			if len(result.sample) < changedSampleSize {
+				result.sample = append(result.sample, path)
+			}
+		}
+		return nil
+	})
+	return result
+}
+
+var errStopWalk = errors.New("stop walking")
+
+// reportChangedSinceSnapshot prints how many files on the live sources were
+// modified after their snapshot was taken, i.e. changes the archive misses.
+func (b BorgBackup) reportChangedSinceSnapshot(snapshots []string) {
+	skip := make(map[string]bool, len(b.mountpoints))
+	for _, m := range b.mountpoints {
+		skip[m] = true
+	}
+	for i, source := range b.sources {
+		if i >= len(snapshots) || snapshots[i] == "" {
+			continue
+		}
+		name, err := b.parseSnapshotName(snapshots[i])
+		if err != nil || name.Timestamp.IsZero() {
+			b.sourceLogf(i, "Cannot tell when snapshot %s was taken, skipping the changed files report for %s", snapshots[i], source)
+			continue
+		}
+		result := findChangedSince(source, name.Timestamp, skip)
+		more := ""
+		if result.truncated {
+			more = fmt.Sprintf(" (stopped after scanning %d entries)", changedScanLimit)
+		}
+		b.sourceLogf(i, "%d files on %s changed since snapshot %s was taken%s", result.count, source, name.Raw, more)
+		if len(result.sample) > 0 {
+			b.sourceLogf(i, "  e.g. %s", strings.Join(result.sample, "\n  e.g. "))
+		}
+	}
+}
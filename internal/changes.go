@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// changeCounts summarizes borg's file status listing (--list --filter=AME).
+type changeCounts struct {
+	Added    int64 `json:"added"`
+	Modified int64 `json:"modified"`
+	Errors   int64 `json:"errors"`
+}
+
+// changeRecorder writes the files borg added, modified or failed to read to
+// a gzip compressed listing in the run's artifacts directory.
+type changeRecorder struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	gz     *gzip.Writer
+	counts changeCounts
+}
+
+// newChangeRecorder creates the listing in a new directory for this run below
+// artifactsDir.
+func newChangeRecorder(artifactsDir string) (*changeRecorder, error) {
+	dir := filepath.Join(artifactsDir, time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "error while creating artifacts directory %s", dir)
+	}
+	path := filepath.Join(dir, "changes.txt.gz")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while creating %s", path)
+	}
+	return &changeRecorder{path: path, f: f, gz: gzip.NewWriter(f)}, nil
+}
+
+// record adds one file_status record of borg.
+func (r *changeRecorder) record(status string, path string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch status {
+	case "A":
+		r.counts.Added++
+	case "M":
+		r.counts.Modified++
+	case "E":
+		r.counts.Errors++
+	default:
+		return
+	}
+	fmt.Fprintf(r.gz, "%s %s\n", status, path)
+}
+
+// close finishes the listing and returns the counts.
+func (r *changeRecorder) close() (changeCounts, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.gz.Close()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return r.counts, errors.Wrapf(err, "error while writing %s", r.path)
+	}
+	return r.counts, nil
+}
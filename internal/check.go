@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// what -check-mode checks
+const (
+	CheckModeRepository = "repository" // borg check --repository-only
+	CheckModeArchives   = "archives"   // borg check --archives-only --last 1
+)
+
+// CheckOptions schedule `borg check` after successful backups.
+type CheckOptions struct {
+	// Interval is the time between checks, a run only checks if the last
+	// check is older
+	Interval time.Duration
+	Mode     string
+}
+
+// CheckError is returned by Run when the backup succeeded, but borg check
+// failed or found problems in the repository.
+type CheckError struct {
+	Err error
+}
+
+func (c *CheckError) Error() string {
+	return fmt.Sprintf("backup succeeded, but the repository check failed: %v", c.Err)
+}
+
+func (c *CheckError) Cause() error {
+	return c.Err
+}
+
+func (c *CheckError) Unwrap() error {
+	return c.Err
+}
+
+// checkArgs returns the arguments of borg check for mode.
+func (b BorgBackup) checkArgs(mode string) []string {
+	args := append([]string{"check"}, b.borgCommonArgs()...)
+	if mode == CheckModeArchives {
+		return append(args, "--archives-only", "--last", "1")
+	}
+	return append(args, "--repository-only")
+}
+
+// checkRepositoryIfDue runs borg check when the last check recorded in the
+// state file is older than the interval, and records the new one if it
+// passed. Its errors are returned as *CheckError.
+func (b BorgBackup) checkRepositoryIfDue(ctx context.Context) error {
+	st, err := loadState(b.stateFile)
+	if err != nil {
+		return &CheckError{Err: err}
+	}
+	if !st.LastCheck.IsZero() {
+		if next := st.LastCheck.Add(b.check.Interval); time.Now().Before(next) {
+			b.logf(LevelInfo, "The repository was checked at %s, the next check is due at %s", st.LastCheck.Format(time.RFC3339), next.Format(time.RFC3339))
+			return nil
+		}
+	}
+	args := b.checkArgs(b.check.Mode)
+	b.logf(LevelInfo, "borg %v", args)
+	if b.dryRun {
+		return nil
+	}
+	start := time.Now()
+	// borg check reports the problems it found with the warning status
+	cb := b
+	cb.failOnWarnings = true
+	if err := cb.runBorgInterruptible(ctx, args); err != nil {
+		if ctx.Err() != nil {
+			// not a finding, the next run checks again
+			return err
+		}
+		return &CheckError{Err: errors.Wrap(err, "error while checking the repository")}
+	}
+	b.logEntryf(LogEntry{Level: LevelInfo, Duration: time.Since(start)}, "The repository check passed")
+	st.LastCheck = start
+	if err := st.save(b.stateFile); err != nil {
+		return &CheckError{Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// limits enforced by borg's ChunkerParams parser
+const (
+	chunkerMinExp       = 6
+	chunkerMaxExp       = 23
+	chunkerMinBlockSize = 64
+	chunkerMaxDataSize  = 20971479
+)
+
+// ParseChunkerParams validates a -chunker-params value and returns it in the
+// form passed to `borg create --chunker-params`. Accepted are `default`,
+// `fixed:SIZE` (SIZE may use a K or M suffix), `fixed,BLOCK[,HEADER]` and
+// `[buzhash,]MIN_EXP,MAX_EXP,MASK_BITS,WINDOW_SIZE`.
+func ParseChunkerParams(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "default" {
+		return value, nil
+	}
+	if strings.HasPrefix(value, "fixed:") {
+		size, err := parseSize(strings.TrimPrefix(value, "fixed:"))
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid chunker params %q", value)
+		}
+		value = "fixed," + strconv.FormatInt(size, 10)
+	}
+	parts := strings.Split(value, ",")
+	numbers := make([]int64, 0, len(parts))
+	algo := ""
+	for i, p := range parts {
+		if i == 0 && (p == "fixed" || p == "buzhash") {
+			algo = p
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(p), 10, 64)
+		if err != nil {
+			return "", errors.Errorf("invalid chunker params %q: %q is not a number", value, p)
+		}
+		numbers = append(numbers, n)
+	}
+
+	switch {
+	case algo == "fixed" && (len(numbers) == 1 || len(numbers) == 2):
+		if numbers[0] < chunkerMinBlockSize {
+			return "", errors.Errorf("invalid chunker params %q: block size must be at least %d bytes", value, chunkerMinBlockSize)
+		}
+		for _, n := range numbers {
+			if n > chunkerMaxDataSize || n < 0 {
+				return "", errors.Errorf("invalid chunker params %q: sizes must be between 0 and %d bytes", value, chunkerMaxDataSize)
+			}
+		}
+	case algo != "fixed" && len(numbers) == 4:
+		minExp, maxExp, mask, window := numbers[0], numbers[1], numbers[2], numbers[3]
+		if minExp < chunkerMinExp {
+			return "", errors.Errorf("invalid chunker params %q: min chunk size exponent must be at least %d", value, chunkerMinExp)
+		}
+		if maxExp > chunkerMaxExp {
+			return "", errors.Errorf("invalid chunker params %q: max chunk size exponent must be at most %d", value, chunkerMaxExp)
+		}
+		if !(minExp <= mask && mask <= maxExp) {
+			return "", errors.Errorf("invalid chunker params %q: required min <= mask bits <= max", value)
+		}
+		if window <= 0 {
+			return "", errors.Errorf("invalid chunker params %q: window size must be positive", value)
+		}
+	default:
+		return "", errors.Errorf("invalid chunker params %q: expected default, fixed:SIZE, fixed,BLOCK[,HEADER] or MIN_EXP,MAX_EXP,MASK_BITS,WINDOW_SIZE", value)
+	}
+	return value, nil
+}
+
+// parseSize parses a byte count with an optional K, M or G suffix (powers of 1024).
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// checkChunkerParams warns when the chunker params differ from the ones the
+// previous run recorded, since that breaks deduplication against all
+// existing archives.
+func (b BorgBackup) checkChunkerParams(st runState) {
+	current := b.effectiveChunkerParams()
+	if st.ChunkerParams != "" && st.ChunkerParams != current {
+		b.logf(LevelWarn, "chunker params changed from %q (previous run) to %q", st.ChunkerParams, current)
+		b.logf(LevelWarn, "new chunks will not deduplicate against chunks of existing archives, expect a much larger repository!")
+	}
+}
+
+func (b BorgBackup) effectiveChunkerParams() string {
+	if b.chunkerParams == "" {
+		return "default"
+	}
+	return b.chunkerParams
+}
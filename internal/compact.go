@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// compactRepository runs `borg compact`, which borg 1.2 and later need to
+// free the space of deleted archives. Older versions free it themselves, so
+// it is skipped for them.
+func (b BorgBackup) compactRepository(ctx context.Context) error {
+	version, err := b.getBorgVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if !version.atLeast(1, 2, 0) {
+		b.logf(LevelInfo, "Skipping borg compact, borg %s frees space without it", version)
+		return nil
+	}
+	args := append([]string{"compact"}, b.borgCommonArgs()...)
+	b.logf(LevelInfo, "borg %s", strings.Join(args, " "))
+	if b.dryRun {
+		return nil
+	}
+	return errors.Wrap(b.runBorgInterruptible(ctx, args), "error while compacting the repository")
+}
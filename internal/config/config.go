@@ -0,0 +1,341 @@
+// Package config loads borg-tm settings from a TOML file.
+//
+// Only the subset of TOML the settings need is understood: `key = value`
+// lines with basic ("...") or literal ('...') strings, booleans and
+// single-line arrays of strings, `#` comments, and `[profiles.NAME]` and
+// `[repos.NAME]` tables. Keys at the top of the file apply to every profile,
+// a profile's keys override them. For example:
+//
+//	repo = "ssh://backup@nas/./borg"
+//	lock-file = "/var/run/borg.lock"
+//
+//	[profiles.nightly]
+//	source = ["/", "/System/Volumes/Data"]
+//	mountpoint = ["/tmp/snapshot", "/tmp/snapshot-data"]
+//	borg-args = "--stats --compression zstd"
+//
+// repo can be an array to back up to several repositories in one run. A
+// `[repos.NAME]` table adds a repository with its own borg-args and
+// passphrase, it applies to every profile:
+//
+//	[repos.offsite]
+//	repo = "ssh://backup@offsite/./borg"
+//	passphrase-file = "/etc/borg-tm/offsite.pass"
+package config
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Config holds the settings of one profile. Zero values were not set.
+type Config struct {
+	Sources     []string
+	Mountpoints []string
+	BorgArgs    string
+	LockFile    string
+	DryRun      *bool
+	Repos       []string // BORG_REPO, or several for one run
+	EnvFile     string
+	OpItem      string
+	PingURL     string
+	// from the [repos.NAME] tables, in the order of the file
+	RepoTables []Repo
+}
+
+// Repo is a [repos.NAME] table. Zero values were not set.
+type Repo struct {
+	Name           string
+	Repo           string
+	BorgArgs       string
+	OpItem         string
+	PassphraseFile string
+	KeychainItem   string
+}
+
+const (
+	profilesTable = "profiles"
+	reposTable    = "repos"
+)
+
+// Load reads path and returns the settings of profile, or only the top-level
+// settings if profile is empty.
+func Load(path string, profile string) (Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Config{}, errors.Wrap(err, "error while opening config file")
+	}
+	defer file.Close()
+	cfg, err := parse(file, profile)
+	if err != nil {
+		return Config{}, errors.Wrapf(err, "error while parsing config file %s", path)
+	}
+	return cfg, nil
+}
+
+func parse(r io.Reader, profile string) (Config, error) {
+	var base, selected Config
+	var repos []Repo
+	profiles := map[string]bool{}
+	current := &base
+	var currentRepo *Repo // inside a [repos.NAME] table
+	skip := false         // inside a profile that isn't selected
+	sc := bufio.NewScanner(r)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return Config{}, errors.Errorf("line %d: unterminated table header", lineNo)
+			}
+			table := strings.TrimSpace(line[1 : len(line)-1])
+			parts := strings.SplitN(table, ".", 2)
+			if len(parts) == 2 && parts[0] == reposTable && parts[1] != "" {
+				for _, r := range repos {
+					if r.Name == parts[1] {
+						return Config{}, errors.Errorf("line %d: repo %s defined twice", lineNo, r.Name)
+					}
+				}
+				repos = append(repos, Repo{Name: parts[1]})
+				currentRepo = &repos[len(repos)-1]
+				skip = false
+				continue
+			}
+			if len(parts) != 2 || parts[0] != profilesTable || parts[1] == "" {
+				return Config{}, errors.Errorf("line %d: unknown table [%s], expected [%s.NAME] or [%s.NAME]", lineNo, table, profilesTable, reposTable)
+			}
+			currentRepo = nil
+			name := parts[1]
+			if profiles[name] {
+				return Config{}, errors.Errorf("line %d: profile %s defined twice", lineNo, name)
+			}
+			profiles[name] = true
+			skip = name != profile
+			current = &selected
+			continue
+		}
+		idx := strings.Index(line, "=")
+		if idx <= 0 {
+			return Config{}, errors.Errorf("line %d: expected key = value", lineNo)
+		}
+		key := strings.TrimSpace(line[:idx])
+		value := strings.TrimSpace(line[idx+1:])
+		if currentRepo != nil {
+			if err := setRepo(currentRepo, key, value); err != nil {
+				return Config{}, errors.Wrapf(err, "line %d", lineNo)
+			}
+			continue
+		}
+		if skip {
+			// still report errors in the other profiles
+			var discard Config
+			if err := set(&discard, key, value); err != nil {
+				return Config{}, errors.Wrapf(err, "line %d", lineNo)
+			}
+			continue
+		}
+		if err := set(current, key, value); err != nil {
+			return Config{}, errors.Wrapf(err, "line %d", lineNo)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return Config{}, err
+	}
+	if profile != "" && !profiles[profile] {
+		return Config{}, errors.Errorf("profile %s not found", profile)
+	}
+	for _, r := range repos {
+		if r.Repo == "" {
+			return Config{}, errors.Errorf("repo %s has no repo key", r.Name)
+		}
+	}
+	cfg := merge(base, selected)
+	cfg.RepoTables = repos
+	return cfg, nil
+}
+
+// stripComment removes a # comment that isn't inside a string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func set(cfg *Config, key string, value string) error {
+	var err error
+	switch key {
+	case "source":
+		cfg.Sources, err = parseStrings(key, value)
+	case "mountpoint":
+		cfg.Mountpoints, err = parseStrings(key, value)
+	case "borg-args":
+		cfg.BorgArgs, err = parseString(key, value)
+	case "lock-file":
+		cfg.LockFile, err = parseString(key, value)
+	case "dry-run":
+		var b bool
+		b, err = parseBool(key, value)
+		cfg.DryRun = &b
+	case "repo":
+		cfg.Repos, err = parseStrings(key, value)
+	case "env-file":
+		cfg.EnvFile, err = parseString(key, value)
+	case "op-item":
+		cfg.OpItem, err = parseString(key, value)
+	case "ping-url":
+		cfg.PingURL, err = parseString(key, value)
+	default:
+		return errors.Errorf("unknown key %q", key)
+	}
+	return err
+}
+
+func setRepo(r *Repo, key string, value string) error {
+	var err error
+	switch key {
+	case "repo":
+		r.Repo, err = parseString(key, value)
+	case "borg-args":
+		r.BorgArgs, err = parseString(key, value)
+	case "op-item":
+		r.OpItem, err = parseString(key, value)
+	case "passphrase-file":
+		r.PassphraseFile, err = parseString(key, value)
+	case "keychain-item":
+		r.KeychainItem, err = parseString(key, value)
+	default:
+		return errors.Errorf("unknown key %q in a repos table", key)
+	}
+	return err
+}
+
+func parseString(key string, value string) (string, error) {
+	s, rest, err := parseStringPrefix(value)
+	if err != nil {
+		return "", errors.Wrapf(err, "key %q", key)
+	}
+	if strings.TrimSpace(rest) != "" {
+		return "", errors.Errorf("key %q: unexpected %q after the string", key, rest)
+	}
+	return s, nil
+}
+
+// parseStringPrefix parses the string value at the start of value and
+// returns it with the remaining input.
+func parseStringPrefix(value string) (string, string, error) {
+	if value == "" || (value[0] != '"' && value[0] != '\'') {
+		return "", "", errors.New("expected a quoted string")
+	}
+	if value[0] == '\'' {
+		end := strings.IndexByte(value[1:], '\'')
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return value[1 : end+1], value[end+2:], nil
+	}
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			s, err := strconv.Unquote(value[:i+1])
+			if err != nil {
+				return "", "", errors.Errorf("invalid string %s", value[:i+1])
+			}
+			return s, value[i+1:], nil
+		}
+	}
+	return "", "", errors.New("unterminated string")
+}
+
+func parseStrings(key string, value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		// a single value is fine as well
+		s, err := parseString(key, value)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+	if !strings.HasSuffix(value, "]") {
+		return nil, errors.Errorf("key %q: unterminated array, arrays must be on one line", key)
+	}
+	rest := strings.TrimSpace(value[1 : len(value)-1])
+	var values []string
+	for rest != "" {
+		s, after, err := parseStringPrefix(rest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "key %q", key)
+		}
+		values = append(values, s)
+		after = strings.TrimSpace(after)
+		if after != "" && after[0] != ',' {
+			return nil, errors.Errorf("key %q: expected , between array elements", key)
+		}
+		rest = strings.TrimSpace(strings.TrimPrefix(after, ","))
+	}
+	return values, nil
+}
+
+func parseBool(key string, value string) (bool, error) {
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, errors.Errorf("key %q: expected true or false, got %s", key, value)
+}
+
+// merge returns base with the values set in override replacing its own.
+func merge(base Config, override Config) Config {
+	if override.Sources != nil {
+		base.Sources = override.Sources
+	}
+	if override.Mountpoints != nil {
+		base.Mountpoints = override.Mountpoints
+	}
+	if override.BorgArgs != "" {
+		base.BorgArgs = override.BorgArgs
+	}
+	if override.LockFile != "" {
+		base.LockFile = override.LockFile
+	}
+	if override.DryRun != nil {
+		base.DryRun = override.DryRun
+	}
+	if override.Repos != nil {
+		base.Repos = override.Repos
+	}
+	if override.EnvFile != "" {
+		base.EnvFile = override.EnvFile
+	}
+	if override.OpItem != "" {
+		base.OpItem = override.OpItem
+	}
+	if override.PingURL != "" {
+		base.PingURL = override.PingURL
+	}
+	return base
+}
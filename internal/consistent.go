@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pickConsistentSnapshots picks one snapshot per entry of lists such that all of
+// them were taken within window of each other, preferring the newest such
+// set. Each list must be in the order of the sources.
+func (b BorgBackup) pickConsistentSnapshots(sources []string, lists [][]string, window time.Duration) ([]string, error) {
+	dated := make([][]datedSnapshot, len(lists))
+	for i, names := range lists {
+		for _, name := range names {
+			if s, err := b.parseSnapshotName(name); err == nil && !s.Timestamp.IsZero() {
+				dated[i] = append(dated[i], datedSnapshot{name: s.Raw, created: s.Timestamp})
+			}
+		}
+		sort.Slice(dated[i], func(a, b int) bool { return dated[i][a].created.After(dated[i][b].created) })
+	}
+	if len(dated) == 0 {
+		return nil, nil
+	}
+	// try the snapshots of the first source as anchors, newest first
+	for _, anchor := range dated[0] {
+		picked := []string{anchor.name}
+		for _, candidates := range dated[1:] {
+			best := -1
+			var bestDiff time.Duration
+			for j, c := range candidates {
+				diff := c.created.Sub(anchor.created)
+				if diff < 0 {
+					diff = -diff
+				}
+				if diff <= window && (best < 0 || diff < bestDiff) {
+					best, bestDiff = j, diff
+				}
+			}
+			if best < 0 {
+				break
+			}
+			picked = append(picked, candidates[best].name)
+		}
+		if len(picked) == len(dated) {
+			return picked, nil
+		}
+	}
+
+	var sb strings.Builder
+	for i, source := range sources {
+		fmt.Fprintf(&sb, "\n  %s:", source)
+		if len(dated[i]) == 0 {
+			sb.WriteString(" (no snapshots)")
+		}
+		for _, s := range dated[i] {
+			fmt.Fprintf(&sb, "\n    %s", s.name)
+		}
+	}
+	return nil, errors.Errorf("no set of snapshots taken within %s of each other exists on all sources, available snapshots:%s", window, sb.String())
+}
+
+// getConsistentSnapshots lists the snapshots of every source that gets mounted
+// and returns a consistent set of them, indexed like b.sources. Sources that
+// aren't mounted get an empty name.
+func (b BorgBackup) getConsistentSnapshots(ctx context.Context) ([]string, error) {
+	var indexes []int
+	var sources []string
+	var lists [][]string
+	for i, source := range b.sources {
+		if source == b.mountpoints[i] || (len(b.snapshotsToUse) > 0 && b.snapshotsToUse[i] != "") {
+			continue
+		}
+		names, err := b.listSnapshots(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, i)
+		sources = append(sources, source)
+		lists = append(lists, names)
+	}
+	picked, err := b.pickConsistentSnapshots(sources, lists, b.consistencyWindow)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, len(b.sources))
+	for j, i := range indexes {
+		result[i] = picked[j]
+	}
+	return result, nil
+}
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tools for listing snapshots, selected with -snapshot-list-tool
+const (
+	SnapshotListAuto     = "auto" // diskutil, falling back to tmutil
+	SnapshotListDiskutil = "diskutil"
+	SnapshotListTmutil   = "tmutil"
+)
+
+// snapshotRecord is a snapshot as listed by diskutil or tmutil. XID is 0
+// when unknown (tmutil doesn't print it), Timestamp is zero when the name
+// doesn't contain one.
+type snapshotRecord struct {
+	Name      string
+	XID       uint64
+	Timestamp time.Time
+}
+
+// volumeInfo is the subset of `diskutil info -plist` we care about.
+type volumeInfo struct {
+	DeviceIdentifier string // e.g. disk1s1
+	DeviceNode       string // e.g. /dev/disk1s1
+	VolumeUUID       string
+	MountPoint       string
+	FilesystemType   string // e.g. apfs
+}
+
+func (b BorgBackup) diskutilPlist(ctx context.Context, args ...string) (map[string]interface{}, error) {
+	stdout, stderr, err := b.run(ctx, "diskutil", args, RunOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while running diskutil %s: %s", strings.Join(args, " "), strings.TrimSpace(string(stderr)))
+	}
+	v, err := parsePlist(bytes.NewReader(stdout))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("unexpected output of diskutil %s", strings.Join(args, " "))
+	}
+	return dict, nil
+}
+
+// getVolumeInfo maps a path (or device) to the APFS volume it is on.
+func (b BorgBackup) getVolumeInfo(ctx context.Context, path string) (volumeInfo, error) {
+	dict, err := b.diskutilPlist(ctx, "info", "-plist", path)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	info := volumeInfo{
+		DeviceIdentifier: plistString(dict, "DeviceIdentifier"),
+		DeviceNode:       plistString(dict, "DeviceNode"),
+		VolumeUUID:       plistString(dict, "VolumeUUID"),
+		MountPoint:       plistString(dict, "MountPoint"),
+		FilesystemType:   plistString(dict, "FilesystemType"),
+	}
+	if info.DeviceIdentifier == "" {
+		return info, errors.Errorf("diskutil reports no device for %s", path)
+	}
+	return info, nil
+}
+
+// listSnapshotsDiskutil lists the snapshots of the volume source is on with
+// `diskutil apfs listSnapshots -plist`.
+func (b BorgBackup) listSnapshotsDiskutil(ctx context.Context, source string) ([]snapshotRecord, error) {
+	info, err := b.getVolumeInfo(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	dict, err := b.diskutilPlist(ctx, "apfs", "listSnapshots", "-plist", info.DeviceIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	list, _ := dict["Snapshots"].([]interface{})
+	records := make([]snapshotRecord, 0, len(list))
+	for _, entry := range list {
+		s, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		r := snapshotRecord{Name: plistString(s, "SnapshotName")}
+		if r.Name == "" {
+			continue
+		}
+		if xid, ok := s["SnapshotXID"].(int64); ok && xid > 0 {
+			r.XID = uint64(xid)
+		}
+		if parsed, err := b.parseSnapshotName(r.Name); err == nil {
+			r.Timestamp = parsed.Timestamp
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// listSnapshotRecords lists the snapshots of source with the configured tool.
+func (b BorgBackup) listSnapshotRecords(ctx context.Context, source string) ([]snapshotRecord, error) {
+	tool := b.snapshotListTool
+	if tool == "" {
+		tool = SnapshotListAuto
+	}
+	if tool != SnapshotListTmutil {
+		records, err := b.listSnapshotsDiskutil(ctx, source)
+		if err == nil || tool == SnapshotListDiskutil {
+			return records, err
+		}
+		b.logf(LevelWarn, "listing snapshots with diskutil failed, falling back to tmutil: %v", err)
+	}
+	names, err := b.listSnapshotsTmutil(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]snapshotRecord, 0, len(names))
+	for _, name := range names {
+		r := snapshotRecord{Name: name}
+		if parsed, err := b.parseSnapshotName(name); err == nil {
+			r.Timestamp = parsed.Timestamp
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// findSnapshot looks up the record of the snapshot called name on source. If
+// it can't be listed, the record only holds the name.
+func (b BorgBackup) findSnapshot(ctx context.Context, source string, name string) snapshotRecord {
+	records, err := b.listSnapshotRecords(ctx, source)
+	if err == nil {
+		for _, r := range records {
+			if r.Name == name {
+				return r
+			}
+		}
+	}
+	return snapshotRecord{Name: name}
+}
+
+// checkSnapshotsToUse makes sure the snapshots named with -snapshot exist,
+// rather than failing to mount them after other sources were mounted.
+func (b BorgBackup) checkSnapshotsToUse(ctx context.Context) error {
+	for i, name := range b.snapshotsToUse {
+		if name == "" || b.sources[i] == b.mountpoints[i] {
+			continue
+		}
+		records, err := b.listSnapshotRecords(ctx, b.sources[i])
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, r := range records {
+			if r.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("snapshot %s does not exist on source %s", name, b.sources[i])
+		}
+	}
+	return nil
+}
+
+func snapshotNames(records []snapshotRecord) []string {
+	names := make([]string, len(records))
+	for i, r := range records {
+		names[i] = r.Name
+	}
+	return names
+}
+
+// prefix of -source values that name an APFS volume by its UUID
+const volumeUUIDPrefix = "uuid:"
+
+// ResolveVolumeUUIDs replaces the sources given as uuid:<volume UUID> with
+// the path the volume is currently mounted on. The UUIDs are returned
+// indexed like sources, empty for sources given as a path.
+func ResolveVolumeUUIDs(sources []string, logger Logger) ([]string, []string, error) {
+	b := BorgBackup{log: newRunLog(logger)}
+	resolved := make([]string, len(sources))
+	uuids := make([]string, len(sources))
+	for i, source := range sources {
+		resolved[i] = source
+		if !strings.HasPrefix(source, volumeUUIDPrefix) {
+			continue
+		}
+		uuid := strings.TrimPrefix(source, volumeUUIDPrefix)
+		info, err := b.getVolumeInfo(context.Background(), uuid)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error while looking up volume %s", uuid)
+		}
+		if info.MountPoint == "" {
+			return nil, nil, errors.Errorf("volume %s (%s) is not mounted", uuid, info.DeviceIdentifier)
+		}
+		b.logf(LevelInfo, "Volume %s is mounted on %s", uuid, info.MountPoint)
+		resolved[i] = info.MountPoint
+		uuids[i] = strings.ToUpper(uuid)
+	}
+	return resolved, uuids, nil
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// LoadEnvFile reads KEY=VALUE lines from path and sets them in the process
+// environment. Since the file usually holds the repository passphrase, it must
+// be owned by root and must not be accessible by group or others. Values are
+// never included in returned errors.
+func LoadEnvFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "error while opening env file")
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "error while checking env file")
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return errors.Errorf("env file %s has permissions %#o, it must not be accessible by group or others (use chmod 600)", path, perm)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid != 0 {
+		return errors.Errorf("env file %s must be owned by root, but is owned by uid %d", path, st.Uid)
+	}
+
+	vars, err := parseEnvFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "error while parsing env file %s", path)
+	}
+	for _, kv := range vars {
+		if err := os.Setenv(kv[0], kv[1]); err != nil {
+			return errors.Wrapf(err, "error while setting %s from env file", kv[0])
+		}
+	}
+	return nil
+}
+
+// parseEnvFile parses lines of the form `KEY=VALUE`, `export KEY=VALUE`,
+// `KEY='VALUE'` and `KEY="VALUE"`. Blank lines and lines starting with `#`
+// are skipped, as are trailing ` # comments` after unquoted values.
+func parseEnvFile(file *os.File) ([][2]string, error) {
+	var vars [][2]string
+	sc := bufio.NewScanner(file)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			return nil, errors.Errorf("line %d: expected KEY=VALUE", lineNo)
+		}
+		key := strings.TrimSpace(line[:idx])
+		if !validEnvKey(key) {
+			return nil, errors.Errorf("line %d: invalid variable name", lineNo)
+		}
+		value, err := parseEnvValue(strings.TrimSpace(line[idx+1:]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNo)
+		}
+		vars = append(vars, [2]string{key, value})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+func validEnvKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i, c := range key {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func parseEnvValue(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	switch raw[0] {
+	case '\'':
+		end := strings.Index(raw[1:], "'")
+		if end < 0 {
+			return "", errors.New("unterminated single quote")
+		}
+		if rest := strings.TrimSpace(raw[end+2:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", errors.New("unexpected characters after closing quote")
+		}
+		return raw[1 : end+1], nil
+	case '"':
+		var sb strings.Builder
+		for i := 1; i < len(raw); i++ {
+			c := raw[i]
+			switch {
+			case c == '\\' && i+1 < len(raw):
+				i++
+				switch raw[i] {
+				case 'n':
+					sb.WriteByte('\n')
+				case 't':
+					sb.WriteByte('\t')
+				default:
+					sb.WriteByte(raw[i])
+				}
+			case c == '"':
+				if rest := strings.TrimSpace(raw[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+					return "", errors.New("unexpected characters after closing quote")
+				}
+				return sb.String(), nil
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		return "", errors.New("unterminated double quote")
+	}
+	if idx := strings.Index(raw, " #"); idx >= 0 {
+		raw = raw[:idx]
+	}
+	return strings.TrimSpace(raw), nil
+}
@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ErrLockHeld: another run holds the lock file
+	ErrLockHeld backupErr = "the lock is held by another process"
+	// ErrNoSnapshots: a source has no snapshot to back up
+	ErrNoSnapshots backupErr = "no available snapshots"
+	// ErrUnrecognizedSnapshotName: a snapshot name borg-tm can't parse
+	ErrUnrecognizedSnapshotName backupErr = "unrecognized snapshot format"
+)
+
+// SnapshotCreateError is returned by Run when snapshots couldn't be created.
+// Source is empty if the failure isn't about a single source, e.g. when the
+// creation times were too far apart.
+type SnapshotCreateError struct {
+	Source string
+	Err    error
+}
+
+func (e *SnapshotCreateError) Error() string {
+	if e.Source == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("error while creating snapshot for source %s: %v", e.Source, e.Err)
+}
+
+// MountError is returned by Run when the snapshot of a source couldn't be
+// found or mounted.
+type MountError struct {
+	Source     string
+	Mountpoint string
+	Err        error
+}
+
+func (e *MountError) Error() string {
+	return fmt.Sprintf("error while mounting source %s at %s: %v", e.Source, e.Mountpoint, e.Err)
+}
+
+// BorgError is returned by Run when borg create failed. ExitCode is -1 if
+// borg didn't start.
+type BorgError struct {
+	ExitCode    int
+	Err         error
+	LockTimeout bool // another borg held the repository lock
+}
+
+func (e *BorgError) Error() string {
+	return e.Err.Error()
+}
+
+// CleanupError is returned by Run when snapshots couldn't be unmounted or
+// removed. They are left over and need to be cleaned up by hand. Leftovers
+// are given as "snapshot (source)".
+type CleanupError struct {
+	Mountpoints []string // still mounted
+	Leftovers   []string
+	Err         error
+}
+
+func (e *CleanupError) Error() string {
+	return fmt.Sprintf("%v, %s", e.Err, e.needsCleanup())
+}
+
+func (e *CleanupError) needsCleanup() string {
+	var parts []string
+	if len(e.Mountpoints) > 0 {
+		parts = append(parts, "still mounted: "+strings.Join(e.Mountpoints, ", "))
+	}
+	if len(e.Leftovers) > 0 {
+		parts = append(parts, "snapshots left over: "+strings.Join(e.Leftovers, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// cleanupFailures collects what the cleanup at the end of Run couldn't undo,
+// so that it can go on with the rest.
+type cleanupFailures struct {
+	stillMounted map[int]bool // by source index
+	mountpoints  []string
+	leftovers    []string
+	errs         []error
+}
+
+func newCleanupFailures() *cleanupFailures {
+	return &cleanupFailures{stillMounted: map[int]bool{}}
+}
+
+func (c *cleanupFailures) unmountFailed(i int, mountpoint string, err error) {
+	c.stillMounted[i] = true
+	c.mountpoints = append(c.mountpoints, mountpoint)
+	c.errs = append(c.errs, errors.Wrapf(err, "error while unmounting %s", mountpoint))
+}
+
+// leftover records a snapshot that wasn't removed, err is nil if removing
+// it wasn't tried.
+func (c *cleanupFailures) leftover(snapshot string, source string, err error) {
+	c.leftovers = append(c.leftovers, fmt.Sprintf("%s (%s)", snapshot, source))
+	if err != nil {
+		c.errs = append(c.errs, err)
+	}
+}
+
+// err returns a *CleanupError listing everything left over, or nil.
+func (c *cleanupFailures) err() error {
+	if len(c.errs) == 0 {
+		return nil
+	}
+	err := c.errs[0]
+	if len(c.errs) > 1 {
+		msgs := make([]string, len(c.errs))
+		for i, e := range c.errs {
+			msgs[i] = e.Error()
+		}
+		err = errors.Errorf("%d cleanup steps failed: %s", len(c.errs), strings.Join(msgs, "; "))
+	}
+	return &CleanupError{Mountpoints: c.mountpoints, Leftovers: c.leftovers, Err: err}
+}
+
+// The typed errors keep what they wrap reachable for errors.Cause, for
+// errors.Unwrap and for the stack traces printed with %+v.
+func (e *SnapshotCreateError) Cause() error { return e.Err }
+func (e *MountError) Cause() error          { return e.Err }
+func (e *BorgError) Cause() error           { return e.Err }
+func (e *CleanupError) Cause() error        { return e.Err }
+
+func (e *SnapshotCreateError) Unwrap() error { return e.Err }
+func (e *MountError) Unwrap() error          { return e.Err }
+func (e *BorgError) Unwrap() error           { return e.Err }
+func (e *CleanupError) Unwrap() error        { return e.Err }
+
+func (e *SnapshotCreateError) Format(s fmt.State, verb rune) {
+	formatError(s, verb, e, e.Err, "source "+e.Source)
+}
+
+func (e *MountError) Format(s fmt.State, verb rune) {
+	formatError(s, verb, e, e.Err, fmt.Sprintf("source %s, mountpoint %s", e.Source, e.Mountpoint))
+}
+
+func (e *BorgError) Format(s fmt.State, verb rune) {
+	formatError(s, verb, e, e.Err, fmt.Sprintf("borg exit code %d", e.ExitCode))
+}
+
+func (e *CleanupError) Format(s fmt.State, verb rune) {
+	formatError(s, verb, e, e.Err, e.needsCleanup())
+}
+
+// formatError prints err like pkg/errors does: with %+v the wrapped error
+// including its stack trace, followed by the fields of err.
+func formatError(s fmt.State, verb rune, err error, cause error, fields string) {
+	if verb == 'v' && s.Flag('+') {
+		fmt.Fprintf(s, "%+v\n%s", cause, fields)
+		return
+	}
+	io.WriteString(s, err.Error())
+}
+
+// Stage is the part of a run a failure happened in.
+type Stage string
+
+const (
+	StageLock      Stage = "lock"
+	StagePreflight Stage = "preflight"
+	StageSnapshot  Stage = "snapshot"
+	StageMount     Stage = "mount"
+	StageBorg      Stage = "borg"
+	StageCleanup   Stage = "cleanup"
+)
+
+// Exit codes of borg-tm, see ExitCode.
+const (
+	ExitFailure      = 1 // anything without a code of its own
+	ExitPartial      = 2 // *PartialError
+	ExitRepoMismatch = 3 // *RepoMismatchError
+	ExitPrune        = 4 // *PruneError
+	ExitValidation   = 5 // invalid flags or options
+	ExitLockBusy     = 6
+	ExitPreflight    = 7
+	ExitSnapshot     = 8
+	ExitMount        = 9
+	ExitBorg         = 10
+	ExitCleanup      = 11 // snapshots left mounted or not removed, needs manual cleanup
+	ExitCheck        = 12 // *CheckError
+	ExitVerify       = 13 // *VerifyError
+)
+
+var stageExitCodes = map[Stage]int{
+	StageLock:      ExitLockBusy,
+	StagePreflight: ExitPreflight,
+	StageSnapshot:  ExitSnapshot,
+	StageMount:     ExitMount,
+	StageBorg:      ExitBorg,
+	StageCleanup:   ExitCleanup,
+}
+
+type causer interface {
+	Cause() error
+}
+
+// stageOf returns the stage of err itself, without looking at what it wraps.
+func stageOf(err error) (Stage, bool) {
+	switch err.(type) {
+	case *PreflightError:
+		return StagePreflight, true
+	case *SnapshotCreateError:
+		return StageSnapshot, true
+	case *MountError:
+		return StageMount, true
+	case *BorgError:
+		return StageBorg, true
+	case *CleanupError:
+		return StageCleanup, true
+	}
+	if err == ErrLockHeld {
+		return StageLock, true
+	}
+	return "", false
+}
+
+// StageOf returns the stage of the outermost typed error in the chain of
+// err, following errors.Wrap and friends.
+func StageOf(err error) (Stage, bool) {
+	for err != nil {
+		if stage, ok := stageOf(err); ok {
+			return stage, true
+		}
+		c, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return "", false
+}
+
+// ExitCode maps an error returned by Run to the exit code of borg-tm: the
+// code of the outermost typed error in its chain, ExitFailure for untyped
+// errors and 0 for nil.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	for e := err; e != nil; {
+		switch e.(type) {
+		case *PartialError:
+			return ExitPartial
+		case *RepoMismatchError:
+			return ExitRepoMismatch
+		case *PruneError:
+			return ExitPrune
+		case *CheckError:
+			return ExitCheck
+		case *VerifyError:
+			return ExitVerify
+		}
+		if stage, ok := stageOf(e); ok {
+			return stageExitCodes[stage]
+		}
+		c, ok := e.(causer)
+		if !ok {
+			break
+		}
+		e = c.Cause()
+	}
+	return ExitFailure
+}
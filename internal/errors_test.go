@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestErrorsIsThroughWrapping(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		target error
+	}{
+		{"lock held", errors.Wrap(ErrLockHeld, "error while locking"), ErrLockHeld},
+		{"lock held, wrapped twice", errors.WithMessage(errors.Wrapf(ErrLockHeld, "error while locking %s", "/var/run/borg-tm.lock"), "previous error"), ErrLockHeld},
+		{"no snapshots", errors.Wrap(ErrNoSnapshots, "error while selecting the snapshot"), ErrNoSnapshots},
+		{"cancelled borg create", &BorgError{ExitCode: 2, Err: errors.Wrap(context.Canceled, "borg create was interrupted")}, context.Canceled},
+		{"mount of a missing mountpoint", errors.Wrap(&MountError{Source: "/", Mountpoint: "/tmp/snapshot", Err: errors.Wrap(os.ErrNotExist, "error while mounting snapshot")}, "error while backing up"), os.ErrNotExist},
+		{"snapshot creation timeout", &SnapshotCreateError{Source: "/", Err: errors.Wrap(context.DeadlineExceeded, "error while creating snapshot")}, context.DeadlineExceeded},
+		{"cleanup", &CleanupError{Err: errors.Wrap(os.ErrPermission, "error while unmounting /tmp/snapshot")}, os.ErrPermission},
+		{"prune", &PruneError{Err: errors.Wrap(context.Canceled, "borg prune was interrupted")}, context.Canceled},
+		{"check", &CheckError{Err: errors.Wrap(context.DeadlineExceeded, "borg check was interrupted")}, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		if !errors.Is(tt.err, tt.target) {
+			t.Errorf("%s: errors.Is(%v, %v) is false", tt.name, tt.err, tt.target)
+		}
+		if tt.target != ErrLockHeld && errors.Is(tt.err, ErrLockHeld) {
+			t.Errorf("%s: errors.Is(%v, ErrLockHeld) is true", tt.name, tt.err)
+		}
+	}
+}
+
+func TestErrorsAsThroughWrapping(t *testing.T) {
+	wrap := func(err error) error {
+		// as Run and the cleanup wrap them
+		return errors.Wrapf(errors.Wrap(err, "error while backing up"), "previous error: %v", "borg failed")
+	}
+	borg := &BorgError{ExitCode: 2, Err: errors.New("error while running borg: exit status 2"), LockTimeout: true}
+	var borgErr *BorgError
+	if !errors.As(wrap(borg), &borgErr) || borgErr != borg {
+		t.Errorf("errors.As didn't find the *BorgError in %v", wrap(borg))
+	} else if !borgErr.LockTimeout || borgErr.ExitCode != 2 {
+		t.Errorf("got %+v, want %+v", borgErr, borg)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		as   func(error) bool
+	}{
+		{"*SnapshotCreateError", &SnapshotCreateError{Source: "/", Err: errors.New("failed")}, func(err error) bool {
+			var target *SnapshotCreateError
+			return errors.As(err, &target) && target.Source == "/"
+		}},
+		{"*MountError", &MountError{Source: "/", Mountpoint: "/tmp/snapshot", Err: errors.New("failed")}, func(err error) bool {
+			var target *MountError
+			return errors.As(err, &target) && target.Mountpoint == "/tmp/snapshot"
+		}},
+		{"*CleanupError", &CleanupError{Mountpoints: []string{"/tmp/snapshot"}, Err: errors.New("failed")}, func(err error) bool {
+			var target *CleanupError
+			return errors.As(err, &target) && len(target.Mountpoints) == 1
+		}},
+		{"*PreflightError", &PreflightError{Failures: []string{"borg in PATH"}}, func(err error) bool {
+			var target *PreflightError
+			return errors.As(err, &target) && len(target.Failures) == 1
+		}},
+		{"*PartialError", &PartialError{Failed: []string{"/Volumes/Data"}, Errors: []error{errors.New("failed")}}, func(err error) bool {
+			var target *PartialError
+			return errors.As(err, &target) && target.Failed[0] == "/Volumes/Data"
+		}},
+		{"*RepoMismatchError", &RepoMismatchError{Location: "/backups/a", Recorded: "aaaa", Current: "bbbb"}, func(err error) bool {
+			var target *RepoMismatchError
+			return errors.As(err, &target) && target.Current == "bbbb"
+		}},
+		{"*PruneError", &PruneError{Err: errors.New("failed")}, func(err error) bool {
+			var target *PruneError
+			return errors.As(err, &target)
+		}},
+		{"*CheckError", &CheckError{Err: errors.New("failed")}, func(err error) bool {
+			var target *CheckError
+			return errors.As(err, &target)
+		}},
+		{"*VerifyError", &VerifyError{Archive: "a@host", Checked: 10}, func(err error) bool {
+			var target *VerifyError
+			return errors.As(err, &target) && target.Archive == "a@host"
+		}},
+		{"*BorgError inside a *PruneError", &PruneError{Err: &BorgError{ExitCode: 2, Err: errors.New("failed")}}, func(err error) bool {
+			var target *BorgError
+			return errors.As(err, &target) && target.ExitCode == 2
+		}},
+	}
+	for _, tt := range tests {
+		for _, err := range []error{tt.err, wrap(tt.err), fmt.Errorf("go wrapped: %w", tt.err)} {
+			if !tt.as(err) {
+				t.Errorf("errors.As didn't find the %s in %v", tt.name, err)
+			}
+		}
+	}
+}
+
+func TestExitCodeAndStage(t *testing.T) {
+	failed := errors.New("failed")
+	tests := []struct {
+		name  string
+		err   error
+		code  int
+		stage Stage // empty for none
+	}{
+		{"success", nil, 0, ""},
+		{"untyped", failed, ExitFailure, ""},
+		{"lock held", errors.Wrap(ErrLockHeld, "error while locking"), ExitLockBusy, StageLock},
+		{"preflight", &PreflightError{Failures: []string{"borg in PATH"}}, ExitPreflight, StagePreflight},
+		{"snapshot", &SnapshotCreateError{Source: "/", Err: failed}, ExitSnapshot, StageSnapshot},
+		{"mount", errors.Wrap(&MountError{Source: "/", Mountpoint: "/tmp/snapshot", Err: failed}, "error while backing up"), ExitMount, StageMount},
+		{"borg", &BorgError{ExitCode: 2, Err: failed}, ExitBorg, StageBorg},
+		{"cleanup", &CleanupError{Err: failed}, ExitCleanup, StageCleanup},
+		// the cleanup failure is what needs attention, it wraps the backup's
+		{"cleanup after borg", &CleanupError{Err: &BorgError{ExitCode: 2, Err: failed}}, ExitCleanup, StageCleanup},
+		{"partial", &PartialError{Failed: []string{"/"}, Errors: []error{failed}}, ExitPartial, ""},
+		{"repository mismatch", &RepoMismatchError{Location: "/backups/a", Recorded: "aaaa", Current: "bbbb"}, ExitRepoMismatch, ""},
+		{"prune", &PruneError{Err: failed}, ExitPrune, ""},
+		{"prune of borg", &PruneError{Err: &BorgError{ExitCode: 2, Err: failed}}, ExitPrune, StageBorg},
+		{"check", &CheckError{Err: failed}, ExitCheck, ""},
+		{"verify", &VerifyError{Archive: "a@host"}, ExitVerify, ""},
+		{"wrapped verify", errors.Wrap(&VerifyError{Archive: "a@host"}, "error while verifying"), ExitVerify, ""},
+	}
+	for _, tt := range tests {
+		if code := ExitCode(tt.err); code != tt.code {
+			t.Errorf("%s: ExitCode(%v) = %d, want %d", tt.name, tt.err, code, tt.code)
+		}
+		stage, ok := StageOf(tt.err)
+		if ok != (tt.stage != "") || stage != tt.stage {
+			t.Errorf("%s: StageOf(%v) = %q, %v, want %q", tt.name, tt.err, stage, ok, tt.stage)
+		}
+	}
+}
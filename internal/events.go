@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// Phase is a transition of a run, reported to the OnPhase callbacks.
+type Phase string
+
+const (
+	PhaseSnapshotCreated Phase = "snapshot-created"
+	PhaseMounted         Phase = "mounted"
+	PhaseBorgStarted     Phase = "borg-started"
+	PhaseBorgFinished    Phase = "borg-finished"
+	PhaseUnmounted       Phase = "unmounted"
+	PhaseSnapshotRemoved Phase = "snapshot-removed"
+)
+
+// PhaseInfo describes a Phase. The borg phases have no source, snapshot or
+// mountpoint, the others no archive.
+type PhaseInfo struct {
+	Source     string
+	Snapshot   string
+	Mountpoint string
+	Archive    string
+	// when the step started, and how long it took, zero for borg-started
+	Start    time.Time
+	Duration time.Duration
+	// how borg create failed, for borg-finished
+	Err error
+}
+
+// ProgressEvent is what borg create reported it has done so far. It is only
+// sent while borg runs.
+type ProgressEvent struct {
+	Time             time.Time `json:"time"`
+	Archive          string    `json:"archive"`
+	OriginalSize     int64     `json:"original_size"`
+	CompressedSize   int64     `json:"compressed_size"`
+	DeduplicatedSize int64     `json:"deduplicated_size"`
+	NFiles           int64     `json:"nfiles"`
+	// the file borg is at
+	Path string `json:"path,omitempty"`
+	// what borg is doing when it isn't reading files, e.g. reading the
+	// cache, from progress_message and progress_percent; the counters are
+	// zero then
+	Message string `json:"message,omitempty"`
+}
+
+// callbacks are the OnPhase and OnProgress functions. They are called one
+// at a time, also when the sources are worked on in parallel, and have to
+// return quickly, as the run waits for them. A nil callbacks calls nothing.
+type callbacks struct {
+	mu       sync.Mutex
+	phase    []func(Phase, PhaseInfo)
+	progress []func(ProgressEvent)
+}
+
+// with returns a copy of c with phase and progress called first, either may
+// be nil. Run adds its own this way, so that running a backup twice doesn't
+// add them twice.
+func (c *callbacks) with(phase func(Phase, PhaseInfo), progress func(ProgressEvent)) *callbacks {
+	n := &callbacks{}
+	if phase != nil {
+		n.phase = append(n.phase, phase)
+	}
+	if progress != nil {
+		n.progress = append(n.progress, progress)
+	}
+	if c != nil {
+		n.phase = append(n.phase, c.phase...)
+		n.progress = append(n.progress, c.progress...)
+	}
+	return n
+}
+
+// wantsProgress reports whether borg has to run with --progress.
+func (c *callbacks) wantsProgress() bool {
+	return c != nil && len(c.progress) > 0
+}
+
+func (c *callbacks) firePhase(phase Phase, info PhaseInfo) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.phase {
+		f(phase, info)
+	}
+}
+
+func (c *callbacks) fireProgress(e ProgressEvent) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.progress {
+		f(e)
+	}
+}
+
+// phaseDone fires phase for a step that began at start.
+func (b BorgBackup) phaseDone(phase Phase, info PhaseInfo, start time.Time) {
+	info.Start = start
+	info.Duration = time.Since(start)
+	b.callbacks.firePhase(phase, info)
+}
+
+// logPhase is the OnPhase callback that logs the transitions of the run.
+func (b BorgBackup) logPhase(phase Phase, info PhaseInfo) {
+	e := LogEntry{Level: LevelInfo}
+	for i, source := range b.sources {
+		if source == info.Source {
+			e = b.sourceEntry(i, LevelInfo)
+		}
+	}
+	e.Snapshot = info.Snapshot
+	e.Duration = info.Duration
+	switch phase {
+	case PhaseSnapshotCreated:
+		b.logEntryf(e, "Created snapshot for source %s", info.Source)
+	case PhaseMounted:
+		b.logEntryf(e, "Mounted snapshot %s at %s", info.Snapshot, info.Mountpoint)
+	case PhaseBorgStarted:
+		e.Level = LevelDebug
+		b.logEntryf(e, "borg create started for archive %s", info.Archive)
+	case PhaseBorgFinished:
+		e.Level = LevelDebug
+		b.logEntryf(e, "borg create finished after %s", info.Duration.Round(time.Second))
+	case PhaseUnmounted:
+		b.logEntryf(e, "Unmounted %s", info.Mountpoint)
+	case PhaseSnapshotRemoved:
+		b.logEntryf(e, "Removed snapshot %s for source %s", info.Snapshot, info.Source)
+	}
+}
@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// the Data volume is firmlinked into /, so /Users/x lives at
+// /System/Volumes/Data/Users/x when the Data volume is the source
+const dataVolume = "/System/Volumes/Data"
+
+// isWithin reports whether path is dir or inside of it. Both must be clean.
+func isWithin(path string, dir string) bool {
+	if dir == "/" {
+		return strings.HasPrefix(path, "/")
+	}
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// mountedPath translates a path on the live filesystem to the path where it
+// appears in the archive, i.e. below the mountpoint of the source containing
+// it. The innermost source wins. ok is false if no source contains path.
+func (b BorgBackup) mountedPath(path string) (translated string, source string, ok bool) {
+	path = filepath.Clean(path)
+	candidates := []string{path}
+	if !isWithin(path, dataVolume) {
+		candidates = append(candidates, filepath.Join(dataVolume, path))
+	}
+	best := -1
+	var bestRel string
+	for _, p := range candidates {
+		for i, s := range b.sources {
+			s = filepath.Clean(s)
+			if !isWithin(p, s) {
+				continue
+			}
+			if best >= 0 && len(s) <= len(filepath.Clean(b.sources[best])) {
+				continue
+			}
+			rel, err := filepath.Rel(s, p)
+			if err != nil {
+				continue
+			}
+			best, bestRel = i, rel
+		}
+	}
+	if best < 0 {
+		return "", "", false
+	}
+	return filepath.Join(b.mountpoints[best], bestRel), b.sources[best], true
+}
+
+// localRepoPath returns the path of repo if it names a local repository.
+func localRepoPath(repo string) (string, bool) {
+	if strings.HasPrefix(repo, "file://") {
+		repo = strings.TrimPrefix(repo, "file://")
+	} else if repo == "" || strings.Contains(repo, "://") || strings.Contains(repo, ":") {
+		// ssh://host/path and host:path are remote
+		return "", false
+	}
+	abs, err := filepath.Abs(repo)
+	if err != nil {
+		return "", false
+	}
+	return abs, true
+}
+
+// borgCacheDir returns the cache directory borg uses, following the
+// precedence of borg's own lookup.
+func borgCacheDir() string {
+	if dir := os.Getenv("BORG_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("BORG_BASE_DIR"); dir != "" {
+		return filepath.Join(dir, ".cache", "borg")
+	}
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "borg")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".cache", "borg")
+}
+
+// autoExcludes returns the --exclude patterns for the repository and the
+// borg cache if they live on one of the sources.
+func (b BorgBackup) autoExcludes() []string {
+	var patterns []string
+	if b.noAutoExcludeRepo {
+		return patterns
+	}
+	type candidate struct{ what, path string }
+	var candidates []candidate
+	repos := []string{b.repo}
+	for _, t := range b.repos {
+		if t.Repo != b.repo {
+			repos = append(repos, t.Repo)
+		}
+	}
+	for _, repo := range repos {
+		if path, ok := localRepoPath(repo); ok {
+			candidates = append(candidates, candidate{"repository", path})
+		}
+	}
+	if cache := borgCacheDir(); cache != "" {
+		candidates = append(candidates, candidate{"borg cache", cache})
+	}
+	for _, c := range candidates {
+		translated, source, ok := b.mountedPath(c.path)
+		if !ok {
+			continue
+		}
+		b.logf(LevelInfo, "Excluding the %s %s (on source %s) from the archive", c.what, c.path, source)
+		patterns = append(patterns, "pf:"+translated)
+	}
+	return patterns
+}
+
+type nestedPath struct {
+	path   string // a source or mountpoint
+	what   string
+	parent int // index of the source containing path
+}
+
+// nestedPaths finds the sources and mountpoints that lie inside the tree of
+// another source, which would otherwise end up in its archive tree as well.
+func nestedPaths(sources []string, mountpoints []string) []nestedPath {
+	var nested []nestedPath
+	for i, parent := range sources {
+		parent = filepath.Clean(parent)
+		for j := range sources {
+			if j == i {
+				continue
+			}
+			for _, c := range []nestedPath{{path: sources[j], what: "source"}, {path: mountpoints[j], what: "mountpoint"}} {
+				path := filepath.Clean(c.path)
+				if path == parent || !isWithin(path, parent) {
+					continue
+				}
+				if c.what == "mountpoint" && path == filepath.Clean(sources[j]) {
+					// already covered as a source
+					continue
+				}
+				nested = append(nested, nestedPath{path: path, what: c.what, parent: i})
+			}
+		}
+	}
+	return nested
+}
+
+// WarnNestedPaths logs a warning to logger for every source or mountpoint
+// inside another source.
+func WarnNestedPaths(sources []string, mountpoints []string, logger Logger) {
+	log := newRunLog(logger)
+	for _, n := range nestedPaths(sources, mountpoints) {
+		log.logf(LevelWarn, "%s %s is inside source %s", n.what, n.path, sources[n.parent])
+	}
+}
+
+// nestedExcludes returns the --exclude patterns that keep nested sources and
+// mountpoints out of the tree of the source containing them.
+func (b BorgBackup) nestedExcludes() []string {
+	var patterns []string
+	if b.noAutoExcludeNested {
+		return patterns
+	}
+	for _, n := range nestedPaths(b.sources, b.mountpoints) {
+		rel, err := filepath.Rel(filepath.Clean(b.sources[n.parent]), n.path)
+		if err != nil {
+			continue
+		}
+		translated := filepath.Join(b.mountpoints[n.parent], rel)
+		b.logf(LevelInfo, "Excluding %s %s from the tree of source %s", n.what, n.path, b.sources[n.parent])
+		patterns = append(patterns, "pf:"+translated)
+	}
+	return patterns
+}
+
+// checkExcludeSources makes sure every path excluded with -exclude-source
+// or an absolute -exclude is inside a source.
+func (b BorgBackup) checkExcludeSources() error {
+	for _, path := range b.excludeSources {
+		if !filepath.IsAbs(path) {
+			return errors.Errorf("excluded path %s is not an absolute path", path)
+		}
+		if _, _, ok := b.mountedPath(path); !ok {
+			return errors.Errorf("excluded path %s is not inside any source", path)
+		}
+	}
+	return nil
+}
+
+// sourceExcludes translates the paths given with -exclude-source to anchored
+// patterns below the mountpoints. Paths outside of all sources are an error.
+func (b BorgBackup) sourceExcludes() ([]string, error) {
+	if err := b.checkExcludeSources(); err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, path := range b.excludeSources {
+		translated, source, _ := b.mountedPath(path)
+		b.logf(LevelInfo, "Excluding %s (on source %s) from the archive as pf:%s", path, source, translated)
+		patterns = append(patterns, "pf:"+translated)
+	}
+	return patterns, nil
+}
+
+// a -exclude in one of borg's pattern styles is passed to borg as it is
+var borgPatternStyleRegexp = regexp.MustCompile(`^(fm|sh|re|pp|pf):`)
+
+// resolveExcludes splits the values of -exclude into paths on the live
+// filesystem, translated like -exclude-source, and borg patterns. Relative
+// paths are taken relative to every source.
+func resolveExcludes(sources []string, excludes []string) (paths []string, patterns []string) {
+	for _, exclude := range excludes {
+		switch {
+		case borgPatternStyleRegexp.MatchString(exclude):
+			patterns = append(patterns, exclude)
+		case filepath.IsAbs(exclude):
+			paths = append(paths, filepath.Clean(exclude))
+		default:
+			for _, source := range sources {
+				paths = append(paths, filepath.Join(source, exclude))
+			}
+		}
+	}
+	return paths, patterns
+}
+
+// ReadExcludeFile reads the -exclude values in path for -exclude-from, one
+// per line. Empty lines and lines starting with # are skipped.
+func ReadExcludeFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error while reading exclude file")
+	}
+	defer f.Close()
+	var excludes []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		excludes = append(excludes, line)
+	}
+	return excludes, errors.Wrapf(sc.Err(), "error while reading exclude file %s", path)
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sourceFailures records the sources that failed during the snapshot or
+// mount phase with -continue-on-error, or at any point with
+// -separate-archives. A nil sourceFailures records nothing.
+type sourceFailures struct {
+	mu     sync.Mutex
+	errors map[int]error
+}
+
+func newSourceFailures() *sourceFailures {
+	return &sourceFailures{errors: map[int]error{}}
+}
+
+func (f *sourceFailures) add(i int, err error) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[i] = err
+}
+
+func (f *sourceFailures) has(i int) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.errors[i]
+	return ok
+}
+
+// get returns the error the i-th source failed with, nil if it didn't.
+func (f *sourceFailures) get(i int) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.errors[i]
+}
+
+func (f *sourceFailures) reset() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors = map[int]error{}
+}
+
+// partialError summarizes the failed sources, nil if there are none.
+func (f *sourceFailures) partialError(sources []string) *PartialError {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.errors) == 0 {
+		return nil
+	}
+	indexes := make([]int, 0, len(f.errors))
+	for i := range f.errors {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	p := &PartialError{}
+	for _, i := range indexes {
+		p.Failed = append(p.Failed, sources[i])
+		p.Errors = append(p.Errors, f.errors[i])
+	}
+	return p
+}
+
+// PartialError is returned by Run when the backup succeeded, but some
+// sources were left out with -continue-on-error, or some of several
+// repositories failed.
+type PartialError struct {
+	Failed       []string
+	Errors       []error
+	Repositories bool // Failed lists repositories instead of sources
+}
+
+func (p *PartialError) Error() string {
+	var sb strings.Builder
+	what := "source(s)"
+	if p.Repositories {
+		what = "repositories"
+	}
+	fmt.Fprintf(&sb, "partial success, %d %s failed:", len(p.Failed), what)
+	for i, source := range p.Failed {
+		fmt.Fprintf(&sb, "\n  %s: %v", source, p.Errors[i])
+	}
+	return sb.String()
+}
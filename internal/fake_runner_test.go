@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fakeRunner is a Runner that records the commands it gets instead of
+// running them, and answers them with respond.
+type fakeRunner struct {
+	respond func(call *fakeCall) fakeResult
+
+	mu     sync.Mutex
+	calls  []*fakeCall
+	events []string
+}
+
+// fakeCall is a command the fakeRunner got.
+type fakeCall struct {
+	name string // without its directory
+	args []string
+	opts RunOptions
+	// what the command read from opts.ExtraFiles, such as the passphrase
+	extraFiles []string
+	// the context of Run was already done when the command ran
+	cancelled bool
+}
+
+func (c *fakeCall) String() string {
+	return strings.Join(append([]string{c.name}, c.args...), " ")
+}
+
+// has tells whether the command is name, with args among its arguments in
+// that order.
+func (c *fakeCall) has(name string, args ...string) bool {
+	if c.name != name {
+		return false
+	}
+	rest := c.args
+	for _, arg := range args {
+		for len(rest) > 0 && rest[0] != arg {
+			rest = rest[1:]
+		}
+		if len(rest) == 0 {
+			return false
+		}
+		rest = rest[1:]
+	}
+	return true
+}
+
+// fakeResult is how a faked command behaves.
+type fakeResult struct {
+	stdout string
+	stderr string
+	exit   int
+	// a started command runs until it gets a signal or until release is
+	// closed, one that is run until release is closed or its context is
+	// done
+	release chan struct{}
+	// called while the command runs
+	during func()
+}
+
+// fakeExitError is the error of a faked command that failed.
+type fakeExitError int
+
+func (e fakeExitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e fakeExitError) ExitCode() int { return int(e) }
+
+func (r *fakeRunner) record(name string, args []string, opts RunOptions) (*fakeCall, fakeResult) {
+	call := &fakeCall{name: filepath.Base(name), args: args, opts: opts}
+	for _, f := range opts.ExtraFiles {
+		// the write end is closed once the command started
+		data, _ := ioutil.ReadAll(f)
+		call.extraFiles = append(call.extraFiles, string(data))
+	}
+	r.mu.Lock()
+	r.calls = append(r.calls, call)
+	r.events = append(r.events, call.String())
+	r.mu.Unlock()
+	var res fakeResult
+	if r.respond != nil {
+		res = r.respond(call)
+	}
+	return call, res
+}
+
+// event records something that happened besides the commands, such as an
+// unmount.
+func (r *fakeRunner) event(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+// log returns the events that start with one of prefixes, in order.
+func (r *fakeRunner) log(prefixes ...string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var log []string
+	for _, e := range r.events {
+		for _, p := range prefixes {
+			if strings.HasPrefix(e, p) {
+				log = append(log, e)
+				break
+			}
+		}
+	}
+	return log
+}
+
+// find returns the first command that has name and args, see fakeCall.has.
+func (r *fakeRunner) find(name string, args ...string) *fakeCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, call := range r.calls {
+		if call.has(name, args...) {
+			return call
+		}
+	}
+	return nil
+}
+
+func (r *fakeRunner) Run(ctx context.Context, name string, args []string, opts RunOptions) ([]byte, []byte, error) {
+	call, res := r.record(name, args, opts)
+	r.mu.Lock()
+	call.cancelled = ctx.Err() != nil
+	r.mu.Unlock()
+	if res.during != nil {
+		res.during()
+	}
+	if res.release != nil {
+		select {
+		case <-res.release:
+		case <-ctx.Done():
+			// like exec.CommandContext killing the command
+			r.event("killed %s", call.name)
+			return nil, nil, ctx.Err()
+		}
+	}
+	write(opts.Stdout, res.stdout)
+	write(opts.Stderr, res.stderr)
+	if res.exit != 0 {
+		return []byte(res.stdout), []byte(res.stderr), fakeExitError(res.exit)
+	}
+	return []byte(res.stdout), []byte(res.stderr), nil
+}
+
+func (r *fakeRunner) Start(name string, args []string, opts RunOptions) (Process, error) {
+	call, res := r.record(name, args, opts)
+	return &fakeProcess{runner: r, call: call, res: res, signals: make(chan os.Signal, 8), exit: -1}, nil
+}
+
+func write(w io.Writer, s string) {
+	if w != nil && s != "" {
+		io.WriteString(w, s)
+	}
+}
+
+// fakeProcess is a command started by a fakeRunner. It exits with 2 on its
+// first signal, like borg on SIGINT.
+type fakeProcess struct {
+	runner  *fakeRunner
+	call    *fakeCall
+	res     fakeResult
+	signals chan os.Signal
+
+	mu   sync.Mutex
+	exit int
+}
+
+func (p *fakeProcess) Signal(sig os.Signal) error {
+	p.runner.event("signal %s %v", p.call.name, sig)
+	select {
+	case p.signals <- sig:
+	default:
+	}
+	return nil
+}
+
+func (p *fakeProcess) Wait() error {
+	if p.res.during != nil {
+		p.res.during()
+	}
+	exit := p.res.exit
+	if p.res.release != nil {
+		select {
+		case <-p.res.release:
+		case <-p.signals:
+			exit = 2
+		}
+	}
+	write(p.call.opts.Stdout, p.res.stdout)
+	write(p.call.opts.Stderr, p.res.stderr)
+	p.mu.Lock()
+	p.exit = exit
+	p.mu.Unlock()
+	if exit != 0 {
+		return fakeExitError(exit)
+	}
+	return nil
+}
+
+func (p *fakeProcess) ExitCode() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.exit
+}
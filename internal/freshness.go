@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// format of the archive times in `borg list --json`, which are local time
+const borgTimeFormat = "2006-01-02T15:04:05.000000"
+
+// Freshness is the newest successful backup found by CheckFreshness.
+type Freshness struct {
+	Archive string
+	Time    time.Time
+	Source  string // where it was found: the state file or the repository
+}
+
+// FreshnessOptions configure CheckFreshness.
+type FreshnessOptions struct {
+	StateFile string
+	MaxAge    time.Duration
+	Hostname  string // empty for the one in the state file, or else this Mac's
+	// BackupName is the -backup-name of the backups, empty for
+	// DefaultArchiveTemplate
+	BackupName string
+	// Sources are the sources whose -separate-archives count, empty for all
+	Sources []string
+}
+
+// CheckFreshness finds the newest successful backup of this host. The state
+// file is consulted first; only if it is missing or older than MaxAge, the
+// repository is asked with `borg list` for the archives named after the
+// archive template, with or without -separate-archives. It never takes the
+// lock and needs no privileges beyond reading the state file and the
+// repository.
+func CheckFreshness(ctx context.Context, opts FreshnessOptions) (Freshness, error) {
+	b := BorgBackup{umask: -1, backupName: opts.BackupName}
+	if b.backupName == "" {
+		b.backupName = DefaultArchiveTemplate
+	}
+	if err := validateArchiveTemplate(b.backupName); err != nil {
+		return Freshness{}, err
+	}
+	stateFile, hostname := opts.StateFile, opts.Hostname
+	st, err := loadState(stateFile)
+	if err != nil {
+		b.logf(LevelWarn, "%v", err)
+	}
+	if !st.LastSuccess.IsZero() && time.Since(st.LastSuccess) <= opts.MaxAge {
+		return Freshness{Archive: st.LastArchive, Time: st.LastSuccess, Source: stateFile}, nil
+	}
+	if hostname == "" {
+		hostname = st.Hostname
+	}
+	if hostname == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return Freshness{}, errors.Wrap(err, "error while getting hostname")
+		}
+		hostname = NormalizeHostname(name)
+	}
+	if os.Getenv("BORG_REPO") == "" {
+		if st.LastSuccess.IsZero() {
+			return Freshness{}, errors.New("no successful backup recorded in the state file and BORG_REPO is not set")
+		}
+		return Freshness{Archive: st.LastArchive, Time: st.LastSuccess, Source: stateFile}, nil
+	}
+
+	if !strings.Contains(b.backupName, "{hostname}") {
+		return Freshness{}, errors.Errorf("-backup-name %q has no {hostname}, the archives of host %s can't be told apart", b.backupName, hostname)
+	}
+	var slugs []string
+	if len(opts.Sources) > 0 {
+		slugs = sourcePrefixes(opts.Sources)
+	}
+	globs := b.hostArchiveGlobs(hostname, slugs)
+	// one glob for all of them, borg takes only one
+	listGlob := strings.TrimSuffix(archiveGlob(b.backupName, hostname), "*") + "*"
+	out, err := b.borgOutput(ctx, "list", "--json", "--glob-archives", listGlob)
+	if err != nil {
+		return Freshness{}, errors.Wrap(err, "error while listing archives")
+	}
+	var list struct {
+		Archives []struct {
+			Name string `json:"name"`
+			Time string `json:"time"`
+		} `json:"archives"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return Freshness{}, errors.Wrap(err, "error while parsing borg list output")
+	}
+	found := Freshness{Archive: st.LastArchive, Time: st.LastSuccess, Source: stateFile}
+	for _, a := range list.Archives {
+		if !matchesAny(globs, a.Name) {
+			continue
+		}
+		t, err := time.ParseInLocation(borgTimeFormat, a.Time, time.Local)
+		if err != nil {
+			return Freshness{}, errors.Wrapf(err, "error while parsing the time of archive %s", a.Name)
+		}
+		if t.After(found.Time) {
+			found = Freshness{Archive: a.Name, Time: t, Source: "repository"}
+		}
+	}
+	if found.Time.IsZero() {
+		return found, errors.Errorf("no archive of host %s found", hostname)
+	}
+	return found, nil
+}
+
+func matchesAny(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
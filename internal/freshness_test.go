@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBorgList puts a borg in PATH that lists archives, printed in borg's
+// JSON, and records its arguments in the returned file.
+func fakeBorgList(t *testing.T, archives string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + args + "\ncat <<'EOF'\n{\"archives\": [" + archives + "]}\nEOF\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "borg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldPath, oldRepo := os.Getenv("PATH"), os.Getenv("BORG_REPO")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	os.Setenv("BORG_REPO", "/backups/a")
+	t.Cleanup(func() {
+		os.Setenv("PATH", oldPath)
+		os.Setenv("BORG_REPO", oldRepo)
+		os.RemoveAll(dir)
+	})
+	return args
+}
+
+func TestCheckFreshnessFromTheRepository(t *testing.T) {
+	day := time.Now().Add(-24 * time.Hour).Format(borgTimeFormat)
+	hour := time.Now().Add(-time.Hour).Format(borgTimeFormat)
+	minute := time.Now().Add(-time.Minute).Format(borgTimeFormat)
+	tests := []struct {
+		name       string
+		archives   string
+		backupName string
+		sources    []string
+		want       string // archive, empty for none
+		glob       string
+	}{
+		{
+			name:     "archives of all sources",
+			archives: `{"name": "2024-01-01-000000@mac", "time": "` + day + `"}, {"name": "2024-01-02-000000@mac", "time": "` + hour + `"}`,
+			want:     "2024-01-02-000000@mac", glob: "*@mac*",
+		},
+		{
+			name:     "separate archives",
+			archives: `{"name": "2024-01-01-000000@mac", "time": "` + day + `"}, {"name": "2024-01-02-000000@mac-data", "time": "` + hour + `"}`,
+			want:     "2024-01-02-000000@mac-data", glob: "*@mac*",
+		},
+		{
+			name:     "separate archives of the given sources",
+			archives: `{"name": "2024-01-02-000000@mac-root", "time": "` + hour + `"}, {"name": "2024-01-03-000000@mac-mini-root", "time": "` + minute + `"}`,
+			sources:  []string{"/"},
+			want:     "2024-01-02-000000@mac-root", glob: "*@mac*",
+		},
+		{
+			name:     "another host",
+			archives: `{"name": "2024-01-02-000000@nas", "time": "` + hour + `"}, {"name": "2024-01-02-000000@macbook", "time": "` + hour + `"}`,
+			glob:     "*@mac*",
+		},
+		{
+			name:       "custom archive names",
+			archives:   `{"name": "mac-2024-01-02", "time": "` + hour + `"}, {"name": "mac-2024-01-02-data", "time": "` + minute + `"}`,
+			backupName: "{hostname}-{now:2006-01-02}",
+			want:       "mac-2024-01-02-data", glob: "mac-*",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := fakeBorgList(t, tt.archives)
+			found, err := CheckFreshness(context.Background(), FreshnessOptions{
+				StateFile:  filepath.Join(filepath.Dir(args), "state.json"),
+				MaxAge:     36 * time.Hour,
+				Hostname:   "mac",
+				BackupName: tt.backupName,
+				Sources:    tt.sources,
+			})
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("found %+v, want none", found)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if found.Archive != tt.want || found.Source != "repository" {
+				t.Errorf("found %+v, want archive %s in the repository", found, tt.want)
+			}
+			data, err := ioutil.ReadFile(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), "--glob-archives "+tt.glob+"\n") {
+				t.Errorf("borg ran with %q, want --glob-archives %s", data, tt.glob)
+			}
+		})
+	}
+}
+
+func TestCheckFreshnessNeedsTheHostname(t *testing.T) {
+	fakeBorgList(t, "")
+	_, err := CheckFreshness(context.Background(), FreshnessOptions{StateFile: "/nonexistent/state.json", Hostname: "mac", BackupName: "{now}"})
+	if err == nil || !strings.Contains(err.Error(), "{hostname}") {
+		t.Errorf("got %v, want an error about the missing {hostname}", err)
+	}
+}
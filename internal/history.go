@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how many runs per label are kept in the history file
+const maxHistoryPerLabel = 50
+
+// how many recent runs are used as the baseline for anomaly detection, and how
+// many are needed before we start comparing at all
+const (
+	anomalyBaselineRuns = 10
+	anomalyMinRuns      = 3
+)
+
+// archiveStats is the subset of the archive stats that `borg create --json` prints.
+type archiveStats struct {
+	OriginalSize     int64 `json:"original_size"`
+	CompressedSize   int64 `json:"compressed_size"`
+	DeduplicatedSize int64 `json:"deduplicated_size"`
+	NFiles           int64 `json:"nfiles"`
+}
+
+type historyEntry struct {
+	Label            string    `json:"label"`
+	Archive          string    `json:"archive"`
+	Time             time.Time `json:"time"`
+	OriginalSize     int64     `json:"original_size"`
+	DeduplicatedSize int64     `json:"deduplicated_size"`
+	// only recorded with -record-changes
+	Changes *changeCounts `json:"changes,omitempty"`
+}
+
+type history struct {
+	Entries []historyEntry `json:"entries"`
+}
+
+// DefaultHistoryFile returns the history file of backups to repo.
+func DefaultHistoryFile(repo string) string {
+	return filepath.Join(stateDir, "history-"+repoHash(repo)+".json")
+}
+
+func loadHistory(path string) (history, error) {
+	var h history
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return h, errors.Wrap(err, "error while reading history file")
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		return h, errors.Wrap(err, "error while parsing history file")
+	}
+	return h, nil
+}
+
+func (h history) save(path string) error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error while encoding history file")
+	}
+	return writeFileAtomic(path, data)
+}
+
+// recent returns up to n of the most recent entries recorded for label.
+func (h history) recent(label string, n int) []historyEntry {
+	var entries []historyEntry
+	for i := len(h.Entries) - 1; i >= 0 && len(entries) < n; i-- {
+		if h.Entries[i].Label == label {
+			entries = append(entries, h.Entries[i])
+		}
+	}
+	return entries
+}
+
+// add appends entry and drops the oldest entries of its label beyond maxHistoryPerLabel.
+func (h *history) add(entry historyEntry) {
+	h.Entries = append(h.Entries, entry)
+	count := 0
+	kept := make([]historyEntry, 0, len(h.Entries))
+	for i := len(h.Entries) - 1; i >= 0; i-- {
+		e := h.Entries[i]
+		if e.Label == entry.Label {
+			count++
+			if count > maxHistoryPerLabel {
+				continue
+			}
+		}
+		kept = append(kept, e)
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	h.Entries = kept
+}
+
+func median(values []int64) int64 {
+	sorted := append([]int64(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// sizeAnomalies compares stats against the median of the recent runs of the
+// same label and returns a warning for every size that deviates by more than
+// factor in either direction.
+func sizeAnomalies(baseline []historyEntry, stats archiveStats, factor float64) []string {
+	var original, deduplicated []int64
+	for _, e := range baseline {
+		if e.OriginalSize == 0 {
+			// recorded without stats
+			continue
+		}
+		original = append(original, e.OriginalSize)
+		deduplicated = append(deduplicated, e.DeduplicatedSize)
+	}
+	if len(original) < anomalyMinRuns {
+		return nil
+	}
+	var warnings []string
+	check := func(what string, current int64, med int64) {
+		if med <= 0 {
+			return
+		}
+		ratio := float64(current) / float64(med)
+		if ratio > factor || ratio < 1/factor {
+			warnings = append(warnings, fmt.Sprintf("%s size %d differs from the median of the last %d runs (%d) by a factor of %.2f",
+				what, current, len(baseline), med, ratio))
+		}
+	}
+	check("original", stats.OriginalSize, median(original))
+	check("deduplicated", stats.DeduplicatedSize, median(deduplicated))
+	return warnings
+}
+
+// recordArchiveSize stores stats in the history file and warns about anomalies
+// compared to the previous runs of the same label.
+func (b BorgBackup) recordArchiveSize(archiveName string, stats *archiveStats, changes *changeCounts) error {
+	h, err := loadHistory(b.historyFile)
+	if err != nil {
+		return err
+	}
+	entry := historyEntry{
+		Label:   b.label,
+		Archive: archiveName,
+		Time:    time.Now(),
+		Changes: changes,
+	}
+	if stats != nil {
+		for _, warning := range sizeAnomalies(h.recent(b.label, anomalyBaselineRuns), *stats, b.sizeAnomalyFactor) {
+			b.logf(LevelWarn, "archive %s: %s", archiveName, warning)
+		}
+		entry.OriginalSize = stats.OriginalSize
+		entry.DeduplicatedSize = stats.DeduplicatedSize
+	}
+	h.add(entry)
+	return h.save(b.historyFile)
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultHookTimeout is after how long the Hooks commands are killed.
+const DefaultHookTimeout = 5 * time.Minute
+
+// Hooks are commands run with sh around the phases of a run, e.g. to stop a
+// database while its snapshot is created. Empty commands are skipped.
+type Hooks struct {
+	// right before the snapshots are created, a failure aborts the run
+	PreSnapshot string
+	// right after the snapshots were created, even if that failed
+	PostSnapshot string
+	// right before borg create, a failure aborts the run
+	PreBorg string
+	// at the end of every run, with BORG_TM_STATUS, BORG_TM_ARCHIVE and
+	// BORG_TM_ERROR
+	PostRun string
+	Timeout time.Duration
+}
+
+// runPhaseHook runs the hook command of phase with the extra environment
+// variables env. Its output is logged once it is done. The post hooks are
+// run with context.Background(), so that they also run after an interrupt.
+func (b BorgBackup) runPhaseHook(ctx context.Context, phase string, command string, env ...string) error {
+	if command == "" {
+		return nil
+	}
+	b.logf(LevelInfo, "Running the %s hook", phase)
+	if b.dryRun {
+		b.logf(LevelInfo, "sh -c %q", command)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, b.hooks.Timeout)
+	defer cancel()
+	cmd := exec.Command("/bin/sh", "-c", command)
+	out := new(bytes.Buffer)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Env = append(safeEnvs(), env...)
+	// in its own process group, so that a timeout also kills what sh
+	// started, which would keep the output open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "error while starting the %s hook", phase)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+		if line != "" {
+			b.logf(LevelInfo, "%s hook: %s", phase, line)
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("the %s hook %q timed out after %s", phase, command, b.hooks.Timeout)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "the %s hook %q failed", phase, command)
+	}
+	b.logf(LevelDebug, "The %s hook finished in %s", phase, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// runPostRunHook tells the post-run hook how the run went.
+func (b BorgBackup) runPostRunHook(report Report, runErr error) {
+	status, msg := "success", ""
+	if runErr != nil {
+		status, msg = "failure", runErr.Error()
+	}
+	archive := report.Archive
+	if len(report.Archives) > 0 {
+		// -separate-archives
+		archive = report.archiveNames()
+	}
+	err := b.runPhaseHook(context.Background(), "post-run", b.hooks.PostRun,
+		"BORG_TM_STATUS="+status, "BORG_TM_ARCHIVE="+archive, "BORG_TM_ERROR="+msg)
+	if err != nil {
+		b.logf(LevelError, "%v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NormalizeHostname lowercases name and strips the ".local" suffix that
+// macOS adds for Bonjour names, so archive names stay stable.
+func NormalizeHostname(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.TrimSuffix(name, ".local")
+}
+
+// resolveHostname returns the hostname used in archive names: -hostname if
+// given, otherwise the normalized os.Hostname(). It warns when it differs
+// from the one recorded by the previous run.
+func (b BorgBackup) resolveHostname(st runState) (string, error) {
+	hostName := b.hostname
+	if hostName == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return "", errors.Wrap(err, "error while getting hostname")
+		}
+		hostName = NormalizeHostname(name)
+	}
+	if st.Hostname != "" && st.Hostname != hostName {
+		b.logf(LevelWarn, "hostname changed from %q (previous run) to %q, archive names will change too. Use -hostname %s to keep the old name.",
+			st.Hostname, hostName, st.Hostname)
+	}
+	b.logf(LevelInfo, "Using hostname %s", hostName)
+	return hostName, nil
+}
@@ -0,0 +1,27 @@
+package internal
+
+import (
+	"os/exec"
+)
+
+// I/O policies for the borg child, see taskpolicy(8)
+const (
+	IOPolicyStandard = "standard"
+	IOPolicyThrottle = "throttle"
+)
+
+// wrapIOPolicy returns the argv that runs name with args under the configured
+// I/O policy. Throttling launches the command through `taskpolicy -d throttle`;
+// if taskpolicy isn't available the command runs with the standard policy.
+func (b BorgBackup) wrapIOPolicy(name string, args []string) []string {
+	argv := append([]string{name}, args...)
+	if b.ioPolicy != IOPolicyThrottle {
+		return argv
+	}
+	taskpolicy, err := exec.LookPath("taskpolicy")
+	if err != nil {
+		b.logf(LevelWarn, "taskpolicy not found, running borg with the standard I/O policy")
+		return argv
+	}
+	return append([]string{taskpolicy, "-d", "throttle"}, argv...)
+}
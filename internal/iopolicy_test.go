@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeTaskpolicy puts a taskpolicy in a PATH of its own, or none, and
+// returns its path.
+func fakeTaskpolicy(t *testing.T, installed bool) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskpolicy := filepath.Join(dir, "taskpolicy")
+	if installed {
+		if err := ioutil.WriteFile(taskpolicy, []byte("#!/bin/sh\nexec \"$@\"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir)
+	t.Cleanup(func() {
+		os.Setenv("PATH", oldPath)
+		os.RemoveAll(dir)
+	})
+	return taskpolicy
+}
+
+func TestWrapIOPolicy(t *testing.T) {
+	args := []string{"create", "::archive", "/tmp/snapshot"}
+	tests := []struct {
+		name       string
+		policy     string
+		taskpolicy bool // installed
+		want       []string
+		warning    bool
+	}{
+		{"standard", IOPolicyStandard, true, []string{"borg", "create", "::archive", "/tmp/snapshot"}, false},
+		{"throttle", IOPolicyThrottle, true, []string{"TASKPOLICY", "-d", "throttle", "borg", "create", "::archive", "/tmp/snapshot"}, false},
+		{"throttle without taskpolicy", IOPolicyThrottle, false, []string{"borg", "create", "::archive", "/tmp/snapshot"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskpolicy := fakeTaskpolicy(t, tt.taskpolicy)
+			log := new(bytes.Buffer)
+			b, err := NewBackup(validOptions(WithIOPolicy(tt.policy))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.log = newRunLog(NewTextLogger(log, LevelWarn))
+			want := append([]string(nil), tt.want...)
+			if want[0] == "TASKPOLICY" {
+				want[0] = taskpolicy
+			}
+			if got := b.wrapIOPolicy("borg", args); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if warned := strings.Contains(log.String(), "taskpolicy not found"); warned != tt.warning {
+				t.Errorf("warned %v, want %v: %q", warned, tt.warning, log)
+			}
+		})
+	}
+}
+
+func TestUsageName(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"/usr/local/bin/borg", []string{"create"}, "borg"},
+		{"/usr/sbin/taskpolicy", []string{"-d", "throttle", "/usr/local/bin/borg", "create"}, "borg"},
+		{"taskpolicy", []string{"-d"}, "taskpolicy"},
+	}
+	for _, tt := range tests {
+		if got := usageName(tt.name, tt.args); got != tt.want {
+			t.Errorf("usageName(%q, %q) = %q, want %q", tt.name, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestRunThrottlesBorgCreate(t *testing.T) {
+	log := new(bytes.Buffer)
+	b, env := newFakeBackup(t, func(call *fakeCall) (fakeResult, bool) {
+		return fakeResult{}, call.has("taskpolicy", "-d", "throttle", "borg", "create")
+	}, WithIOPolicy(IOPolicyThrottle), WithLogger(NewTextLogger(log, LevelInfo)))
+	if err := ioutil.WriteFile(filepath.Join(env.dir, "bin", "taskpolicy"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	create := env.runner.find("taskpolicy")
+	if create == nil || !reflect.DeepEqual(create.args[:4], []string{"-d", "throttle", "borg", "create"}) {
+		t.Fatalf("ran %v, want borg create under taskpolicy -d throttle", env.runner.log("taskpolicy", "borg"))
+	}
+	if env.runner.find("borg", "create") != nil {
+		t.Error("borg create also ran without taskpolicy")
+	}
+	// only borg create reads the snapshots
+	for _, call := range env.runner.calls {
+		if call.name == "taskpolicy" && call != create {
+			t.Errorf("%s runs under taskpolicy", call)
+		}
+	}
+	if !strings.Contains(log.String(), "I/O policy for borg: throttle") {
+		t.Errorf("the log doesn't have the I/O policy:\n%s", log)
+	}
+}
@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultJournalFile returns the journal of backups to repo.
+func DefaultJournalFile(repo string) string {
+	return filepath.Join(stateDir, "journal-"+repoHash(repo)+".json")
+}
+
+// version of the journal format. Newer fields are ignored by older binaries,
+// a newer version is only warned about.
+const journalVersion = 1
+
+type journalSnapshot struct {
+	Source   string `json:"source"`
+	Snapshot string `json:"snapshot"`
+}
+
+// runJournal records the snapshots a run created and the mountpoints it
+// mounted them on while it goes, so that `borg-tm cleanup` can undo what a
+// crashed run left behind. A nil journal ignores everything.
+type runJournal struct {
+	mu        sync.Mutex
+	path      string
+	log       *runLog
+	Version   int               `json:"version"`
+	PID       int               `json:"pid"`
+	Started   time.Time         `json:"started"`
+	Phase     string            `json:"phase"`
+	Snapshots []journalSnapshot `json:"snapshots"`
+	Mounted   []string          `json:"mounted"`
+}
+
+func loadJournal(path string, log *runLog) (*runJournal, error) {
+	j := &runJournal{path: path, log: log}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error while reading journal")
+	}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, errors.Wrapf(err, "error while parsing journal %s", path)
+	}
+	if j.Version > journalVersion {
+		log.logf(LevelWarn, "journal %s has version %d, newer than this borg-tm (%d), using the fields it knows", path, j.Version, journalVersion)
+	}
+	return j, nil
+}
+
+// start begins the journal of a new run. What an earlier run left in it is
+// kept, so that it can still be cleaned up.
+func (j *runJournal) start() {
+	j.update(func() {
+		j.PID = os.Getpid()
+		j.Started = time.Now()
+		j.Phase = "start"
+	})
+}
+
+// describe names the run that wrote the journal and what it left behind.
+func (j *runJournal) describe() string {
+	return fmt.Sprintf("the run with PID %d started %s (phase %s) left %d snapshot(s) and %d mount(s) behind",
+		j.PID, j.Started.Format("2006-01-02T15:04"), j.Phase, len(j.Snapshots), len(j.Mounted))
+}
+
+func (j *runJournal) empty() bool {
+	return len(j.Snapshots) == 0 && len(j.Mounted) == 0
+}
+
+// save writes the journal, or removes it when there is nothing in it. The
+// caller holds mu or is the only user.
+func (j *runJournal) save() error {
+	if j.empty() && j.Phase == "" {
+		err := os.Remove(j.path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return errors.Wrapf(err, "error while removing journal %s", j.path)
+	}
+	j.Version = journalVersion
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error while encoding journal")
+	}
+	return writeFileAtomic(j.path, data)
+}
+
+// update changes the journal and saves it. Failing to save is only logged,
+// the journal is a safety net for the backup and mustn't break it.
+func (j *runJournal) update(change func()) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	change()
+	if err := j.save(); err != nil {
+		j.log.logf(LevelWarn, "%v", err)
+	}
+}
+
+func (j *runJournal) setPhase(phase string) {
+	j.update(func() { j.Phase = phase })
+}
+
+func (j *runJournal) snapshotCreated(source string, snapshot string) {
+	j.update(func() { j.Snapshots = append(j.Snapshots, journalSnapshot{source, snapshot}) })
+}
+
+func (j *runJournal) snapshotRemoved(source string, snapshot string) {
+	j.update(func() {
+		for i, s := range j.Snapshots {
+			if s.Source == source && s.Snapshot == snapshot {
+				j.Snapshots = append(j.Snapshots[:i], j.Snapshots[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// has reports whether snapshot of source was created by a journalled run.
+func (j *runJournal) has(source string, snapshot string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, s := range j.Snapshots {
+		if s.Source == source && s.Snapshot == snapshot {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *runJournal) mounted(mountpoint string) {
+	j.update(func() { j.Mounted = append(j.Mounted, mountpoint) })
+}
+
+func (j *runJournal) unmounted(mountpoint string) {
+	j.update(func() {
+		for i, m := range j.Mounted {
+			if m == mountpoint {
+				j.Mounted = append(j.Mounted[:i], j.Mounted[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// finish ends the run in the journal. Snapshots kept on purpose are
+// forgotten; the file is removed unless something was left behind.
+func (j *runJournal) finish(keepSnapshots bool) {
+	j.update(func() {
+		if keepSnapshots {
+			j.Snapshots = nil
+		}
+		j.Phase = ""
+		if !j.empty() {
+			j.Phase = "finished"
+		}
+	})
+}
+
+// isMountpoint is IsMountpoint, replaced by the tests
+var isMountpoint = IsMountpoint
+
+// recoverJournal unmounts the mounts and removes the snapshots left in
+// b.journal. Entries that are already gone are dropped, so it can be
+// repeated; the error lists what is still left.
+func (b BorgBackup) recoverJournal(ctx context.Context) error {
+	j := b.journal
+	var failed []string
+	for _, mountpoint := range append([]string(nil), j.Mounted...) {
+		i := b.mountpointIndex(mountpoint)
+		if !isMountpoint(mountpoint) {
+			b.logEntryf(b.sourceEntry(i, LevelWarn), "Recovery: %s is no longer mounted", mountpoint)
+			j.unmounted(mountpoint)
+			continue
+		}
+		b.logEntryf(b.sourceEntry(i, LevelWarn), "Recovery: unmounting %s", mountpoint)
+		cleanupCtx, cancel := cleanupContext()
+		err := b.unmountRetrying(cleanupCtx, i, mountpoint)
+		cancel()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", mountpoint, err))
+		}
+	}
+	for _, s := range append([]journalSnapshot(nil), j.Snapshots...) {
+		if names, err := b.listSnapshots(ctx, s.Source); err == nil && !containsString(names, s.Snapshot) {
+			b.logf(LevelWarn, "Recovery: snapshot %s of %s is already gone", s.Snapshot, s.Source)
+			j.snapshotRemoved(s.Source, s.Snapshot)
+			continue
+		}
+		b.logf(LevelWarn, "Recovery: removing snapshot %s of %s", s.Snapshot, s.Source)
+		cleanupCtx, cancel := cleanupContext()
+		err := b.removeSnapshot(cleanupCtx, s.Snapshot, s.Source)
+		cancel()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s of %s: %v", s.Snapshot, s.Source, err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("recovery incomplete, run `borg-tm cleanup` again or clean up by hand:\n  %s", strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+// mountpointIndex returns the index of the source mounted on mountpoint, or
+// len(b.sources) if it isn't one of ours.
+func (b BorgBackup) mountpointIndex(mountpoint string) int {
+	for i, mp := range b.mountpoints {
+		if filepath.Clean(mp) == filepath.Clean(mountpoint) {
+			return i
+		}
+	}
+	return len(b.sources)
+}
+
+// CleanupOptions locate what `borg-tm cleanup` works on.
+type CleanupOptions struct {
+	JournalFile  string // empty for DefaultJournalFile of BORG_REPO
+	LockFile     string // empty for DefaultLockFile of BORG_REPO
+	SnapUtilPath string
+}
+
+// Cleanup unmounts the mounts and removes the snapshots a crashed run left
+// in its journal. It holds the lock, so it never touches a running backup,
+// and does nothing when nothing was left behind.
+func Cleanup(ctx context.Context, opts CleanupOptions) error {
+	repo := os.Getenv("BORG_REPO")
+	b := BorgBackup{
+		lockFile:          opts.LockFile,
+		snapUtilPath:      opts.SnapUtilPath,
+		unmountRetries:    defaultUnmountRetries,
+		unmountRetryDelay: defaultUnmountRetryDelay,
+	}
+	if b.lockFile == "" {
+		b.lockFile = DefaultLockFile(repo)
+	}
+	path := opts.JournalFile
+	if path == "" {
+		path = DefaultJournalFile(repo)
+	}
+	releaseLock, err := b.getFileLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer releaseLock()
+	j, err := loadJournal(path, b.log)
+	if err != nil {
+		return err
+	}
+	b.journal = j
+	if j.empty() {
+		b.logf(LevelInfo, "Nothing to clean up")
+		j.finish(false)
+		return nil
+	}
+	b.logf(LevelInfo, "Cleaning up: %s", j.describe())
+	if err := b.recoverJournal(ctx); err != nil {
+		return err
+	}
+	j.finish(false)
+	b.logf(LevelInfo, "Cleaned up")
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
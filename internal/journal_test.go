@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// an earlier run's snapshot
+const oldSnapshot = "com.borg-tm.1700000000"
+
+func writeJournal(t *testing.T, path string, j *runJournal) {
+	t.Helper()
+	j.Version = journalVersion
+	data, err := json.Marshal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeMounted makes mountpoints count as mounted until their unmount.
+func fakeMounted(t *testing.T, env *fakeBackupEnv, mountpoints ...string) {
+	old := isMountpoint
+	isMountpoint = func(path string) bool {
+		return containsString(mountpoints, path) && !containsString(env.runner.log("unmount"), "unmount "+path)
+	}
+	t.Cleanup(func() { isMountpoint = old })
+}
+
+func TestRunRecoversAnInterruptedRun(t *testing.T) {
+	tests := []struct {
+		name string
+		// where the earlier run was interrupted
+		phase   string
+		mounted bool
+		// the snapshot is already gone
+		gone        bool
+		noRecover   bool
+		removeFails bool
+		// what this run does before creating its snapshots
+		want []string
+		left bool // the earlier run is still in the journal
+	}{
+		{name: "creating snapshots", phase: "snapshot", want: []string{"snapUtil -d " + oldSnapshot}},
+		{name: "backing up", phase: "borg", mounted: true, want: []string{"unmount", "snapUtil -d " + oldSnapshot}},
+		{name: "after unmounting", phase: "cleanup", want: []string{"snapUtil -d " + oldSnapshot}},
+		{name: "snapshot removed by hand", phase: "cleanup", gone: true},
+		{name: "-no-auto-recover", phase: "borg", mounted: true, noRecover: true, left: true},
+		{name: "the snapshot can't be removed", phase: "cleanup", removeFails: true, want: []string{"snapUtil -d " + oldSnapshot}, left: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var env *fakeBackupEnv
+			b, env := newFakeBackup(t, func(call *fakeCall) (fakeResult, bool) {
+				switch {
+				case call.has("tmutil", "listlocalsnapshots") && tt.gone:
+					return fakeResult{stdout: tmutilListHeader + "disk /:\n"}, true
+				case call.has("snapUtil", "-d", oldSnapshot) && tt.removeFails:
+					return fakeResult{stderr: "snapUtil: Resource busy", exit: 1}, true
+				}
+				return fakeResult{}, false
+			}, WithAutoRecover(!tt.noRecover))
+			mountpoint := b.mountpoints[0]
+			earlier := &runJournal{PID: 1, Started: time.Now().Add(-time.Hour), Phase: tt.phase,
+				Snapshots: []journalSnapshot{{Source: env.source, Snapshot: oldSnapshot}}}
+			if tt.mounted {
+				earlier.Mounted = []string{mountpoint}
+				fakeMounted(t, env, mountpoint)
+			}
+			writeJournal(t, b.journalFile, earlier)
+			if _, err := b.Run(context.Background()); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+
+			var before []string
+			for _, e := range env.runner.log("unmount", "snapUtil") {
+				if strings.HasPrefix(e, "snapUtil -c") {
+					break
+				}
+				if e == "unmount "+mountpoint {
+					e = "unmount"
+				}
+				before = append(before, strings.TrimSuffix(e, " "+env.source))
+			}
+			if !reflect.DeepEqual(before, tt.want) {
+				t.Errorf("before the backup ran %v, want %v", before, tt.want)
+			}
+			j, err := loadJournal(b.journalFile, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if left := j.has(env.source, oldSnapshot); left != tt.left {
+				t.Errorf("the journal has %s, want the earlier snapshot kept %v", j.describe(), tt.left)
+			}
+			if tt.left != (j.Phase == "finished") {
+				t.Errorf("the journal has phase %q", j.Phase)
+			}
+		})
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// records how it was called
+	args := filepath.Join(dir, "args")
+	snapUtil := filepath.Join(dir, "snapUtil")
+	if err := ioutil.WriteFile(snapUtil, []byte("#!/bin/sh\necho \"$@\" >> "+args+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mountpoint := filepath.Join(dir, "snapshot")
+	var unmounted []string
+	oldUnmount, oldMounted := unmountFS, isMountpoint
+	unmountFS = func(target string, flags int) error {
+		unmounted = append(unmounted, target)
+		return nil
+	}
+	isMountpoint = func(path string) bool { return path == mountpoint && len(unmounted) == 0 }
+	defer func() { unmountFS, isMountpoint = oldUnmount, oldMounted }()
+	opts := CleanupOptions{
+		JournalFile:  filepath.Join(dir, "journal.json"),
+		LockFile:     filepath.Join(dir, "backup.lock"),
+		SnapUtilPath: snapUtil,
+	}
+
+	if err := Cleanup(context.Background(), opts); err != nil {
+		t.Fatalf("Cleanup without a journal: %v", err)
+	}
+	if _, err := os.Stat(opts.JournalFile); !os.IsNotExist(err) {
+		t.Errorf("Cleanup without a journal left %s: %v", opts.JournalFile, err)
+	}
+
+	writeJournal(t, opts.JournalFile, &runJournal{PID: 1, Phase: "borg",
+		Snapshots: []journalSnapshot{{Source: "/", Snapshot: oldSnapshot}, {Source: "/System/Volumes/Data", Snapshot: oldSnapshot}},
+		Mounted:   []string{mountpoint, filepath.Join(dir, "gone")}})
+	if err := Cleanup(context.Background(), opts); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if !reflect.DeepEqual(unmounted, []string{mountpoint}) {
+		t.Errorf("unmounted %v, want %s", unmounted, mountpoint)
+	}
+	data, err := ioutil.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-d " + oldSnapshot + " /\n-d " + oldSnapshot + " /System/Volumes/Data\n"; string(data) != want {
+		t.Errorf("snapUtil ran with\n%s\nwant\n%s", data, want)
+	}
+	if _, err := os.Stat(opts.JournalFile); !os.IsNotExist(err) {
+		t.Errorf("the journal is still there after the cleanup: %v", err)
+	}
+
+	// the journal of a running backup isn't touched
+	writeJournal(t, opts.JournalFile, &runJournal{PID: 1, Phase: "borg", Mounted: []string{mountpoint}})
+	b := BorgBackup{lockFile: opts.LockFile}
+	release, err := b.getFileLock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	unmounted = nil
+	if err := Cleanup(context.Background(), opts); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("Cleanup during a backup returned %v, want ErrLockHeld", err)
+	}
+	if len(unmounted) > 0 {
+		t.Errorf("Cleanup during a backup unmounted %v", unmounted)
+	}
+}
+
+func TestCleanupReportsWhatIsLeft(t *testing.T) {
+	dir, err := ioutil.TempDir("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapUtil := filepath.Join(dir, "snapUtil")
+	if err := ioutil.WriteFile(snapUtil, []byte("#!/bin/sh\necho busy >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mountpoint := filepath.Join(dir, "snapshot")
+	oldUnmount, oldMounted := unmountFS, isMountpoint
+	unmountFS = func(target string, flags int) error { return syscall.EPERM }
+	isMountpoint = func(path string) bool { return path == mountpoint }
+	defer func() { unmountFS, isMountpoint = oldUnmount, oldMounted }()
+	opts := CleanupOptions{
+		JournalFile:  filepath.Join(dir, "journal.json"),
+		LockFile:     filepath.Join(dir, "backup.lock"),
+		SnapUtilPath: snapUtil,
+	}
+	writeJournal(t, opts.JournalFile, &runJournal{PID: 1, Phase: "borg",
+		Snapshots: []journalSnapshot{{Source: "/", Snapshot: oldSnapshot}}, Mounted: []string{mountpoint}})
+	err = Cleanup(context.Background(), opts)
+	if err == nil || !strings.Contains(err.Error(), mountpoint) || !strings.Contains(err.Error(), oldSnapshot+" of /") {
+		t.Fatalf("got %v, want an error naming %s and %s", err, mountpoint, oldSnapshot)
+	}
+	j, err := loadJournal(opts.JournalFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.has("/", oldSnapshot) || !containsString(j.Mounted, mountpoint) {
+		t.Errorf("the journal has %s, want both kept for the next cleanup", j.describe())
+	}
+}
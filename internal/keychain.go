@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// exit statuses of security(1)
+const (
+	securityItemNotFound       = 44 // errSecItemNotFound
+	securityInteractionBlocked = 36 // errSecInteractionNotAllowed, the keychain is locked
+	securityAuthFailed         = 51 // errSecAuthFailed
+)
+
+// the account of the keychain items borg-tm stores
+const keychainAccount = "borg-tm"
+
+type keychainSource struct {
+	service string
+	user    string // empty for the default keychain of the user running borg-tm
+}
+
+// NewKeychainSource reads the passphrase from the generic password with the
+// service name service, with `security find-generic-password`. With user,
+// it is looked up in the login keychain of that user, as root's keychain is
+// a different one.
+func NewKeychainSource(service string, user string) PassphraseSource {
+	return keychainSource{service: service, user: user}
+}
+
+func (s keychainSource) Name() string {
+	if s.user == "" {
+		return "keychain item " + s.service
+	}
+	return fmt.Sprintf("keychain item %s of user %s", s.service, s.user)
+}
+
+// securityCommand runs security with args as s.user, in the security session
+// of their login, where their login keychain is unlocked.
+func (s keychainSource) securityCommand(ctx context.Context, args ...string) (*exec.Cmd, error) {
+	if s.user == "" {
+		return exec.CommandContext(ctx, "security", args...), nil
+	}
+	u, err := user.Lookup(s.user)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while looking up -keychain-user %s", s.user)
+	}
+	argv := append([]string{"asuser", u.Uid, "sudo", "-u", s.user, "security"}, args...)
+	return exec.CommandContext(ctx, "launchctl", argv...), nil
+}
+
+// keychainError turns the usual failures of security into actionable errors.
+func (s keychainSource) keychainError(err error, stderr string) error {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return errors.Wrap(err, "error while running security")
+	}
+	keychain := "the default keychain"
+	if s.user != "" {
+		keychain = "the login keychain of " + s.user
+	}
+	switch exitErr.ExitCode() {
+	case securityItemNotFound:
+		store := "borg-tm -keychain-store -keychain-item " + s.service
+		if s.user != "" {
+			store += " -keychain-user " + s.user
+		}
+		return errors.Errorf("%s has no item %s, store the passphrase with `%s`", keychain, s.service, store)
+	case securityInteractionBlocked, securityAuthFailed:
+		hint := "unlock it with `security unlock-keychain`"
+		if s.user != "" {
+			hint = fmt.Sprintf("%s must be logged in, or unlock it with `security unlock-keychain`", s.user)
+		}
+		return errors.Errorf("%s is locked (%s), %s", keychain, stderr, hint)
+	}
+	return errors.Wrapf(err, "error while reading keychain item %s: %s", s.service, stderr)
+}
+
+func (s keychainSource) Passphrase(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, passphraseCommandTimeout)
+	defer cancel()
+	cmd, err := s.securityCommand(ctx, "find-generic-password", "-s", s.service, "-w")
+	if err != nil {
+		return "", err
+	}
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = safeEnvs()
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", errors.Errorf("security timed out after %s, is it waiting for the keychain to be unlocked?", passphraseCommandTimeout)
+		}
+		return "", s.keychainError(err, strings.TrimSpace(stderr.String()))
+	}
+	passphrase := strings.TrimRight(stdout.String(), "\r\n")
+	if passphrase == "" {
+		return "", errors.Errorf("keychain item %s holds an empty passphrase", s.service)
+	}
+	return passphrase, nil
+}
+
+// StoreKeychainPassphrase stores a passphrase in the keychain item read by
+// NewKeychainSource(service, user), replacing an existing one. security
+// asks for the passphrase on the terminal, so it never shows up in a file
+// or an argument list.
+func StoreKeychainPassphrase(ctx context.Context, service string, user string) error {
+	s := keychainSource{service: service, user: user}
+	// a trailing -w without a value makes security prompt for it
+	cmd, err := s.securityCommand(ctx, "add-generic-password", "-U", "-a", keychainAccount, "-s", service, "-l", "borg-tm passphrase", "-w")
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Env = safeEnvs()
+	// the prompts of security go to the terminal as well
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	if err := cmd.Run(); err != nil {
+		return s.keychainError(err, strings.TrimSpace(stderr.String()))
+	}
+	fmt.Printf("Stored the passphrase in %s\n", s.Name())
+	return nil
+}
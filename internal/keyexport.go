@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// formats of -key-export-format
+const (
+	KeyExportBinary = "binary" // borg key export without options, for borg key import
+	KeyExportPaper  = "paper"  // borg key export --paper, to print and type in again
+)
+
+// exportKey runs borg key export to -key-export-path when the export is
+// missing, or with -key-export-overwrite. It returns whether the key was
+// exported. An existing export is never replaced otherwise, not even for a
+// repository borg init just created.
+func (b BorgBackup) exportKey(ctx context.Context) (bool, error) {
+	_, err := os.Stat(b.keyExportPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.Wrap(err, "error while checking the key export")
+	}
+	if err == nil && !b.keyExportOverwrite {
+		if b.repoCreated != nil && *b.repoCreated {
+			return false, errors.Errorf("refusing to overwrite %s with the key of the new repository, move it away or use -key-export-overwrite", b.keyExportPath)
+		}
+		b.logf(LevelDebug, "The repository key is already exported to %s", b.keyExportPath)
+		return false, nil
+	}
+	args := []string{"key", "export"}
+	if b.keyExportFormat == KeyExportPaper {
+		args = append(args, "--paper")
+	}
+	// the path would be taken for the repository if it was left out
+	args = append(append(args, b.borgCommonArgs()...), b.repo)
+	b.logf(LevelInfo, "borg %v %s", args, b.keyExportPath)
+	if b.dryRun {
+		return false, nil
+	}
+	// borg writes into the temporary file, which is created with 0600, so
+	// the key is never readable by others and a failed export leaves the
+	// previous one alone
+	tmp, err := ioutil.TempFile(filepath.Dir(b.keyExportPath), "."+filepath.Base(b.keyExportPath)+".")
+	if err != nil {
+		return false, errors.Wrap(err, "error while creating the key export")
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := b.runBorgInterruptible(ctx, append(args, tmp.Name())); err != nil {
+		return false, errors.Wrap(err, "error while exporting the repository key")
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return false, errors.Wrap(err, "error while exporting the repository key")
+	}
+	if err := os.Rename(tmp.Name(), b.keyExportPath); err != nil {
+		return false, errors.Wrap(err, "error while exporting the repository key")
+	}
+	b.logf(LevelInfo, "Exported the repository key to %s", b.keyExportPath)
+	return true, nil
+}
@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// LaunchdLabel is the label of the LaunchDaemon -install-launchd installs.
+	LaunchdLabel = "com.borg-tm.backup"
+	// LaunchdPlistPath is where its plist goes.
+	LaunchdPlistPath = "/Library/LaunchDaemons/" + LaunchdLabel + ".plist"
+	// DefaultLaunchdLog is where the daemon's output goes.
+	DefaultLaunchdLog = "/var/log/borg-tm.log"
+)
+
+// launchd's PATH is only /usr/bin:/bin:/usr/sbin:/sbin, which has no borg
+const launchdPath = "/opt/homebrew/bin:/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin"
+
+// how long launchd waits after SIGTERM before it kills the backup, which
+// still has to unmount and remove its snapshots
+const launchdExitTimeout = 5 * time.Minute
+
+// LaunchdTime is a time of day the LaunchDaemon starts a backup at.
+type LaunchdTime struct {
+	Hour   int
+	Minute int
+}
+
+// ParseLaunchdTime parses a -schedule value such as 02:30.
+func ParseLaunchdTime(value string) (LaunchdTime, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return LaunchdTime{}, errors.Errorf("invalid -schedule %q, expected a time of day like 02:30", value)
+	}
+	return LaunchdTime{Hour: t.Hour(), Minute: t.Minute()}, nil
+}
+
+// LaunchdJob is what the plist of the LaunchDaemon says.
+type LaunchdJob struct {
+	// the borg-tm binary and its flags, which name the config file rather
+	// than repeating what it says
+	ProgramArguments []string
+	Schedule         []LaunchdTime
+	WorkingDirectory string
+	LogPath          string // stdout and stderr
+	// besides PATH and HOME, which are always set
+	Environment map[string]string
+}
+
+// launchdEnvironment is the environment of the daemon: a PATH that finds
+// borg wherever it is installed, and a HOME, which system daemons don't get
+// and borg needs for its config and cache.
+func (j LaunchdJob) launchdEnvironment() map[string]string {
+	env := map[string]string{"PATH": launchdPath, "HOME": "/var/root"}
+	if borg, err := exec.LookPath("borg"); err == nil {
+		dir := filepath.Dir(borg)
+		if !strings.Contains(":"+launchdPath+":", ":"+dir+":") {
+			env["PATH"] = dir + ":" + launchdPath
+		}
+	}
+	for k, v := range j.Environment {
+		env[k] = v
+	}
+	return env
+}
+
+type plistWriter struct {
+	buf    bytes.Buffer
+	indent int
+}
+
+func (w *plistWriter) line(format string, args ...interface{}) {
+	w.buf.WriteString(strings.Repeat("\t", w.indent))
+	fmt.Fprintf(&w.buf, format, args...)
+	w.buf.WriteByte('\n')
+}
+
+func (w *plistWriter) escaped(tag string, value string) {
+	var esc bytes.Buffer
+	xml.EscapeText(&esc, []byte(value))
+	w.line("<%s>%s</%s>", tag, esc.String(), tag)
+}
+
+func (w *plistWriter) key(key string) {
+	w.escaped("key", key)
+}
+
+func (w *plistWriter) open(tag string) {
+	w.line("<%s>", tag)
+	w.indent++
+}
+
+func (w *plistWriter) close(tag string) {
+	w.indent--
+	w.line("</%s>", tag)
+}
+
+// Plist renders the job as an XML property list.
+func (j LaunchdJob) Plist() []byte {
+	w := &plistWriter{}
+	w.buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+`)
+	w.open("dict")
+	w.key("Label")
+	w.escaped("string", LaunchdLabel)
+	w.key("ProgramArguments")
+	w.open("array")
+	for _, arg := range j.ProgramArguments {
+		w.escaped("string", arg)
+	}
+	w.close("array")
+	w.key("StartCalendarInterval")
+	w.open("array")
+	for _, t := range j.Schedule {
+		w.open("dict")
+		w.key("Hour")
+		w.line("<integer>%d</integer>", t.Hour)
+		w.key("Minute")
+		w.line("<integer>%d</integer>", t.Minute)
+		w.close("dict")
+	}
+	w.close("array")
+	// a backup that finished must not be started again right away
+	w.key("KeepAlive")
+	w.line("<false/>")
+	w.key("RunAtLoad")
+	w.line("<false/>")
+	w.key("WorkingDirectory")
+	w.escaped("string", j.WorkingDirectory)
+	w.key("StandardOutPath")
+	w.escaped("string", j.LogPath)
+	w.key("StandardErrorPath")
+	w.escaped("string", j.LogPath)
+	w.key("ExitTimeOut")
+	w.line("<integer>%d</integer>", int(launchdExitTimeout.Seconds()))
+	w.key("ProcessType")
+	w.escaped("string", "Background")
+	env := j.launchdEnvironment()
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.key("EnvironmentVariables")
+	w.open("dict")
+	for _, name := range names {
+		w.key(name)
+		w.escaped("string", env[name])
+	}
+	w.close("dict")
+	w.close("dict")
+	w.buf.WriteString("</plist>\n")
+	return w.buf.Bytes()
+}
+
+func launchctl(args ...string) ([]byte, error) {
+	cmd := exec.Command("launchctl", args...)
+	cmd.Env = safeEnvs()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, errors.Wrapf(err, "error while running launchctl %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// launchdLoaded reports whether the LaunchDaemon is loaded.
+func launchdLoaded() bool {
+	_, err := launchctl("print", "system/"+LaunchdLabel)
+	return err == nil
+}
+
+// InstallLaunchd writes the plist of job to LaunchdPlistPath, owned by root
+// with mode 0644 as launchd requires, and loads it with launchctl
+// bootstrap. A LaunchDaemon that is already loaded is replaced.
+func InstallLaunchd(job LaunchdJob) error {
+	if len(job.Schedule) == 0 {
+		return errors.New("-install-launchd needs a -schedule")
+	}
+	if err := os.MkdirAll(filepath.Dir(job.LogPath), 0755); err != nil {
+		return errors.Wrap(err, "error while creating the log directory")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(LaunchdPlistPath), "."+LaunchdLabel+".")
+	if err != nil {
+		return errors.Wrap(err, "error while writing the plist")
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(job.Plist())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Chown(tmp.Name(), 0, 0)
+	}
+	if err != nil {
+		return errors.Wrap(err, "error while writing the plist")
+	}
+	if launchdLoaded() {
+		fmt.Printf("Unloading the installed %s\n", LaunchdLabel)
+		if _, err := launchctl("bootout", "system/"+LaunchdLabel); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), LaunchdPlistPath); err != nil {
+		return errors.Wrap(err, "error while writing the plist")
+	}
+	fmt.Printf("Wrote %s\n", LaunchdPlistPath)
+	if _, err := launchctl("bootstrap", "system", LaunchdPlistPath); err != nil {
+		return err
+	}
+	fmt.Printf("Loaded %s, the output goes to %s\n", LaunchdLabel, job.LogPath)
+	return nil
+}
+
+// UninstallLaunchd unloads the LaunchDaemon and removes its plist.
+func UninstallLaunchd() error {
+	if launchdLoaded() {
+		if _, err := launchctl("bootout", "system/"+LaunchdLabel); err != nil {
+			return err
+		}
+		fmt.Printf("Unloaded %s\n", LaunchdLabel)
+	}
+	err := os.Remove(LaunchdPlistPath)
+	if os.IsNotExist(err) {
+		fmt.Printf("%s isn't installed\n", LaunchdPlistPath)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "error while removing the plist")
+	}
+	fmt.Printf("Removed %s\n", LaunchdPlistPath)
+	return nil
+}
+
+// LaunchdStatus describes the LaunchDaemon.
+type LaunchdStatus struct {
+	Installed bool
+	Loaded    bool
+	// from launchctl print, empty if launchd doesn't say
+	State        string
+	Runs         int
+	LastExitCode string
+}
+
+// GetLaunchdStatus checks whether the plist is installed and asks launchctl
+// about the LaunchDaemon.
+func GetLaunchdStatus() (LaunchdStatus, error) {
+	var status LaunchdStatus
+	_, err := os.Stat(LaunchdPlistPath)
+	if err != nil && !os.IsNotExist(err) {
+		return status, errors.Wrap(err, "error while checking the plist")
+	}
+	status.Installed = err == nil
+	out, err := launchctl("print", "system/"+LaunchdLabel)
+	if err != nil {
+		// not loaded
+		return status, nil
+	}
+	status.Loaded = true
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), " = ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "state":
+			status.State = parts[1]
+		case "runs":
+			status.Runs, _ = strconv.Atoi(parts[1])
+		case "last exit code":
+			status.LastExitCode = parts[1]
+		}
+	}
+	return status, nil
+}
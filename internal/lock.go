@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how often a busy lock is tried again with -lock-wait
+const lockPollInterval = time.Second
+
+// directory of the default lock files, a variable for the tests
+var lockDir = "/var/run"
+
+// repoHash names the files kept per repository: its lock file, state,
+// history and journal.
+func repoHash(repo string) string {
+	sum := sha1.Sum([]byte(strings.TrimRight(repo, "/")))
+	return fmt.Sprintf("%x", sum[:6])
+}
+
+// DefaultLockFile returns the lock file of backups to repo, so that backups
+// to different repositories can run at the same time.
+func DefaultLockFile(repo string) string {
+	return filepath.Join(lockDir, "borg-tm-"+repoHash(repo)+".lock")
+}
+
+// mountpointLockFile returns the lock file guarding mountpoint, which is
+// held while a run mounts a snapshot there.
+func mountpointLockFile(mountpoint string) string {
+	sum := sha1.Sum([]byte(filepath.Clean(mountpoint)))
+	return filepath.Join(lockDir, fmt.Sprintf("borg-tm-mnt-%x.lock", sum[:6]))
+}
+
+// allLockFiles returns the default lock files of all repositories and
+// mountpoints that were used so far.
+func allLockFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(lockDir, "borg-tm-*.lock"))
+	return files, errors.Wrap(err, "error while listing lock files")
+}
+
+// lockMountpoints takes the guard of every mountpoint a snapshot is
+// mounted on, so that no other run mounts a snapshot there at the same
+// time.
+func (b BorgBackup) lockMountpoints(ctx context.Context) (func(), error) {
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for i, mountpoint := range b.mountpoints {
+		if b.sources[i] == mountpoint {
+			// nothing gets mounted
+			continue
+		}
+		guard := b
+		guard.lockFile = mountpointLockFile(mountpoint)
+		r, err := guard.getFileLock(ctx)
+		if err != nil {
+			release()
+			return nil, errors.Wrapf(err, "mountpoint %s is used by another run", mountpoint)
+		}
+		releases = append(releases, r)
+	}
+	return release, nil
+}
+
+// lockHolder is what a run writes into the lock file once it holds it.
+type lockHolder struct {
+	pid      int
+	hostname string
+	started  time.Time
+}
+
+func (h lockHolder) String() string {
+	return fmt.Sprintf("%d %s %s\n", h.pid, h.hostname, h.started.Format(time.RFC3339))
+}
+
+// parseLockHolder parses the lock file contents, ok is false if it is empty
+// or was written by an older version.
+func parseLockHolder(data string) (lockHolder, bool) {
+	fields := strings.Fields(data)
+	if len(fields) != 3 {
+		return lockHolder{}, false
+	}
+	var h lockHolder
+	if _, err := fmt.Sscan(fields[0], &h.pid); err != nil || h.pid <= 0 {
+		return lockHolder{}, false
+	}
+	started, err := time.Parse(time.RFC3339, fields[2])
+	if err != nil {
+		return lockHolder{}, false
+	}
+	h.hostname, h.started = fields[1], started
+	return h, true
+}
+
+func (h lockHolder) alive() bool {
+	err := syscall.Kill(h.pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func (h lockHolder) describe() string {
+	state := "running"
+	if !h.alive() {
+		state = "no longer running"
+	}
+	return fmt.Sprintf("held by PID %d on %s started %s (%s)", h.pid, h.hostname, h.started.Format("2006-01-02T15:04"), state)
+}
+
+// writeLockRecord replaces the content of the lock file with record,
+// replaced by the tests
+var writeLockRecord = func(file *os.File, record string) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := file.WriteAt([]byte(record), 0)
+	return err
+}
+
+// getFileLock takes the lock file and records this process in it. With
+// -lock-wait, a busy lock is waited for that long. The returned func
+// releases the lock and clears the file; the lock also goes away when the
+// process exits, however it does.
+func (b BorgBackup) getFileLock(ctx context.Context) (func(), error) {
+	file, err := os.OpenFile(b.lockFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "error while opening lockfile")
+	}
+	var deadline <-chan time.Time
+	if b.lockWait > 0 {
+		timer := time.NewTimer(b.lockWait)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	waiting := false
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != syscall.EWOULDBLOCK || deadline == nil {
+			break
+		}
+		if !waiting {
+			b.logf(LevelInfo, "Waiting up to %s for the lock %s", b.lockWait, b.lockFile)
+			waiting = true
+		}
+		select {
+		case <-time.After(lockPollInterval):
+			continue
+		case <-deadline:
+		case <-ctx.Done():
+		}
+		break
+	}
+	if err != nil {
+		data, _ := ioutil.ReadAll(file)
+		file.Close()
+		if err != syscall.EWOULDBLOCK {
+			return nil, errors.Wrap(err, "error while acquiring file lock")
+		}
+		if holder, ok := parseLockHolder(string(data)); ok {
+			return nil, errors.Wrapf(ErrLockHeld, "error while acquiring file lock %s, %s", b.lockFile, holder.describe())
+		}
+		return nil, errors.Wrapf(ErrLockHeld, "error while acquiring file lock %s", b.lockFile)
+	}
+
+	data, _ := ioutil.ReadAll(file)
+	if previous, ok := parseLockHolder(string(data)); ok {
+		// a clean exit clears the file
+		b.logf(LevelWarn, "Stale lock: the run with PID %d started %s didn't exit cleanly", previous.pid, previous.started.Format("2006-01-02T15:04"))
+	}
+	hostname, _ := os.Hostname()
+	holder := lockHolder{pid: os.Getpid(), hostname: hostname, started: time.Now()}
+	if werr := writeLockRecord(file, holder.String()); werr != nil {
+		// the lock is still ours, only who holds it can't be told
+		b.logf(LevelWarn, "error while writing the lock file %s: %v", b.lockFile, werr)
+	}
+	release := func() {
+		file.Truncate(0)
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}
+	return release, nil
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRepoHashIsStable(t *testing.T) {
+	// changing the hash would orphan the lock, state, history and journal
+	// files of every installation
+	tests := []struct {
+		repo string
+		hash string
+	}{
+		{"/Volumes/Backup/borg", "09c0573e7945"},
+		{"ssh://user@nas:22/./backups/mac", "7768be4259f8"},
+		{"", "da39a3ee5e6b"},
+	}
+	for _, tt := range tests {
+		if got := repoHash(tt.repo); got != tt.hash {
+			t.Errorf("repoHash(%q) = %s, want %s", tt.repo, got, tt.hash)
+		}
+	}
+}
+
+func TestDefaultFilesPerRepo(t *testing.T) {
+	same := []string{"/Volumes/Backup/borg", "/Volumes/Backup/borg/", "/Volumes/Backup/borg//"}
+	for _, repo := range same[1:] {
+		if DefaultLockFile(repo) != DefaultLockFile(same[0]) {
+			t.Errorf("%s and %s have different locks: %s, %s", repo, same[0], DefaultLockFile(repo), DefaultLockFile(same[0]))
+		}
+	}
+	defaults := map[string]func(string) string{
+		"lock":    DefaultLockFile,
+		"state":   DefaultStateFile,
+		"history": DefaultHistoryFile,
+		"journal": DefaultJournalFile,
+	}
+	for what, def := range defaults {
+		a, b := def("/Volumes/Backup/borg"), def("ssh://nas/backups/mac")
+		if a == b {
+			t.Errorf("two repositories share the %s file %s", what, a)
+		}
+		if def("/Volumes/Backup/borg") != a {
+			t.Errorf("the %s file of a repository changed between calls", what)
+		}
+	}
+	// all of them are named by the same hash
+	hash := repoHash("/Volumes/Backup/borg")
+	for what, def := range defaults {
+		if name := filepath.Base(def("/Volumes/Backup/borg")); !strings.Contains(name, "-"+hash+".") {
+			t.Errorf("the %s file %s isn't named by the repository hash %s", what, name, hash)
+		}
+	}
+}
+
+func TestGetFileLockRecordsTheHolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := BorgBackup{lockFile: filepath.Join(dir, "backup.lock")}
+	release, err := b.getFileLock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	_, err = b.getFileLock(context.Background())
+	if !errors.Is(err, ErrLockHeld) || !strings.Contains(err.Error(), fmt.Sprintf("held by PID %d", os.Getpid())) {
+		t.Errorf("got %v, want the lock held by this process", err)
+	}
+}
+
+func TestGetFileLockLogsAFailedRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := writeLockRecord
+	writeLockRecord = func(file *os.File, record string) error { return syscall.ENOSPC }
+	defer func() { writeLockRecord = old }()
+	log := new(bytes.Buffer)
+	b := BorgBackup{lockFile: filepath.Join(dir, "backup.lock"), log: newRunLog(NewTextLogger(log, LevelWarn))}
+	release, err := b.getFileLock(context.Background())
+	if err != nil {
+		t.Fatalf("a failed record lost the lock: %v", err)
+	}
+	defer release()
+	if !strings.Contains(log.String(), "error while writing the lock file") || !strings.Contains(log.String(), syscall.ENOSPC.Error()) {
+		t.Errorf("the log doesn't have the failed write: %q", log)
+	}
+}
@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LogLevel orders log messages by importance.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses debug, info, warn (or warning) and error.
+func ParseLogLevel(s string) (LogLevel, error) {
+	s = strings.ToLower(s)
+	if s == "warning" {
+		return LevelWarn, nil
+	}
+	for i, name := range logLevelNames {
+		if s == name {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, errors.Errorf("unknown log level %q, expected debug, info, warn or error", s)
+}
+
+// LogEntry is one log message with the context it was logged in. Only the
+// command lines of borg and the helpers are logged, never their environment,
+// so the passphrase doesn't show up even at debug level.
+type LogEntry struct {
+	Time     time.Time
+	Level    LogLevel
+	Message  string
+	Phase    string         // phase of the run, e.g. snapshot or borg
+	Source   string         // source the message is about
+	Tag      string         // log prefix of Source, set with several sources
+	Snapshot string         // snapshot the message is about
+	Duration time.Duration  // how long the step took, if it's about one
+	Progress *ProgressEvent // borg's counters, for -progress snapshots
+}
+
+// Logger receives the log messages of a backup.
+type Logger interface {
+	Log(e LogEntry)
+}
+
+var textLevelPrefixes = map[LogLevel]string{
+	LevelDebug: "Debug: ",
+	LevelWarn:  "Warning: ",
+	LevelError: "Error: ",
+}
+
+type textLogger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level LogLevel
+}
+
+// NewTextLogger prints the messages of at least level to out as plain
+// lines, tagged with the source prefix and, unless they are info, the level.
+func NewTextLogger(out io.Writer, level LogLevel) Logger {
+	return &textLogger{out: out, level: level}
+}
+
+func (l *textLogger) Log(e LogEntry) {
+	if e.Level < l.level {
+		return
+	}
+	msg := textLevelPrefixes[e.Level] + e.Message
+	if e.Tag != "" {
+		msg = "[" + e.Tag + "] " + msg
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.out, msg)
+}
+
+type jsonLogger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level LogLevel
+}
+
+// NewJSONLogger writes the messages of at least level to out, one JSON
+// object per line.
+func NewJSONLogger(out io.Writer, level LogLevel) Logger {
+	return &jsonLogger{out: out, level: level}
+}
+
+func (l *jsonLogger) Log(e LogEntry) {
+	if e.Level < l.level {
+		return
+	}
+	line := struct {
+		Time     time.Time      `json:"time"`
+		Level    string         `json:"level"`
+		Message  string         `json:"msg"`
+		Phase    string         `json:"phase,omitempty"`
+		Source   string         `json:"source,omitempty"`
+		Snapshot string         `json:"snapshot,omitempty"`
+		Duration float64        `json:"duration,omitempty"` // seconds
+		Progress *ProgressEvent `json:"progress,omitempty"`
+	}{e.Time, e.Level.String(), e.Message, e.Phase, e.Source, e.Snapshot, e.Duration.Seconds(), e.Progress}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(data, '\n'))
+}
+
+// default logger, matching the plain output of earlier versions
+var defaultLogger = NewTextLogger(os.Stdout, LevelInfo)
+
+// runLog adds the current phase to the entries of a run. A nil runLog logs
+// to the default logger.
+type runLog struct {
+	mu     sync.Mutex
+	logger Logger
+	phase  string
+}
+
+func newRunLog(logger Logger) *runLog {
+	if logger == nil {
+		logger = defaultLogger
+	}
+	return &runLog{logger: logger}
+}
+
+func (r *runLog) setPhase(phase string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.phase = phase
+}
+
+func (r *runLog) log(e LogEntry) {
+	e.Time = time.Now()
+	e.Message = strings.TrimRight(e.Message, "\n")
+	if r == nil {
+		defaultLogger.Log(e)
+		return
+	}
+	r.mu.Lock()
+	e.Phase = r.phase
+	r.mu.Unlock()
+	r.logger.Log(e)
+}
+
+func (r *runLog) logf(level LogLevel, format string, args ...interface{}) {
+	r.log(LogEntry{Level: level, Message: fmt.Sprintf(format, args...)})
+}
+
+// enterPhase announces the next phase of the run to the log, the usage
+// tracker, the progress FIFO and the journal.
+func (b BorgBackup) enterPhase(phase string) {
+	b.log.setPhase(phase)
+	b.usage.setPhase(phase)
+	b.journal.setPhase(phase)
+	b.progress.phase(phase)
+}
+
+func (b BorgBackup) logf(level LogLevel, format string, args ...interface{}) {
+	b.log.logf(level, format, args...)
+}
+
+// logEntryf logs e with the formatted message.
+func (b BorgBackup) logEntryf(e LogEntry, format string, args ...interface{}) {
+	e.Message = fmt.Sprintf(format, args...)
+	b.log.log(e)
+}
+
+// sourceEntry is a log entry about the i-th source.
+func (b BorgBackup) sourceEntry(i int, level LogLevel) LogEntry {
+	e := LogEntry{Level: level}
+	if i < len(b.sources) {
+		e.Source = b.sources[i]
+	}
+	if i < len(b.prefixes) {
+		e.Tag = b.prefixes[i]
+	}
+	return e
+}
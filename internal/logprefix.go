@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// sourcePrefixes derives a short, unique log prefix for every source from
+// its path, e.g. root for / and data for /System/Volumes/Data.
+func sourcePrefixes(sources []string) []string {
+	parts := make([][]string, len(sources))
+	for i, source := range sources {
+		for _, p := range strings.Split(filepath.Clean(source), "/") {
+			if p != "" {
+				parts[i] = append(parts[i], strings.ToLower(p))
+			}
+		}
+	}
+	prefixes := make([]string, len(sources))
+	// use as many trailing path elements as needed to tell the sources apart
+	for depth := 1; ; depth++ {
+		seen := map[string]int{}
+		grown := false
+		for i, p := range parts {
+			if len(p) == 0 {
+				prefixes[i] = "root"
+			} else {
+				start := len(p) - depth
+				if start < 0 {
+					start = 0
+				} else if start > 0 {
+					grown = true
+				}
+				prefixes[i] = strings.Join(p[start:], "-")
+			}
+			seen[prefixes[i]]++
+		}
+		unique := true
+		for _, n := range seen {
+			if n > 1 {
+				unique = false
+			}
+		}
+		if unique {
+			return prefixes
+		}
+		if !grown {
+			break
+		}
+	}
+	// the same source given twice
+	for i := range prefixes {
+		prefixes[i] = fmt.Sprintf("%s-%d", prefixes[i], i+1)
+	}
+	return prefixes
+}
+
+// printPrefixes logs the mapping of log prefixes to sources.
+func (b BorgBackup) printPrefixes() {
+	if b.prefixes == nil {
+		return
+	}
+	b.logf(LevelInfo, "Log prefixes:")
+	for i, source := range b.sources {
+		b.logf(LevelInfo, "  [%s] %s", b.prefixes[i], source)
+	}
+}
+
+// sourceLogf logs a message about the i-th source, tagged with its prefix
+// when there are several sources.
+func (b BorgBackup) sourceLogf(i int, format string, args ...interface{}) {
+	b.logEntryf(b.sourceEntry(i, LevelInfo), format, args...)
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// MNT_NOWAIT from <sys/mount.h>, not exported by the syscall package
+const mntNoWait = 2
+
+// mountInfo describes the filesystem a path lives on.
+type mountInfo struct {
+	fsType      string
+	mountedOn   string
+	mountedFrom string
+}
+
+func statfsMount(path string) (mountInfo, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return mountInfo{}, errors.Wrapf(err, "error while running statfs on %s", path)
+	}
+	return statfsToMountInfo(&st), nil
+}
+
+// listMounts returns all currently mounted filesystems.
+func listMounts() ([]mountInfo, error) {
+	n, err := syscall.Getfsstat(nil, mntNoWait)
+	if err != nil {
+		return nil, errors.Wrap(err, "error while listing mounts")
+	}
+	// leave some room for filesystems mounted in between the two calls
+	buf := make([]syscall.Statfs_t, n+8)
+	n, err = syscall.Getfsstat(buf, mntNoWait)
+	if err != nil {
+		return nil, errors.Wrap(err, "error while listing mounts")
+	}
+	mounts := make([]mountInfo, 0, n)
+	for i := 0; i < n; i++ {
+		mounts = append(mounts, statfsToMountInfo(&buf[i]))
+	}
+	return mounts, nil
+}
+
+func statfsToMountInfo(st *syscall.Statfs_t) mountInfo {
+	return mountInfo{
+		fsType:      int8sToString(st.Fstypename[:]),
+		mountedOn:   int8sToString(st.Mntonname[:]),
+		mountedFrom: int8sToString(st.Mntfromname[:]),
+	}
+}
+
+func int8sToString(chars []int8) string {
+	buf := make([]byte, 0, len(chars))
+	for _, c := range chars {
+		if c == 0 {
+			break
+		}
+		buf = append(buf, byte(c))
+	}
+	return string(buf)
+}
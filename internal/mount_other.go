@@ -0,0 +1,25 @@
+//go:build !darwin
+// +build !darwin
+
+package internal
+
+import (
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// mountInfo describes the filesystem a path lives on.
+type mountInfo struct {
+	fsType      string
+	mountedOn   string
+	mountedFrom string
+}
+
+func statfsMount(path string) (mountInfo, error) {
+	return mountInfo{}, errors.Errorf("looking up the mount of %s is not supported on %s", path, runtime.GOOS)
+}
+
+func listMounts() ([]mountInfo, error) {
+	return nil, errors.Errorf("listing mounts is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// isMountedOn reports whether something is mounted on dir, i.e. whether it
+// is on another device than its parent.
+func isMountedOn(dir string) (bool, error) {
+	dir = filepath.Clean(dir)
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return false, errors.Wrapf(err, "error while checking mountpoint %s", dir)
+	}
+	if err := syscall.Stat(filepath.Dir(dir), &parent); err != nil {
+		return false, errors.Wrapf(err, "error while checking mountpoint %s", dir)
+	}
+	return st.Dev != parent.Dev, nil
+}
+
+// isEmptyDir reports whether dir has no entries. The .DS_Store Finder
+// leaves behind doesn't count.
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, errors.Wrapf(err, "error while checking mountpoint %s", dir)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return false, errors.Wrapf(err, "error while checking mountpoint %s", dir)
+	}
+	for _, name := range names {
+		if name != ".DS_Store" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// prepareMountpoint makes sure a snapshot can be mounted on mountpoint: it
+// is created if missing, a leftover borg-tm snapshot mount on it is
+// unmounted, and it must be an empty directory unless -force-mountpoint is
+// given.
+func (b BorgBackup) prepareMountpoint(ctx context.Context, i int, mountpoint string) error {
+	info, err := os.Stat(mountpoint)
+	if os.IsNotExist(err) {
+		b.sourceLogf(i, "Creating mountpoint %s\n", mountpoint)
+		return errors.Wrapf(os.MkdirAll(mountpoint, 0755), "error while creating mountpoint %s", mountpoint)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error while checking mountpoint %s", mountpoint)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("mountpoint %s is not a directory", mountpoint)
+	}
+	mounted, err := isMountedOn(mountpoint)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		m, err := statfsMount(mountpoint)
+		if err != nil {
+			return errors.Wrapf(err, "something is already mounted on %s", mountpoint)
+		}
+		snapshot, _, isSnapshot := splitSnapshotDevice(m.mountedFrom)
+		parsed, perr := b.parseSnapshotName(snapshot)
+		if !isSnapshot || m.fsType != "apfs" || perr != nil || parsed.Kind != SnapshotBorgTM {
+			return errors.Errorf("%s is already mounted on %s, unmount it or choose another mountpoint", m.mountedFrom, mountpoint)
+		}
+		// the mountpoint guard makes sure it's not from a run still going on
+		b.sourceLogf(i, "Unmounting snapshot %s left on %s by an earlier run\n", snapshot, mountpoint)
+		cleanupCtx, cancel := cleanupContext()
+		err = b.unmountRetrying(cleanupCtx, i, mountpoint)
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "error while unmounting the leftover snapshot on %s", mountpoint)
+		}
+	}
+	empty, err := isEmptyDir(mountpoint)
+	if err != nil {
+		return err
+	}
+	if !empty && !b.forceMountpoint {
+		return errors.Errorf("mountpoint %s is not empty, give -force-mountpoint to mount over it anyway", mountpoint)
+	}
+	return nil
+}
+
+// prepareMountpoints runs prepareMountpoint for every source that gets
+// mounted, before any snapshot is created.
+func (b BorgBackup) prepareMountpoints(ctx context.Context) error {
+	for i, mountpoint := range b.mountpoints {
+		source := b.sources[i]
+		if source == mountpoint {
+			continue
+		}
+		if err := b.prepareMountpoint(ctx, i, mountpoint); err != nil {
+			return &MountError{Source: source, Mountpoint: mountpoint, Err: err}
+		}
+	}
+	return nil
+}
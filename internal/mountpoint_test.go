@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestPrepareMountpoint(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, mountpoint string)
+		force bool
+		err   string // empty for none
+	}{
+		{"missing", func(t *testing.T, mountpoint string) {}, false, ""},
+		{"missing parent", func(t *testing.T, mountpoint string) {}, false, ""},
+		{"empty", mkdir, false, ""},
+		{"only .DS_Store", func(t *testing.T, mountpoint string) {
+			mkdir(t, mountpoint)
+			writeFile(t, filepath.Join(mountpoint, ".DS_Store"))
+		}, false, ""},
+		{"not empty", func(t *testing.T, mountpoint string) {
+			mkdir(t, mountpoint)
+			writeFile(t, filepath.Join(mountpoint, "Users"))
+		}, false, "is not empty, give -force-mountpoint"},
+		{"not empty with -force-mountpoint", func(t *testing.T, mountpoint string) {
+			mkdir(t, mountpoint)
+			writeFile(t, filepath.Join(mountpoint, "Users"))
+		}, true, ""},
+		{"a file", func(t *testing.T, mountpoint string) {
+			writeFile(t, mountpoint)
+		}, true, "is not a directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "borg-tm-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			mountpoint := filepath.Join(dir, "snapshot")
+			if tt.name == "missing parent" {
+				mountpoint = filepath.Join(dir, "tmp", "snapshot")
+			}
+			tt.setup(t, mountpoint)
+			b, err := NewBackup(validOptions(WithForceMountpoint(tt.force))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.log = newRunLog(NewTextLogger(ioutil.Discard, LevelError))
+			err = b.prepareMountpoint(context.Background(), 0, mountpoint)
+			if tt.err == "" && err != nil {
+				t.Fatalf("got %v", err)
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %v, want an error with %q", err, tt.err)
+				}
+				return
+			}
+			info, err := os.Stat(mountpoint)
+			if err != nil || !info.IsDir() {
+				t.Fatalf("the mountpoint is %v, %v, want a directory", info, err)
+			}
+			if perm := info.Mode().Perm(); strings.HasPrefix(tt.name, "missing") && perm != 0755&^umask() {
+				t.Errorf("created the mountpoint with %#o, want %#o", perm, 0755&^umask())
+			}
+		})
+	}
+}
+
+func TestIsMountedOn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if mounted, err := isMountedOn(dir); err != nil || mounted {
+		t.Errorf("isMountedOn(%s) = %v, %v, want false", dir, mounted, err)
+	}
+	if _, err := isMountedOn(filepath.Join(dir, "missing")); err == nil {
+		t.Error("isMountedOn of a missing directory didn't fail")
+	}
+	// /dev is mounted on macOS and usually on Linux
+	if mounted, err := isMountedOn("/dev"); err != nil || !mounted {
+		t.Skipf("isMountedOn(/dev) = %v, %v", mounted, err)
+	}
+}
+
+func TestRunChecksTheMountpointsFirst(t *testing.T) {
+	b, env := newFakeBackup(t, nil, WithStoreOriginalPaths(false))
+	writeFile(t, filepath.Join(env.mountpoint, "Users"))
+	_, err := b.Run(context.Background())
+	var mountErr *MountError
+	if !errors.As(err, &mountErr) || !strings.Contains(err.Error(), "not empty") {
+		t.Fatalf("Run returned %v, want a MountError about the mountpoint", err)
+	}
+	if env.runner.find("snapUtil") != nil || env.runner.find("mount_apfs") != nil {
+		t.Errorf("ran %v before checking the mountpoint", env.flow())
+	}
+}
+
+func mkdir(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFile(t *testing.T, path string) {
+	t.Helper()
+	mkdir(t, filepath.Dir(path))
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// umask returns the umask of the process.
+func umask() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return os.FileMode(mask)
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SnapshotMount is a mounted APFS snapshot.
+type SnapshotMount struct {
+	Device     string `json:"device"`
+	Snapshot   string `json:"snapshot"`
+	Mountpoint string `json:"mountpoint"`
+	// Owned is set when the mount is on a configured mountpoint or the
+	// snapshot was created by borg-tm.
+	Owned bool `json:"owned"`
+}
+
+// splitSnapshotDevice splits the f_mntfromname of an APFS snapshot mount,
+// which looks like `<snapshot name>@/dev/disk1s1`.
+func splitSnapshotDevice(from string) (snapshot string, device string, ok bool) {
+	idx := strings.LastIndex(from, "@")
+	if idx < 0 {
+		return "", from, false
+	}
+	return from[:idx], from[idx+1:], true
+}
+
+// ListSnapshotMounts returns the mounted APFS snapshots, plus whatever is
+// mounted on any of mountpoints.
+func ListSnapshotMounts(mountpoints []string) ([]SnapshotMount, error) {
+	mounts, err := listMounts()
+	if err != nil {
+		return nil, err
+	}
+	configured := make(map[string]bool, len(mountpoints))
+	for _, m := range mountpoints {
+		configured[m] = true
+	}
+	var result []SnapshotMount
+	for _, m := range mounts {
+		snapshot, device, isSnapshot := splitSnapshotDevice(m.mountedFrom)
+		isSnapshot = isSnapshot && m.fsType == "apfs"
+		if !isSnapshot && !configured[m.mountedOn] {
+			continue
+		}
+		parsed, err := ParseSnapshotName(snapshot)
+		created := err == nil && parsed.Kind == SnapshotBorgTM
+		result = append(result, SnapshotMount{
+			Device:     device,
+			Snapshot:   snapshot,
+			Mountpoint: m.mountedOn,
+			Owned:      configured[m.mountedOn] || (isSnapshot && created),
+		})
+	}
+	return result, nil
+}
+
+// Unmount unmounts a mountpoint like the cleanup at the end of a run does,
+// with the default retries.
+func Unmount(mountpoint string) error {
+	b := BorgBackup{unmountRetries: defaultUnmountRetries, unmountRetryDelay: defaultUnmountRetryDelay}
+	ctx, cancel := cleanupContext()
+	defer cancel()
+	return b.unmountRetrying(ctx, 0, mountpoint)
+}
+
+// CheckSnapshotMount returns an error unless an APFS snapshot is mounted
+// exactly on mountpoint.
+func CheckSnapshotMount(mountpoint string) error {
+	m, err := statfsMount(mountpoint)
+	if err != nil {
+		return err
+	}
+	if filepath.Clean(m.mountedOn) != filepath.Clean(mountpoint) {
+		return errors.Errorf("%s is not a mountpoint (it is on %s)", mountpoint, m.mountedOn)
+	}
+	if _, _, ok := splitSnapshotDevice(m.mountedFrom); !ok || m.fsType != "apfs" {
+		return errors.Errorf("%s is not an APFS snapshot mount (%s, %s)", mountpoint, m.fsType, m.mountedFrom)
+	}
+	return nil
+}
+
+// IsMountpoint reports whether something is mounted exactly on path.
+func IsMountpoint(path string) bool {
+	m, err := statfsMount(path)
+	return err == nil && filepath.Clean(m.mountedOn) == filepath.Clean(path)
+}
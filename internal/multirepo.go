@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// RepoTarget is one of the repositories a run backs up to with WithRepos.
+// A nil PassphraseSource or BorgArgs uses the one of the run.
+type RepoTarget struct {
+	Name             string // for logs and the report, empty for Repo
+	Repo             string
+	PassphraseSource PassphraseSource
+	BorgArgs         []string
+}
+
+func (t RepoTarget) displayName() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.Repo
+}
+
+// RepoResult is the outcome of the archive in one repository when a run
+// backs up to several. Error is also set when the archive was created but
+// pruning or compacting the repository failed.
+type RepoResult struct {
+	Name    string        `json:"name,omitempty"`
+	Repo    string        `json:"repo"`
+	Archive string        `json:"archive,omitempty"`
+	Status  string        `json:"status"`
+	Error   string        `json:"error,omitempty"`
+	Stats   *ArchiveStats `json:"stats,omitempty"`
+}
+
+// multiRepo reports whether the run backs up to several repositories.
+func (b BorgBackup) multiRepo() bool {
+	return len(b.repos) > 1
+}
+
+// missingPassphrase reports whether one of the repositories has no way to
+// get its passphrase.
+func (b BorgBackup) missingPassphrase() bool {
+	if !b.multiRepo() {
+		return b.passphraseMechanism() == ""
+	}
+	for _, t := range b.repos {
+		if b.forRepo(t).passphraseMechanism() == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func duplicateRepo(targets []RepoTarget) string {
+	seen := map[string]bool{}
+	for _, t := range targets {
+		if seen[t.Repo] {
+			return t.Repo
+		}
+		seen[t.Repo] = true
+	}
+	return ""
+}
+
+// forRepo returns the backup as it runs against t.
+func (b BorgBackup) forRepo(t RepoTarget) BorgBackup {
+	b.repo = t.Repo
+	if t.PassphraseSource != nil {
+		b.passphraseSource = t.PassphraseSource
+		b.passphrase = ""
+	}
+	if t.BorgArgs != nil {
+		b.borgArgs = t.BorgArgs
+	}
+	return b
+}
+
+// backUpToRepos creates the archive of the mounted paths in every
+// repository, one after the other. A failing repository is recorded in its
+// result and the others go on. st is updated with the repository IDs.
+func (b BorgBackup) backUpToRepos(ctx context.Context, hostName string, backupName string, paths []string, st *runState) []RepoResult {
+	results := make([]RepoResult, len(b.repos))
+	for i, t := range b.repos {
+		results[i] = RepoResult{Name: t.Name, Repo: t.Repo, Archive: backupName, Status: ArchiveFailed}
+		rb := b.forRepo(t)
+		b.logf(LevelInfo, "Repository %s", t.displayName())
+		stats, err := rb.backUpToRepo(ctx, t, backupName, paths, st)
+		if err != nil {
+			b.logf(LevelError, "Archive in repository %s failed: %v", t.displayName(), err)
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].Status = ArchiveCreated
+		results[i].Stats = stats
+		if b.prune != nil {
+			b.enterPhase("prune")
+			err = rb.pruneArchives(ctx, rb.hostArchiveGlob(hostName, ""), backupName)
+		}
+		if err == nil && b.compact {
+			b.enterPhase("compact")
+			err = rb.compactRepository(ctx)
+		}
+		if err != nil {
+			b.logf(LevelError, "Repository %s: %v", t.displayName(), err)
+			results[i].Error = err.Error()
+		}
+		b.enterPhase("borg")
+	}
+	return results
+}
+
+// backUpToRepo runs the repository checks the preflight leaves out with
+// several repositories, then borg create.
+func (b BorgBackup) backUpToRepo(ctx context.Context, t RepoTarget, backupName string, paths []string, st *runState) (*ArchiveStats, error) {
+	if t.PassphraseSource != nil {
+		var err error
+		b.logf(LevelInfo, "Reading passphrase from %s", t.PassphraseSource.Name())
+		b.passphrase, err = t.PassphraseSource.Passphrase(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	info, err := b.repoInfoOrInit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.checkRepoID(info, st); err != nil {
+		return nil, err
+	}
+	b.archiveComment = appendComment(b.archiveComment, "repository ID: "+info.Repository.ID)
+	if b.quotaWarnPercent > 0 || b.quotaAbortPercent > 0 {
+		if err := b.checkQuota(info); err != nil {
+			return nil, err
+		}
+	}
+	stats, duration, err := b.invokeBorg(ctx, backupName, paths)
+	if err != nil || stats == nil {
+		return nil, err
+	}
+	// the sizes differ by repository, e.g. by compression
+	sb := b
+	sb.label = b.label + "@" + t.displayName()
+	return newArchiveStats(*stats, duration), sb.recordArchiveSize(backupName, stats, nil)
+}
+
+// appendComment adds part to the archive comment.
+func appendComment(comment string, part string) string {
+	if comment == "" {
+		return part
+	}
+	return comment + "; " + part
+}
+
+// repoPartialError summarizes the failed repositories, nil if there are
+// none.
+func repoPartialError(results []RepoResult) *PartialError {
+	var p *PartialError
+	for _, r := range results {
+		if r.Error == "" {
+			continue
+		}
+		if p == nil {
+			p = &PartialError{Repositories: true}
+		}
+		name := r.Repo
+		if r.Name != "" {
+			name = r.Name
+		}
+		p.Failed = append(p.Failed, name)
+		p.Errors = append(p.Errors, errors.New(r.Error))
+	}
+	return p
+}
+
+// allReposFailed reports whether no archive was created.
+func allReposFailed(results []RepoResult) bool {
+	for _, r := range results {
+		if r.Status == ArchiveCreated {
+			return false
+		}
+	}
+	return true
+}
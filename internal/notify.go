@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// how long showing the notification may take
+	notifyTimeout = 10 * time.Second
+	// longer errors are cut off in the notification
+	notifyMaxError = 200
+)
+
+// consoleUser returns the user logged in at the console, i.e. the owner of
+// /dev/console. ok is false if nobody is, root owns it at the login window.
+func consoleUser() (uid int, name string, ok bool) {
+	info, err := os.Stat("/dev/console")
+	if err != nil {
+		return 0, "", false
+	}
+	st, isStat := info.Sys().(*syscall.Stat_t)
+	if !isStat || st.Uid == 0 {
+		return 0, "", false
+	}
+	u, err := user.LookupId(strconv.Itoa(int(st.Uid)))
+	if err != nil {
+		return 0, "", false
+	}
+	return int(st.Uid), u.Username, true
+}
+
+// appleScriptString quotes s as an AppleScript string literal.
+func appleScriptString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// notify shows the outcome of the run in the notification center of the
+// console user. Without a console session, e.g. on a headless Mac, nothing
+// is shown; failures are only logged.
+func (b BorgBackup) notify(report Report, runErr error) {
+	if !b.notifyCompletion {
+		return
+	}
+	uid, name, ok := consoleUser()
+	if !ok {
+		b.logf(LevelDebug, "Nobody is logged in at the console, not showing a notification")
+		return
+	}
+	title := "Backup finished"
+	msg := fmt.Sprintf("%s in %s", report.archiveNames(), time.Since(report.Start).Round(time.Second))
+	if runErr != nil {
+		title = "Backup failed"
+		msg = runErr.Error()
+		if len(msg) > notifyMaxError {
+			msg = msg[:notifyMaxError] + "…"
+		}
+	}
+	script := fmt.Sprintf("display notification %s with title %s", appleScriptString(msg), appleScriptString("borg-tm: "+title))
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	// osascript has to run in the session of the user, and as the user
+	args := []string{"asuser", strconv.Itoa(uid), "sudo", "-u", name, "osascript", "-e", script}
+	if _, stderr, err := b.run(ctx, "launchctl", args, RunOptions{}); err != nil {
+		b.logf(LevelWarn, "%v", errors.Wrapf(err, "error while showing a notification: %s", strings.TrimSpace(string(stderr))))
+	}
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const mountPollInterval = 5 * time.Second
+
+// isMounted reports whether a filesystem is mounted exactly at path.
+func isMounted(path string) bool {
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	info, err := statfsMount(path)
+	return err == nil && info.mountedOn == path
+}
+
+// WaitForMount blocks until one of paths has been continuously mounted for
+// at least debounce, and returns that path. A flaky connection that drops the
+// volume resets its timer, so it doesn't trigger a run per reconnect. The
+// waiting is logged to logger.
+func WaitForMount(ctx context.Context, paths []string, debounce time.Duration, logger Logger) (string, error) {
+	log := newRunLog(logger)
+	if _, err := statfsMount("/"); err != nil {
+		return "", errors.Wrap(err, "cannot watch for mounts")
+	}
+	log.logf(LevelInfo, "Waiting for one of %v to be mounted", paths)
+	since := make(map[string]time.Time)
+	ticker := time.NewTicker(mountPollInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		for _, path := range paths {
+			if !isMounted(path) {
+				delete(since, path)
+				continue
+			}
+			first, ok := since[path]
+			if !ok {
+				log.logf(LevelInfo, "%s appeared, waiting %s for it to settle", path, debounce)
+				since[path] = now
+				first = now
+			}
+			if now.Sub(first) >= debounce {
+				log.logf(LevelInfo, "%s is mounted", path)
+				return path, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", errors.Wrap(ctx.Err(), "stopped waiting for mount")
+		case <-ticker.C:
+		}
+	}
+}
+
+// EjectVolume ejects the disk mounted at path with `diskutil eject`.
+func EjectVolume(path string) error {
+	cmd := exec.Command("diskutil", "eject", path)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = safeEnvs()
+	return errors.Wrapf(cmd.Run(), "error while ejecting %s", path)
+}
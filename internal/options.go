@@ -0,0 +1,739 @@
+package internal
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Option configures a BorgBackup created by NewBackup.
+type Option func(*BorgBackup)
+
+// WithMountpoints the directories the snapshots are mounted on, one per source.
+func WithMountpoints(mountpoints ...string) Option {
+	return func(b *BorgBackup) {
+		b.mountpoints = mountpoints
+	}
+}
+
+// WithSources the volumes or directories to back up.
+func WithSources(sources ...string) Option {
+	return func(b *BorgBackup) {
+		b.sources = sources
+	}
+}
+
+// WithRepo backs up to repo instead of BORG_REPO. borg gets it as BORG_REPO
+// in its own environment only.
+func WithRepo(repo string) Option {
+	return func(b *BorgBackup) {
+		b.repo = repo
+	}
+}
+
+// WithRepos backs up to every repository of targets in one run, after the
+// snapshots were mounted once. The lock, journal and state files belong to
+// the first one. A single target works like WithRepo.
+func WithRepos(targets ...RepoTarget) Option {
+	return func(b *BorgBackup) {
+		b.repos = targets
+	}
+}
+
+// WithLockFile the file locked while a backup runs. By default it is
+// derived from BORG_REPO, see DefaultLockFile.
+func WithLockFile(path string) Option {
+	return func(b *BorgBackup) {
+		b.lockFile = path
+	}
+}
+
+// WithUseExistingSnapshots backs up existing snapshots instead of creating new ones.
+func WithUseExistingSnapshots(use bool) Option {
+	return func(b *BorgBackup) {
+		b.useExistingSnapshots = use
+	}
+}
+
+// WithSnapshotsToUse forces the snapshot of each source, an empty name picks the latest one.
+func WithSnapshotsToUse(snapshots ...string) Option {
+	return func(b *BorgBackup) {
+		b.snapshotsToUse = snapshots
+	}
+}
+
+// WithBackupName sets the archive name template, see expandArchiveName.
+func WithBackupName(name string) Option {
+	return func(b *BorgBackup) {
+		if name != "" {
+			b.backupName = name
+		}
+	}
+}
+
+// WithBorgArgs appends arguments to `borg create`.
+func WithBorgArgs(args ...string) Option {
+	return func(b *BorgBackup) {
+		b.borgArgs = args
+	}
+}
+
+// WithDryRun only prints the borg command instead of running it.
+func WithDryRun(dryRun bool) Option {
+	return func(b *BorgBackup) {
+		b.dryRun = dryRun
+	}
+}
+
+// WithQuota sets the storage quota utilization thresholds, 0 disables a threshold.
+func WithQuota(warnPercent float64, abortPercent float64) Option {
+	return func(b *BorgBackup) {
+		b.quotaWarnPercent = warnPercent
+		b.quotaAbortPercent = abortPercent
+	}
+}
+
+// WithLabel sets the label size anomalies are compared within.
+func WithLabel(label string) Option {
+	return func(b *BorgBackup) {
+		b.label = label
+	}
+}
+
+// WithHistoryFile sets the file recording the archive sizes. By default it is
+// derived from the repository, see DefaultHistoryFile.
+func WithHistoryFile(path string) Option {
+	return func(b *BorgBackup) {
+		b.historyFile = path
+	}
+}
+
+// WithSizeAnomalyFactor enables size anomaly warnings, 0 disables them.
+func WithSizeAnomalyFactor(factor float64) Option {
+	return func(b *BorgBackup) {
+		b.sizeAnomalyFactor = factor
+	}
+}
+
+// WithPassphraseSource reads the passphrase from source instead of BORG_PASSPHRASE.
+func WithPassphraseSource(source PassphraseSource) Option {
+	return func(b *BorgBackup) {
+		b.passphraseSource = source
+	}
+}
+
+// WithAllowUnencrypted lets a backup run without any passphrase, for
+// repositories without encryption or with a key without passphrase.
+func WithAllowUnencrypted(allow bool) Option {
+	return func(b *BorgBackup) {
+		b.allowUnencrypted = allow
+	}
+}
+
+// WithUmask sets the umask of borg and borg-tm, -1 keeps the inherited one.
+func WithUmask(umask int) Option {
+	return func(b *BorgBackup) {
+		b.umask = umask
+	}
+}
+
+// WithSparse forces --sparse on or off, nil detects it.
+func WithSparse(sparse *bool) Option {
+	return func(b *BorgBackup) {
+		b.sparse = sparse
+	}
+}
+
+// WithChunkerParams sets the chunker params, as returned by ParseChunkerParams.
+func WithChunkerParams(params string) Option {
+	return func(b *BorgBackup) {
+		b.chunkerParams = params
+	}
+}
+
+// WithStateFile sets the file persisted between runs. By default it is
+// derived from the repository, see DefaultStateFile.
+func WithStateFile(path string) Option {
+	return func(b *BorgBackup) {
+		b.stateFile = path
+	}
+}
+
+// WithHostname replaces the system hostname in archive names.
+func WithHostname(hostname string) Option {
+	return func(b *BorgBackup) {
+		b.hostname = hostname
+	}
+}
+
+// WithThermal pauses borg under thermal pressure, nil disables it.
+func WithThermal(thermal *ThermalOptions) Option {
+	return func(b *BorgBackup) {
+		b.thermal = thermal
+	}
+}
+
+// WithIOPolicy sets the disk I/O policy of borg.
+func WithIOPolicy(policy string) Option {
+	return func(b *BorgBackup) {
+		b.ioPolicy = policy
+	}
+}
+
+// WithKeepSnapshots keeps the created snapshots after the backup.
+func WithKeepSnapshots(keep bool) Option {
+	return func(b *BorgBackup) {
+		b.keepSnapshots = keep
+	}
+}
+
+// WithSnapshotRetention prunes the snapshots created by borg-tm after the backup, nil disables it.
+func WithSnapshotRetention(retention *SnapshotRetention) Option {
+	return func(b *BorgBackup) {
+		b.snapshotRetention = retention
+	}
+}
+
+// WithConsistentSnapshots picks existing snapshots taken within window of each other.
+func WithConsistentSnapshots(window time.Duration) Option {
+	return func(b *BorgBackup) {
+		b.consistentSnapshots = true
+		b.consistencyWindow = window
+	}
+}
+
+// WithMaxSnapshotSpread limits the time between the first and last created snapshot.
+func WithMaxSnapshotSpread(spread time.Duration, policy string) Option {
+	return func(b *BorgBackup) {
+		b.maxSnapshotSpread = spread
+		b.snapshotSpreadPolicy = policy
+	}
+}
+
+// WithReportChanged reports the files changed on the sources after their snapshot.
+func WithReportChanged(report bool) Option {
+	return func(b *BorgBackup) {
+		b.reportChanged = report
+	}
+}
+
+// WithAutoExcludes selects the automatic exclusions of the repository and cache, and of nested sources and mountpoints.
+func WithAutoExcludes(repo bool, nested bool) Option {
+	return func(b *BorgBackup) {
+		b.noAutoExcludeRepo = !repo
+		b.noAutoExcludeNested = !nested
+	}
+}
+
+// WithExcludeSources excludes paths on the live filesystem from the archive.
+func WithExcludeSources(paths ...string) Option {
+	return func(b *BorgBackup) {
+		b.excludeSources = paths
+	}
+}
+
+// WithProgress shows the progress of borg create, see progressLine.
+func WithProgress(enable bool) Option {
+	return func(b *BorgBackup) {
+		b.showProgress = enable
+	}
+}
+
+// WithProgressFifo writes progress events to the named pipe at path.
+func WithProgressFifo(path string) Option {
+	return func(b *BorgBackup) {
+		b.progressFifoPath = path
+	}
+}
+
+// WithAcceptRepoChanges answers yes to borg's questions about relocated and unknown repositories.
+func WithAcceptRepoChanges(accept bool) Option {
+	return func(b *BorgBackup) {
+		b.acceptRepoChanges = accept
+	}
+}
+
+// WithSnapshotListTool selects the tool snapshots are listed with.
+func WithSnapshotListTool(tool string) Option {
+	return func(b *BorgBackup) {
+		b.snapshotListTool = tool
+	}
+}
+
+// WithSourceUUIDs records the volume UUID of each source, as returned by ResolveVolumeUUIDs.
+func WithSourceUUIDs(uuids ...string) Option {
+	return func(b *BorgBackup) {
+		b.sourceUUIDs = uuids
+	}
+}
+
+// WithSnapshotRetries sets how often a busy snapshot creation is retried.
+func WithSnapshotRetries(retries int) Option {
+	return func(b *BorgBackup) {
+		b.snapshotRetries = retries
+	}
+}
+
+// WithContinueOnError leaves out sources whose snapshot or mount fails.
+func WithContinueOnError(continueOnError bool) Option {
+	return func(b *BorgBackup) {
+		b.continueOnError = continueOnError
+	}
+}
+
+// WithRecordChanges records the changed files of the run below artifactsDir.
+func WithRecordChanges(artifactsDir string) Option {
+	return func(b *BorgBackup) {
+		b.recordChanges = true
+		b.artifactsDir = artifactsDir
+	}
+}
+
+// WithPrune runs borg prune after the backup, nil disables it.
+func WithPrune(prune *PruneOptions) Option {
+	return func(b *BorgBackup) {
+		b.prune = prune
+	}
+}
+
+// WithInitIfMissing runs borg init with encryption during the preflight
+// when the repository doesn't exist yet.
+func WithInitIfMissing(init bool, encryption string) Option {
+	return func(b *BorgBackup) {
+		b.initIfMissing = init
+		b.initEncryption = encryption
+	}
+}
+
+// WithKeyExport runs borg key export to path in format when the export is
+// missing, or on every run with overwrite. An empty path disables it.
+func WithKeyExport(path string, format string, overwrite bool) Option {
+	return func(b *BorgBackup) {
+		b.keyExportPath = path
+		b.keyExportFormat = format
+		b.keyExportOverwrite = overwrite
+	}
+}
+
+// WithVerify compares sample random files of the new archive with the
+// mounted snapshots, 0 disables it.
+func WithVerify(sample int) Option {
+	return func(b *BorgBackup) {
+		b.verifySample = sample
+	}
+}
+
+// WithSkipIfUnchanged skips borg create when detection, one of the
+// ChangeDetection heuristics, finds no changes since the last archive. An
+// empty detection disables it.
+func WithSkipIfUnchanged(detection string) Option {
+	return func(b *BorgBackup) {
+		b.changeDetection = detection
+	}
+}
+
+// WithHooks runs the commands of hooks around the phases of a run.
+func WithHooks(hooks Hooks) Option {
+	return func(b *BorgBackup) {
+		b.hooks = hooks
+	}
+}
+
+// OnPhase calls f at every Phase of a run. It can be given more than once.
+func OnPhase(f func(phase Phase, info PhaseInfo)) Option {
+	return func(b *BorgBackup) {
+		b.callbacks = b.callbacks.with(nil, nil)
+		b.callbacks.phase = append(b.callbacks.phase, f)
+	}
+}
+
+// OnProgress calls f with the progress of borg create, which then runs with
+// --progress. It can be given more than once.
+func OnProgress(f func(ProgressEvent)) Option {
+	return func(b *BorgBackup) {
+		b.callbacks = b.callbacks.with(nil, nil)
+		b.callbacks.progress = append(b.callbacks.progress, f)
+	}
+}
+
+// WithCheck runs borg check after a successful backup when the last check is
+// older than check.Interval, nil disables it.
+func WithCheck(check *CheckOptions) Option {
+	return func(b *BorgBackup) {
+		b.check = check
+	}
+}
+
+// WithSSHControlMaster shares one ssh connection between all borg invocations.
+func WithSSHControlMaster(enable bool) Option {
+	return func(b *BorgBackup) {
+		b.sshControlMaster = enable
+	}
+}
+
+// WithSync selects whether buffers are flushed before the snapshots, and which files get F_FULLFSYNC.
+func WithSync(sync bool, fullfsyncPaths ...string) Option {
+	return func(b *BorgBackup) {
+		b.noSync = !sync
+		b.fullfsyncPaths = fullfsyncPaths
+	}
+}
+
+// WithQuiesceHooks runs hooks around the snapshot of their source, see ParseQuiesceHooks.
+func WithQuiesceHooks(hooks map[string]QuiesceHooks, timeout time.Duration) Option {
+	return func(b *BorgBackup) {
+		b.quiesceHooks = hooks
+		b.quiesceTimeout = timeout
+	}
+}
+
+// WithAcceptNewRepo records a changed repository ID instead of failing.
+func WithAcceptNewRepo(accept bool) Option {
+	return func(b *BorgBackup) {
+		b.acceptNewRepo = accept
+	}
+}
+
+// WithCompact runs borg compact after the backup and prune.
+func WithCompact(compact bool) Option {
+	return func(b *BorgBackup) {
+		b.compact = compact
+	}
+}
+
+// WithStatsSummary prints the statistics of the archive at the end of Run.
+func WithStatsSummary(summary bool) Option {
+	return func(b *BorgBackup) {
+		b.statsSummary = summary
+	}
+}
+
+// WithFailOnWarnings treats borg's warnings (exit status 1) as errors.
+func WithFailOnWarnings(fail bool) Option {
+	return func(b *BorgBackup) {
+		b.failOnWarnings = fail
+	}
+}
+
+// WithSnapshotTool selects the tool snapshots are created with.
+func WithSnapshotTool(tool string) Option {
+	return func(b *BorgBackup) {
+		b.snapshotTool = tool
+	}
+}
+
+// WithSnapUtilPath sets the location of snapUtil instead of looking it up.
+func WithSnapUtilPath(path string) Option {
+	return func(b *BorgBackup) {
+		b.snapUtilPath = path
+	}
+}
+
+// WithRunner runs borg and the helpers such as tmutil, snapUtil, diskutil
+// and mount_apfs with r.
+func WithRunner(r Runner) Option {
+	return func(b *BorgBackup) {
+		b.runner = r
+	}
+}
+
+// WithLogger sends the log messages of a run to l.
+func WithLogger(l Logger) Option {
+	return func(b *BorgBackup) {
+		b.logger = l
+	}
+}
+
+// WithReportFile writes the Report of every run to path as JSON, also when
+// the run fails.
+func WithReportFile(path string) Option {
+	return func(b *BorgBackup) {
+		b.reportFile = path
+	}
+}
+
+// WithPing notifies url at the end of every run, and with start also when
+// it begins. Dry runs don't ping.
+func WithPing(url string, start bool) Option {
+	return func(b *BorgBackup) {
+		b.pingURL = url
+		b.pingStart = start
+	}
+}
+
+// WithNotify shows a notification to the console user when a run finishes.
+func WithNotify(notify bool) Option {
+	return func(b *BorgBackup) {
+		b.notifyCompletion = notify
+	}
+}
+
+// WithUnmountRetries sets how often a busy unmount is retried before it is
+// forced, and the delay before the first retry, which doubles every time.
+func WithUnmountRetries(retries int, delay time.Duration) Option {
+	return func(b *BorgBackup) {
+		b.unmountRetries = retries
+		b.unmountRetryDelay = delay
+	}
+}
+
+// WithBorgLockWait passes --lock-wait to borg, so that it waits up to wait
+// for a repository lock held by another borg.
+func WithBorgLockWait(wait time.Duration) Option {
+	return func(b *BorgBackup) {
+		b.borgLockWait = wait
+	}
+}
+
+// WithBorgRetries runs borg create again up to retries times, delay apart,
+// when it failed because the repository was locked.
+func WithBorgRetries(retries int, delay time.Duration) Option {
+	return func(b *BorgBackup) {
+		b.borgRetries = retries
+		b.borgRetryDelay = delay
+	}
+}
+
+// WithLockWait waits up to wait for a lock held by another run instead of
+// failing right away.
+func WithLockWait(wait time.Duration) Option {
+	return func(b *BorgBackup) {
+		b.lockWait = wait
+	}
+}
+
+// WithForceMountpoint mounts snapshots over mountpoints that aren't empty.
+func WithForceMountpoint(force bool) Option {
+	return func(b *BorgBackup) {
+		b.forceMountpoint = force
+	}
+}
+
+// WithJournalFile sets the journal of created snapshots and mounts that
+// `borg-tm cleanup` reads after a crash. By default it is derived from
+// BORG_REPO, see DefaultJournalFile.
+func WithJournalFile(path string) Option {
+	return func(b *BorgBackup) {
+		b.journalFile = path
+	}
+}
+
+// WithAutoRecover sets whether a run first cleans up what an interrupted
+// run left in the journal. It is on by default.
+func WithAutoRecover(recover bool) Option {
+	return func(b *BorgBackup) {
+		b.noAutoRecover = !recover
+	}
+}
+
+// WithSnapshotPrefix sets the start of the names of created snapshots,
+// DefaultSnapshotPrefix by default. Only snapshots named with it are pruned
+// or cleaned up.
+func WithSnapshotPrefix(prefix string) Option {
+	return func(b *BorgBackup) {
+		b.snapshotPrefix = prefix
+	}
+}
+
+// WithSeparateArchives creates one archive per source, named after the
+// archive template and the source, instead of one archive of all of them.
+func WithSeparateArchives(separate bool) Option {
+	return func(b *BorgBackup) {
+		b.separateArchives = separate
+	}
+}
+
+// WithStoreOriginalPaths archives the files under the paths of the sources
+// rather than the mountpoints, with the snapshots mounted below the
+// mountpoints at the paths of the sources. It is on by default.
+func WithStoreOriginalPaths(store bool) Option {
+	return func(b *BorgBackup) {
+		b.storeOriginalPaths = store
+	}
+}
+
+// WithExcludes excludes paths relative to every source, absolute paths on
+// the live filesystem like WithExcludeSources, or borg patterns given with a
+// style prefix (sh:, fm:, re:, pp:, pf:), which are passed as they are.
+func WithExcludes(excludes ...string) Option {
+	return func(b *BorgBackup) {
+		b.excludeArgs = excludes
+	}
+}
+
+// WithExcludeCaches passes --exclude-caches to borg, leaving out directories
+// tagged with a CACHEDIR.TAG.
+func WithExcludeCaches(exclude bool) Option {
+	return func(b *BorgBackup) {
+		b.excludeCaches = exclude
+	}
+}
+
+// WithTMExclusions leaves out what Time Machine leaves out: the paths of its
+// exclusion lists and everything `tmutil isexcluded` reports as excluded up
+// to depth directory levels below each source.
+func WithTMExclusions(honor bool, depth int) Option {
+	return func(b *BorgBackup) {
+		b.honorTMExclusions = honor
+		b.tmExclusionDepth = depth
+	}
+}
+
+// NewBackup returns a backup configured by opts, or an error if they don't
+// make sense together.
+func NewBackup(opts ...Option) (BorgBackup, error) {
+	b := BorgBackup{
+		backupName:           DefaultArchiveTemplate,
+		label:                "default",
+		umask:                -1,
+		ioPolicy:             IOPolicyStandard,
+		snapshotSpreadPolicy: SpreadPolicyRetry,
+		snapshotListTool:     SnapshotListAuto,
+		snapshotTool:         SnapshotToolAuto,
+		quiesceTimeout:       time.Minute,
+		unmountRetries:       defaultUnmountRetries,
+		unmountRetryDelay:    defaultUnmountRetryDelay,
+		snapshotPrefix:       DefaultSnapshotPrefix,
+		storeOriginalPaths:   true,
+		tmExclusionDepth:     DefaultTMExclusionDepth,
+		hooks:                Hooks{Timeout: DefaultHookTimeout},
+	}
+	for _, opt := range opts {
+		opt(&b)
+	}
+	if len(b.repos) == 1 {
+		b = b.forRepo(b.repos[0])
+		b.repos = nil
+	}
+	if len(b.repos) > 0 && b.repo == "" {
+		b.repo = b.repos[0].Repo
+	}
+	if b.repo == "" {
+		b.repo = os.Getenv("BORG_REPO")
+	}
+	if b.lockFile == "" {
+		b.lockFile = DefaultLockFile(b.repo)
+	}
+	if b.journalFile == "" {
+		b.journalFile = DefaultJournalFile(b.repo)
+	}
+	if b.stateFile == "" {
+		b.stateFile = DefaultStateFile(b.repo)
+	}
+	if b.historyFile == "" {
+		b.historyFile = DefaultHistoryFile(b.repo)
+	}
+	b.tmExclusionCacheFile = tmExclusionCacheFile(b.repo)
+	// relative to the sources as given, before they are grouped by volume
+	paths, patterns := resolveExcludes(b.sources, b.excludeArgs)
+	b.excludeSources = append(append([]string(nil), b.excludeSources...), paths...)
+	b.excludePatterns = patterns
+	if err := b.validate(); err != nil {
+		return b, err
+	}
+	b.groupSubdirectorySources(lookupVolume)
+	if b.storeOriginalPaths {
+		b.mountBases = b.mountpoints
+		b.mountpoints = originalPathMountpoints(b.sources, b.mountpoints)
+	}
+	return b, nil
+}
+
+func (b BorgBackup) validate() error {
+	switch {
+	case len(b.mountpoints) == 0:
+		return errors.New("need at least one mountpoint, such as `-mountpoint /tmp/snapshot`")
+	case len(b.sources) == 0:
+		return errors.New("need at least one source, such as `-source /`")
+	case b.repo == "":
+		return errors.New("no repository given, use -repo or set BORG_REPO")
+	case len(b.mountpoints) != len(b.sources):
+		return errors.Errorf("the number of mountpoints provided (%d) is not the same as the number of sources provided (%d)", len(b.mountpoints), len(b.sources))
+	case b.missingPassphrase():
+		return errors.New("no passphrase configured: set BORG_PASSPHRASE or BORG_PASSCOMMAND, or use -passphrase-file, -keychain-item or -op-item (-allow-unencrypted for repositories without one)")
+	case validateArchiveTemplate(b.backupName) != nil:
+		return validateArchiveTemplate(b.backupName)
+	case b.prune != nil && b.prune.validate(b.backupName) != nil:
+		return b.prune.validate(b.backupName)
+	case b.pingStart && b.pingURL == "":
+		return errors.New("-ping-start requires -ping-url")
+	case !b.useExistingSnapshots && len(b.snapshotsToUse) > 0:
+		return errors.New("need --use-existing-snapshots when providing at least one --snapshotToUse")
+	case len(b.snapshotsToUse) > 0 && len(b.snapshotsToUse) != len(b.sources):
+		return errors.Errorf("the number of sources and mountpoints provided (%d) is not the same as the number of snapshots to use (`--snapshotToUse`) provided (%d)", len(b.sources), len(b.snapshotsToUse))
+	case len(b.sourceUUIDs) > 0 && len(b.sourceUUIDs) != len(b.sources):
+		return errors.Errorf("got %d volume UUIDs for %d sources", len(b.sourceUUIDs), len(b.sources))
+	case b.quotaWarnPercent < 0 || b.quotaWarnPercent > 100 || b.quotaAbortPercent < 0 || b.quotaAbortPercent > 100:
+		return errors.New("-quota-warn-percent and -quota-abort-percent must be between 0 and 100")
+	case b.sizeAnomalyFactor != 0 && b.sizeAnomalyFactor <= 1:
+		return errors.New("-size-anomaly-factor must be greater than 1")
+	case b.umask < -1 || b.umask > 0777:
+		return errors.Errorf("invalid umask %o", b.umask)
+	case b.ioPolicy != IOPolicyStandard && b.ioPolicy != IOPolicyThrottle:
+		return errors.Errorf("invalid -io-policy %q, expected standard or throttle", b.ioPolicy)
+	case b.consistentSnapshots && !b.useExistingSnapshots:
+		return errors.New("-consistent-snapshots requires -use-existing-snapshots")
+	case b.consistentSnapshots && b.consistencyWindow <= 0:
+		return errors.New("-consistency-window must be positive")
+	case b.maxSnapshotSpread < 0:
+		return errors.New("-max-snapshot-spread must not be negative")
+	case b.snapshotSpreadPolicy != SpreadPolicyRetry && b.snapshotSpreadPolicy != SpreadPolicyFail:
+		return errors.Errorf("invalid -snapshot-spread-policy %q, expected retry or fail", b.snapshotSpreadPolicy)
+	case b.snapshotListTool != SnapshotListAuto && b.snapshotListTool != SnapshotListDiskutil && b.snapshotListTool != SnapshotListTmutil:
+		return errors.Errorf("invalid -snapshot-list-tool %q, expected auto, diskutil or tmutil", b.snapshotListTool)
+	case b.snapshotTool != SnapshotToolAuto && b.snapshotTool != SnapshotToolSnapUtil && b.snapshotTool != SnapshotToolTmutil:
+		return errors.Errorf("invalid -snapshot-tool %q, expected auto, snaputil or tmutil", b.snapshotTool)
+	case b.snapshotRetries < 0:
+		return errors.New("-snapshot-retries must not be negative")
+	case b.unmountRetries < 0:
+		return errors.New("-unmount-retries must not be negative")
+	case b.lockWait < 0:
+		return errors.New("-lock-wait must not be negative")
+	case b.borgLockWait < 0:
+		return errors.New("-borg-lock-wait must not be negative")
+	case b.borgRetries < 0 || b.borgRetryDelay < 0:
+		return errors.New("-borg-retries and -borg-retry-delay must not be negative")
+	case b.tmExclusionDepth < 0:
+		return errors.New("-tm-exclusion-depth must not be negative")
+	case len(b.mountpoints) == len(b.sources) && b.checkExcludeSources() != nil:
+		return b.checkExcludeSources()
+	case ValidateSnapshotPrefix(b.snapshotPrefix) != nil:
+		return ValidateSnapshotPrefix(b.snapshotPrefix)
+	case b.noSync && len(b.fullfsyncPaths) > 0:
+		return errors.New("-fullfsync-path can't be used with -no-sync")
+	case len(b.quiesceHooks) > 0 && b.useExistingSnapshots:
+		return errors.New("-quiesce can't be used with -use-existing-snapshots")
+	case b.quiesceTimeout <= 0:
+		return errors.New("-quiesce-timeout must be positive")
+	case b.recordChanges && b.artifactsDir == "":
+		return errors.New("-record-changes needs an -artifacts-dir")
+	case b.recordChanges && b.separateArchives:
+		return errors.New("-record-changes can't be used with -separate-archives")
+	case b.multiRepo() && (b.separateArchives || b.recordChanges || b.check != nil || b.verifySample > 0):
+		return errors.New("-separate-archives, -record-changes, -check and -verify-after-backup can't be used with several repositories")
+	case b.separateArchives && b.verifySample > 0:
+		return errors.New("-verify-after-backup can't be used with -separate-archives")
+	case b.changeDetection != "" && (b.multiRepo() || b.separateArchives):
+		return errors.New("-skip-if-unchanged can't be used with several repositories or -separate-archives")
+	case b.changeDetection != "" && b.changeDetection != ChangeDetectionDryRun && b.changeDetection != ChangeDetectionManifest:
+		return errors.Errorf("invalid -change-detection %q, expected %s or %s", b.changeDetection, ChangeDetectionDryRun, ChangeDetectionManifest)
+	case b.hooks.Timeout <= 0:
+		return errors.New("-hook-timeout must be positive")
+	case b.verifySample < 0:
+		return errors.New("-verify-sample must not be negative")
+	case b.check != nil && b.check.Mode != CheckModeRepository && b.check.Mode != CheckModeArchives:
+		return errors.Errorf("invalid -check-mode %q, expected %s or %s", b.check.Mode, CheckModeRepository, CheckModeArchives)
+	case b.keyExportPath != "" && b.keyExportFormat != KeyExportBinary && b.keyExportFormat != KeyExportPaper:
+		return errors.Errorf("invalid -key-export-format %q, expected %s or %s", b.keyExportFormat, KeyExportBinary, KeyExportPaper)
+	case b.keyExportPath != "" && b.multiRepo():
+		return errors.New("-key-export-path can't be used with several repositories")
+	case b.initIfMissing && b.initEncryption == "":
+		return errors.New("-init-if-missing needs -init-encryption")
+	case b.check != nil && b.check.Interval < 0:
+		return errors.New("-check-interval must not be negative")
+	case duplicateRepo(b.repos) != "":
+		return errors.Errorf("repository %s is given twice", duplicateRepo(b.repos))
+	}
+	return nil
+}
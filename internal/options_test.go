@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validOptions is a backup NewBackup accepts, which the tests break.
+func validOptions(opts ...Option) []Option {
+	return append([]Option{
+		WithSources("/"),
+		WithMountpoints("/tmp/snapshot"),
+		WithRepo("/backups/a"),
+		WithAllowUnencrypted(true),
+	}, opts...)
+}
+
+func TestNewBackupRejectsInvalidOptions(t *testing.T) {
+	if _, err := NewBackup(validOptions()...); err != nil {
+		t.Fatalf("NewBackup rejected the valid options: %v", err)
+	}
+	tests := []struct {
+		name string
+		opts []Option
+		want string // part of the error
+	}{
+		{"more mountpoints than sources", validOptions(WithMountpoints("/tmp/snapshot", "/tmp/snapshot-data")), "number of mountpoints"},
+		{"no mountpoint", validOptions(WithMountpoints()), "need at least one mountpoint"},
+		{"no source", validOptions(WithSources()), "need at least one source"},
+		{"snapshots to use without using existing ones", validOptions(WithSnapshotsToUse("com.apple.TimeMachine.2024-01-01-000000.local")), "--use-existing-snapshots"},
+		{"too many snapshots to use", validOptions(WithUseExistingSnapshots(true), WithSnapshotsToUse("a", "b")), "number of snapshots to use"},
+		{"ping start without URL", validOptions(WithPing("", true)), "-ping-start requires -ping-url"},
+		{"quota above 100", validOptions(WithQuota(101, 0)), "between 0 and 100"},
+		{"negative quota", validOptions(WithQuota(0, -1)), "between 0 and 100"},
+		{"size anomaly factor of 1", validOptions(WithSizeAnomalyFactor(1)), "-size-anomaly-factor"},
+		{"umask above 0777", validOptions(WithUmask(01000)), "invalid umask"},
+		{"unknown I/O policy", validOptions(WithIOPolicy("fast")), "invalid -io-policy"},
+		{"consistent snapshots without existing ones", validOptions(WithConsistentSnapshots(time.Minute)), "requires -use-existing-snapshots"},
+		{"no consistency window", validOptions(WithUseExistingSnapshots(true), WithConsistentSnapshots(0)), "-consistency-window"},
+		{"negative snapshot spread", validOptions(WithMaxSnapshotSpread(-time.Second, SpreadPolicyRetry)), "-max-snapshot-spread"},
+		{"unknown spread policy", validOptions(WithMaxSnapshotSpread(time.Second, "ignore")), "-snapshot-spread-policy"},
+		{"unknown snapshot list tool", validOptions(WithSnapshotListTool("ls")), "-snapshot-list-tool"},
+		{"unknown snapshot tool", validOptions(WithSnapshotTool("zfs")), "-snapshot-tool"},
+		{"negative snapshot retries", validOptions(WithSnapshotRetries(-1)), "-snapshot-retries"},
+		{"negative unmount retries", validOptions(WithUnmountRetries(-1, time.Second)), "-unmount-retries"},
+		{"negative lock wait", validOptions(WithLockWait(-time.Second)), "-lock-wait"},
+		{"negative borg lock wait", validOptions(WithBorgLockWait(-time.Second)), "-borg-lock-wait"},
+		{"negative borg retries", validOptions(WithBorgRetries(-1, time.Second)), "-borg-retries"},
+		{"relative excluded source", validOptions(WithExcludeSources("Library/Caches")), "not an absolute path"},
+		{"invalid snapshot prefix", validOptions(WithSnapshotPrefix("has space")), "prefix"},
+		{"full fsync without sync", validOptions(WithSync(false, "/")), "-fullfsync-path"},
+		{"quiesce with existing snapshots", validOptions(WithUseExistingSnapshots(true), WithQuiesceHooks(map[string]QuiesceHooks{"/": {Quiesce: "true"}}, time.Minute)), "-quiesce"},
+		{"no quiesce timeout", validOptions(WithQuiesceHooks(nil, 0)), "-quiesce-timeout"},
+		{"record changes without artifacts dir", validOptions(WithRecordChanges("")), "-artifacts-dir"},
+		{"record changes of separate archives", validOptions(WithRecordChanges("/tmp/artifacts"), WithSeparateArchives(true)), "-separate-archives"},
+		{"several repositories with separate archives", validOptions(WithRepos(RepoTarget{Repo: "/backups/a"}, RepoTarget{Repo: "/backups/b"}), WithSeparateArchives(true)), "several repositories"},
+		{"verify separate archives", validOptions(WithSeparateArchives(true), WithVerify(10)), "-verify-after-backup"},
+		{"skip if unchanged with separate archives", validOptions(WithSeparateArchives(true), WithSkipIfUnchanged(ChangeDetectionDryRun)), "-skip-if-unchanged"},
+		{"unknown change detection", validOptions(WithSkipIfUnchanged("mtime")), "invalid -change-detection"},
+		{"no hook timeout", validOptions(WithHooks(Hooks{})), "-hook-timeout"},
+		{"negative verify sample", validOptions(WithVerify(-1)), "-verify-sample"},
+		{"unknown check mode", validOptions(WithCheck(&CheckOptions{Mode: "full"})), "invalid -check-mode"},
+		{"negative check interval", validOptions(WithCheck(&CheckOptions{Mode: CheckModeRepository, Interval: -time.Hour})), "-check-interval"},
+		{"unknown key export format", validOptions(WithKeyExport("/tmp/key", "qr", false)), "invalid -key-export-format"},
+		{"key export of several repositories", validOptions(WithRepos(RepoTarget{Repo: "/backups/a"}, RepoTarget{Repo: "/backups/b"}), WithKeyExport("/tmp/key", KeyExportBinary, false)), "-key-export-path"},
+		{"init without encryption", validOptions(WithInitIfMissing(true, "")), "-init-encryption"},
+		{"repository given twice", validOptions(WithRepos(RepoTarget{Repo: "/backups/a"}, RepoTarget{Repo: "/backups/a"})), "given twice"},
+		{"invalid archive name", validOptions(WithBackupName("{snapshot}@{nonsense}")), "nonsense"},
+		{"prune selecting other archives", validOptions(WithPrune(&PruneOptions{Args: []string{"--glob-archives", "*"}})), "-prune-all-hosts"},
+		{"prune of archives without the hostname", validOptions(WithBackupName("{now}"), WithPrune(&PruneOptions{KeepDaily: 7})), "{hostname}"},
+	}
+	for _, tt := range tests {
+		_, err := NewBackup(tt.opts...)
+		if err == nil {
+			t.Errorf("%s: NewBackup accepted it", tt.name)
+		} else if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %q, want one about %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestNewBackupNeedsPassphrase(t *testing.T) {
+	for _, name := range []string{"BORG_PASSPHRASE", "BORG_PASSCOMMAND", "BORG_PASSPHRASE_FD"} {
+		if old, ok := os.LookupEnv(name); ok {
+			os.Unsetenv(name)
+			defer os.Setenv(name, old)
+		}
+	}
+	opts := []Option{WithSources("/"), WithMountpoints("/tmp/snapshot"), WithRepo("/backups/a")}
+	if _, err := NewBackup(opts...); err == nil || !strings.Contains(err.Error(), "no passphrase configured") {
+		t.Errorf("got %v, want an error about the missing passphrase", err)
+	}
+	if _, err := NewBackup(append(opts, WithAllowUnencrypted(true))...); err != nil {
+		t.Errorf("-allow-unencrypted: %v", err)
+	}
+	if _, err := NewBackup(append(opts, WithPassphraseSource(NewPassphraseFileSource("/etc/borg-tm/passphrase")))...); err != nil {
+		t.Errorf("passphrase file: %v", err)
+	}
+}
+
+func TestNewBackupNeedsRepository(t *testing.T) {
+	if old, ok := os.LookupEnv("BORG_REPO"); ok {
+		os.Unsetenv("BORG_REPO")
+		defer os.Setenv("BORG_REPO", old)
+	}
+	_, err := NewBackup(WithSources("/"), WithMountpoints("/tmp/snapshot"), WithAllowUnencrypted(true))
+	if err == nil || !strings.Contains(err.Error(), "no repository given") {
+		t.Errorf("got %v, want an error about the missing repository", err)
+	}
+}
+
+func TestNewBackupPrintsNothing(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	_, err = NewBackup(validOptions(WithSources("/tmp"), WithBackupName("{hostname}-{now}"))...)
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadAll(r)
+	if len(out) > 0 {
+		t.Errorf("NewBackup printed %q, that's up to Run", out)
+	}
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+)
+
+// originalPathMountpoints returns where the snapshots are mounted with
+// -store-original-paths: below the given mountpoint, at the path of the
+// source itself, so that borgPath can cut off the mountpoint with borg's
+// slashdot syntax. / stays mounted on the mountpoint. Sources backed up
+// as they are keep their path.
+func originalPathMountpoints(sources []string, mountpoints []string) []string {
+	result := make([]string, len(mountpoints))
+	for i, mountpoint := range mountpoints {
+		if sources[i] == mountpoint {
+			result[i] = mountpoint
+			continue
+		}
+		result[i] = filepath.Join(mountpoint, filepath.Clean(sources[i]))
+	}
+	return result
+}
+
+// borgPaths returns the paths of the i-th source passed to borg create: its
+// mountpoint, or the directories of it given as -source. With
+// -store-original-paths they are <mountpoint>/./<path>, which borg (1.2
+// and newer) archives as the path on the source, e.g.
+// /tmp/data/./System/Volumes/Data for the Data volume mounted from
+// /tmp/data.
+func (b BorgBackup) borgPaths(i int) []string {
+	subpaths := []string{"."}
+	if i < len(b.subpaths) && b.subpaths[i] != nil {
+		subpaths = b.subpaths[i]
+	}
+	paths := make([]string, 0, len(subpaths))
+	mountpoint := b.mountpoints[i]
+	for _, sub := range subpaths {
+		if !b.storeOriginalPaths || b.sources[i] == mountpoint {
+			paths = append(paths, filepath.Join(mountpoint, sub))
+			continue
+		}
+		rel := strings.TrimPrefix(filepath.Join(filepath.Clean(b.sources[i]), sub), "/")
+		paths = append(paths, strings.TrimRight(b.mountBases[i], "/")+"/./"+rel)
+	}
+	return paths
+}
+
+// resolveOriginalPaths checks that borg understands the slashdot syntax. An
+// older borg archives the paths of the mountpoints, like before.
+func (b BorgBackup) resolveOriginalPaths(ctx context.Context) (bool, error) {
+	if !b.storeOriginalPaths {
+		return false, nil
+	}
+	version, err := b.getBorgVersion(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !version.atLeast(1, 2, 0) {
+		b.logf(LevelWarn, "borg %s can't store the original paths of the sources, the archive gets the paths of the mountpoints", version)
+		return false, nil
+	}
+	return true, nil
+}
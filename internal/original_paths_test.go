@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunStoresOriginalPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources int
+		store   bool
+		version string // of borg
+		// the paths borg create gets, of the mountpoint and the source
+		want func(mountpoint, source string) string
+	}{
+		{"one source", 1, true, "borg 1.2.8", func(m, s string) string { return m + "/." + s }},
+		{"several sources", 3, true, "borg 1.2.8", func(m, s string) string { return m + "/." + s }},
+		{"paths of the mountpoints", 3, false, "borg 1.2.8", func(m, s string) string { return m }},
+		{"borg without slashdot", 2, true, "borg 1.1.18", func(m, s string) string { return m + s }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, env := newFakeBackupOf(t, tt.sources, func(call *fakeCall) (fakeResult, bool) {
+				return fakeResult{stdout: tt.version + "\n"}, call.has("borg", "--version")
+			}, WithStoreOriginalPaths(tt.store))
+			if _, err := b.Run(context.Background()); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			var want []string
+			for i, source := range env.sources {
+				want = append(want, tt.want(env.mountpoints[i], source))
+			}
+			if got := createPaths(t, env.runner); !reflect.DeepEqual(got, want) {
+				t.Errorf("borg create got\n  %v\nwant\n  %v", got, want)
+			}
+			for i, source := range env.sources {
+				mount := env.runner.find("mount_apfs", source)
+				if mount == nil {
+					t.Fatalf("%s wasn't mounted", source)
+				}
+				if got := mount.args[len(mount.args)-1]; tt.store && got != env.mountpoints[i]+source || !tt.store && got != env.mountpoints[i] {
+					t.Errorf("%s was mounted on %s", source, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBorgPaths(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     string
+		mountpoint string
+		subpaths   []string
+		store      bool
+		want       []string
+	}{
+		{"root", "/", "/tmp/snapshot", nil, true, []string{"/tmp/snapshot/./"}},
+		{"data volume", "/System/Volumes/Data", "/tmp/data", nil, true, []string{"/tmp/data/./System/Volumes/Data"}},
+		{"directories of the source", "/System/Volumes/Data", "/tmp/data", []string{"Users/me", "Library"}, true,
+			[]string{"/tmp/data/./System/Volumes/Data/Users/me", "/tmp/data/./System/Volumes/Data/Library"}},
+		{"mountpoint with a slash", "/Volumes/Backup", "/tmp/backup/", nil, true, []string{"/tmp/backup/./Volumes/Backup"}},
+		{"backed up as it is", "/Volumes/Backup", "/Volumes/Backup", nil, true, []string{"/Volumes/Backup"}},
+		{"not stored", "/System/Volumes/Data", "/tmp/data", []string{"Users/me"}, false, []string{"/tmp/data/Users/me"}},
+	}
+	for _, tt := range tests {
+		b := BorgBackup{
+			sources:            []string{tt.source},
+			mountpoints:        []string{tt.mountpoint},
+			storeOriginalPaths: tt.store,
+		}
+		if tt.subpaths != nil {
+			b.subpaths = [][]string{tt.subpaths}
+		}
+		if tt.store {
+			b.mountBases = b.mountpoints
+			b.mountpoints = originalPathMountpoints(b.sources, b.mountpoints)
+		}
+		if got := b.borgPaths(0); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		// the snapshot is mounted where the slashdot path points to
+		if tt.store && tt.source != tt.mountpoint {
+			want := filepath.Join(tt.mountpoint, tt.source)
+			if got := b.mountpoints[0]; got != want {
+				t.Errorf("%s: mounted on %s, want %s", tt.name, got, want)
+			}
+			for i, path := range b.borgPaths(0) {
+				if !strings.HasPrefix(filepath.Clean(strings.Replace(path, "/./", "/", 1)), want) {
+					t.Errorf("%s: path %d %s isn't below %s", tt.name, i, path, want)
+				}
+			}
+		}
+	}
+}
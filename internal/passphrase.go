@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const passphraseCommandTimeout = 30 * time.Second
+
+// PassphraseSource supplies the repository passphrase to borg. When a source
+// is configured it takes precedence over BORG_PASSPHRASE from the environment.
+type PassphraseSource interface {
+	// Name describes the source for logs, it must not include the secret.
+	Name() string
+	Passphrase(ctx context.Context) (string, error)
+}
+
+type onePasswordSource struct {
+	ref string
+}
+
+// NewOnePasswordSource reads the passphrase with `op read <ref>`, where ref is
+// a secret reference such as op://Vault/borg/passphrase.
+func NewOnePasswordSource(ref string) PassphraseSource {
+	return onePasswordSource{ref: ref}
+}
+
+func (s onePasswordSource) Name() string {
+	return "1Password item " + s.ref
+}
+
+func (s onePasswordSource) Passphrase(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, passphraseCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "op", "read", "--no-newline", s.ref)
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = safeEnvs()
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", errors.Errorf("op read timed out after %s", passphraseCommandTimeout)
+		}
+		return "", errors.Wrapf(err, "error while reading passphrase with op (is the 1Password CLI signed in?): %s",
+			strings.TrimSpace(stderr.String()))
+	}
+	passphrase := strings.TrimRight(stdout.String(), "\r\n")
+	if passphrase == "" {
+		return "", errors.Errorf("op read returned an empty passphrase for %s", s.ref)
+	}
+	return passphrase, nil
+}
+
+type passphraseFileSource struct {
+	path string
+}
+
+// NewPassphraseFileSource reads the passphrase from the file at path, without
+// surrounding whitespace. Like -env-file, the file must not be accessible
+// by group or others.
+func NewPassphraseFileSource(path string) PassphraseSource {
+	return passphraseFileSource{path: path}
+}
+
+func (s passphraseFileSource) Name() string {
+	return "passphrase file " + s.path
+}
+
+// check makes sure the file exists with safe permissions, without reading it.
+func (s passphraseFileSource) check() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return errors.Wrap(err, "error while checking passphrase file")
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return errors.Errorf("passphrase file %s has permissions %#o, it must not be accessible by group or others (use chmod 600)", s.path, perm)
+	}
+	return nil
+}
+
+func (s passphraseFileSource) Passphrase(ctx context.Context) (string, error) {
+	if err := s.check(); err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return "", errors.Wrap(err, "error while reading passphrase file")
+	}
+	passphrase := strings.TrimSpace(string(data))
+	if passphrase == "" {
+		return "", errors.Errorf("passphrase file %s is empty", s.path)
+	}
+	return passphrase, nil
+}
+
+// the variables borg reads the passphrase from, BORG_PASSPHRASE first, and
+// the new passphrase of borg key change-passphrase, which borg-tm never runs
+var passphraseEnvs = []string{"BORG_PASSPHRASE", "BORG_PASSCOMMAND", "BORG_PASSPHRASE_FD", "BORG_NEW_PASSPHRASE"}
+
+// passphraseMechanism describes how borg gets the passphrase, for the
+// preflight output. It is empty if nothing is configured.
+func (b BorgBackup) passphraseMechanism() string {
+	switch {
+	case b.passphraseSource != nil:
+		return b.passphraseSource.Name()
+	case os.Getenv("BORG_PASSPHRASE") != "":
+		return "BORG_PASSPHRASE"
+	case os.Getenv("BORG_PASSCOMMAND") != "":
+		return "BORG_PASSCOMMAND"
+	case b.allowUnencrypted:
+		return "none (-allow-unencrypted)"
+	}
+	return ""
+}
+
+// the variables of our environment borg gets besides the BORG_ ones
+var borgEnvWhitelist = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TERM", "TMPDIR", "TZ", "LANG", "SSH_AUTH_SOCK", "XDG_CACHE_HOME", "XDG_CONFIG_HOME", "XDG_DATA_HOME"}
+
+// borgEnvs returns the environment for borg: the repository, the whitelisted
+// variables, the locale and the BORG_ variables of ours, without the
+// passphrase variables except BORG_PASSCOMMAND when borg is to run it
+// itself. A passphrase is added by setBorgEnv.
+func (b BorgBackup) borgEnvs() []string {
+	keep := ""
+	if b.passphraseSource == nil && os.Getenv("BORG_PASSPHRASE") == "" {
+		keep = "BORG_PASSCOMMAND"
+	}
+	var envs []string
+	if b.repo != "" {
+		envs = append(envs, "BORG_REPO="+b.repo)
+	}
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		switch {
+		case name == "BORG_REPO" && b.repo != "":
+		case containsString(passphraseEnvs, name):
+			if name == keep {
+				envs = append(envs, env)
+			}
+		case strings.HasPrefix(name, "BORG_"), strings.HasPrefix(name, "LC_"), containsString(borgEnvWhitelist, name):
+			envs = append(envs, env)
+		}
+	}
+	return envs
+}
+
+// setBorgEnv sets the environment of a borg command in opts. The passphrase
+// is removed from it and passed through a pipe named by BORG_PASSPHRASE_FD
+// instead, where other processes of the same user can't read it. The
+// returned function closes our end of the pipe and must be called once borg
+// has started.
+func (b BorgBackup) setBorgEnv(opts *RunOptions) (func(), error) {
+	passphrase := b.passphrase
+	if passphrase == "" {
+		passphrase = os.Getenv("BORG_PASSPHRASE")
+	}
+	opts.Env = b.borgEnv()
+	if passphrase == "" {
+		return func() {}, nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "error while creating passphrase pipe")
+	}
+	// a passphrase easily fits into the pipe buffer, so this doesn't block
+	_, err = io.WriteString(w, passphrase)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "error while writing passphrase pipe")
+	}
+	opts.ExtraFiles = append(opts.ExtraFiles, r)
+	// ExtraFiles start at fd 3
+	opts.Env = append(opts.Env, fmt.Sprintf("BORG_PASSPHRASE_FD=%d", 2+len(opts.ExtraFiles)))
+	return func() { r.Close() }, nil
+}
@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testPassphrase = "correct horse battery staple"
+
+// checkPassphrase makes sure call got the passphrase only through the pipe
+// named by BORG_PASSPHRASE_FD.
+func checkPassphrase(t *testing.T, call *fakeCall) {
+	t.Helper()
+	fd := -1
+	for _, env := range call.opts.Env {
+		if strings.Contains(env, testPassphrase) {
+			t.Errorf("%s: the passphrase is in its environment: %s", call, env)
+		}
+		if strings.HasPrefix(env, "BORG_PASSPHRASE=") {
+			t.Errorf("%s: got %s", call, env)
+		}
+		if strings.HasPrefix(env, "BORG_PASSPHRASE_FD=") {
+			fd, _ = strconv.Atoi(strings.TrimPrefix(env, "BORG_PASSPHRASE_FD="))
+		}
+	}
+	for _, arg := range call.args {
+		if strings.Contains(arg, testPassphrase) {
+			t.Errorf("%s: the passphrase is in its arguments", call)
+		}
+	}
+	// ExtraFiles start at fd 3
+	if i := fd - 3; i < 0 || i >= len(call.extraFiles) {
+		t.Errorf("%s: BORG_PASSPHRASE_FD is %d with %d extra files", call, fd, len(call.extraFiles))
+	} else if call.extraFiles[i] != testPassphrase {
+		t.Errorf("%s: read %q from fd %d, want the passphrase", call, call.extraFiles[i], fd)
+	}
+}
+
+func TestSetBorgEnv(t *testing.T) {
+	oldPassphrase, hadPassphrase := os.LookupEnv("BORG_PASSPHRASE")
+	defer func() {
+		if hadPassphrase {
+			os.Setenv("BORG_PASSPHRASE", oldPassphrase)
+		} else {
+			os.Unsetenv("BORG_PASSPHRASE")
+		}
+	}()
+	other, err := ioutil.TempFile("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(other.Name())
+	tests := []struct {
+		name       string
+		passphrase string // of the source
+		env        string // BORG_PASSPHRASE
+		extraFiles int    // before the passphrase
+	}{
+		{"from a source", testPassphrase, "", 0},
+		{"from the environment", "", testPassphrase, 0},
+		{"source over the environment", testPassphrase, "another passphrase", 0},
+		{"after another extra file", testPassphrase, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("BORG_PASSPHRASE", tt.env)
+			b, err := NewBackup(validOptions()...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.passphrase = tt.passphrase
+			var opts RunOptions
+			for i := 0; i < tt.extraFiles; i++ {
+				opts.ExtraFiles = append(opts.ExtraFiles, other)
+			}
+			done, err := b.setBorgEnv(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer done()
+			if len(opts.ExtraFiles) != tt.extraFiles+1 {
+				t.Fatalf("got %d extra files, want %d", len(opts.ExtraFiles), tt.extraFiles+1)
+			}
+			data, err := ioutil.ReadAll(opts.ExtraFiles[tt.extraFiles])
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkPassphrase(t, &fakeCall{name: "borg", opts: opts, extraFiles: append(make([]string, tt.extraFiles), string(data))})
+			for _, env := range opts.Env {
+				if strings.Contains(env, "another passphrase") {
+					t.Errorf("got %s", env)
+				}
+			}
+		})
+	}
+}
+
+func TestSetBorgEnvWithoutPassphrase(t *testing.T) {
+	oldPassphrase, hadPassphrase := os.LookupEnv("BORG_PASSPHRASE")
+	os.Unsetenv("BORG_PASSPHRASE")
+	defer func() {
+		if hadPassphrase {
+			os.Setenv("BORG_PASSPHRASE", oldPassphrase)
+		}
+	}()
+	b, err := NewBackup(validOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opts RunOptions
+	done, err := b.setBorgEnv(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	if len(opts.ExtraFiles) != 0 {
+		t.Errorf("got %d extra files, want none", len(opts.ExtraFiles))
+	}
+	for _, env := range opts.Env {
+		if strings.HasPrefix(env, "BORG_PASSPHRASE") {
+			t.Errorf("got %s", env)
+		}
+	}
+}
+
+func TestRunPassesThePassphraseThroughAPipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passphraseFile := filepath.Join(dir, "passphrase")
+	if err := ioutil.WriteFile(passphraseFile, []byte(testPassphrase+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, env := newFakeBackup(t, nil, WithPassphraseSource(NewPassphraseFileSource(passphraseFile)))
+	if _, err := b.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %+v", err)
+	}
+	var borgCalls int
+	for _, call := range env.runner.calls {
+		if call.has("borg", "--version") {
+			// doesn't open the repository
+			continue
+		}
+		if call.name == "borg" {
+			borgCalls++
+			checkPassphrase(t, call)
+		} else if strings.Contains(fmt.Sprint(call.args, call.opts.Env), testPassphrase) {
+			t.Errorf("%s got the passphrase", call)
+		}
+	}
+	if borgCalls == 0 {
+		t.Error("borg didn't run")
+	}
+}
+
+func TestBorgEnvs(t *testing.T) {
+	setenvs(t, map[string]string{"LC_ALL": "C", "BORG_RSH": "ssh -i /etc/borg-key", "BORG_CACHE_DIR": "/var/cache/borg",
+		"AWS_SECRET_ACCESS_KEY": "secret", "BORG_REPO": "ssh://backup@nas/repo"})
+	tests := []struct {
+		name    string
+		envs    map[string]string
+		source  bool
+		repo    string
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "passphrase from the environment", envs: map[string]string{"BORG_PASSPHRASE": "secret", "BORG_PASSCOMMAND": "cat /etc/secret"}, repo: "/backups/a",
+			want:    []string{"BORG_REPO=/backups/a", "LC_ALL=C", "BORG_RSH=ssh -i /etc/borg-key", "BORG_CACHE_DIR=/var/cache/borg", "PATH=" + os.Getenv("PATH")},
+			notWant: []string{"BORG_REPO", "BORG_PASSPHRASE", "BORG_PASSCOMMAND", "AWS_SECRET_ACCESS_KEY"},
+		},
+		{
+			name: "passphrase source", envs: map[string]string{"BORG_PASSCOMMAND": "cat /etc/secret"}, source: true, repo: "/backups/a",
+			want:    []string{"BORG_REPO=/backups/a"},
+			notWant: []string{"BORG_PASSPHRASE", "BORG_PASSCOMMAND"},
+		},
+		{
+			name: "borg runs the passcommand", envs: map[string]string{"BORG_PASSCOMMAND": "cat /etc/secret", "BORG_NEW_PASSPHRASE": "new secret"}, repo: "/backups/a",
+			want:    []string{"BORG_PASSCOMMAND=cat /etc/secret"},
+			notWant: []string{"BORG_NEW_PASSPHRASE", "BORG_PASSPHRASE_FD"},
+		},
+		{
+			name: "repository from the environment",
+			want: []string{"BORG_REPO=ssh://backup@nas/repo"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range passphraseEnvs {
+				setenvs(t, map[string]string{name: tt.envs[name]})
+				if tt.envs[name] == "" {
+					os.Unsetenv(name)
+				}
+			}
+			b := BorgBackup{repo: tt.repo}
+			if tt.source {
+				b.passphraseSource = NewPassphraseFileSource("/etc/borg-tm/passphrase")
+			}
+			envs := b.borgEnvs()
+			for _, want := range tt.want {
+				if !containsString(envs, want) {
+					t.Errorf("%s is missing from %v", want, envs)
+				}
+			}
+			for _, env := range envs {
+				name := strings.SplitN(env, "=", 2)[0]
+				if containsString(tt.notWant, name) && !containsString(tt.want, env) {
+					t.Errorf("got %s", env)
+				}
+			}
+		})
+	}
+}
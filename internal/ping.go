@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how long a ping may take, a slow monitoring service doesn't hold up or
+// fail the backup
+const pingTimeout = 10 * time.Second
+
+// ping notifies the -ping-url monitor, healthchecks.io style: GET url on
+// success, url/start when the run begins and a POST of the error to url/fail
+// on failure. Failed pings are only logged.
+func (b BorgBackup) ping(event string, runErr error) {
+	if b.pingURL == "" || b.dryRun {
+		return
+	}
+	// not the context of the run, the failure ping is also sent after an
+	// interrupt
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	url := strings.TrimSuffix(b.pingURL, "/")
+	method := http.MethodGet
+	var body []byte
+	switch event {
+	case "start":
+		url += "/start"
+	case "fail":
+		url += "/fail"
+		method = http.MethodPost
+		body, _ = json.Marshal(struct {
+			Error string `json:"error"`
+		}{runErr.Error()})
+	}
+	if err := sendPing(ctx, method, url, body); err != nil {
+		// the URL may contain a token, so it isn't logged
+		b.logf(LevelWarn, "%v", errors.Wrapf(err, "error while sending the %s ping", event))
+	}
+}
+
+func sendPing(ctx context.Context, method string, url string, body []byte) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
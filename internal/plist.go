@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// parsePlist decodes an XML property list as printed by `diskutil -plist`.
+// Dictionaries become map[string]interface{}, arrays []interface{}, and the
+// scalars string, int64, float64, bool, time.Time or []byte.
+func parsePlist(r io.Reader) (interface{}, error) {
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, errors.Wrap(err, "error while parsing plist")
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local != "plist" {
+			return parsePlistValue(dec, start)
+		}
+	}
+}
+
+func parsePlistValue(dec *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := map[string]interface{}{}
+		var key string
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, errors.Wrap(err, "error while parsing plist dict")
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				if t.Name.Local == "key" {
+					var k string
+					if err := dec.DecodeElement(&k, &t); err != nil {
+						return nil, errors.Wrap(err, "error while parsing plist key")
+					}
+					key = k
+					continue
+				}
+				v, err := parsePlistValue(dec, t)
+				if err != nil {
+					return nil, err
+				}
+				dict[key] = v
+			case xml.EndElement:
+				return dict, nil
+			}
+		}
+	case "array":
+		var array []interface{}
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, errors.Wrap(err, "error while parsing plist array")
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				v, err := parsePlistValue(dec, t)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, v)
+			case xml.EndElement:
+				return array, nil
+			}
+		}
+	case "true", "false":
+		if err := dec.Skip(); err != nil {
+			return nil, errors.Wrap(err, "error while parsing plist")
+		}
+		return start.Name.Local == "true", nil
+	}
+
+	var text string
+	if err := dec.DecodeElement(&text, &start); err != nil {
+		return nil, errors.Wrapf(err, "error while parsing plist %s", start.Name.Local)
+	}
+	switch start.Name.Local {
+	case "string":
+		return text, nil
+	case "integer":
+		return strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+	case "real":
+		return strconv.ParseFloat(strings.TrimSpace(text), 64)
+	case "date":
+		return time.Parse(time.RFC3339, strings.TrimSpace(text))
+	case "data":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+	}
+	return nil, errors.Errorf("unknown plist element %s", start.Name.Local)
+}
+
+// plistString returns dict[key] if it is a string.
+func plistString(dict map[string]interface{}, key string) string {
+	s, _ := dict[key].(string)
+	return s
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how long the repository may take to answer borg info during the preflight
+const preflightRepoTimeout = 30 * time.Second
+
+// getuid is os.Getuid, replaced by the tests
+var getuid = os.Getuid
+
+// PreflightError lists every preflight check that failed.
+type PreflightError struct {
+	Failures []string
+}
+
+func (p *PreflightError) Error() string {
+	return fmt.Sprintf("%d preflight check(s) failed:\n  %s", len(p.Failures), strings.Join(p.Failures, "\n  "))
+}
+
+type preflightCheck struct {
+	name string
+	run  func() error
+}
+
+// preflightChecks returns the checks run before anything is snapshotted. The
+// repository check stores the borg info it got in info.
+func (b BorgBackup) preflightChecks(ctx context.Context, info *repoInfo) []preflightCheck {
+	checks := []preflightCheck{
+		{"running as root", func() error {
+			if getuid() != 0 {
+				return errors.New("requires root privileges")
+			}
+			return nil
+		}},
+		{"borg in PATH", func() error {
+			_, err := exec.LookPath("borg")
+			return err
+		}},
+	}
+	for i := range b.sources {
+		source, mountpoint := b.sources[i], b.mountpoints[i]
+		checks = append(checks, preflightCheck{"source " + source, func() error {
+			if _, err := os.Stat(source); err != nil {
+				return err
+			}
+			if source == mountpoint {
+				// backed up as it is
+				return nil
+			}
+			vol, err := b.getVolumeInfo(ctx, source)
+			if err != nil {
+				return err
+			}
+			if vol.FilesystemType != "apfs" {
+				return errors.Errorf("%s is on a %s volume, snapshots need APFS", source, vol.FilesystemType)
+			}
+			return nil
+		}})
+		if source == mountpoint {
+			continue
+		}
+		checks = append(checks, preflightCheck{"mountpoint " + mountpoint, func() error {
+			fi, err := os.Stat(mountpoint)
+			if os.IsNotExist(err) {
+				// created before mounting
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				return errors.Errorf("%s is not a directory", mountpoint)
+			}
+			return nil
+		}})
+	}
+	if !b.useExistingSnapshots && b.snapshotTool == SnapshotToolSnapUtil {
+		checks = append(checks, preflightCheck{"snapUtil", func() error {
+			_, err := findSnapUtil(b.snapUtilPath)
+			return err
+		}})
+	}
+	checks = append(checks, preflightCheck{"passphrase from " + b.passphraseMechanism(), func() error {
+		if s, ok := b.passphraseSource.(passphraseFileSource); ok {
+			return s.check()
+		}
+		return nil
+	}})
+	if b.multiRepo() {
+		// checked before each archive, a repository that is down doesn't
+		// stop the others
+		return checks
+	}
+	checks = append(checks, preflightCheck{"repository " + b.repo, func() error {
+		if _, err := exec.LookPath("borg"); err != nil {
+			return errors.New("can't be checked without borg")
+		}
+		var err error
+		*info, err = b.repoInfoOrInit(ctx)
+		return err
+	}})
+	return checks
+}
+
+// preflight runs all checks and returns a *PreflightError listing every
+// failure, or the repository info borg reported. With verbose, the result
+// of each check is printed.
+func (b BorgBackup) preflight(ctx context.Context, verbose bool) (repoInfo, error) {
+	var info repoInfo
+	var failures []string
+	for _, c := range b.preflightChecks(ctx, &info) {
+		err := c.run()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", c.name, err))
+		}
+		if verbose {
+			if err != nil {
+				fmt.Printf("FAIL %s: %v\n", c.name, err)
+			} else {
+				fmt.Printf("ok   %s\n", c.name)
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return info, &PreflightError{Failures: failures}
+	}
+	return info, nil
+}
+
+// Doctor runs the preflight checks of Run without snapshotting or backing up
+// anything.
+func (b BorgBackup) Doctor(ctx context.Context) error {
+	// only reported, the doctor doesn't change anything
+	b.initIfMissing = false
+	if b.passphraseSource != nil {
+		var err error
+		b.logf(LevelInfo, "Reading passphrase from %s", b.passphraseSource.Name())
+		b.passphrase, err = b.passphraseSource.Passphrase(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := b.preflight(ctx, true)
+	if err == nil {
+		fmt.Println("All checks passed")
+	}
+	return err
+}
@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// minimum time between two borg progress events
+const progressInterval = time.Second
+
+type progressEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"` // phase, progress or summary
+	Phase string    `json:"phase,omitempty"`
+	*archiveStats
+	Path    string `json:"path,omitempty"`
+	Success *bool  `json:"success,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// progressFifo writes progress events as JSON lines to a named pipe. Writes
+// never block: events are dropped while no reader is attached or the pipe is
+// full. A nil progressFifo ignores everything.
+type progressFifo struct {
+	mu           sync.Mutex
+	path         string
+	created      bool
+	f            *os.File
+	lastProgress time.Time
+}
+
+// openProgressFifo creates the FIFO at path if it doesn't exist yet.
+func openProgressFifo(path string) (*progressFifo, error) {
+	p := &progressFifo{path: path}
+	info, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		if err := syscall.Mkfifo(path, 0644); err != nil {
+			return nil, errors.Wrapf(err, "error while creating progress FIFO %s", path)
+		}
+		p.created = true
+	case err != nil:
+		return nil, errors.Wrapf(err, "error while checking progress FIFO %s", path)
+	case info.Mode()&os.ModeNamedPipe == 0:
+		return nil, errors.Errorf("-progress-fifo %s exists and is not a FIFO", path)
+	}
+	return p, nil
+}
+
+// write sends one event, (re)opening the FIFO when a reader attached.
+func (p *progressFifo) write(e progressEvent) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.f == nil {
+		// fails with ENXIO while nobody reads
+		fd, err := syscall.Open(p.path, syscall.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			return
+		}
+		p.f = os.NewFile(uintptr(fd), p.path)
+	}
+	e.Time = time.Now()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if _, err := syscall.Write(int(p.f.Fd()), append(line, '\n')); err != nil && err != syscall.EAGAIN {
+		// EPIPE: the reader went away, try again with the next event
+		p.f.Close()
+		p.f = nil
+	}
+}
+
+func (p *progressFifo) phase(name string) {
+	p.write(progressEvent{Event: "phase", Phase: name})
+}
+
+// progress sends borg's counters, at most once per progressInterval. It is
+// the OnProgress callback of the FIFO.
+func (p *progressFifo) progress(e ProgressEvent) {
+	if p == nil || e.Message != "" {
+		return
+	}
+	p.mu.Lock()
+	if time.Since(p.lastProgress) < progressInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.lastProgress = time.Now()
+	p.mu.Unlock()
+	stats := archiveStats{
+		OriginalSize:     e.OriginalSize,
+		CompressedSize:   e.CompressedSize,
+		DeduplicatedSize: e.DeduplicatedSize,
+		NFiles:           e.NFiles,
+	}
+	p.write(progressEvent{Event: "progress", archiveStats: &stats, Path: e.Path})
+}
+
+// close sends the summary line and removes the FIFO if we created it.
+func (p *progressFifo) close(runErr error) {
+	if p == nil {
+		return
+	}
+	success := runErr == nil
+	e := progressEvent{Event: "summary", Success: &success}
+	if runErr != nil {
+		e.Error = runErr.Error()
+	}
+	p.write(e)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.f != nil {
+		p.f.Close()
+		p.f = nil
+	}
+	if p.created {
+		os.Remove(p.path)
+	}
+}
+
+// borgLogWriter receives borg's stderr when it runs with --log-json. It
+// forwards progress to the OnProgress callbacks and file status to the
+// change listing, and prints everything else as text to out.
+type borgLogWriter struct {
+	archive   string
+	callbacks *callbacks
+	// send progress_message and progress_percent to the callbacks instead
+	// of printing them, with -progress
+	progressMessages bool
+	changes          *changeRecorder
+	out              io.Writer
+	buf              []byte
+	warnings         int
+}
+
+func (w *borgLogWriter) Write(data []byte) (int, error) {
+	w.buf = append(w.buf, data...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		w.handleLine(w.buf[:idx])
+		w.buf = w.buf[idx+1:]
+	}
+	return len(data), nil
+}
+
+// flush handles a last line without a trailing newline.
+func (w *borgLogWriter) flush() {
+	if len(w.buf) > 0 {
+		w.handleLine(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *borgLogWriter) handleLine(line []byte) {
+	var msg struct {
+		Type     string `json:"type"`
+		Status   string `json:"status"`
+		Message  string `json:"message"`
+		Path     string `json:"path"`
+		Finished bool   `json:"finished"`
+		Level    string `json:"levelname"`
+		archiveStats
+	}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		fmt.Fprintf(w.out, "%s\n", line)
+		return
+	}
+	switch msg.Type {
+	case "archive_progress":
+		if !msg.Finished {
+			w.callbacks.fireProgress(ProgressEvent{
+				Time:             time.Now(),
+				Archive:          w.archive,
+				OriginalSize:     msg.OriginalSize,
+				CompressedSize:   msg.CompressedSize,
+				DeduplicatedSize: msg.DeduplicatedSize,
+				NFiles:           msg.NFiles,
+				Path:             msg.Path,
+			})
+		}
+	case "file_status":
+		w.changes.record(msg.Status, msg.Path)
+	case "log_message":
+		if msg.Level == "WARNING" {
+			w.warnings++
+		}
+		fmt.Fprintln(w.out, msg.Message)
+	case "progress_message", "progress_percent":
+		if w.progressMessages {
+			if !msg.Finished {
+				w.callbacks.fireProgress(ProgressEvent{Time: time.Now(), Archive: w.archive, Message: strings.TrimSpace(msg.Message)})
+			}
+		} else if msg.Message != "" {
+			fmt.Fprintln(w.out, msg.Message)
+		}
+	default:
+		fmt.Fprintf(w.out, "%s\n", line)
+	}
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how often -progress logs the progress when it can't update a line on a
+// terminal
+const progressSnapshotInterval = 30 * time.Second
+
+// progressLine shows the progress of borg create with -progress. On a
+// terminal, one line is rewritten with every event. Otherwise, and with the
+// JSON logger, an entry with the counters is logged every
+// progressSnapshotInterval.
+type progressLine struct {
+	mu    sync.Mutex
+	b     BorgBackup
+	out   io.Writer // the terminal, nil to log snapshots
+	next  io.Writer // where the rest of borg's output goes
+	width int
+	shown bool
+	last  time.Time
+}
+
+func (b BorgBackup) newProgressLine(next io.Writer) *progressLine {
+	p := &progressLine{b: b, next: next, last: time.Now()}
+	_, jsonLog := b.logger.(*jsonLogger)
+	if isTerminal(os.Stderr) && !jsonLog {
+		p.out = os.Stderr
+		p.width = terminalWidth()
+	}
+	return p
+}
+
+// terminalWidth is $COLUMNS, 80 if it isn't set.
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return 80
+}
+
+func formatProgress(e ProgressEvent) string {
+	if e.Message != "" {
+		return e.Message
+	}
+	s := fmt.Sprintf("%d files, original %.1f MiB, compressed %.1f MiB, deduplicated %.1f MiB", e.NFiles,
+		float64(e.OriginalSize)/(1<<20), float64(e.CompressedSize)/(1<<20), float64(e.DeduplicatedSize)/(1<<20))
+	if e.Path != "" {
+		s += ", at " + e.Path
+	}
+	return s
+}
+
+// update is the OnProgress callback.
+func (p *progressLine) update(e ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.out == nil {
+		if time.Since(p.last) < progressSnapshotInterval || e.Message != "" {
+			return
+		}
+		p.last = time.Now()
+		entry := LogEntry{Level: LevelInfo, Progress: &e}
+		p.b.logEntryf(entry, "Progress: %s", formatProgress(e))
+		return
+	}
+	line := []rune(formatProgress(e))
+	if len(line) > p.width-1 {
+		line = line[:p.width-1]
+	}
+	fmt.Fprintf(p.out, "\r\x1b[K%s", string(line))
+	p.shown = true
+}
+
+// Write passes the other output of borg through, below the progress line.
+func (p *progressLine) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	return p.next.Write(data)
+}
+
+// finish removes the progress line once borg is done.
+func (p *progressLine) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+}
+
+func (p *progressLine) clear() {
+	if p.shown {
+		fmt.Fprint(p.out, "\r\x1b[K")
+		p.shown = false
+	}
+}
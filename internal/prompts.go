@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// questions borg can ask about a repository, and the variables answering them
+var borgPrompts = []struct {
+	text string // part of the question
+	what string
+	env  string
+}{
+	{"was previously located at", "access a relocated repository", "BORG_RELOCATED_REPO_ACCESS_IS_OK"},
+	{"previously unknown unencrypted repository", "access an unknown unencrypted repository", "BORG_UNKNOWN_UNENCRYPTED_REPO_ACCESS_IS_OK"},
+}
+
+// borgEnv returns the environment for borg children. With
+// -accept-repo-changes, borg's questions about relocated and unknown
+// repositories are answered with yes. Without it, they are answered with no
+// unless borg can ask on a terminal, so borg fails instead of waiting for an
+// answer that never comes.
+func (b BorgBackup) borgEnv() []string {
+	envs := b.borgEnvs()
+	answer := ""
+	if b.acceptRepoChanges {
+		answer = "yes"
+	} else if !isTerminal(os.Stdin) {
+		answer = "no"
+	}
+	if answer != "" {
+		for _, p := range borgPrompts {
+			if os.Getenv(p.env) == "" {
+				envs = append(envs, p.env+"="+answer)
+			}
+		}
+	}
+	return envs
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// borg's LockTimeout error, in its plain and its --log-json form
+var borgLockTimeout = regexp.MustCompile(`Failed to create/acquire the lock \S+ \(timeout\)|"msgid": "LockTimeout"`)
+
+// promptWatcher passes borg's stderr through to out and remembers which of
+// borg's questions appeared in it, and whether borg gave up waiting for the
+// repository lock.
+type promptWatcher struct {
+	out         io.Writer
+	log         *runLog
+	tail        string // end of the previous write, for matches spanning writes
+	seen        map[string]bool
+	lockTimeout bool
+}
+
+func (w *promptWatcher) Write(data []byte) (int, error) {
+	text := w.tail + string(data)
+	if borgLockTimeout.MatchString(text) {
+		w.lockTimeout = true
+	}
+	for _, p := range borgPrompts {
+		if strings.Contains(text, p.text) {
+			if w.seen == nil {
+				w.seen = map[string]bool{}
+			}
+			w.seen[p.env] = true
+		}
+	}
+	if len(text) > 128 {
+		text = text[len(text)-128:]
+	}
+	w.tail = text
+	return w.out.Write(data)
+}
+
+// explain logs which flag would have answered a question borg asked.
+func (w *promptWatcher) explain(accepted bool) {
+	for _, p := range borgPrompts {
+		if !w.seen[p.env] {
+			continue
+		}
+		if accepted {
+			w.log.logf(LevelInfo, "borg asked whether to %s, answered yes (-accept-repo-changes)", p.what)
+		} else {
+			w.log.logf(LevelWarn, "borg asked whether to %s. If that is expected, answer it once interactively or run with -accept-repo-changes (sets %s=yes)", p.what, p.env)
+		}
+	}
+}
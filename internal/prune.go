@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PruneOptions are the retention rules passed to `borg prune` after a
+// successful backup.
+type PruneOptions struct {
+	KeepWithin  string
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	// AllHosts prunes the archives of every host in the repository, not only
+	// the ones of this host
+	AllHosts bool
+	// Args are passed to borg prune as they are, e.g. from -prune-args
+	Args []string
+}
+
+// PruneError is returned by Run when the backup succeeded, but pruning the
+// archives afterwards failed.
+type PruneError struct {
+	Err error
+}
+
+func (p *PruneError) Error() string {
+	return fmt.Sprintf("backup succeeded, but pruning failed: %v", p.Err)
+}
+
+func (p *PruneError) Cause() error {
+	return p.Err
+}
+
+func (p *PruneError) Unwrap() error {
+	return p.Err
+}
+
+// the borg prune flags that select archives, which would override the glob
+var pruneScopeFlags = []string{"--glob-archives", "-a", "--prefix", "-P"}
+
+// validate makes sure the prune can be restricted to the archives of this
+// host: the archive names have to tell the hosts apart, and Args mustn't
+// select other archives. Neither matters with AllHosts.
+func (p *PruneOptions) validate(template string) error {
+	if p.AllHosts {
+		return nil
+	}
+	if !strings.Contains(template, "{hostname}") {
+		return errors.Errorf("-backup-name %q has no {hostname}, so -prune can't tell the archives of this host apart, use -prune-all-hosts to prune all archives", template)
+	}
+	for _, arg := range p.Args {
+		if selectsArchives(arg) {
+			return errors.Errorf("-prune-args %s would override the archives of this host -prune is restricted to, use -prune-all-hosts to select the archives yourself", arg)
+		}
+	}
+	return nil
+}
+
+// selectsArchives tells whether arg is one of pruneScopeFlags, given with
+// its value or, as argparse allows, abbreviated.
+func selectsArchives(arg string) bool {
+	name := strings.SplitN(arg, "=", 2)[0]
+	for _, flag := range pruneScopeFlags {
+		if len(flag) == 2 && strings.HasPrefix(arg, flag) {
+			return true
+		}
+		if len(flag) > 2 && strings.HasPrefix(name, "--") && len(name) > 2 && strings.HasPrefix(flag, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostArchiveGlob matches the archive names of host, made from the archive
+// template. With -separate-archives, the names end in -<slug> of their
+// source, which slug adds.
+func (b BorgBackup) hostArchiveGlob(host string, slug string) string {
+	glob := archiveGlob(b.backupName, host)
+	if slug != "" {
+		glob += "-" + escapeGlob(slug)
+	}
+	return glob
+}
+
+// hostArchiveGlobs match the archives of host, both the ones of all sources
+// and the -separate-archives of the sources with slugs. Without slugs, those
+// of any source match.
+func (b BorgBackup) hostArchiveGlobs(host string, slugs []string) []string {
+	globs := []string{b.hostArchiveGlob(host, "")}
+	if len(slugs) == 0 {
+		return append(globs, globs[0]+"-*")
+	}
+	for _, slug := range slugs {
+		globs = append(globs, b.hostArchiveGlob(host, slug))
+	}
+	return globs
+}
+
+// pruneArgs builds the `borg prune` argv. Unless AllHosts is set, it always
+// restricts the prune to the archives glob matches.
+func (b BorgBackup) pruneArgs(glob string) []string {
+	args := append([]string{"prune", "--list"}, b.borgCommonArgs()...)
+	if !b.prune.AllHosts {
+		args = append(args, "--glob-archives", glob)
+	}
+	if b.prune.KeepWithin != "" {
+		args = append(args, "--keep-within", b.prune.KeepWithin)
+	}
+	for _, keep := range []struct {
+		flag string
+		n    int
+	}{{"--keep-daily", b.prune.KeepDaily}, {"--keep-weekly", b.prune.KeepWeekly}, {"--keep-monthly", b.prune.KeepMonthly}} {
+		if keep.n > 0 {
+			args = append(args, keep.flag, fmt.Sprint(keep.n))
+		}
+	}
+	return append(args, b.prune.Args...)
+}
+
+// checkPruneScope lists the archives borg selects with glob and makes sure
+// they all match it, and that the archive just created is among them.
+func (b BorgBackup) checkPruneScope(ctx context.Context, glob string, archiveName string) error {
+	out, err := b.borgOutput(ctx, append([]string{"list", "--json", "--glob-archives", glob}, b.borgCommonArgs()...)...)
+	if err != nil {
+		return errors.Wrap(err, "error while listing the archives to prune")
+	}
+	var list struct {
+		Archives []struct {
+			Name string `json:"name"`
+		} `json:"archives"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return errors.Wrap(err, "error while parsing borg list output")
+	}
+	found := false
+	for _, a := range list.Archives {
+		if ok, _ := path.Match(glob, a.Name); !ok {
+			return errors.Errorf("refusing to prune, borg selected archive %s, which doesn't match %s", a.Name, glob)
+		}
+		found = found || a.Name == archiveName
+	}
+	if !found && !b.dryRun {
+		return errors.Errorf("refusing to prune, %s doesn't select the archive %s just created", glob, archiveName)
+	}
+	b.logf(LevelInfo, "Pruning among %d archive(s) matching %s", len(list.Archives), glob)
+	return nil
+}
+
+// pruneArchives runs `borg prune` with the configured retention rules on the
+// archives glob matches. Its errors are returned as *PruneError.
+func (b BorgBackup) pruneArchives(ctx context.Context, glob string, archiveName string) error {
+	if err := b.runPrune(ctx, glob, archiveName); err != nil {
+		return &PruneError{Err: err}
+	}
+	return nil
+}
+
+func (b BorgBackup) runPrune(ctx context.Context, glob string, archiveName string) error {
+	if b.prune.AllHosts {
+		b.logf(LevelWarn, "pruning the archives of all hosts in the repository (-prune-all-hosts)")
+	} else if err := b.checkPruneScope(ctx, glob, archiveName); err != nil {
+		return err
+	}
+	args := b.pruneArgs(glob)
+	b.logf(LevelInfo, "borg %s", strings.Join(args, " "))
+	if b.dryRun {
+		return nil
+	}
+	return errors.Wrap(b.runBorgInterruptible(ctx, args), "error while pruning archives")
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// argValue returns the value following flag in args.
+func argValue(args []string, flag string) (string, bool) {
+	for i, arg := range args {
+		if arg == flag && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+func TestPruneArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		prune    PruneOptions
+		slug     string
+		glob     string // empty for none
+	}{
+		{"default names", DefaultArchiveTemplate, PruneOptions{KeepDaily: 7}, "", "*@mac"},
+		{"separate archives", DefaultArchiveTemplate, PruneOptions{KeepDaily: 7}, "data", "*@mac-data"},
+		{"named after the time", "{hostname}-{now:2006-01-02}", PruneOptions{KeepDaily: 7}, "", "mac-*"},
+		{"second job on the host", "{snapshot}@{hostname}-work", PruneOptions{KeepDaily: 7}, "", "*@mac-work"},
+		{"runs of placeholders", "{snapshot}{now}-{source}@{hostname}", PruneOptions{KeepDaily: 7}, "", "*-*@mac"},
+		{"extra args", DefaultArchiveTemplate, PruneOptions{KeepDaily: 7, Args: []string{"--keep-yearly", "2"}}, "", "*@mac"},
+		{"all hosts", DefaultArchiveTemplate, PruneOptions{KeepDaily: 7, AllHosts: true}, "", ""},
+		{"all hosts selecting the archives", DefaultArchiveTemplate, PruneOptions{AllHosts: true, Args: []string{"--glob-archives", "*@nas"}}, "", "*@nas"},
+	}
+	for _, tt := range tests {
+		prune := tt.prune
+		b, err := NewBackup(validOptions(WithBackupName(tt.template), WithPrune(&prune))...)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		args := b.pruneArgs(b.hostArchiveGlob("mac", tt.slug))
+		if args[0] != "prune" {
+			t.Errorf("%s: got %v, want a borg prune", tt.name, args)
+		}
+		glob, ok := argValue(args, "--glob-archives")
+		if ok != (tt.glob != "") || glob != tt.glob {
+			t.Errorf("%s: got %v, want --glob-archives %q", tt.name, args, tt.glob)
+		}
+		if n := strings.Count(strings.Join(args, " "), "--glob-archives"); n > 1 {
+			t.Errorf("%s: got %v, --glob-archives %d times", tt.name, args, n)
+		}
+		if keep, _ := argValue(args, "--keep-daily"); tt.prune.KeepDaily > 0 && keep != fmt.Sprint(tt.prune.KeepDaily) {
+			t.Errorf("%s: got %v, want --keep-daily %d", tt.name, args, tt.prune.KeepDaily)
+		}
+		if !strings.HasSuffix(strings.Join(args, " "), strings.Join(tt.prune.Args, " ")) {
+			t.Errorf("%s: got %v, want it to end in %v", tt.name, args, tt.prune.Args)
+		}
+	}
+}
+
+func TestPruneOptionsValidate(t *testing.T) {
+	tests := []struct {
+		template string
+		args     []string
+		allHosts bool
+		ok       bool
+	}{
+		{DefaultArchiveTemplate, nil, false, true},
+		{DefaultArchiveTemplate, []string{"--keep-yearly", "2", "--save-space"}, false, true},
+		{DefaultArchiveTemplate, []string{"--glob-archives", "*"}, false, false},
+		{DefaultArchiveTemplate, []string{"--glob-archives=*"}, false, false},
+		{DefaultArchiveTemplate, []string{"--glob", "*"}, false, false},
+		{DefaultArchiveTemplate, []string{"-a", "*"}, false, false},
+		{DefaultArchiveTemplate, []string{"-a*"}, false, false},
+		{DefaultArchiveTemplate, []string{"--prefix", "mac"}, false, false},
+		{DefaultArchiveTemplate, []string{"--prefix=mac"}, false, false},
+		{DefaultArchiveTemplate, []string{"-P", "mac"}, false, false},
+		{DefaultArchiveTemplate, []string{"--glob-archives", "*"}, true, true},
+		{DefaultArchiveTemplate, []string{"-P", "mac"}, true, true},
+		{"{snapshot}", nil, false, false},
+		{"{snapshot}", nil, true, true},
+	}
+	for _, tt := range tests {
+		p := PruneOptions{Args: tt.args, AllHosts: tt.allHosts}
+		if err := p.validate(tt.template); (err == nil) != tt.ok {
+			t.Errorf("-backup-name %q -prune-args %q, all hosts %v: got %v, want ok %v", tt.template, tt.args, tt.allHosts, err, tt.ok)
+		}
+	}
+}
+
+// pruneResponses answers borg list with the archive just created and the
+// given other ones.
+func pruneResponses(env **fakeBackupEnv, others ...string) func(call *fakeCall) (fakeResult, bool) {
+	return func(call *fakeCall) (fakeResult, bool) {
+		switch {
+		case call.has("borg", "list"):
+			names := others
+			if create := (*env).runner.find("borg", "create"); create != nil {
+				for _, arg := range create.args {
+					if strings.HasPrefix(arg, "::") {
+						names = append([]string{strings.TrimPrefix(arg, "::")}, others...)
+					}
+				}
+			}
+			var archives []string
+			for _, name := range names {
+				archives = append(archives, fmt.Sprintf(`{"name": %q}`, name))
+			}
+			return fakeResult{stdout: `{"archives": [` + strings.Join(archives, ", ") + `]}`}, true
+		case call.has("borg", "prune"):
+			return fakeResult{}, true
+		}
+		return fakeResult{}, false
+	}
+}
+
+func TestRunPrunesOnlyThisHost(t *testing.T) {
+	var env *fakeBackupEnv
+	b, env := newFakeBackup(t, pruneResponses(&env, "com.apple.TimeMachine.2024-01-01-000000@mac"),
+		WithHostname("mac"), WithPrune(&PruneOptions{KeepDaily: 7}))
+	if _, err := b.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, command := range []string{"list", "prune"} {
+		call := env.runner.find("borg", command)
+		if call == nil {
+			t.Fatalf("borg %s didn't run", command)
+		}
+		if glob, _ := argValue(call.args, "--glob-archives"); glob != "*@mac" {
+			t.Errorf("borg %s selected %q, want *@mac: %v", command, glob, call.args)
+		}
+	}
+}
+
+func TestRunRefusesToPruneOtherHosts(t *testing.T) {
+	var env *fakeBackupEnv
+	b, env := newFakeBackup(t, pruneResponses(&env, "com.apple.TimeMachine.2024-01-01-000000@mac-mini"),
+		WithHostname("mac"), WithPrune(&PruneOptions{KeepDaily: 7}))
+	_, err := b.Run(context.Background())
+	var pruneErr *PruneError
+	if !errors.As(err, &pruneErr) || !strings.Contains(err.Error(), "mac-mini") {
+		t.Fatalf("got %v, want a *PruneError about the archive of mac-mini", err)
+	}
+	if env.runner.find("borg", "prune") != nil {
+		t.Error("borg prune ran")
+	}
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// QuiesceHooks are the commands run right before and after the snapshot of
+// one source is created, e.g. to pause a VM.
+type QuiesceHooks struct {
+	Quiesce   string
+	Unquiesce string
+}
+
+// ParseQuiesceHooks parses the source=CMD values of -quiesce and -unquiesce.
+// Every source needs both commands, and must be one of sources.
+func ParseQuiesceHooks(quiesce []string, unquiesce []string, sources []string) (map[string]QuiesceHooks, error) {
+	known := map[string]string{}
+	for _, s := range sources {
+		known[filepath.Clean(s)] = s
+	}
+	hooks := map[string]QuiesceHooks{}
+	parse := func(flag string, value string) (string, string, error) {
+		idx := strings.Index(value, "=")
+		if idx <= 0 || idx == len(value)-1 {
+			return "", "", errors.Errorf("invalid -%s %q, expected source=command", flag, value)
+		}
+		source, ok := known[filepath.Clean(value[:idx])]
+		if !ok {
+			return "", "", errors.Errorf("-%s %q names %s, which is not a source", flag, value, value[:idx])
+		}
+		return source, value[idx+1:], nil
+	}
+	for _, value := range quiesce {
+		source, command, err := parse("quiesce", value)
+		if err != nil {
+			return nil, err
+		}
+		h := hooks[source]
+		if h.Quiesce != "" {
+			return nil, errors.Errorf("more than one -quiesce for source %s", source)
+		}
+		h.Quiesce = command
+		hooks[source] = h
+	}
+	for _, value := range unquiesce {
+		source, command, err := parse("unquiesce", value)
+		if err != nil {
+			return nil, err
+		}
+		h := hooks[source]
+		if h.Unquiesce != "" {
+			return nil, errors.Errorf("more than one -unquiesce for source %s", source)
+		}
+		h.Unquiesce = command
+		hooks[source] = h
+	}
+	for source, h := range hooks {
+		if h.Quiesce == "" || h.Unquiesce == "" {
+			return nil, errors.Errorf("source %s needs both -quiesce and -unquiesce", source)
+		}
+	}
+	return hooks, nil
+}
+
+// runHook runs command with sh, killing it after timeout.
+func runHook(ctx context.Context, command string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = safeEnvs()
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("%q timed out after %s", command, timeout)
+	}
+	return errors.Wrapf(err, "%q failed", command)
+}
+
+// createSnapshotQuiesced creates the snapshot of the i-th source between its
+// quiesce and unquiesce hooks, if it has any. The unquiesce hook runs even if
+// quiescing or the snapshot fail.
+func (b BorgBackup) createSnapshotQuiesced(ctx context.Context, i int, name string, source string) (created string, retries int, err error) {
+	hooks, ok := b.quiesceHooks[source]
+	if !ok {
+		return b.createSnapshotRetrying(ctx, i, name, source)
+	}
+	b.sourceLogf(i, "Quiescing source %s\n", source)
+	start := time.Now()
+	defer func() {
+		b.sourceLogf(i, "Unquiescing source %s\n", source)
+		// also after a cancellation, the source mustn't stay paused
+		uerr := runHook(context.Background(), hooks.Unquiesce, b.quiesceTimeout)
+		b.sourceLogf(i, "Source %s was quiesced for %s\n", source, time.Since(start).Round(time.Millisecond))
+		if uerr != nil {
+			uerr = errors.Wrapf(uerr, "error while unquiescing source %s", source)
+			if err != nil {
+				err = errors.Wrapf(err, "%v, also", uerr)
+			} else {
+				err = uerr
+			}
+		}
+	}()
+	if err := runHook(ctx, hooks.Quiesce, b.quiesceTimeout); err != nil {
+		return "", 0, errors.Wrapf(err, "error while quiescing source %s", source)
+	}
+	return b.createSnapshotRetrying(ctx, i, name, source)
+}
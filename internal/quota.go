@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// repoInfo is the subset of `borg info --json` we care about.
+type repoInfo struct {
+	Repository struct {
+		ID       string `json:"id"`
+		Location string `json:"location"`
+		// storage_quota is only reported by some hosting providers (e.g. BorgBase),
+		// so it's a pointer to tell "no quota" apart from "quota of 0".
+		StorageQuota *int64 `json:"storage_quota"`
+	} `json:"repository"`
+	Cache struct {
+		Stats struct {
+			UniqueCSize int64 `json:"unique_csize"`
+		} `json:"stats"`
+	} `json:"cache"`
+}
+
+func (b BorgBackup) getRepoInfo(ctx context.Context) (repoInfo, error) {
+	var info repoInfo
+	args := append([]string{"info", "--json"}, b.borgCommonArgs()...)
+	opts := RunOptions{Stderr: os.Stderr}
+	closePassphrase, err := b.setBorgEnv(&opts)
+	if err != nil {
+		return info, err
+	}
+	out, stderr, err := b.run(ctx, "borg", args, opts)
+	closePassphrase()
+	if err != nil && isRepoMissing(err, string(stderr)) {
+		return info, errors.Wrapf(ErrRepoDoesNotExist, "error while running borg info (%v)", err)
+	}
+	if err != nil {
+		return info, errors.Wrap(err, "error while running borg info")
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return info, errors.Wrap(err, "error while parsing borg info output")
+	}
+	return info, nil
+}
+
+// checkQuota compares the repository utilization against the configured
+// thresholds. Exceeding the warn threshold only prints a warning, exceeding
+// the abort threshold returns an error.
+func (b BorgBackup) checkQuota(info repoInfo) error {
+	quota := info.Repository.StorageQuota
+	if quota == nil || *quota <= 0 {
+		b.logf(LevelInfo, "Repository reports no storage quota, skipping quota check")
+		return nil
+	}
+	used := info.Cache.Stats.UniqueCSize
+	percent := float64(used) / float64(*quota) * 100
+	b.logf(LevelInfo, "Repository quota usage: %d of %d bytes (%.1f%%)", used, *quota, percent)
+	if b.quotaAbortPercent > 0 && percent >= b.quotaAbortPercent {
+		return errors.Errorf("repository uses %d of %d bytes (%.1f%%), which exceeds -quota-abort-percent %.1f%%",
+			used, *quota, percent, b.quotaAbortPercent)
+	}
+	if b.quotaWarnPercent > 0 && percent >= b.quotaWarnPercent {
+		b.logf(LevelWarn, "repository uses %d of %d bytes (%.1f%%), which exceeds -quota-warn-percent %.1f%%",
+			used, *quota, percent, b.quotaWarnPercent)
+	}
+	return nil
+}
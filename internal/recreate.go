@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RecreateOptions selects the archives `borg recreate` rewrites and the
+// exclusions applied to them.
+type RecreateOptions struct {
+	Sources        []string
+	Mountpoints    []string
+	ExcludeSources []string // live paths, translated like -exclude-source
+	Excludes       []string // borg patterns, passed as they are
+	Glob           string
+	Last           int
+	Hostname       string
+	LockFile       string
+	Umask          int
+
+	// the archives were created with -store-original-paths, Mountpoints
+	// aren't needed then
+	StoreOriginalPaths bool
+}
+
+// RecreatePreview is the effect of the exclusions on one archive.
+type RecreatePreview struct {
+	Archive       string
+	Size          int64
+	ExcludedSize  int64
+	ExcludedFiles int64
+}
+
+// Recreate applies new exclusions to existing archives.
+type Recreate struct {
+	b        BorgBackup
+	excludes []string
+}
+
+// NewRecreate resolves the exclusions of opts.
+func NewRecreate(opts RecreateOptions) (*Recreate, error) {
+	b := BorgBackup{
+		sources:        opts.Sources,
+		mountpoints:    opts.Mountpoints,
+		excludeSources: opts.ExcludeSources,
+		lockFile:       opts.LockFile,
+		hostname:       opts.Hostname,
+		umask:          opts.Umask,
+	}
+	if b.lockFile == "" {
+		b.lockFile = DefaultLockFile(os.Getenv("BORG_REPO"))
+	}
+	if opts.StoreOriginalPaths {
+		// the archived paths are the paths of the sources
+		b.mountpoints = b.sources
+	}
+	excludes, err := b.sourceExcludes()
+	if err != nil {
+		return nil, err
+	}
+	excludes = append(excludes, opts.Excludes...)
+	if len(excludes) == 0 {
+		return nil, errors.New("no exclusions given, nothing to recreate")
+	}
+	return &Recreate{b: b, excludes: excludes}, nil
+}
+
+// Archives lists the selected archives. Archives of other hosts are an
+// error, borg-tm only rewrites the archives of the machine it runs on.
+func (r *Recreate) Archives(ctx context.Context, glob string, last int) ([]string, error) {
+	host, err := r.b.resolveHostname(runState{})
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{"list", "--json"}, r.b.borgCommonArgs()...)
+	if glob != "" {
+		args = append(args, "--glob-archives", glob)
+	}
+	if last > 0 {
+		args = append(args, "--last", fmt.Sprint(last))
+	}
+	out, err := r.b.borgOutput(ctx, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error while listing archives")
+	}
+	var list struct {
+		Archives []struct {
+			Name string `json:"name"`
+		} `json:"archives"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, errors.Wrap(err, "error while parsing borg list output")
+	}
+	var names, foreign []string
+	for _, a := range list.Archives {
+		idx := strings.LastIndex(a.Name, "@")
+		if idx < 0 || a.Name[idx+1:] != host {
+			foreign = append(foreign, a.Name)
+			continue
+		}
+		names = append(names, a.Name)
+	}
+	if len(foreign) > 0 {
+		return nil, errors.Errorf("refusing to recreate archives not created by host %s: %s (narrow the selection with -archive)", host, strings.Join(foreign, ", "))
+	}
+	return names, nil
+}
+
+// Preview computes how much the exclusions remove from archive, by listing
+// its contents with and without them.
+func (r *Recreate) Preview(ctx context.Context, archive string) (RecreatePreview, error) {
+	p := RecreatePreview{Archive: archive}
+	size, files, err := r.itemsSize(ctx, archive, nil)
+	if err != nil {
+		return p, err
+	}
+	keptSize, keptFiles, err := r.itemsSize(ctx, archive, r.excludes)
+	if err != nil {
+		return p, err
+	}
+	p.Size = size
+	p.ExcludedSize = size - keptSize
+	p.ExcludedFiles = files - keptFiles
+	return p, nil
+}
+
+func (r *Recreate) itemsSize(ctx context.Context, archive string, excludes []string) (size int64, files int64, err error) {
+	args := append([]string{"list", "--json-lines"}, r.b.borgCommonArgs()...)
+	for _, pattern := range excludes {
+		args = append(args, "--exclude", pattern)
+	}
+	args = append(args, "::"+archive)
+	out, err := r.b.borgOutput(ctx, args...)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "error while listing archive %s", archive)
+	}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var item struct {
+			Type string `json:"type"`
+			Size int64  `json:"size"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &item); err != nil {
+			return 0, 0, errors.Wrapf(err, "error while parsing the contents of archive %s", archive)
+		}
+		size += item.Size
+		if item.Type == "-" {
+			files++
+		}
+	}
+	return size, files, errors.Wrapf(sc.Err(), "error while reading the contents of archive %s", archive)
+}
+
+// Run rewrites archives with the exclusions. It holds the borg-tm lock, as
+// recreate rewrites the repository.
+func (r *Recreate) Run(ctx context.Context, archives []string) error {
+	releaseLock, err := r.b.getFileLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer releaseLock()
+	for _, archive := range archives {
+		args := append([]string{"recreate"}, r.b.borgCommonArgs()...)
+		for _, pattern := range r.excludes {
+			args = append(args, "--exclude", pattern)
+		}
+		args = append(args, "::"+archive)
+		r.b.logf(LevelInfo, "borg %s", strings.Join(args, " "))
+		opts := RunOptions{Stdout: os.Stderr, Stderr: os.Stderr}
+		closePassphrase, err := r.b.setBorgEnv(&opts)
+		if err != nil {
+			return err
+		}
+		_, _, err = r.b.run(ctx, "borg", args, opts)
+		closePassphrase()
+		if err != nil {
+			return errors.Wrapf(err, "error while recreating archive %s", archive)
+		}
+	}
+	return nil
+}
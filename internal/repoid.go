@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// RepoMismatchError is returned by Run when the repository points at a different
+// repository than previous runs backed up to.
+type RepoMismatchError struct {
+	Location string
+	Recorded string
+	Current  string
+}
+
+func (e *RepoMismatchError) Error() string {
+	return fmt.Sprintf(`repository %s has ID %s, but previous backups went to repository %s.
+Check -repo or BORG_REPO; if the repository was replaced on purpose, run again with -accept-new-repo.`, e.Location, e.Current, e.Recorded)
+}
+
+// checkRepoID compares the ID of the repository against the one recorded for
+// its location in the state file, so that backups to several repositories
+// can share it. The ID is recorded on first use and when -accept-new-repo is
+// given, st is updated and saved in that case.
+func (b BorgBackup) checkRepoID(info repoInfo, st *runState) error {
+	id := info.Repository.ID
+	recorded := st.RepoIDs[b.repo]
+	// recorded by an older borg-tm, which didn't say for which repository
+	legacy := recorded == "" && st.RepoID != ""
+	switch {
+	case recorded == id:
+		return nil
+	case legacy && st.RepoID == id:
+		b.logf(LevelInfo, "Recording repository ID %s for %s", id, b.repo)
+		st.RepoID = ""
+	case legacy:
+		// either another repository or a replaced one, there's no telling
+		b.logf(LevelWarn, "repository %s has ID %s, not %s as recorded for an unknown repository, recording it for %s", info.Repository.Location, id, st.RepoID, b.repo)
+	case recorded == "":
+		b.logf(LevelInfo, "Recording repository ID %s", id)
+	case b.acceptNewRepo:
+		b.logf(LevelWarn, "Repository ID changed from %s to %s, recording the new one (-accept-new-repo)", recorded, id)
+	default:
+		return &RepoMismatchError{Location: info.Repository.Location, Recorded: recorded, Current: id}
+	}
+	if b.dryRun {
+		return nil
+	}
+	if st.RepoIDs == nil {
+		st.RepoIDs = map[string]string{}
+	}
+	st.RepoIDs[b.repo] = id
+	return st.save(b.stateFile)
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testRepoInfo(id string, location string) repoInfo {
+	var info repoInfo
+	info.Repository.ID = id
+	info.Repository.Location = location
+	return info
+}
+
+func TestCheckRepoID(t *testing.T) {
+	tests := []struct {
+		name     string
+		st       runState
+		repo     string
+		id       string
+		accept   bool
+		mismatch bool
+		want     runState
+	}{
+		{
+			name: "first use",
+			repo: "/backups/a", id: "aaaa",
+			want: runState{RepoIDs: map[string]string{"/backups/a": "aaaa"}},
+		},
+		{
+			name: "same repository",
+			st:   runState{RepoIDs: map[string]string{"/backups/a": "aaaa"}},
+			repo: "/backups/a", id: "aaaa",
+			want: runState{RepoIDs: map[string]string{"/backups/a": "aaaa"}},
+		},
+		{
+			name: "second repository",
+			st:   runState{RepoIDs: map[string]string{"/backups/a": "aaaa"}},
+			repo: "ssh://nas/backups/b", id: "bbbb",
+			want: runState{RepoIDs: map[string]string{"/backups/a": "aaaa", "ssh://nas/backups/b": "bbbb"}},
+		},
+		{
+			name: "replaced repository",
+			st:   runState{RepoIDs: map[string]string{"/backups/a": "aaaa"}},
+			repo: "/backups/a", id: "cccc",
+			mismatch: true,
+			want:     runState{RepoIDs: map[string]string{"/backups/a": "aaaa"}},
+		},
+		{
+			name: "replaced repository with -accept-new-repo",
+			st:   runState{RepoIDs: map[string]string{"/backups/a": "aaaa"}},
+			repo: "/backups/a", id: "cccc", accept: true,
+			want: runState{RepoIDs: map[string]string{"/backups/a": "cccc"}},
+		},
+		{
+			name: "legacy ID of this repository",
+			st:   runState{RepoID: "aaaa"},
+			repo: "/backups/a", id: "aaaa",
+			want: runState{RepoIDs: map[string]string{"/backups/a": "aaaa"}},
+		},
+		{
+			name: "legacy ID of another repository",
+			st:   runState{RepoID: "aaaa"},
+			repo: "/backups/b", id: "bbbb",
+			want: runState{RepoID: "aaaa", RepoIDs: map[string]string{"/backups/b": "bbbb"}},
+		},
+	}
+	dir, err := ioutil.TempDir("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateFile := filepath.Join(dir, tt.name+".json")
+			b := BorgBackup{repo: tt.repo, stateFile: stateFile, acceptNewRepo: tt.accept}
+			st := tt.st
+			err := b.checkRepoID(testRepoInfo(tt.id, tt.repo), &st)
+			if _, ok := err.(*RepoMismatchError); ok != tt.mismatch {
+				t.Fatalf("test %d: got error %v, want a mismatch: %v", i, err, tt.mismatch)
+			}
+			if tt.mismatch {
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(st, tt.want) {
+				t.Errorf("got state %+v, want %+v", st, tt.want)
+			}
+			if reflect.DeepEqual(tt.st, tt.want) {
+				// nothing to save
+				return
+			}
+			saved, err := loadState(stateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(saved, tt.want) {
+				t.Errorf("saved state %+v, want %+v", saved, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRepoIDDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := BorgBackup{repo: "/backups/a", stateFile: filepath.Join(dir, "state.json"), dryRun: true}
+	var st runState
+	if err := b.checkRepoID(testRepoInfo("aaaa", "/backups/a"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(b.stateFile); !os.IsNotExist(err) {
+		t.Errorf("a dry run saved the state: %v", err)
+	}
+}
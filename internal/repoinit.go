@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultInitEncryption is the encryption -init-if-missing creates
+// repositories with.
+const DefaultInitEncryption = "repokey-blake2"
+
+// ErrRepoDoesNotExist is the cause of the error of borg info when borg
+// reported that there is no repository at BORG_REPO.
+var ErrRepoDoesNotExist = errors.New("the repository does not exist")
+
+// borg's Repository.DoesNotExist error, in its plain and its --log-json form
+var borgRepoDoesNotExist = regexp.MustCompile(`Repository \S.* does not exist\.|"msgid": "Repository.DoesNotExist"`)
+
+// exit statuses of borg for Repository.DoesNotExist: the generic error of
+// borg before 1.4, and its own code with BORG_EXIT_CODES=modern
+const (
+	borgExitError        = 2
+	borgExitDoesNotExist = 13
+)
+
+// isRepoMissing reports whether a failed borg command failed because the
+// repository doesn't exist. Both the exit status and the message have to
+// match, so that ssh failures and repositories that can't be read don't
+// count.
+func isRepoMissing(err error, stderr string) bool {
+	code, ok := exitCode(err)
+	if !ok {
+		return false
+	}
+	return (code == borgExitError || code == borgExitDoesNotExist) && borgRepoDoesNotExist.MatchString(stderr)
+}
+
+// repoInfoWithin runs borg info within preflightRepoTimeout.
+func (b BorgBackup) repoInfoWithin(ctx context.Context) (repoInfo, error) {
+	infoCtx, cancel := context.WithTimeout(ctx, preflightRepoTimeout)
+	defer cancel()
+	info, err := b.getRepoInfo(infoCtx)
+	if infoCtx.Err() == context.DeadlineExceeded {
+		return info, errors.Errorf("borg info didn't finish within %s", preflightRepoTimeout)
+	}
+	return info, err
+}
+
+// repoInfoOrInit runs borg info like repoInfoWithin. With -init-if-missing,
+// a repository that doesn't exist is created first.
+func (b BorgBackup) repoInfoOrInit(ctx context.Context) (repoInfo, error) {
+	info, err := b.repoInfoWithin(ctx)
+	if errors.Cause(err) != ErrRepoDoesNotExist {
+		return info, err
+	}
+	if !b.initIfMissing {
+		return info, errors.Wrap(err, "create it with borg init, or run with -init-if-missing")
+	}
+	if err := b.initRepository(ctx); err != nil {
+		return info, err
+	}
+	if b.dryRun {
+		return info, nil
+	}
+	return b.repoInfoWithin(ctx)
+}
+
+// initRepository runs borg init with -init-encryption.
+func (b BorgBackup) initRepository(ctx context.Context) error {
+	if path, ok := localRepoPath(b.repo); ok {
+		if err := checkRepoParent(path); err != nil {
+			return errors.Wrapf(err, "refusing to create the repository %s", b.repo)
+		}
+	}
+	args := append([]string{"init", "--encryption", b.initEncryption}, b.borgCommonArgs()...)
+	b.logf(LevelWarn, "The repository %s doesn't exist, creating it (-init-if-missing)", b.repo)
+	b.logf(LevelInfo, "borg %v", args)
+	if b.dryRun {
+		return nil
+	}
+	if err := b.runBorgInterruptible(ctx, args); err != nil {
+		return errors.Wrapf(err, "error while creating the repository %s", b.repo)
+	}
+	if b.repoCreated != nil {
+		*b.repoCreated = true
+	}
+	export := fmt.Sprintf("Export the key now and keep it somewhere safe, away from this Mac:\n\n    borg key export %s /path/to/borg-key-backup", b.repo)
+	if b.keyExportPath != "" {
+		export = fmt.Sprintf("The key is exported to %s (-key-export-path), keep a copy of it\nsomewhere safe, away from this Mac.", b.keyExportPath)
+	}
+	b.logf(LevelWarn, `
+********************************************************************************
+Created the repository %s with encryption %s.
+Without its key and passphrase, the backups in it can't be restored.
+%s
+
+********************************************************************************`, b.repo, b.initEncryption, export)
+	return nil
+}
+
+// checkRepoParent makes sure a local repository is created where it is
+// expected: its parent directory has to exist, and a repository on an
+// external volume is not created in /Volumes of the boot volume while the
+// volume isn't mounted.
+func checkRepoParent(path string) error {
+	parent := filepath.Dir(path)
+	if _, err := os.Stat(parent); err != nil {
+		return errors.Wrap(err, "its parent directory isn't there")
+	}
+	rel, err := filepath.Rel("/Volumes", path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+	volume := filepath.Join("/Volumes", strings.SplitN(rel, string(filepath.Separator), 2)[0])
+	volumeInfo, err := os.Stat(volume)
+	if err != nil {
+		return errors.Wrapf(err, "%s isn't mounted", volume)
+	}
+	volumesInfo, err := os.Stat("/Volumes")
+	if err != nil {
+		return errors.Wrap(err, "error while checking /Volumes")
+	}
+	if sameDevice(volumeInfo, volumesInfo) {
+		return errors.Errorf("%s isn't mounted", volume)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Report describes a run and the archive it created. It is also what
+// -report-file contains.
+type Report struct {
+	Start     time.Time        `json:"start"`
+	End       time.Time        `json:"end"`
+	Snapshots []SourceSnapshot `json:"snapshots"`
+	// empty unless the archive was created
+	Archive string `json:"archive,omitempty"`
+	// the archive of each source with -separate-archives, whose stats
+	// aren't summed up in Stats
+	Archives []ArchiveResult `json:"archives,omitempty"`
+	// why borg create didn't run, e.g. SkippedUnchanged
+	Skipped string `json:"skipped,omitempty"`
+	// the archive in each repository when backing up to several, whose
+	// stats aren't in Stats
+	Repos []RepoResult `json:"repos,omitempty"`
+	// nil if borg create didn't run
+	BorgExitStatus *int `json:"borg_exit_status"`
+	// nil unless borg ran with --json, i.e. with -stats-summary or
+	// -size-anomaly-factor
+	Stats *ArchiveStats `json:"stats,omitempty"`
+	// number of --exclude patterns for Time Machine exclusions, nil without
+	// -honor-tm-exclusions
+	TMExclusions *int `json:"tm_exclusions,omitempty"`
+	// where the repository key was exported to, empty if it wasn't
+	KeyExport string `json:"key_export,omitempty"`
+	// resource usage of the helpers Run started, such as borg and snapUtil
+	Usage []ChildUsage `json:"usage,omitempty"`
+	// the error Run returned, empty on success
+	Error string `json:"error,omitempty"`
+}
+
+// SourceSnapshot names the snapshot a source was backed up from. Snapshot
+// is empty if the source was backed up as it is.
+type SourceSnapshot struct {
+	Source   string `json:"source"`
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// ArchiveStats are the statistics `borg create --json` reports.
+// DeduplicatedSize is what was added to the repository.
+type ArchiveStats struct {
+	OriginalSize     int64         `json:"original_size"`
+	CompressedSize   int64         `json:"compressed_size"`
+	DeduplicatedSize int64         `json:"deduplicated_size"`
+	NFiles           int64         `json:"nfiles"`
+	Duration         time.Duration `json:"duration_ns"`
+}
+
+func newArchiveStats(stats archiveStats, duration time.Duration) *ArchiveStats {
+	return &ArchiveStats{
+		OriginalSize:     stats.OriginalSize,
+		CompressedSize:   stats.CompressedSize,
+		DeduplicatedSize: stats.DeduplicatedSize,
+		NFiles:           stats.NFiles,
+		Duration:         duration,
+	}
+}
+
+// parseCreateOutput parses the stdout of `borg create --json`. Anything borg
+// prints before the JSON document, such as warnings, is skipped.
+func parseCreateOutput(out []byte) (archiveStats, time.Duration, error) {
+	var output struct {
+		Archive struct {
+			Duration float64      `json:"duration"`
+			Stats    archiveStats `json:"stats"`
+		} `json:"archive"`
+	}
+	start := bytes.Index(out, []byte("\n{"))
+	if bytes.HasPrefix(out, []byte("{")) {
+		start = 0
+	} else if start >= 0 {
+		start++
+	}
+	if start < 0 {
+		return archiveStats{}, 0, errors.New("error while parsing borg create output: no JSON found")
+	}
+	if err := json.NewDecoder(bytes.NewReader(out[start:])).Decode(&output); err != nil {
+		return archiveStats{}, 0, errors.Wrap(err, "error while parsing borg create output")
+	}
+	duration := time.Duration(output.Archive.Duration * float64(time.Second))
+	return output.Archive.Stats, duration, nil
+}
+
+// finish fills in what is known once Run is done.
+func (r *Report) finish(sources []string, snapshots []snapshotRecord, borgExit *int, err error) {
+	r.End = time.Now()
+	r.Snapshots = make([]SourceSnapshot, 0, len(sources))
+	for i, source := range sources {
+		s := SourceSnapshot{Source: source}
+		if i < len(snapshots) {
+			s.Snapshot = snapshots[i].Name
+		}
+		r.Snapshots = append(r.Snapshots, s)
+	}
+	if borgExit != nil && *borgExit >= 0 {
+		code := *borgExit
+		r.BorgExitStatus = &code
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// write stores the report as JSON at path, atomically.
+func (r Report) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error while encoding report")
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// archiveNames lists the archives created, also with -separate-archives.
+func (r Report) archiveNames() string {
+	if r.Skipped != "" {
+		return r.Skipped
+	}
+	if len(r.Archives) == 0 {
+		return r.Archive
+	}
+	var names []string
+	for _, a := range r.Archives {
+		if a.Status == ArchiveCreated {
+			names = append(names, a.Archive)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// logReport logs the summary of the run, see -stats-summary.
+func (b BorgBackup) logReport(r Report) {
+	for _, a := range r.Archives {
+		b.logStats("", a.Archive, a.Stats)
+	}
+	for _, repo := range r.Repos {
+		prefix := fmt.Sprintf("Repository %s: ", repo.Repo)
+		switch {
+		case repo.Status == ArchiveFailed:
+			b.logf(LevelError, "%sfailed: %s", prefix, repo.Error)
+			continue
+		case repo.Stats == nil:
+			b.logf(LevelInfo, "%s%s", prefix, repo.Status)
+		default:
+			b.logStats(prefix, repo.Archive, repo.Stats)
+		}
+		if repo.Error != "" {
+			b.logf(LevelWarn, "%s%s", prefix, repo.Error)
+		}
+	}
+	b.logStats("", r.Archive, r.Stats)
+	if r.Skipped != "" {
+		b.logf(LevelInfo, "Backup %s", r.Skipped)
+	}
+	if r.TMExclusions != nil {
+		b.logf(LevelInfo, "Time Machine exclusions applied: %d", *r.TMExclusions)
+	}
+	if r.KeyExport != "" {
+		b.logf(LevelInfo, "Repository key exported to %s", r.KeyExport)
+	}
+}
+
+// logStats logs the statistics of archive, with the time borg took as the
+// duration of the entry.
+func (b BorgBackup) logStats(prefix string, archive string, s *ArchiveStats) {
+	if s == nil {
+		return
+	}
+	msg := fmt.Sprintf("%sArchive %s: %d files, original %.1f MiB, compressed %.1f MiB, deduplicated %.1f MiB", prefix, archive, s.NFiles,
+		float64(s.OriginalSize)/(1<<20), float64(s.CompressedSize)/(1<<20), float64(s.DeduplicatedSize)/(1<<20))
+	if s.DeduplicatedSize > 0 {
+		msg += fmt.Sprintf(" (dedup ratio %.1fx)", float64(s.OriginalSize)/float64(s.DeduplicatedSize))
+	}
+	msg += fmt.Sprintf(", took %s", s.Duration.Round(time.Second))
+	b.logEntryf(LogEntry{Level: LevelInfo, Duration: s.Duration}, "%s", msg)
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const fakeCreateOutput = `{"archive": {"duration": 12.5, "stats": {"original_size": 10485760, "compressed_size": 5242880, "deduplicated_size": 1048576, "nfiles": 42}}}`
+
+func TestRunLogsTheSummaryAsJSON(t *testing.T) {
+	log := new(bytes.Buffer)
+	b, _ := newFakeBackup(t, func(call *fakeCall) (fakeResult, bool) {
+		return fakeResult{stdout: fakeCreateOutput}, call.has("borg", "create")
+	}, WithStatsSummary(true), WithLogger(NewJSONLogger(log, LevelInfo)))
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	_, err = b.Run(context.Background())
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	out, _ := ioutil.ReadAll(r)
+	if len(out) > 0 {
+		t.Errorf("Run printed\n%s\nwhich belongs in the log", out)
+	}
+	var stats map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Errorf("logged %q, which isn't JSON: %v", line, err)
+			continue
+		}
+		if msg, _ := entry["msg"].(string); strings.Contains(msg, "42 files") {
+			stats = entry
+		}
+	}
+	if stats == nil {
+		t.Fatalf("the log has no statistics:\n%s", log)
+	}
+	if msg := stats["msg"].(string); !strings.Contains(msg, "deduplicated 1.0 MiB (dedup ratio 10.0x)") {
+		t.Errorf("logged the statistics %q", msg)
+	}
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RestoreOptions select what Restore gets out of an archive.
+type RestoreOptions struct {
+	Archive string
+	// a path as it was on the sources, or a borg pattern like
+	// sh:Users/*/Documents, empty for the whole archive
+	Path   string
+	Target string
+	// borg mount the archive on Target until ctx is cancelled, instead of
+	// extracting it into Target
+	Mount bool
+	// allow extracting into /
+	Force bool
+}
+
+// ParseRestoreSpec splits a -restore value, archive::path, where ::path is
+// optional.
+func ParseRestoreSpec(spec string) (archive string, path string, err error) {
+	parts := strings.SplitN(spec, "::", 2)
+	if parts[0] == "" {
+		return "", "", errors.Errorf("invalid -restore %q, expected archive::path", spec)
+	}
+	if len(parts) == 2 {
+		path = parts[1]
+	}
+	return parts[0], path, nil
+}
+
+// isBorgPattern reports whether path is meant as a borg pattern, which is
+// passed to borg as it is.
+func isBorgPattern(path string) bool {
+	if strings.ContainsAny(path, "*?[") {
+		return true
+	}
+	for _, prefix := range []string{"fm:", "sh:", "re:", "pp:", "pf:"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreCandidate is where a path may be in an archive, and the
+// --strip-components that extract it to its path on the source.
+type restoreCandidate struct {
+	path  string
+	strip int
+}
+
+func pathComponents(path string) int {
+	return len(strings.Split(strings.Trim(path, "/"), "/"))
+}
+
+// restoreCandidates lists where the archive may have path: as it was on the
+// sources with -store-original-paths, there also below the Data volume for
+// firmlinked paths, or below the mountpoint of its source for archives
+// created without -store-original-paths or with borg before 1.2.
+func (b BorgBackup) restoreCandidates(path string) []restoreCandidate {
+	path = filepath.Clean(path)
+	candidates := []restoreCandidate{{path: strings.TrimPrefix(path, "/")}}
+	if !isWithin(path, dataVolume) {
+		candidates = append(candidates, restoreCandidate{path: strings.TrimPrefix(filepath.Join(dataVolume, path), "/"), strip: pathComponents(dataVolume)})
+	}
+	bases := b.mountpoints
+	if b.mountBases != nil {
+		bases = b.mountBases
+	}
+	for i, source := range b.sources {
+		source = filepath.Clean(source)
+		if bases[i] == source {
+			continue
+		}
+		for _, p := range []string{path, filepath.Join(dataVolume, path)} {
+			rel, err := filepath.Rel(source, p)
+			if err != nil || !isWithin(p, source) {
+				continue
+			}
+			candidates = append(candidates, restoreCandidate{path: strings.TrimPrefix(filepath.Join(bases[i], rel), "/"), strip: pathComponents(bases[i])})
+			break
+		}
+	}
+	return candidates
+}
+
+// archiveHasPath reports whether the archive has an item at path. The pf:
+// pattern only matches the item itself, not everything below it.
+func (b BorgBackup) archiveHasPath(ctx context.Context, archive string, path string) (bool, error) {
+	args := append([]string{"list", "--short"}, b.borgCommonArgs()...)
+	out, err := b.borgOutput(ctx, append(args, "::"+archive, "pf:"+path)...)
+	if err != nil && !b.isBorgWarning(err) {
+		return false, borgError(err, "listing archive "+archive)
+	}
+	return strings.TrimSpace(string(out)) != "", nil
+}
+
+// resolveRestorePath finds where the archive has path, see restoreCandidates.
+func (b BorgBackup) resolveRestorePath(ctx context.Context, archive string, path string) (restoreCandidate, error) {
+	if isBorgPattern(path) {
+		return restoreCandidate{path: path}, nil
+	}
+	var tried []string
+	for _, c := range b.restoreCandidates(path) {
+		found, err := b.archiveHasPath(ctx, archive, c.path)
+		if err != nil {
+			return c, err
+		}
+		if found {
+			return c, nil
+		}
+		tried = append(tried, c.path)
+	}
+	return restoreCandidate{}, errors.Errorf("archive %s has nothing at %s (tried %s)", archive, path, strings.Join(tried, ", "))
+}
+
+// Restore extracts a path, or the whole archive, into opts.Target with borg
+// extract, or mounts it there with borg mount until ctx is cancelled.
+func (b BorgBackup) Restore(ctx context.Context, opts RestoreOptions) error {
+	target, err := filepath.Abs(opts.Target)
+	if err != nil {
+		return errors.Wrap(err, "error while resolving -restore-target")
+	}
+	if target == "/" && !opts.Force {
+		return errors.New("refusing to restore into /, use -force if that is really what you want")
+	}
+	if b.passphraseSource != nil {
+		b.logf(LevelInfo, "Reading passphrase from %s", b.passphraseSource.Name())
+		b.passphrase, err = b.passphraseSource.Passphrase(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return errors.Wrap(err, "error while creating -restore-target")
+	}
+	if opts.Mount {
+		return b.mountArchive(ctx, opts, target)
+	}
+	args := append([]string{"extract"}, b.borgCommonArgs()...)
+	var paths []string
+	if opts.Path != "" {
+		c, err := b.resolveRestorePath(ctx, opts.Archive, opts.Path)
+		if err != nil {
+			return err
+		}
+		if c.strip > 0 {
+			args = append(args, "--strip-components", strconv.Itoa(c.strip))
+		}
+		paths = []string{c.path}
+	}
+	if b.dryRun {
+		args = append(args, "--dry-run", "--list")
+	}
+	args = append(append(args, "::"+opts.Archive), paths...)
+	b.logf(LevelInfo, "borg %v (in %s)", args, target)
+	if err := b.runBorgIn(ctx, target, args); err != nil {
+		return borgError(err, "extracting archive "+opts.Archive)
+	}
+	if !b.dryRun {
+		b.logf(LevelInfo, "Extracted into %s", target)
+	}
+	return nil
+}
+
+// mountArchive runs borg mount, which returns once the archive is mounted,
+// waits for ctx to be cancelled and unmounts it again.
+func (b BorgBackup) mountArchive(ctx context.Context, opts RestoreOptions, target string) error {
+	args := append([]string{"mount"}, b.borgCommonArgs()...)
+	args = append(args, "::"+opts.Archive, target)
+	if opts.Path != "" {
+		c, err := b.resolveRestorePath(ctx, opts.Archive, opts.Path)
+		if err != nil {
+			return err
+		}
+		args = append(args, c.path)
+	}
+	b.logf(LevelInfo, "borg %v", args)
+	if b.dryRun {
+		return nil
+	}
+	if err := b.runBorgInterruptible(ctx, args); err != nil {
+		return borgError(err, "mounting archive "+opts.Archive)
+	}
+	fmt.Printf("Mounted archive %s on %s, press Ctrl-C to unmount it\n", opts.Archive, target)
+	<-ctx.Done()
+	cleanupCtx, cancel := cleanupContext()
+	defer cancel()
+	if err := b.runBorgInterruptible(cleanupCtx, []string{"umount", target}); err != nil {
+		return errors.Wrapf(err, "error while unmounting %s, unmount it with `borg umount %s`", target, target)
+	}
+	fmt.Printf("Unmounted %s\n", target)
+	return nil
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Runner runs the commands of a backup: borg, and helpers such as tmutil,
+// snapUtil, diskutil and mount_apfs.
+type Runner interface {
+	// Run runs a command to completion and returns its output. It is killed
+	// when ctx is cancelled.
+	Run(ctx context.Context, name string, args []string, opts RunOptions) (stdout []byte, stderr []byte, err error)
+	// Start starts a command that is stopped with a signal rather than
+	// killed, such as borg create. Its output goes to opts.Stdout and
+	// opts.Stderr only.
+	Start(name string, args []string, opts RunOptions) (Process, error)
+}
+
+// Process is a command started by a Runner.
+type Process interface {
+	Signal(sig os.Signal) error
+	// Wait waits for the command to exit. A failure is reported like
+	// exec.Cmd.Wait does, with an error that has an ExitCode method.
+	Wait() error
+	// ExitCode is -1 until the command exited, or if a signal killed it.
+	ExitCode() int
+}
+
+// RunOptions adjusts how a Runner runs a command.
+type RunOptions struct {
+	// also copy the output to our stderr while the command runs
+	Passthrough bool
+	// the environment of the command, safeEnvs() if nil
+	Env []string
+	// passed to the command from fd 3 on, e.g. the passphrase pipe
+	ExtraFiles []*os.File
+	Stdin      io.Reader
+	// the working directory, ours if empty
+	Dir string
+	// where the output goes while the command runs, besides what Run
+	// returns
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// execRunner runs commands with os/exec and records their resource usage.
+type execRunner struct {
+	usage *usageTracker
+}
+
+func (r execRunner) command(cmd *exec.Cmd, opts RunOptions) {
+	cmd.Env = opts.Env
+	if cmd.Env == nil {
+		cmd.Env = safeEnvs()
+	}
+	cmd.ExtraFiles = opts.ExtraFiles
+	cmd.Stdin = opts.Stdin
+	cmd.Dir = opts.Dir
+}
+
+func (r execRunner) Run(ctx context.Context, name string, args []string, opts RunOptions) ([]byte, []byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	r.command(cmd, opts)
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	var outs, errs []io.Writer = []io.Writer{stdout}, []io.Writer{stderr}
+	if opts.Passthrough {
+		outs, errs = append(outs, os.Stderr), append(errs, os.Stderr)
+	}
+	if opts.Stdout != nil {
+		outs = append(outs, opts.Stdout)
+	}
+	if opts.Stderr != nil {
+		errs = append(errs, opts.Stderr)
+	}
+	cmd.Stdout = io.MultiWriter(outs...)
+	cmd.Stderr = io.MultiWriter(errs...)
+	err := cmd.Run()
+	r.usage.record(usageName(name, args), cmd.ProcessState)
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+func (r execRunner) Start(name string, args []string, opts RunOptions) (Process, error) {
+	cmd := exec.Command(name, args...)
+	r.command(cmd, opts)
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return execProcess{cmd: cmd, usage: r.usage, name: usageName(name, args)}, nil
+}
+
+type execProcess struct {
+	cmd   *exec.Cmd
+	usage *usageTracker
+	name  string
+}
+
+func (p execProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p execProcess) Wait() error {
+	err := p.cmd.Wait()
+	p.usage.record(p.name, p.cmd.ProcessState)
+	return err
+}
+
+func (p execProcess) ExitCode() int {
+	if p.cmd.ProcessState == nil {
+		return -1
+	}
+	return p.cmd.ProcessState.ExitCode()
+}
+
+// usageName is what the usage of a command is recorded as: the command,
+// also when it runs under taskpolicy.
+func usageName(name string, args []string) string {
+	if filepath.Base(name) == "taskpolicy" && len(args) > 2 {
+		return filepath.Base(args[2])
+	}
+	return filepath.Base(name)
+}
+
+// exitCode returns the exit status of a command that failed with err.
+func exitCode(err error) (int, bool) {
+	exitErr, ok := err.(interface{ ExitCode() int })
+	if !ok {
+		return 0, false
+	}
+	return exitErr.ExitCode(), true
+}
+
+// commandRunner is the configured Runner, os/exec by default.
+func (b BorgBackup) commandRunner() Runner {
+	if b.runner != nil {
+		return b.runner
+	}
+	return execRunner{usage: b.usage}
+}
+
+// run runs a helper command with the configured Runner.
+func (b BorgBackup) run(ctx context.Context, name string, args []string, opts RunOptions) ([]byte, []byte, error) {
+	b.logf(LevelDebug, "Running %s %s", name, strings.Join(args, " "))
+	return b.commandRunner().Run(ctx, name, args, opts)
+}
+
+// start starts a command with the configured Runner.
+func (b BorgBackup) start(name string, args []string, opts RunOptions) (Process, error) {
+	b.logf(LevelDebug, "Starting %s %s", name, strings.Join(args, " "))
+	return b.commandRunner().Start(name, args, opts)
+}
+
+// readingProcess is a command whose output is read while it runs.
+type readingProcess struct {
+	Process
+	io.Reader
+	pipe   *io.PipeReader
+	waited chan error
+}
+
+// Wait skips the rest of the output and waits for the command to exit.
+func (p *readingProcess) Wait() error {
+	io.Copy(ioutil.Discard, p.pipe)
+	return <-p.waited
+}
+
+// startReading starts a command like start, with its stdout readable from
+// the returned process, or its stderr with fromStderr.
+func (b BorgBackup) startReading(name string, args []string, opts RunOptions, fromStderr bool) (*readingProcess, error) {
+	pr, pw := io.Pipe()
+	if fromStderr {
+		opts.Stderr = pw
+	} else {
+		opts.Stdout = pw
+	}
+	process, err := b.start(name, args, opts)
+	if err != nil {
+		return nil, err
+	}
+	p := &readingProcess{Process: process, Reader: pr, pipe: pr, waited: make(chan error, 1)}
+	go func() {
+		err := process.Wait()
+		pw.Close()
+		p.waited <- err
+	}()
+	return p, nil
+}
+
+// signalOnCancel sends sigs to process once ctx is cancelled, until the
+// returned function is called.
+func signalOnCancel(ctx context.Context, process Process, sigs ...os.Signal) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			for _, sig := range sigs {
+				process.Signal(sig)
+			}
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExecRunnerPassesStdinAndExtraFiles(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	io.WriteString(w, "from fd 3")
+	w.Close()
+	opts := RunOptions{
+		Env:        []string{"GREETING=hello"},
+		ExtraFiles: []*os.File{r},
+		Stdin:      strings.NewReader("from stdin "),
+	}
+	stdout, _, err := execRunner{}.Run(context.Background(), "/bin/sh", []string{"-c", `echo "$GREETING"; cat; cat <&3`}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(stdout), "hello\nfrom stdin from fd 3"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestExecRunnerExitCode(t *testing.T) {
+	_, stderr, err := execRunner{}.Run(context.Background(), "/bin/sh", []string{"-c", "echo failed >&2; exit 3"}, RunOptions{})
+	if code, ok := exitCode(err); !ok || code != 3 {
+		t.Errorf("got exit code %d (%v), want 3", code, err)
+	}
+	if string(stderr) != "failed\n" {
+		t.Errorf("got stderr %q", stderr)
+	}
+}
+
+func TestStartReadingAndSignalOnCancel(t *testing.T) {
+	b := BorgBackup{runner: execRunner{}, logger: NewTextLogger(ioutil.Discard, LevelError)}
+	process, err := b.startReading("/bin/sh", []string{"-c", "echo started; exec sleep 60"}, RunOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := make([]byte, len("started\n"))
+	if _, err := io.ReadFull(process, line); err != nil || string(line) != "started\n" {
+		t.Fatalf("read %q: %v", line, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer signalOnCancel(ctx, process, syscall.SIGTERM)()
+	cancel()
+	done := make(chan error, 1)
+	go func() { done <- process.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("the signalled command exited successfully")
+		}
+	case <-time.After(10 * time.Second):
+		process.Signal(os.Kill)
+		t.Fatal("the command didn't get the signal")
+	}
+}
+
+func TestExecRunnerDefaultsToSafeEnvs(t *testing.T) {
+	setenvs(t, secretEnvs)
+	stdout, _, err := execRunner{}.Run(context.Background(), "/usr/bin/env", nil, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range strings.Split(strings.TrimSpace(string(stdout)), "\n") {
+		if name := strings.SplitN(env, "=", 2)[0]; secretEnvs[name] != "" {
+			t.Errorf("the command got %s", env)
+		}
+	}
+}
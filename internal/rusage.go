@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// UsageCounts is the resource usage of the runs of a helper.
+type UsageCounts struct {
+	Runs   int           `json:"runs"`
+	User   time.Duration `json:"user_ns"`
+	System time.Duration `json:"system_ns"`
+	MaxRSS int64         `json:"max_rss_bytes"` // maximum over all runs
+}
+
+func (c *UsageCounts) add(o UsageCounts) {
+	c.Runs += o.Runs
+	c.User += o.User
+	c.System += o.System
+	if o.MaxRSS > c.MaxRSS {
+		c.MaxRSS = o.MaxRSS
+	}
+}
+
+// ChildUsage is the resource usage of a helper, such as borg or snapUtil,
+// over the run and in each phase it ran in.
+type ChildUsage struct {
+	Command string `json:"command"`
+	UsageCounts
+	Phases map[string]UsageCounts `json:"phases"`
+}
+
+// usageTracker collects the resource usage of the child processes started
+// during a run, by the phase they were started in. A nil tracker ignores
+// everything.
+type usageTracker struct {
+	mu    sync.Mutex
+	phase string
+	usage map[string]*ChildUsage
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{phase: "start", usage: map[string]*ChildUsage{}}
+}
+
+// setPhase sets the phase the children exiting from now on are recorded in.
+func (t *usageTracker) setPhase(phase string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phase = phase
+}
+
+// record adds the usage of an exited child. state is nil if the child never
+// started.
+func (t *usageTracker) record(name string, state *os.ProcessState) {
+	if t == nil || state == nil {
+		return
+	}
+	run := UsageCounts{Runs: 1, User: state.UserTime(), System: state.SystemTime()}
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		run.MaxRSS = maxRSSBytes(ru)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.usage[name]
+	if !ok {
+		u = &ChildUsage{Command: name, Phases: map[string]UsageCounts{}}
+		t.usage[name] = u
+	}
+	u.add(run)
+	phase := u.Phases[t.phase]
+	phase.add(run)
+	u.Phases[t.phase] = phase
+}
+
+// summary returns the usage per helper, the one with the most CPU time
+// first.
+func (t *usageTracker) summary() []ChildUsage {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var usage []ChildUsage
+	for _, u := range t.usage {
+		phases := make(map[string]UsageCounts, len(u.Phases))
+		for phase, c := range u.Phases {
+			phases[phase] = c
+		}
+		usage = append(usage, ChildUsage{Command: u.Command, UsageCounts: u.UsageCounts, Phases: phases})
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		a, b := usage[i], usage[j]
+		if a.User+a.System != b.User+b.System {
+			return a.User+a.System > b.User+b.System
+		}
+		return a.Command < b.Command
+	})
+	return usage
+}
+
+func (c UsageCounts) String() string {
+	return fmt.Sprintf("%d run(s), user %s, system %s, max RSS %.1f MiB", c.Runs,
+		c.User.Round(time.Millisecond), c.System.Round(time.Millisecond), float64(c.MaxRSS)/(1<<20))
+}
+
+// logUsage logs the usage of the helpers, each with its phases.
+func (b BorgBackup) logUsage(usage []ChildUsage) {
+	if len(usage) == 0 {
+		return
+	}
+	b.logf(LevelInfo, "Resource usage of child processes:")
+	for _, u := range usage {
+		phases := make([]string, 0, len(u.Phases))
+		for phase := range u.Phases {
+			phases = append(phases, phase)
+		}
+		sort.Strings(phases)
+		for i, phase := range phases {
+			phases[i] = fmt.Sprintf("%s %d", phase, u.Phases[phase].Runs)
+		}
+		b.logf(LevelInfo, "  %s: %s (runs by phase: %s)", u.Command, u.UsageCounts, strings.Join(phases, ", "))
+	}
+}
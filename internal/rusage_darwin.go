@@ -0,0 +1,8 @@
+package internal
+
+import "syscall"
+
+// ru_maxrss is in bytes on macOS
+func maxRSSBytes(ru *syscall.Rusage) int64 {
+	return int64(ru.Maxrss)
+}
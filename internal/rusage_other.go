@@ -0,0 +1,11 @@
+//go:build !darwin
+// +build !darwin
+
+package internal
+
+import "syscall"
+
+// ru_maxrss is in kilobytes on Linux and the BSDs
+func maxRSSBytes(ru *syscall.Rusage) int64 {
+	return int64(ru.Maxrss) * 1024
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestUsageTrackerByPhase(t *testing.T) {
+	tracker := newUsageTracker()
+	r := execRunner{usage: tracker}
+	run := func(name string, args ...string) {
+		t.Helper()
+		if _, _, err := r.Run(context.Background(), name, args, RunOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run("/bin/sh", "-c", "true")
+	tracker.setPhase("snapshot")
+	run("/bin/sh", "-c", "true")
+	run("/bin/sh", "-c", "true")
+	p, err := r.Start("/bin/echo", []string{"started"}, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// not started, nothing to record
+	r.Run(context.Background(), "/nonexistent/snapUtil", nil, RunOptions{})
+
+	usage := tracker.summary()
+	byName := map[string]ChildUsage{}
+	for _, u := range usage {
+		byName[u.Command] = u
+	}
+	if len(usage) != 2 {
+		t.Fatalf("got the usage of %v, want sh and echo", usage)
+	}
+	sh := byName["sh"]
+	if sh.Runs != 3 || sh.Phases["start"].Runs != 1 || sh.Phases["snapshot"].Runs != 2 {
+		t.Errorf("sh: got %+v, want 3 runs, 1 at the start and 2 while snapshotting", sh)
+	}
+	if sh.MaxRSS <= 0 {
+		t.Errorf("sh: got max RSS %d", sh.MaxRSS)
+	}
+	if echo := byName["echo"]; echo.Runs != 1 || echo.Phases["snapshot"].Runs != 1 {
+		t.Errorf("echo: got %+v, want one run while snapshotting", echo)
+	}
+
+	log := new(bytes.Buffer)
+	b := BorgBackup{log: newRunLog(NewJSONLogger(log, LevelInfo))}
+	b.logUsage(usage)
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("logged %q, want a header and a line per helper", log)
+	}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Errorf("logged %q: %v", line, err)
+		}
+	}
+	if !strings.Contains(log.String(), "sh: 3 run(s)") || !strings.Contains(log.String(), "snapshot 2, start 1") {
+		t.Errorf("the log doesn't have the usage of sh:\n%s", log)
+	}
+
+	data, err := json.Marshal(Report{Usage: usage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Usage []struct {
+			Command string                    `json:"command"`
+			Runs    int                       `json:"runs"`
+			Phases  map[string]map[string]int `json:"phases"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range report.Usage {
+		if u.Command == "sh" && (u.Runs != 3 || u.Phases["snapshot"]["runs"] != 2) {
+			t.Errorf("the report has %s", data)
+		}
+	}
+}
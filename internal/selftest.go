@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const selfTestArchive = "selftest"
+
+// metadataProbe exercises one kind of macOS-specific metadata: setup applies
+// it to a file and read returns a comparable representation of it.
+type metadataProbe struct {
+	name  string
+	file  string
+	setup func(path string) error
+	read  func(path string) (string, error)
+}
+
+var metadataProbes = []metadataProbe{
+	{
+		name:  "extended attribute",
+		file:  "xattr",
+		setup: func(path string) error { return runHelper("xattr", "-w", "com.borg-tm.selftest", "borg-tm", path) },
+		read:  func(path string) (string, error) { return helperOutput("xattr", "-p", "com.borg-tm.selftest", path) },
+	},
+	{
+		name: "resource fork",
+		file: "resource-fork",
+		setup: func(path string) error {
+			return runHelper("xattr", "-w", "com.apple.ResourceFork", "borg-tm resource fork", path)
+		},
+		read: func(path string) (string, error) { return helperOutput("xattr", "-p", "com.apple.ResourceFork", path) },
+	},
+	{
+		name:  "UF_HIDDEN flag",
+		file:  "hidden",
+		setup: func(path string) error { return runHelper("chflags", "hidden", path) },
+		read:  func(path string) (string, error) { return helperOutput("stat", "-f", "%Sf", path) },
+	},
+	{
+		// APFS moves the birth time back when the modification time is set
+		// to an earlier date, which is the only way to set it without SetFile.
+		name:  "birth time",
+		file:  "birthtime",
+		setup: func(path string) error { return runHelper("touch", "-t", "201001020304.05", path) },
+		read:  func(path string) (string, error) { return helperOutput("stat", "-f", "%B", path) },
+	},
+	{
+		name:  "modification time",
+		file:  "mtime",
+		setup: func(path string) error { return runHelper("touch", "-t", "201501020304.05", path) },
+		read:  func(path string) (string, error) { return helperOutput("stat", "-f", "%m", path) },
+	},
+}
+
+// RunMetadataSelfTest creates files carrying macOS-specific metadata below
+// dir, backs them up to a throwaway repository (from a snapshot unless
+// noSnapshot is set), extracts them again and prints which metadata survived
+// the round-trip. An error is returned if anything was lost.
+func RunMetadataSelfTest(ctx context.Context, dir string, noSnapshot bool) error {
+	workDir, err := ioutil.TempDir(dir, "borg-tm-selftest-")
+	if err != nil {
+		return errors.Wrap(err, "error while creating selftest directory")
+	}
+	defer os.RemoveAll(workDir)
+	// resolve /tmp -> /private/tmp so the path can be matched with its volume
+	if workDir, err = filepath.EvalSymlinks(workDir); err != nil {
+		return errors.Wrap(err, "error while resolving selftest directory")
+	}
+
+	sourceDir := filepath.Join(workDir, "source")
+	if err := os.Mkdir(sourceDir, 0755); err != nil {
+		return errors.Wrap(err, "error while creating selftest directory")
+	}
+	for _, probe := range metadataProbes {
+		path := filepath.Join(sourceDir, probe.file)
+		if err := ioutil.WriteFile(path, []byte(probe.name+"\n"), 0644); err != nil {
+			return errors.Wrapf(err, "error while creating %s", path)
+		}
+		if err := probe.setup(path); err != nil {
+			return errors.Wrapf(err, "error while setting up %s", probe.name)
+		}
+	}
+
+	var b BorgBackup
+	backupDir := sourceDir
+	if !noSnapshot {
+		info, err := statfsMount(sourceDir)
+		if err != nil {
+			return err
+		}
+		volume := info.mountedOn
+		relative, err := relativeToVolume(sourceDir, volume)
+		if err != nil {
+			return err
+		}
+		b.logf(LevelInfo, "Creating snapshot for source %s", volume)
+		snapshot := b.newSnapshotName(time.Now())
+		snapshot, err = b.createSnapshot(ctx, snapshot, volume)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			b.logf(LevelInfo, "Removing snapshot %s for source %s", snapshot, volume)
+			cleanupCtx, cancel := cleanupContext()
+			defer cancel()
+			if err := b.removeSnapshot(cleanupCtx, snapshot, volume); err != nil {
+				b.logf(LevelWarn, "%v", err)
+			}
+		}()
+		mountpoint := filepath.Join(workDir, "mnt")
+		if err := os.Mkdir(mountpoint, 0755); err != nil {
+			return errors.Wrap(err, "error while creating mountpoint")
+		}
+		if err := b.mountSnapshot(ctx, 0, snapshotRecord{Name: snapshot}, volume, mountpoint); err != nil {
+			return err
+		}
+		defer func() {
+			b.logf(LevelInfo, "Unmounting %s", mountpoint)
+			if err := unmount(mountpoint); err != nil {
+				b.logf(LevelWarn, "unmount %s failed, need manual cleanup: %v", mountpoint, err)
+			}
+		}()
+		backupDir = filepath.Join(mountpoint, relative)
+	}
+
+	repo := filepath.Join(workDir, "repo")
+	extractDir := filepath.Join(workDir, "extract")
+	if err := os.Mkdir(extractDir, 0755); err != nil {
+		return errors.Wrap(err, "error while creating extract directory")
+	}
+	envs := append(os.Environ(),
+		"BORG_REPO="+repo,
+		"BORG_PASSPHRASE=",
+		"BORG_UNKNOWN_UNENCRYPTED_REPO_ACCESS_IS_OK=yes",
+	)
+	steps := [][]string{
+		{"init", "--encryption", "none"},
+		{"create", "::" + selfTestArchive, backupDir},
+		{"extract", "::" + selfTestArchive},
+	}
+	for _, args := range steps {
+		b.logf(LevelInfo, "borg %s", strings.Join(args, " "))
+		cmd := exec.CommandContext(ctx, "borg", args...)
+		cmd.Dir = extractDir
+		cmd.Env = envs
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "error while running borg %s", args[0])
+		}
+	}
+
+	extractedDir := filepath.Join(extractDir, strings.TrimPrefix(backupDir, "/"))
+	var lost []string
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "METADATA\tORIGINAL\tRESTORED\tRESULT")
+	for _, probe := range metadataProbes {
+		original, err := probe.read(filepath.Join(sourceDir, probe.file))
+		if err != nil {
+			original = "<error: " + err.Error() + ">"
+		}
+		restored, err := probe.read(filepath.Join(extractedDir, probe.file))
+		if err != nil {
+			restored = "<missing>"
+		}
+		result := "preserved"
+		if original != restored {
+			result = "LOST"
+			lost = append(lost, probe.name)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", probe.name, original, restored, result)
+	}
+	w.Flush()
+	if len(lost) > 0 {
+		return errors.Errorf("metadata lost in backup round-trip: %s", strings.Join(lost, ", "))
+	}
+	return nil
+}
+
+// relativeToVolume returns path relative to the volume mounted at volume. On
+// the Data volume, paths like /private/tmp are reachable through firmlinks
+// and only exist below the volume's mountpoint under the same name.
+func relativeToVolume(path string, volume string) (string, error) {
+	if rel, err := filepath.Rel(volume, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel, nil
+	}
+	if _, err := os.Stat(filepath.Join(volume, path)); err == nil {
+		return strings.TrimPrefix(path, "/"), nil
+	}
+	return "", errors.Errorf("cannot locate %s on volume %s", path, volume)
+}
+
+func runHelper(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	cmd.Env = safeEnvs()
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "%s: %s", name, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func helperOutput(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Env = safeEnvs()
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrap(err, name)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
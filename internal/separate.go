@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"time"
+)
+
+// statuses of an ArchiveResult
+const (
+	ArchiveCreated = "created"
+	ArchiveFailed  = "failed"
+)
+
+// ArchiveResult is the outcome of the archive of one source with
+// -separate-archives.
+type ArchiveResult struct {
+	Source  string        `json:"source"`
+	Archive string        `json:"archive,omitempty"`
+	Status  string        `json:"status"`
+	Error   string        `json:"error,omitempty"`
+	Stats   *ArchiveStats `json:"stats,omitempty"`
+}
+
+// sourceSlugs names the archives of the sources with -separate-archives,
+// e.g. root for / and data for /System/Volumes/Data.
+func (b BorgBackup) sourceSlugs() []string {
+	if b.prefixes != nil {
+		return b.prefixes
+	}
+	return sourcePrefixes(b.sources)
+}
+
+// backUpSeparately creates one archive per source, named after the archive
+// template and the slug of the source. Each snapshot is only mounted while
+// its archive is created. A failing source is recorded in b.failures and
+// the others go on. snapshots is filled in like b.sources, for the cleanup.
+func (b BorgBackup) backUpSeparately(ctx context.Context, hostName string, created []string, consistent []string, snapshots []snapshotRecord, cleanup *cleanupFailures) []ArchiveResult {
+	slugs := b.sourceSlugs()
+	results := make([]ArchiveResult, len(b.sources))
+	for i, source := range b.sources {
+		results[i] = ArchiveResult{Source: source, Status: ArchiveFailed}
+		if b.failures.has(i) {
+			// the snapshot couldn't be created
+			results[i].Error = b.failures.get(i).Error()
+			continue
+		}
+		archive, stats, err := b.backUpSource(ctx, i, hostName, slugs[i], created, consistent, snapshots, cleanup)
+		results[i].Archive = archive
+		if err != nil {
+			b.logEntryf(b.sourceEntry(i, LevelError), "Archive of source %s failed: %v", source, err)
+			b.failures.add(i, err)
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].Status = ArchiveCreated
+		results[i].Stats = stats
+	}
+	return results
+}
+
+// backUpSource mounts the snapshot of the i-th source, creates its archive
+// and unmounts it again.
+func (b BorgBackup) backUpSource(ctx context.Context, i int, hostName string, slug string, created []string, consistent []string, snapshots []snapshotRecord, cleanup *cleanupFailures) (string, *ArchiveStats, error) {
+	source := b.sources[i]
+	mountpoint := b.mountpoints[i]
+	b.sourceLogf(i, "source: %s\n", source)
+	b.sourceLogf(i, "mountpoint: %s\n", mountpoint)
+	snapshot, err := b.selectSnapshot(ctx, i, created, consistent)
+	// recorded before mounting, so that a created snapshot gets removed
+	snapshots[i] = snapshot
+	if err != nil {
+		return "", nil, err
+	}
+	vars := archiveNameVars{hostname: hostName, now: time.Now(), source: source}
+	if snapshot.Name != "" {
+		name, err := b.parseSnapshotName(snapshot.Name)
+		if err != nil {
+			return "", nil, err
+		}
+		vars.snapshot = name.archivePart()
+	}
+	archive, err := expandArchiveName(b.backupName, vars)
+	if err != nil {
+		return "", nil, err
+	}
+	archive += "-" + slug
+	if source != mountpoint {
+		if err := b.mountSnapshot(ctx, i, snapshot, source, mountpoint); err != nil {
+			return archive, nil, &MountError{Source: source, Mountpoint: mountpoint, Err: err}
+		}
+		defer b.unmountSource(i, cleanup)
+	}
+	if tm := b.sourceTMExclusions(ctx, i, snapshot.Name); len(tm) > 0 {
+		// b.excludes is shared with the other sources
+		b.excludes = append(append([]string(nil), b.excludes...), tm...)
+	}
+	b.sourceLogf(i, "Archive name: %s\n", archive)
+	stats, duration, err := b.invokeBorg(ctx, archive, b.borgPaths(i))
+	if err != nil {
+		return archive, nil, err
+	}
+	var reported *ArchiveStats
+	if stats != nil {
+		reported = newArchiveStats(*stats, duration)
+		// the size history compares each source with itself
+		sb := b
+		sb.label = b.label + "-" + slug
+		if err := sb.recordArchiveSize(archive, stats, nil); err != nil {
+			return archive, reported, err
+		}
+	}
+	return archive, reported, nil
+}
+
+// pruneSeparately prunes the archives of every source that got one on its
+// own, as their names end in -<slug>.
+func (b BorgBackup) pruneSeparately(ctx context.Context, hostName string, results []ArchiveResult) error {
+	slugs := b.sourceSlugs()
+	for i, r := range results {
+		if r.Status != ArchiveCreated {
+			continue
+		}
+		if err := b.pruneArchives(ctx, b.hostArchiveGlob(hostName, slugs[i]), r.Archive); err != nil {
+			return err
+		}
+		if b.prune.AllHosts {
+			// one prune covers all of them
+			return nil
+		}
+	}
+	return nil
+}
+
+// allFailed reports whether no source got an archive.
+func allFailed(results []ArchiveResult) bool {
+	for _, r := range results {
+		if r.Status == ArchiveCreated {
+			return false
+		}
+	}
+	return true
+}
+
+// lastCreated returns the name of the last archive created.
+func lastCreated(results []ArchiveResult) string {
+	last := ""
+	for _, r := range results {
+		if r.Status == ArchiveCreated {
+			last = r.Archive
+		}
+	}
+	return last
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SplitShellWords splits s into words like a POSIX shell would, without any
+// expansion: whitespace separates words, single quotes keep everything up to
+// the next single quote, double quotes keep everything but \" \\ \$ and \`,
+// and a backslash outside of quotes escapes the next character. Empty quotes
+// give an empty word. Unterminated quotes and a trailing backslash are an
+// error.
+func SplitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	// a word started, possibly an empty one from ''
+	inWord := false
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			if i+1 >= len(runes) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			if runes[i] != '\n' {
+				// a backslash-newline joins lines
+				word.WriteRune(runes[i])
+				inWord = true
+			}
+		case c == '\'':
+			end := strings.IndexRune(string(runes[i+1:]), '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			quoted := []rune(string(runes[i+1:])[:end])
+			word.WriteString(string(quoted))
+			i += len(quoted) + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`\n", runes[i+1]) {
+					i++
+					if runes[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inWord = true
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"  \t\n", nil, true},
+		{"--keep-yearly 2", []string{"--keep-yearly", "2"}, true},
+		{"  --save-space\t--stats\n", []string{"--save-space", "--stats"}, true},
+		{`--glob-archives '*@mac mini'`, []string{"--glob-archives", "*@mac mini"}, true},
+		{`--glob-archives "*@mac mini"`, []string{"--glob-archives", "*@mac mini"}, true},
+		{`'it''s'`, []string{"its"}, true},
+		{`'a\b'`, []string{`a\b`}, true},
+		{`'say "hi"'`, []string{`say "hi"`}, true},
+		{`"it's"`, []string{"it's"}, true},
+		{`"a\"b" "c\\d" "\$HOME" "\x"`, []string{`a"b`, `c\d`, "$HOME", `\x`}, true},
+		{"\"a\\\nb\"", []string{"ab"}, true},
+		{`'' ""`, []string{"", ""}, true},
+		{`a''b`, []string{"ab"}, true},
+		{`pre"quoted"post`, []string{"prequotedpost"}, true},
+		{`mac\ mini \'x\'`, []string{"mac mini", "'x'"}, true},
+		{"a\\\nb", []string{"ab"}, true},
+		{`'∗@mäc'`, []string{"∗@mäc"}, true},
+		{`'unterminated`, nil, false},
+		{`"unterminated`, nil, false},
+		{`"escaped end\"`, nil, false},
+		{`trailing\`, nil, false},
+	}
+	for _, tt := range tests {
+		got, err := SplitShellWords(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("SplitShellWords(%q): got error %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitShellWords(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"context"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// policies for snapshots whose creation times are further apart than -max-snapshot-spread
+const (
+	SpreadPolicyRetry = "retry"
+	SpreadPolicyFail  = "fail"
+)
+
+// base delay between attempts to create a snapshot, doubled on every retry
+const snapshotRetryDelay = 2 * time.Second
+
+// transientError marks a failure that may go away when retried, e.g. while
+// Time Machine is taking a snapshot of the same volume.
+type transientError struct {
+	error
+}
+
+// Cause is used by errors.Cause
+func (e transientError) Cause() error {
+	return e.error
+}
+
+// isTransientSnapshotError tells from the helper's stderr whether it lost a
+// race against another snapshot operation. Anything else, such as a missing
+// entitlement or a bad volume, is permanent.
+func isTransientSnapshotError(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, s := range []string{"resource busy", "ebusy", "temporarily unavailable", "try again"} {
+		if strings.Contains(stderr, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTransient(err error) bool {
+	for err != nil {
+		if _, ok := err.(transientError); ok {
+			return true
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = cause.Cause()
+	}
+	return false
+}
+
+// createSnapshotRetrying creates a snapshot on the i-th source, retrying
+// transient failures up to -snapshot-retries times. It returns the name of
+// the created snapshot and the number of retries needed.
+func (b BorgBackup) createSnapshotRetrying(ctx context.Context, i int, name string, source string) (string, int, error) {
+	delay := snapshotRetryDelay
+	for retries := 0; ; retries++ {
+		created, err := b.createSnapshot(ctx, name, source)
+		if err == nil || !isTransient(err) || retries >= b.snapshotRetries {
+			return created, retries, err
+		}
+		b.sourceLogf(i, "Creating snapshot for source %s failed (%v), retrying in %s (%d/%d)\n", source, err, delay, retries+1, b.snapshotRetries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", retries, errors.Wrap(ctx.Err(), "error while creating snapshot")
+		}
+		delay *= 2
+	}
+}
+
+// createSnapshots creates a snapshot called name on every source in parallel
+// and returns the names of the created snapshots and the time each creation
+// completed, indexed like b.sources. Failed sources get an empty name. The
+// names are also returned along with an error, so that the snapshots that
+// were created can be removed.
+func (b BorgBackup) createSnapshots(ctx context.Context, name string) ([]string, []time.Time, error) {
+	names := make([]string, len(b.sources))
+	created := make([]time.Time, len(b.sources))
+	retries := make([]int, len(b.sources))
+	// one slot per source, so that no goroutine blocks on sending
+	errs := make(chan error, len(b.sources))
+	var wg sync.WaitGroup
+	wg.Add(len(b.sources))
+
+	for i := 0; i < len(b.sources); i++ {
+		source := b.sources[i]
+
+		go func(i int, source string) {
+			defer wg.Done()
+			// the recover of Run doesn't reach this goroutine
+			defer func() {
+				if r := recover(); r != nil {
+					errs <- &SnapshotCreateError{Source: source, Err: errors.Errorf("panic while creating snapshot: %v\n%s", r, debug.Stack())}
+				}
+			}()
+			b.sourceLogf(i, "Creating snapshot for source %s\n", source)
+			start := time.Now()
+			var err error
+			names[i], retries[i], err = b.createSnapshotQuiesced(ctx, i, name, source)
+			if err != nil && b.continueOnError {
+				b.sourceLogf(i, "Leaving out source %s (-continue-on-error): %v\n", source, err)
+				b.failures.add(i, err)
+			} else if err != nil {
+				errs <- &SnapshotCreateError{Source: source, Err: err}
+			} else {
+				created[i] = time.Now()
+				b.phaseDone(PhaseSnapshotCreated, PhaseInfo{Source: source, Snapshot: names[i]}, start)
+			}
+		}(i, source)
+	}
+	wg.Wait()
+	close(errs)
+
+	for i, n := range retries {
+		if n > 0 {
+			b.sourceLogf(i, "Snapshot for source %s needed %d retries\n", b.sources[i], n)
+		}
+	}
+	var failed []error
+	for err := range errs {
+		failed = append(failed, err)
+	}
+	switch len(failed) {
+	case 0:
+		return names, created, nil
+	case 1:
+		return names, created, failed[0]
+	default:
+		msgs := make([]string, len(failed))
+		for i, err := range failed {
+			msgs[i] = err.Error()
+		}
+		return names, created, &SnapshotCreateError{Err: errors.Errorf("%d snapshots couldn't be created: %s", len(failed), strings.Join(msgs, "; "))}
+	}
+}
+
+// creationSpread returns the time between the first and the last snapshot
+// creation. Zero times (failed creations) are ignored.
+func creationSpread(created []time.Time) time.Duration {
+	var first, last time.Time
+	for _, t := range created {
+		if t.IsZero() {
+			continue
+		}
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last.Sub(first)
+}
+
+// createSnapshotSet creates the snapshots for all sources and returns their
+// names and the measured spread of their creation times. All snapshots share
+// one name derived from the start time, which says nothing about when each of
+// them was actually taken. When the spread exceeds -max-snapshot-spread, the
+// snapshots are removed and, depending on the policy, created once more or
+// the run fails. Errors are a *SnapshotCreateError, or a *CleanupError if
+// the snapshots couldn't be removed again. When some snapshots couldn't be
+// created, the names of the others are returned with the error.
+func (b BorgBackup) createSnapshotSet(ctx context.Context) ([]string, time.Duration, error) {
+	for attempt := 1; ; attempt++ {
+		name := b.newSnapshotName(time.Now())
+		names, created, err := b.createSnapshots(ctx, name)
+		if err != nil {
+			// the caller removes the snapshots that were created
+			return names, 0, err
+		}
+		spread := creationSpread(created)
+		b.logf(LevelInfo, "Snapshots were created within %s of each other", spread)
+		if b.maxSnapshotSpread <= 0 || spread <= b.maxSnapshotSpread {
+			return names, spread, nil
+		}
+
+		cleanup := newCleanupFailures()
+		for i, source := range b.sources {
+			if names[i] == "" {
+				continue
+			}
+			b.sourceLogf(i, "Removing snapshot %s for source %s\n", names[i], source)
+			start := time.Now()
+			cleanupCtx, cancel := cleanupContext()
+			err := b.removeSnapshot(cleanupCtx, names[i], source)
+			cancel()
+			if err != nil {
+				// still try the others
+				cleanup.leftover(names[i], source, errors.Wrapf(err, "error while removing snapshot %s", names[i]))
+				continue
+			}
+			b.phaseDone(PhaseSnapshotRemoved, PhaseInfo{Source: source, Snapshot: names[i]}, start)
+		}
+		if err := cleanup.err(); err != nil {
+			return nil, spread, err
+		}
+		if b.snapshotSpreadPolicy == SpreadPolicyRetry && attempt == 1 {
+			b.logf(LevelWarn, "Snapshot creation spread %s exceeds -max-snapshot-spread %s, retrying once", spread, b.maxSnapshotSpread)
+			b.failures.reset()
+			continue
+		}
+		return nil, spread, &SnapshotCreateError{Err: errors.Errorf("snapshot creation spread %s exceeds -max-snapshot-spread %s", spread, b.maxSnapshotSpread)}
+	}
+}
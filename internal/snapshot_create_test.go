@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestSpreadExceededRemovesAllSnapshots(t *testing.T) {
+	var env *fakeBackupEnv
+	b, env := newFakeBackupOf(t, 3, func(call *fakeCall) (fakeResult, bool) {
+		switch {
+		case call.has("snapUtil", "-c", env.sources[2]):
+			// the last snapshot comes too late
+			return fakeResult{during: func() { time.Sleep(50 * time.Millisecond) }}, true
+		case call.has("snapUtil", "-d") && call.args[len(call.args)-1] == env.sources[0]:
+			return fakeResult{stderr: "snapUtil: Resource busy", exit: 1}, true
+		}
+		return fakeResult{}, false
+	}, WithMaxSnapshotSpread(10*time.Millisecond, SpreadPolicyFail))
+	_, err := b.Run(context.Background())
+	var cleanupErr *CleanupError
+	if !errors.As(err, &cleanupErr) {
+		t.Fatalf("Run returned %v, want a *CleanupError", err)
+	}
+	if len(cleanupErr.Leftovers) != 1 || !strings.Contains(cleanupErr.Leftovers[0], env.sources[0]) {
+		t.Errorf("leftovers %v, want only the snapshot of %s", cleanupErr.Leftovers, env.sources[0])
+	}
+	for _, source := range env.sources {
+		if !hasCall(env.runner, "snapUtil", "-d", source) {
+			t.Errorf("the snapshot of %s wasn't removed", source)
+		}
+	}
+	if env.runner.find("mount_apfs") != nil || env.runner.find("borg", "create") != nil {
+		t.Error("the backup went on after the spread was exceeded")
+	}
+}
+
+// hasCall tells whether r got the command name with args.
+func hasCall(r *fakeRunner, name string, args ...string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, call := range r.calls {
+		if call.has(name, args...) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRunRemovesSnapshotsWhenACreationFails(t *testing.T) {
+	tests := []struct {
+		name   string
+		failed []int // the sources whose snapshot can't be created
+	}{
+		{"the second of three", []int{1}},
+		{"the first and the last", []int{0, 2}},
+		{"all of them", []int{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var env *fakeBackupEnv
+			b, env := newFakeBackupOf(t, 3, func(call *fakeCall) (fakeResult, bool) {
+				for _, i := range tt.failed {
+					if call.has("snapUtil", "-c") && call.args[len(call.args)-1] == env.sources[i] {
+						return fakeResult{stderr: "snapUtil: Operation not permitted", exit: 1}, true
+					}
+				}
+				return fakeResult{}, false
+			})
+			_, err := b.Run(context.Background())
+			var createErr *SnapshotCreateError
+			if !errors.As(err, &createErr) {
+				t.Fatalf("Run returned %v, want a *SnapshotCreateError", err)
+			}
+			for i, source := range env.sources {
+				isFailed := false
+				for _, f := range tt.failed {
+					isFailed = isFailed || f == i
+				}
+				if isFailed && !strings.Contains(err.Error(), source) {
+					t.Errorf("the error %q doesn't name %s", err, source)
+				}
+				if removed := hasCall(env.runner, "snapUtil", "-d", source); removed == isFailed {
+					t.Errorf("the snapshot of %s: removed %v, want %v", source, removed, !isFailed)
+				}
+			}
+			if env.runner.find("mount_apfs") != nil || env.runner.find("borg", "create") != nil {
+				t.Error("the backup went on after a snapshot couldn't be created")
+			}
+			j, err := loadJournal(b.journalFile, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !j.empty() {
+				t.Errorf("the journal still has %s", j.describe())
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ListedSnapshot is a local snapshot of a source as shown by -list-snapshots.
+type ListedSnapshot struct {
+	Name     string       `json:"name"`
+	Created  *time.Time   `json:"created,omitempty"` // nil if the name has no timestamp
+	Kind     SnapshotKind `json:"kind"`
+	BorgTM   bool         `json:"borg_tm"` // created by borg-tm, by its name
+	Selected bool         `json:"selected"`
+}
+
+// SourceSnapshots are the snapshots of one source and the one a run with
+// -use-existing-snapshots would back up.
+type SourceSnapshots struct {
+	Source    string           `json:"source"`
+	Snapshots []ListedSnapshot `json:"snapshots"`
+	Selected  string           `json:"selected,omitempty"`
+	// why nothing is selected: the source is backed up live, or no
+	// snapshot qualifies
+	NoneSelected string `json:"none_selected,omitempty"`
+}
+
+// ListSnapshots lists the local snapshots of every source and marks the ones
+// -use-existing-snapshots would pick, with the same selection as Run: the
+// -snapshotToUse of the source, a -consistent-snapshots set, or the newest.
+func (b BorgBackup) ListSnapshots(ctx context.Context) ([]SourceSnapshots, error) {
+	var consistent []string
+	var consistentErr error
+	if b.consistentSnapshots {
+		consistent, consistentErr = b.getConsistentSnapshots(ctx)
+	}
+	result := make([]SourceSnapshots, len(b.sources))
+	for i, source := range b.sources {
+		list := SourceSnapshots{Source: source, Snapshots: []ListedSnapshot{}}
+		records, err := b.listSnapshotRecords(ctx, source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error while listing snapshots of %s", source)
+		}
+		names := snapshotNames(records)
+		switch {
+		case source == b.mountpoints[i]:
+			list.NoneSelected = "backed up live, the source is its own mountpoint"
+		case len(b.snapshotsToUse) > 0 && b.snapshotsToUse[i] != "":
+			list.Selected = b.snapshotsToUse[i]
+			if !containsString(names, list.Selected) {
+				list.NoneSelected = "-snapshotToUse " + list.Selected + " doesn't exist"
+			}
+		case consistentErr != nil:
+			list.NoneSelected = consistentErr.Error()
+		case consistent != nil:
+			list.Selected = consistent[i]
+		default:
+			if latest, ok := b.latestSnapshot(names); ok {
+				list.Selected = latest.Raw
+			} else {
+				list.NoneSelected = "no snapshots"
+			}
+		}
+		for _, r := range records {
+			s := ListedSnapshot{Name: r.Name, Kind: SnapshotCustom, Selected: r.Name == list.Selected}
+			if parsed, err := b.parseSnapshotName(r.Name); err == nil {
+				s.Kind = parsed.Kind
+				s.BorgTM = parsed.Kind == SnapshotBorgTM
+			}
+			if !r.Timestamp.IsZero() {
+				created := r.Timestamp
+				s.Created = &created
+			}
+			list.Snapshots = append(list.Snapshots, s)
+		}
+		result[i] = list
+	}
+	return result, nil
+}
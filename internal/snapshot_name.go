@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SnapshotKind tells who created a snapshot, according to its name.
+type SnapshotKind string
+
+const (
+	// SnapshotTimeMachine is a Time Machine snapshot, e.g.
+	// com.apple.TimeMachine.2024-05-01-031500.local
+	SnapshotTimeMachine SnapshotKind = "timemachine"
+	// SnapshotBorgTM is a snapshot created by borg-tm, e.g.
+	// com.borg-tm.1714533300
+	SnapshotBorgTM SnapshotKind = "borgtm"
+	// SnapshotCustom is any other snapshot, its timestamp is unknown
+	SnapshotCustom SnapshotKind = "custom"
+)
+
+// Time Machine appends .local to local snapshots and .backup to the ones on
+// backup disks; older releases used no suffix at all.
+var timeMachineSnapshotRegexp = regexp.MustCompile(`^com\.apple\.TimeMachine\.(\d{4}-\d{2}-\d{2}-\d{6})(?:\.(local|backup))?$`)
+
+const timeMachineTimestampFormat = "2006-01-02-150405"
+
+// DefaultSnapshotPrefix starts the names of the snapshots borg-tm creates,
+// followed by the Unix time. See WithSnapshotPrefix.
+const DefaultSnapshotPrefix = "com.borg-tm."
+
+// ValidateSnapshotPrefix checks a -snapshot-prefix. It must not be empty,
+// as the prefix is what keeps borg-tm from removing foreign snapshots, nor
+// claim the names of Time Machine.
+func ValidateSnapshotPrefix(prefix string) error {
+	switch {
+	case prefix == "":
+		return errors.New("-snapshot-prefix must not be empty")
+	case strings.HasPrefix(prefix, "com.apple."):
+		return errors.Errorf("-snapshot-prefix %q is in the namespace of Apple", prefix)
+	case strings.ContainsAny(prefix, "/ \t\n"):
+		return errors.Errorf("-snapshot-prefix %q must not contain slashes or whitespace", prefix)
+	}
+	return nil
+}
+
+// newSnapshotName returns the name of a snapshot created at t.
+func (b BorgBackup) newSnapshotName(t time.Time) string {
+	return b.snapshotPrefixOrDefault() + strconv.FormatInt(t.Unix(), 10)
+}
+
+func (b BorgBackup) snapshotPrefixOrDefault() string {
+	if b.snapshotPrefix == "" {
+		return DefaultSnapshotPrefix
+	}
+	return b.snapshotPrefix
+}
+
+// SnapshotInfo is what the name of an APFS snapshot tells about it.
+type SnapshotInfo struct {
+	Raw       string
+	Timestamp time.Time // zero for SnapshotCustom
+	Kind      SnapshotKind
+	// Domain is local or backup for Time Machine snapshots that carry the
+	// suffix, empty otherwise
+	Domain string
+}
+
+// ParseSnapshotName parses the names used by Time Machine and borg-tm with
+// DefaultSnapshotPrefix. Any other non-empty name is accepted as
+// SnapshotCustom without a timestamp.
+func ParseSnapshotName(raw string) (SnapshotInfo, error) {
+	return parseSnapshotName(raw, DefaultSnapshotPrefix)
+}
+
+// parseSnapshotName is ParseSnapshotName for the -snapshot-prefix of b.
+func (b BorgBackup) parseSnapshotName(raw string) (SnapshotInfo, error) {
+	return parseSnapshotName(raw, b.snapshotPrefixOrDefault())
+}
+
+func parseSnapshotName(raw string, prefix string) (SnapshotInfo, error) {
+	name := strings.TrimSpace(raw)
+	if name == "" {
+		return SnapshotInfo{}, errors.WithStack(ErrUnrecognizedSnapshotName)
+	}
+	if m := timeMachineSnapshotRegexp.FindStringSubmatch(name); m != nil {
+		if t, err := time.ParseInLocation(timeMachineTimestampFormat, m[1], time.Local); err == nil {
+			return SnapshotInfo{Raw: name, Timestamp: t, Kind: SnapshotTimeMachine, Domain: m[2]}, nil
+		}
+	}
+	if strings.HasPrefix(name, prefix) {
+		if sec, err := strconv.ParseInt(strings.TrimPrefix(name, prefix), 10, 64); err == nil {
+			return SnapshotInfo{Raw: name, Timestamp: time.Unix(sec, 0), Kind: SnapshotBorgTM}, nil
+		}
+	}
+	// the bare timestamps of borg-tm before the prefix
+	if t, err := time.ParseInLocation(snapshotNameFormat, name, time.Local); err == nil {
+		return SnapshotInfo{Raw: name, Timestamp: t, Kind: SnapshotBorgTM}, nil
+	}
+	return SnapshotInfo{Raw: name, Kind: SnapshotCustom}, nil
+}
+
+// archivePart is the part of the snapshot name used in the default archive
+// name: the timestamp of Time Machine and borg-tm snapshots, the full name
+// otherwise. borg-tm snapshots keep the archive names of the bare timestamps
+// they used to be named with.
+func (s SnapshotInfo) archivePart() string {
+	switch s.Kind {
+	case SnapshotTimeMachine:
+		return s.Timestamp.Format(timeMachineTimestampFormat)
+	case SnapshotBorgTM:
+		return s.Timestamp.Format(snapshotNameFormat)
+	}
+	return s.Raw
+}
+
+// latestSnapshot returns the newest of names by parsed timestamp. Names
+// without one are only considered if no name has a timestamp, in which case
+// the last one listed wins.
+func (b BorgBackup) latestSnapshot(names []string) (SnapshotInfo, bool) {
+	var latest SnapshotInfo
+	found := false
+	for _, raw := range names {
+		s, err := b.parseSnapshotName(raw)
+		if err != nil {
+			continue
+		}
+		switch {
+		case !found:
+			latest, found = s, true
+		case s.Timestamp.IsZero():
+			if latest.Timestamp.IsZero() {
+				latest = s
+			}
+		case !s.Timestamp.Before(latest.Timestamp):
+			latest = s
+		}
+	}
+	return latest, found
+}
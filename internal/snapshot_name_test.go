@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseSnapshotName(t *testing.T) {
+	local := func(year int, month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, 0, time.Local)
+	}
+	tests := []struct {
+		name   string // where it was seen
+		raw    string
+		kind   SnapshotKind
+		time   time.Time
+		domain string
+		part   string // archivePart
+	}{
+		// Time Machine
+		{"10.15 tmutil localsnapshot", "com.apple.TimeMachine.2019-11-20-101528", SnapshotTimeMachine, local(2019, 11, 20, 10, 15, 28), "", "2019-11-20-101528"},
+		{"11 local snapshot", "com.apple.TimeMachine.2021-02-03-040506.local", SnapshotTimeMachine, local(2021, 2, 3, 4, 5, 6), "local", "2021-02-03-040506"},
+		{"12 local snapshot", "com.apple.TimeMachine.2022-06-30-235959.local", SnapshotTimeMachine, local(2022, 6, 30, 23, 59, 59), "local", "2022-06-30-235959"},
+		{"12 backup disk snapshot", "com.apple.TimeMachine.2022-01-01-000000.backup", SnapshotTimeMachine, local(2022, 1, 1, 0, 0, 0), "backup", "2022-01-01-000000"},
+		{"13 local snapshot", "com.apple.TimeMachine.2023-03-14-150926.local", SnapshotTimeMachine, local(2023, 3, 14, 15, 9, 26), "local", "2023-03-14-150926"},
+		{"14 local snapshot", "com.apple.TimeMachine.2024-05-01-031500.local", SnapshotTimeMachine, local(2024, 5, 1, 3, 15, 0), "local", "2024-05-01-031500"},
+		{"tmutil listlocalsnapshots with a newline", "com.apple.TimeMachine.2024-05-01-031500.local\n", SnapshotTimeMachine, local(2024, 5, 1, 3, 15, 0), "local", "2024-05-01-031500"},
+		// borg-tm
+		{"borg-tm", "com.borg-tm.1714533300", SnapshotBorgTM, time.Unix(1714533300, 0), "", time.Unix(1714533300, 0).Format(snapshotNameFormat)},
+		{"borg-tm before the prefix", "2024-05-01 03:15:00", SnapshotBorgTM, local(2024, 5, 1, 3, 15, 0), "", "2024-05-01 03:15:00"},
+		// anything else keeps its name
+		{"11 system update", "com.apple.os.update-8AD0EAC8B9F1C4C8D9E0F1A2B3C4D5E6F708192A3B4C5D6E7F8091A2B3C4D5E6", SnapshotCustom, time.Time{}, "", "com.apple.os.update-8AD0EAC8B9F1C4C8D9E0F1A2B3C4D5E6F708192A3B4C5D6E7F8091A2B3C4D5E6"},
+		{"10.15 installer", "com.apple.bless.7E8B9C0D-1A2B-4C3D-8E9F-0A1B2C3D4E5F", SnapshotCustom, time.Time{}, "", "com.apple.bless.7E8B9C0D-1A2B-4C3D-8E9F-0A1B2C3D4E5F"},
+		{"Carbon Copy Cloner", "com.bombich.ccc.2B1C8A3E-5F4D-4E6A-9B7C-1D2E3F4A5B6C.2023-09-10-120000", SnapshotCustom, time.Time{}, "", "com.bombich.ccc.2B1C8A3E-5F4D-4E6A-9B7C-1D2E3F4A5B6C.2023-09-10-120000"},
+		{"Time Machine name with an impossible date", "com.apple.TimeMachine.2024-13-45-999999.local", SnapshotCustom, time.Time{}, "", "com.apple.TimeMachine.2024-13-45-999999.local"},
+		{"Time Machine name with an unknown domain", "com.apple.TimeMachine.2024-05-01-031500.remote", SnapshotCustom, time.Time{}, "", "com.apple.TimeMachine.2024-05-01-031500.remote"},
+		{"borg-tm prefix without a time", "com.borg-tm.latest", SnapshotCustom, time.Time{}, "", "com.borg-tm.latest"},
+		{"snapUtil -c by hand", "before upgrade", SnapshotCustom, time.Time{}, "", "before upgrade"},
+	}
+	for _, tt := range tests {
+		s, err := ParseSnapshotName(tt.raw)
+		if err != nil {
+			t.Errorf("%s: ParseSnapshotName(%q) failed: %v", tt.name, tt.raw, err)
+			continue
+		}
+		if s.Kind != tt.kind || !s.Timestamp.Equal(tt.time) || s.Domain != tt.domain {
+			t.Errorf("%s: ParseSnapshotName(%q) = %s at %s in %q, want %s at %s in %q", tt.name, tt.raw, s.Kind, s.Timestamp, s.Domain, tt.kind, tt.time, tt.domain)
+		}
+		if part := s.archivePart(); part != tt.part {
+			t.Errorf("%s: archivePart of %q = %q, want %q", tt.name, tt.raw, part, tt.part)
+		}
+	}
+	for _, raw := range []string{"", " ", "\n"} {
+		if _, err := ParseSnapshotName(raw); errors.Cause(err) != ErrUnrecognizedSnapshotName {
+			t.Errorf("ParseSnapshotName(%q) returned %v, want %v", raw, err, ErrUnrecognizedSnapshotName)
+		}
+	}
+}
+
+func TestParseSnapshotNameWithPrefix(t *testing.T) {
+	b := BorgBackup{snapshotPrefix: "org.example.backup."}
+	tests := []struct {
+		raw  string
+		kind SnapshotKind
+	}{
+		{"org.example.backup.1714533300", SnapshotBorgTM},
+		// another prefix is someone else's snapshot
+		{"com.borg-tm.1714533300", SnapshotCustom},
+		{"com.apple.TimeMachine.2024-05-01-031500.local", SnapshotTimeMachine},
+	}
+	for _, tt := range tests {
+		s, err := b.parseSnapshotName(tt.raw)
+		if err != nil || s.Kind != tt.kind {
+			t.Errorf("parseSnapshotName(%q) = %s, %v, want %s", tt.raw, s.Kind, err, tt.kind)
+		}
+	}
+	if name := b.newSnapshotName(time.Unix(1714533300, 0)); name != "org.example.backup.1714533300" {
+		t.Errorf("newSnapshotName = %s", name)
+	}
+}
+
+func TestLatestSnapshot(t *testing.T) {
+	var b BorgBackup
+	tests := []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"com.apple.TimeMachine.2024-05-01-031500.local", "com.apple.TimeMachine.2024-05-02-031500.local", "com.apple.TimeMachine.2024-04-30-031500.local"}, "com.apple.TimeMachine.2024-05-02-031500.local"},
+		// by time, whoever created them
+		{[]string{"com.borg-tm.1714700000", "com.apple.TimeMachine.2024-05-01-031500.local"}, "com.borg-tm.1714700000"},
+		// names without a time only count if no name has one
+		{[]string{"com.apple.TimeMachine.2024-05-01-031500.local", "before upgrade"}, "com.apple.TimeMachine.2024-05-01-031500.local"},
+		{[]string{"first", "second"}, "second"},
+		{[]string{"", "com.borg-tm.1714533300"}, "com.borg-tm.1714533300"},
+	}
+	for _, tt := range tests {
+		latest, ok := b.latestSnapshot(tt.names)
+		if !ok || latest.Raw != tt.want {
+			t.Errorf("latestSnapshot(%q) = %q, %v, want %q", tt.names, latest.Raw, ok, tt.want)
+		}
+	}
+	if _, ok := b.latestSnapshot([]string{""}); ok {
+		t.Error("latestSnapshot found a snapshot among empty names")
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SnapshotRetention decides which of the snapshots created by borg-tm are
+// kept: the newest Keep snapshots, plus any created within KeepWithin.
+type SnapshotRetention struct {
+	Keep       int
+	KeepWithin time.Duration
+}
+
+type datedSnapshot struct {
+	name    string
+	created time.Time
+}
+
+// expiredSnapshots returns the snapshots not retained by policy, oldest first.
+// Snapshots not created by borg-tm are never considered.
+func (b BorgBackup) expiredSnapshots(names []string, policy SnapshotRetention, now time.Time) []datedSnapshot {
+	var ours []datedSnapshot
+	for _, name := range names {
+		if s, err := b.parseSnapshotName(name); err == nil && s.Kind == SnapshotBorgTM {
+			ours = append(ours, datedSnapshot{name: s.Raw, created: s.Timestamp})
+		}
+	}
+	// newest first
+	sort.Slice(ours, func(i, j int) bool { return ours[i].created.After(ours[j].created) })
+	var expired []datedSnapshot
+	for i, s := range ours {
+		if i < policy.Keep {
+			continue
+		}
+		if policy.KeepWithin > 0 && now.Sub(s.created) < policy.KeepWithin {
+			continue
+		}
+		expired = append(expired, s)
+	}
+	for i, j := 0, len(expired)-1; i < j; i, j = i+1, j-1 {
+		expired[i], expired[j] = expired[j], expired[i]
+	}
+	return expired
+}
+
+// PruneSnapshots applies policy to the snapshots borg-tm created on each
+// source, named with prefix (empty for DefaultSnapshotPrefix). With dryRun,
+// the snapshots that would be removed are only listed.
+func PruneSnapshots(ctx context.Context, sources []string, policy SnapshotRetention, prefix string, dryRun bool) error {
+	b := BorgBackup{snapshotPrefix: prefix}
+	return b.pruneSnapshots(ctx, sources, policy, dryRun)
+}
+
+func (b BorgBackup) pruneSnapshots(ctx context.Context, sources []string, policy SnapshotRetention, dryRun bool) error {
+	now := time.Now()
+	for _, source := range sources {
+		names, err := b.listSnapshots(ctx, source)
+		if err != nil {
+			return errors.Wrapf(err, "error while pruning snapshots of %s", source)
+		}
+		expired := b.expiredSnapshots(names, policy, now)
+		if len(expired) == 0 {
+			b.logf(LevelInfo, "No snapshots to prune for source %s", source)
+			continue
+		}
+		for _, s := range expired {
+			if dryRun {
+				b.logf(LevelInfo, "Would remove snapshot %s for source %s", s.name, source)
+				continue
+			}
+			b.logf(LevelInfo, "Removing snapshot %s for source %s", s.name, source)
+			if err := b.removeSnapshot(ctx, s.name, source); err != nil {
+				return errors.Wrapf(err, "error while pruning snapshots of %s", source)
+			}
+		}
+	}
+	return nil
+}
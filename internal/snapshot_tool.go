@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Tools snapshots can be created with, see -snapshot-tool.
+const (
+	SnapshotToolAuto     = "auto"
+	SnapshotToolSnapUtil = "snaputil"
+	SnapshotToolTmutil   = "tmutil"
+)
+
+// snapUtil needs the com.apple.developer.vfs.snapshot entitlement
+const (
+	snapUtilName = "snapUtil"
+	// overrides the lookup like -snaputil-path
+	snapUtilEnv = "BORG_TM_SNAPUTIL"
+	// relative to the working directory, where it used to be looked up
+	legacySnapUtilPath = "./apfs/snapUtil"
+)
+
+// tmutil localsnapshot prints e.g. "Created local snapshot with date: 2024-01-15-093000"
+var tmutilCreatedRegexp = regexp.MustCompile(`(\d{4}-\d{2}-\d{2}-\d{6})`)
+
+// tmutil localsnapshot snapshots all local APFS volumes at once, so parallel
+// calls for several sources are serialized
+var tmutilSnapshotMu sync.Mutex
+
+// executable is os.Executable, replaced by the tests
+var executable = os.Executable
+
+// findSnapUtil returns the path of snapUtil: configured (-snaputil-path) or
+// $BORG_TM_SNAPUTIL if set, otherwise the first one found next to the
+// executable, in an apfs directory next to it, in PATH and in ./apfs.
+func findSnapUtil(configured string) (string, error) {
+	for _, explicit := range []struct{ what, path string }{{"-snaputil-path", configured}, {snapUtilEnv, os.Getenv(snapUtilEnv)}} {
+		if explicit.path == "" {
+			continue
+		}
+		if _, err := os.Stat(explicit.path); err != nil {
+			return "", errors.Wrapf(err, "snapUtil given by %s not found", explicit.what)
+		}
+		return explicit.path, nil
+	}
+	var candidates []string
+	if exe, err := executable(); err == nil {
+		if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+			exe = resolved
+		}
+		dir := filepath.Dir(exe)
+		candidates = append(candidates, filepath.Join(dir, snapUtilName), filepath.Join(dir, "apfs", snapUtilName))
+	}
+	if path, err := exec.LookPath(snapUtilName); err == nil {
+		candidates = append(candidates, path)
+	}
+	candidates = append(candidates, legacySnapUtilPath)
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+	return "", errors.Errorf("snapUtil not found next to the borg-tm executable, in PATH or in ./apfs; give its location with -snaputil-path or %s, or use -snapshot-tool tmutil", snapUtilEnv)
+}
+
+// snapUtilCmd returns the resolved snapUtil, looking it up if that didn't
+// happen yet (e.g. in prune-snapshots).
+func (b BorgBackup) snapUtilCmd() (string, error) {
+	if b.snapUtil != "" {
+		return b.snapUtil, nil
+	}
+	return findSnapUtil(b.snapUtilPath)
+}
+
+// resolveSnapshotTool picks the tool snapshots are created with and looks up
+// snapUtil. With -snapshot-tool auto, a missing snapUtil means tmutil;
+// with snaputil, it is an error, reported before any snapshot is created.
+func (b BorgBackup) resolveSnapshotTool() (tool string, snapUtil string, err error) {
+	tool = b.snapshotTool
+	if tool != SnapshotToolTmutil {
+		snapUtil, err = findSnapUtil(b.snapUtilPath)
+		if err != nil && tool == SnapshotToolSnapUtil {
+			return "", "", err
+		}
+		if err != nil {
+			b.logf(LevelInfo, "%v, creating snapshots with tmutil localsnapshot", err)
+			return SnapshotToolTmutil, "", nil
+		}
+		tool = SnapshotToolSnapUtil
+	}
+	if tool == SnapshotToolSnapUtil {
+		b.logf(LevelInfo, "Creating snapshots with %s", snapUtil)
+	} else {
+		b.logf(LevelInfo, "Creating snapshots with tmutil localsnapshot")
+	}
+	return tool, snapUtil, nil
+}
+
+// isEntitlementError tells whether snapUtil failed because it lacks the
+// snapshot entitlement.
+func isEntitlementError(msg string) bool {
+	return strings.Contains(msg, "Operation not permitted") || strings.Contains(strings.ToLower(msg), "entitlement")
+}
+
+func (b BorgBackup) createSnapshotSnapUtil(ctx context.Context, name string, source string) (string, error) {
+	snapUtil, err := b.snapUtilCmd()
+	if err != nil {
+		return "", err
+	}
+	_, stderr, err := b.run(ctx, snapUtil, []string{"-c", name, source}, RunOptions{})
+	if err != nil {
+		msg := strings.TrimSpace(string(stderr))
+		if isTransientSnapshotError(msg) {
+			return "", errors.Wrapf(transientError{err}, "error while creating snapshot: %s", msg)
+		}
+		if b.snapshotTool == SnapshotToolAuto && isEntitlementError(msg) {
+			b.logf(LevelWarn, "snapUtil isn't allowed to create snapshots (%s), falling back to tmutil localsnapshot", msg)
+			return b.createSnapshotTmutil(ctx, source)
+		}
+		return "", errors.Wrapf(err, "error while creating snapshot: %s", msg)
+	}
+	// snapUtil uses the name as given
+	return name, nil
+}
+
+// createSnapshotTmutil creates a Time Machine snapshot, which gets a name of
+// its own: com.apple.TimeMachine.<date>.local.
+func (b BorgBackup) createSnapshotTmutil(ctx context.Context, source string) (string, error) {
+	tmutilSnapshotMu.Lock()
+	defer tmutilSnapshotMu.Unlock()
+	stdout, stderr, err := b.run(ctx, tmUtilCmd, []string{"localsnapshot"}, RunOptions{})
+	msg := strings.TrimSpace(string(stdout) + string(stderr))
+	if err != nil {
+		if isTransientSnapshotError(msg) {
+			return "", errors.Wrapf(transientError{err}, "error while creating snapshot: %s", msg)
+		}
+		return "", errors.Wrapf(err, "error while creating snapshot: %s", msg)
+	}
+	m := tmutilCreatedRegexp.FindStringSubmatch(msg)
+	if m == nil {
+		return "", errors.Errorf("error while creating snapshot: unexpected tmutil output %q", msg)
+	}
+	return "com.apple.TimeMachine." + m[1] + ".local", nil
+}
+
+// removeSnapshotTmutil deletes a Time Machine snapshot, which tmutil only
+// does by date.
+func (b BorgBackup) removeSnapshotTmutil(ctx context.Context, snapshot SnapshotInfo, source string) error {
+	date := snapshot.Timestamp.Format(timeMachineTimestampFormat)
+	_, _, err := b.run(ctx, tmUtilCmd, []string{"deletelocalsnapshots", date}, RunOptions{Passthrough: true})
+	return errors.Wrap(err, "error while removing snapshot "+snapshot.Raw)
+}
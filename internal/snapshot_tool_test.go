@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindSnapUtil(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      []string // created below the temp dir, dirs end in /
+		configured string
+		env        string
+		symlink    bool // the executable is a symlink from link/borg-tm
+		want       string
+		err        string
+	}{
+		{name: "-snaputil-path first", files: []string{"given", "env", "bin/snapUtil"}, configured: "given", env: "env", want: "given"},
+		{name: "then the variable", files: []string{"env", "bin/snapUtil"}, env: "env", want: "env"},
+		{name: "-snaputil-path missing", files: []string{"bin/snapUtil"}, configured: "missing", err: "-snaputil-path"},
+		{name: "variable missing", files: []string{"bin/snapUtil"}, env: "missing", err: snapUtilEnv},
+		{name: "next to the executable", files: []string{"bin/snapUtil", "bin/apfs/snapUtil", "path/snapUtil", "work/apfs/snapUtil"}, want: "bin/snapUtil"},
+		{name: "in apfs next to the executable", files: []string{"bin/apfs/snapUtil", "path/snapUtil", "work/apfs/snapUtil"}, want: "bin/apfs/snapUtil"},
+		{name: "next to the linked executable", files: []string{"bin/snapUtil", "link/snapUtil"}, symlink: true, want: "bin/snapUtil"},
+		{name: "in PATH", files: []string{"path/snapUtil", "work/apfs/snapUtil"}, want: "path/snapUtil"},
+		{name: "in ./apfs", files: []string{"work/apfs/snapUtil"}, want: legacySnapUtilPath},
+		{name: "directories don't count", files: []string{"bin/snapUtil/", "work/apfs/snapUtil"}, want: legacySnapUtilPath},
+		{name: "nowhere", files: []string{"bin/apfs/"}, err: "snapUtil not found next to the borg-tm executable"},
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldExecutable, oldPath, oldEnv := executable, os.Getenv("PATH"), os.Getenv(snapUtilEnv)
+	defer func() {
+		executable = oldExecutable
+		os.Setenv("PATH", oldPath)
+		os.Setenv(snapUtilEnv, oldEnv)
+		os.Chdir(wd)
+	}()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "borg-tm-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			// resolve /tmp links, e.g. on macOS, like EvalSymlinks does
+			if dir, err = filepath.EvalSymlinks(dir); err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range append([]string{"bin/borg-tm", "path/", "work/"}, tt.files...) {
+				isDir := strings.HasSuffix(path, "/")
+				path = filepath.Join(dir, path)
+				if isDir {
+					mkdir(t, path)
+					continue
+				}
+				mkdir(t, filepath.Dir(path))
+				if err := ioutil.WriteFile(path, nil, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			exe := filepath.Join(dir, "bin", "borg-tm")
+			if tt.symlink {
+				link := filepath.Join(dir, "link", "borg-tm")
+				mkdir(t, filepath.Dir(link))
+				if err := os.Symlink(exe, link); err != nil {
+					t.Fatal(err)
+				}
+				exe = link
+			}
+			executable = func() (string, error) { return exe, nil }
+			os.Setenv("PATH", filepath.Join(dir, "path"))
+			env := ""
+			if tt.env != "" {
+				env = filepath.Join(dir, tt.env)
+			}
+			os.Setenv(snapUtilEnv, env)
+			configured := ""
+			if tt.configured != "" {
+				configured = filepath.Join(dir, tt.configured)
+			}
+			if err := os.Chdir(filepath.Join(dir, "work")); err != nil {
+				t.Fatal(err)
+			}
+			got, err := findSnapUtil(configured)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %q, %v, want an error with %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want
+			if want != legacySnapUtilPath {
+				want = filepath.Join(dir, want)
+			}
+			if got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestRunNeedsSnapUtilBeforeCreatingSnapshots(t *testing.T) {
+	b, env := newFakeBackup(t, nil, WithSnapshotTool(SnapshotToolSnapUtil), WithSnapUtilPath("/nonexistent/snapUtil"))
+	_, err := b.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "-snaputil-path") {
+		t.Fatalf("Run returned %v, want an error about -snaputil-path", err)
+	}
+	if env.runner.find("snapUtil") != nil || env.runner.find("tmutil", "localsnapshot") != nil {
+		t.Errorf("ran %v without snapUtil", env.flow())
+	}
+}
+
+func TestRunFallsBackToTmutilWithoutSnapUtil(t *testing.T) {
+	b, env := newFakeBackup(t, func(call *fakeCall) (fakeResult, bool) {
+		if call.has("tmutil", "localsnapshot") {
+			return fakeResult{stdout: "Created local snapshot with date: 2024-01-15-093000\n"}, true
+		}
+		return fakeResult{}, false
+	}, WithSnapUtilPath("/nonexistent/snapUtil"))
+	b.Run(context.Background())
+	if env.runner.find("snapUtil") != nil || env.runner.find("tmutil", "localsnapshot") == nil {
+		t.Errorf("ran %v, want the snapshot from tmutil", env.flow())
+	}
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// directories holding VM disk images, which are usually large sparse files
+var sparseDataGlobs = []string{
+	"Users/*/Library/Containers/com.docker.docker",
+	"Users/*/Library/Group Containers/group.com.docker",
+	"Users/*/Parallels",
+	"Users/*/Library/Containers/com.utmapp.UTM",
+}
+
+// findSparseData returns the first VM data directory found below any of the sources.
+func findSparseData(sources []string) string {
+	for _, source := range sources {
+		for _, pattern := range sparseDataGlobs {
+			matches, _ := filepath.Glob(filepath.Join(source, pattern))
+			if len(matches) > 0 {
+				return matches[0]
+			}
+		}
+	}
+	return ""
+}
+
+// resolveSparse decides whether `borg create --sparse` is used. An explicit
+// -sparse is an error when borg doesn't support it, while the automatic
+// detection just falls back to no sparse handling.
+func (b BorgBackup) resolveSparse(ctx context.Context) (bool, error) {
+	explicit := b.sparse != nil
+	enabled := explicit && *b.sparse
+	if !explicit {
+		if dir := findSparseData(b.sources); dir != "" {
+			b.logf(LevelInfo, "Found VM data in %s, enabling sparse file handling (use -sparse=false to disable)", dir)
+			enabled = true
+		}
+	}
+	if !enabled {
+		b.logf(LevelInfo, "Sparse file handling: off")
+		return false, nil
+	}
+	version, err := b.getBorgVersion(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !version.atLeast(1, 2, 0) {
+		if explicit {
+			return false, errors.Errorf("-sparse requires borg 1.2.0 or newer, but borg %s is installed", version)
+		}
+		b.logf(LevelInfo, "borg %s doesn't support --sparse for create, sparse file handling: off", version)
+		return false, nil
+	}
+	b.logf(LevelInfo, "Sparse file handling: on")
+	return true, nil
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sun_path is 104 bytes on macOS, including the terminating NUL
+const maxSocketPath = 103
+
+// sshTarget is the host part of an ssh repository location.
+type sshTarget struct {
+	dest string // [user@]host
+	port string
+}
+
+// parseSSHRepo extracts the ssh destination of repo, which is either
+// ssh://[user@]host[:port]/path or the scp-like [user@]host:path.
+func parseSSHRepo(repo string) (sshTarget, bool) {
+	if strings.HasPrefix(repo, "ssh://") {
+		u, err := url.Parse(repo)
+		if err != nil || u.Hostname() == "" {
+			return sshTarget{}, false
+		}
+		dest := u.Hostname()
+		if u.User != nil {
+			dest = u.User.Username() + "@" + dest
+		}
+		return sshTarget{dest: dest, port: u.Port()}, true
+	}
+	if strings.Contains(repo, "://") || strings.HasPrefix(repo, "/") {
+		return sshTarget{}, false
+	}
+	idx := strings.Index(repo, ":")
+	if idx <= 0 || strings.Contains(repo[:idx], "/") {
+		return sshTarget{}, false
+	}
+	return sshTarget{dest: repo[:idx]}, true
+}
+
+// sshMaster is an OpenSSH ControlMaster shared by all borg invocations of a
+// run. A nil sshMaster does nothing.
+type sshMaster struct {
+	rsh     []string
+	target  sshTarget
+	dir     string
+	socket  string
+	prevRsh string
+	hadRsh  bool
+	log     *runLog
+}
+
+// startSSHMaster opens a master connection to the repository's host and
+// points BORG_RSH at it. It returns nil without an error when the repository
+// isn't accessed over ssh or the rsh isn't OpenSSH.
+func (b BorgBackup) startSSHMaster() (*sshMaster, error) {
+	target, ok := parseSSHRepo(b.repo)
+	if !ok {
+		b.logf(LevelInfo, "Repository is not accessed over ssh, not starting an ssh control master")
+		return nil, nil
+	}
+	prevRsh, hadRsh := os.LookupEnv("BORG_RSH")
+	rsh := strings.Fields(prevRsh)
+	if len(rsh) == 0 {
+		rsh = []string{"ssh"}
+	}
+	version := new(bytes.Buffer)
+	cmd := exec.Command(rsh[0], "-V")
+	cmd.Stdout = version
+	cmd.Stderr = version
+	if err := cmd.Run(); err != nil || !strings.Contains(version.String(), "OpenSSH") {
+		b.logf(LevelWarn, "%s doesn't look like OpenSSH, not using a control master", rsh[0])
+		return nil, nil
+	}
+
+	// /tmp rather than $TMPDIR, which is far too long on macOS
+	dir, err := ioutil.TempDir("/tmp", "btm")
+	if err != nil {
+		return nil, errors.Wrap(err, "error while creating ssh control directory")
+	}
+	m := &sshMaster{rsh: rsh, target: target, dir: dir, socket: filepath.Join(dir, "cm"), prevRsh: prevRsh, hadRsh: hadRsh, log: b.log}
+	if len(m.socket) > maxSocketPath {
+		os.RemoveAll(dir)
+		return nil, errors.Errorf("ssh control socket path %s is too long", m.socket)
+	}
+	args := append(m.sshArgs(), "-o", "ControlMaster=yes", "-o", "ControlPersist=yes", "-N", "-f", target.dest)
+	cmd = exec.Command(rsh[0], args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = sshEnvs()
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(dir)
+		return nil, errors.Wrap(err, "error while starting the ssh control master")
+	}
+	b.logf(LevelInfo, "Started ssh control master for %s", target.dest)
+	borgRsh := strings.Join(append(append([]string(nil), rsh...), "-o", "ControlPath="+m.socket, "-o", "ControlMaster=no"), " ")
+	if err := os.Setenv("BORG_RSH", borgRsh); err != nil {
+		m.stop()
+		return nil, errors.Wrap(err, "error while setting BORG_RSH")
+	}
+	return m, nil
+}
+
+// sshEnvs is the environment of the ssh commands, which need the agent.
+func sshEnvs() []string {
+	envs := safeEnvs()
+	if sock, ok := os.LookupEnv("SSH_AUTH_SOCK"); ok {
+		envs = append(envs, "SSH_AUTH_SOCK="+sock)
+	}
+	return envs
+}
+
+// sshArgs are the rsh options plus the control path and port.
+func (m *sshMaster) sshArgs() []string {
+	args := append([]string(nil), m.rsh[1:]...)
+	args = append(args, "-o", "ControlPath="+m.socket)
+	if m.target.port != "" {
+		args = append(args, "-p", m.target.port)
+	}
+	return args
+}
+
+// stop closes the master connection and restores BORG_RSH.
+func (m *sshMaster) stop() {
+	if m == nil {
+		return
+	}
+	if m.hadRsh {
+		os.Setenv("BORG_RSH", m.prevRsh)
+	} else {
+		os.Unsetenv("BORG_RSH")
+	}
+	cmd := exec.Command(m.rsh[0], append(m.sshArgs(), "-O", "exit", m.target.dest)...)
+	cmd.Env = sshEnvs()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		m.log.logf(LevelWarn, "error while stopping the ssh control master: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	os.RemoveAll(m.dir)
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// directory of the default state, history and journal files, which have to
+// survive a reboot, a variable for the tests
+var stateDir = "/var/db/borg-tm"
+
+// names of the state and history files in stateDir that all repositories
+// shared, before they were kept per repository
+const (
+	legacyStateName   = "state.json"
+	legacyHistoryName = "history.json"
+)
+
+// DefaultStateFile returns the state file of backups to repo.
+func DefaultStateFile(repo string) string {
+	return filepath.Join(stateDir, "state-"+repoHash(repo)+".json")
+}
+
+// runState is persisted between runs to detect configuration drift.
+type runState struct {
+	ChunkerParams string `json:"chunker_params,omitempty"`
+	Hostname      string `json:"hostname,omitempty"`
+	// ID of the repository the backups went to, as recorded before the IDs
+	// were recorded by location, until that repository claims it
+	RepoID string `json:"repo_id,omitempty"`
+	// ID of each repository the backups go to, by location
+	RepoIDs map[string]string `json:"repo_ids,omitempty"`
+	// end of the last successful backup, used by check-freshness
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastArchive string    `json:"last_archive,omitempty"`
+	// start of the last borg check that passed, for -check-interval
+	LastCheck time.Time `json:"last_check,omitempty"`
+	// digests of the files of each source at the last archive, for
+	// -change-detection manifest
+	Manifests map[string]string `json:"manifests,omitempty"`
+}
+
+// adoptLegacyFiles moves the state and history files, which earlier versions
+// shared between all repositories, to the defaults of this repository, unless
+// it has its own already. The first repository backed up after the upgrade
+// gets them.
+func (b BorgBackup) adoptLegacyFiles() error {
+	for _, f := range []struct{ legacy, path, defaultPath string }{
+		{filepath.Join(stateDir, legacyStateName), b.stateFile, DefaultStateFile(b.repo)},
+		{filepath.Join(stateDir, legacyHistoryName), b.historyFile, DefaultHistoryFile(b.repo)},
+	} {
+		if f.path != f.defaultPath {
+			// given explicitly
+			continue
+		}
+		if _, err := os.Stat(f.path); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := os.Stat(f.legacy); err != nil {
+			continue
+		}
+		b.logf(LevelInfo, "Moving %s, shared by all repositories before, to %s", f.legacy, f.path)
+		if err := os.Rename(f.legacy, f.path); err != nil {
+			return errors.Wrapf(err, "error while moving %s", f.legacy)
+		}
+	}
+	return nil
+}
+
+func loadState(path string) (runState, error) {
+	var st runState
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return st, errors.Wrap(err, "error while reading state file")
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, errors.Wrap(err, "error while parsing state file")
+	}
+	return st, nil
+}
+
+func (st runState) save(path string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error while encoding state file")
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// over path, creating the parent directory if needed.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "error while creating directory for %s", path)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrapf(err, "error while writing %s", path)
+	}
+	return errors.Wrapf(os.Rename(tmp, path), "error while writing %s", path)
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdoptLegacyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "borg-tm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldStateDir := stateDir
+	defer func() { stateDir = oldStateDir }()
+	stateDir = dir
+	legacyState, legacyHistory := filepath.Join(dir, legacyStateName), filepath.Join(dir, legacyHistoryName)
+	for _, path := range []string{legacyState, legacyHistory} {
+		if err := ioutil.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a state file given explicitly leaves the legacy one alone, the
+	// default history file takes over the legacy one
+	b := BorgBackup{repo: "/backups/a", stateFile: filepath.Join(dir, "explicit.json"), historyFile: DefaultHistoryFile("/backups/a")}
+	if err := b.adoptLegacyFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacyState); err != nil {
+		t.Errorf("the legacy state file was moved for an explicit state file: %v", err)
+	}
+	if _, err := os.Stat(legacyHistory); !os.IsNotExist(err) {
+		t.Errorf("the legacy history file is still there: %v", err)
+	}
+	if _, err := os.Stat(b.historyFile); err != nil {
+		t.Errorf("the legacy history file wasn't moved: %v", err)
+	}
+
+	// the next repository starts its own
+	other := BorgBackup{repo: "/backups/b", stateFile: DefaultStateFile("/backups/b"), historyFile: DefaultHistoryFile("/backups/b")}
+	if err := ioutil.WriteFile(other.stateFile, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.adoptLegacyFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacyState); err != nil {
+		t.Errorf("the legacy state file replaced an existing one: %v", err)
+	}
+	if _, err := os.Stat(other.historyFile); !os.IsNotExist(err) {
+		t.Errorf("a second repository got a history file: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// lookupVolume is volumeOfPath, replaced by the tests
+var lookupVolume = volumeOfPath
+
+// volumeOfPath returns the mount point of the volume containing path and
+// the path relative to it. The firmlinks of the Data volume are followed,
+// e.g. /Users is Users on /System/Volumes/Data.
+func volumeOfPath(path string) (volume string, rel string, err error) {
+	m, err := statfsMount(path)
+	if err != nil {
+		return "", "", err
+	}
+	path = filepath.Clean(path)
+	volume = filepath.Clean(m.mountedOn)
+	if !isWithin(path, volume) && isWithin(filepath.Join(dataVolume, path), volume) {
+		path = filepath.Join(dataVolume, path)
+	}
+	rel, err = filepath.Rel(volume, path)
+	if err != nil || !isWithin(path, volume) {
+		return "", "", errors.Errorf("%s is not below its volume %s", path, volume)
+	}
+	return volume, rel, nil
+}
+
+// groupSubdirectorySources replaces sources that are directories inside a
+// volume with the volume itself and remembers the directories in
+// b.subpaths, so that the volume is snapshotted and mounted and only the
+// directories are handed to borg. Directories on the same volume share its
+// snapshot and the mountpoint of the first of them. Sources backed up as
+// they are and sources that can't be looked up stay as they are.
+func (b *BorgBackup) groupSubdirectorySources(volumeOf func(string) (string, string, error)) {
+	var sources, mountpoints, uuids, snapshotsToUse []string
+	var subpaths [][]string
+	byVolume := map[string]int{}
+	for i, source := range b.sources {
+		volume, rel := source, "."
+		if source != b.mountpoints[i] {
+			if v, r, err := volumeOf(source); err == nil {
+				volume, rel = v, r
+			}
+		}
+		if j, ok := byVolume[volume]; ok {
+			switch {
+			case subpaths[j] == nil:
+				b.subdirWarnings = append(b.subdirWarnings, fmt.Sprintf("source %s is on volume %s, which is backed up as a whole already", source, volume))
+			case rel == ".":
+				// the whole volume covers the directories
+				subpaths[j] = nil
+			default:
+				subpaths[j] = append(subpaths[j], rel)
+			}
+			if filepath.Clean(b.mountpoints[i]) != filepath.Clean(mountpoints[j]) {
+				b.subdirWarnings = append(b.subdirWarnings, fmt.Sprintf("source %s shares the snapshot of volume %s mounted on %s, mountpoint %s is not used", source, volume, mountpoints[j], b.mountpoints[i]))
+			}
+			b.moveQuiesceHooks(source, volume)
+			continue
+		}
+		var sub []string
+		if rel != "." {
+			sub = []string{rel}
+			b.moveQuiesceHooks(source, volume)
+		} else {
+			volume = source
+		}
+		byVolume[volume] = len(sources)
+		sources = append(sources, volume)
+		mountpoints = append(mountpoints, b.mountpoints[i])
+		subpaths = append(subpaths, sub)
+		if len(b.sourceUUIDs) > 0 {
+			uuids = append(uuids, b.sourceUUIDs[i])
+		}
+		if len(b.snapshotsToUse) > 0 {
+			snapshotsToUse = append(snapshotsToUse, b.snapshotsToUse[i])
+		}
+	}
+	b.sources, b.mountpoints, b.subpaths = sources, mountpoints, subpaths
+	if len(b.sourceUUIDs) > 0 {
+		b.sourceUUIDs = uuids
+	}
+	if len(b.snapshotsToUse) > 0 {
+		b.snapshotsToUse = snapshotsToUse
+	}
+}
+
+// printSubdirectorySources shows the volumes of directory sources and the
+// paths borg gets for them.
+func (b BorgBackup) printSubdirectorySources() {
+	for _, warning := range b.subdirWarnings {
+		b.logf(LevelWarn, "%s", warning)
+	}
+	for i, sub := range b.subpaths {
+		if sub != nil {
+			b.logf(LevelInfo, "Backing up %s of volume %s, mounted on %s, as %s", strings.Join(sub, ", "), b.sources[i], b.mountpoints[i], strings.Join(b.borgPaths(i), " "))
+		}
+	}
+}
+
+// moveQuiesceHooks keeps the -quiesce hooks of a directory source with the
+// volume whose snapshot they now surround.
+func (b *BorgBackup) moveQuiesceHooks(source string, volume string) {
+	hooks, ok := b.quiesceHooks[source]
+	if !ok || source == volume {
+		return
+	}
+	delete(b.quiesceHooks, source)
+	b.quiesceHooks[volume] = hooks
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reasons a child process can be paused for
+const (
+	pauseBySignal  = "signal"
+	pauseByThermal = "thermal throttling"
+)
+
+// suspender pauses a child process on SIGTSTP and resumes it on SIGCONT,
+// while borg-tm itself keeps running so the snapshots stay mounted and the
+// lock stays held. The process can also be paused programmatically, e.g. by
+// the thermal throttling.
+type suspender struct {
+	name    string
+	process Process
+	log     *runLog
+	signals chan os.Signal
+	done    chan struct{}
+
+	mu          sync.Mutex
+	pausedBy    string
+	pausedSince time.Time
+	pausedTotal map[string]time.Duration
+}
+
+func suspendOnSignals(name string, process Process, log *runLog) *suspender {
+	s := &suspender{
+		name:        name,
+		process:     process,
+		log:         log,
+		signals:     make(chan os.Signal, 1),
+		done:        make(chan struct{}),
+		pausedTotal: make(map[string]time.Duration),
+	}
+	signal.Notify(s.signals, syscall.SIGTSTP, syscall.SIGCONT)
+	go func() {
+		for {
+			select {
+			case <-s.done:
+				return
+			case sig := <-s.signals:
+				if sig == syscall.SIGTSTP {
+					s.pause(pauseBySignal)
+				} else {
+					s.resume(pauseBySignal)
+				}
+			}
+		}
+	}()
+	return s
+}
+
+// pause stops the process unless it is already paused.
+func (s *suspender) pause(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pausedBy != "" {
+		return
+	}
+	if err := s.process.Signal(syscall.SIGSTOP); err != nil {
+		s.log.logf(LevelWarn, "failed to pause %s: %v", s.name, err)
+		return
+	}
+	s.pausedBy = reason
+	s.pausedSince = time.Now()
+	s.log.logf(LevelInfo, "Paused %s (%s) since %s", s.name, reason, s.pausedSince.Format(time.RFC3339))
+}
+
+// resume continues the process if it was paused for reason. A SIGCONT
+// resumes the process regardless of why it was paused.
+func (s *suspender) resume(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pausedBy == "" || (reason != pauseBySignal && reason != s.pausedBy) {
+		return
+	}
+	if err := s.process.Signal(syscall.SIGCONT); err != nil {
+		s.log.logf(LevelWarn, "failed to resume %s: %v", s.name, err)
+		return
+	}
+	d := time.Since(s.pausedSince)
+	s.pausedTotal[s.pausedBy] += d
+	s.log.logf(LevelInfo, "Resumed %s after %s (%s)", s.name, d.Round(time.Second), s.pausedBy)
+	s.pausedBy = ""
+	s.pausedSince = time.Time{}
+}
+
+// stop restores the default signal handling and returns the total time the
+// process spent paused, per reason.
+func (s *suspender) stop() map[string]time.Duration {
+	signal.Stop(s.signals)
+	close(s.done)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pausedBy != "" {
+		s.pausedTotal[s.pausedBy] += time.Since(s.pausedSince)
+	}
+	return s.pausedTotal
+}
@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// flushBeforeSnapshot calls sync(2) and makes sure the contents of the
+// -fullfsync-path files are on the disk itself, not only in its cache,
+// before the snapshots freeze the volumes.
+func (b BorgBackup) flushBeforeSnapshot() error {
+	start := time.Now()
+	syscall.Sync()
+	for _, path := range b.fullfsyncPaths {
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Wrapf(err, "error while opening %s for F_FULLFSYNC", path)
+		}
+		err = fullfsync(f)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "error while flushing %s", path)
+		}
+	}
+	b.logf(LevelInfo, "Flushed filesystem buffers in %s", time.Since(start).Round(time.Millisecond))
+	return nil
+}
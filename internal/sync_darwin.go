@@ -0,0 +1,16 @@
+package internal
+
+import (
+	"os"
+	"syscall"
+)
+
+// fullfsync issues F_FULLFSYNC, which unlike fsync(2) also flushes the
+// drive's write cache.
+func fullfsync(f *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_FULLFSYNC, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
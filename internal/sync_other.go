@@ -0,0 +1,11 @@
+//go:build !darwin
+// +build !darwin
+
+package internal
+
+import "os"
+
+// fullfsync falls back to fsync(2), F_FULLFSYNC only exists on macOS.
+func fullfsync(f *os.File) error {
+	return f.Sync()
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CPU speed limit (percent) reported by `pmset -g therm` at or below which
+// the thermal pressure is considered serious
+const thermalSpeedLimit = 80
+
+var (
+	cpuSpeedLimitRegexp = regexp.MustCompile(`CPU_Speed_Limit\s*=\s*(\d+)`)
+	thermalLevelRegexp  = regexp.MustCompile(`(?i)thermal warning level set to (\d+)`)
+)
+
+// ThermalOptions configures pausing borg while the machine is under thermal
+// pressure or high load.
+type ThermalOptions struct {
+	Interval time.Duration // how often to sample
+	Cooldown time.Duration // how long to pause borg when throttling
+	MaxLoad  float64       // 1 minute load average considered too high, 0 disables
+}
+
+// thermalPressure parses `pmset -g therm` and returns a reason when the
+// pressure is serious, or "" otherwise.
+func thermalPressure(output string) string {
+	if m := cpuSpeedLimitRegexp.FindStringSubmatch(output); m != nil {
+		if limit, _ := strconv.Atoi(m[1]); limit <= thermalSpeedLimit {
+			return fmt.Sprintf("CPU speed limited to %d%%", limit)
+		}
+	}
+	if m := thermalLevelRegexp.FindStringSubmatch(output); m != nil {
+		if level, _ := strconv.Atoi(m[1]); level > 0 {
+			return fmt.Sprintf("thermal warning level %d", level)
+		}
+	}
+	return ""
+}
+
+// parseLoadAverage parses the 1 minute load from `sysctl -n vm.loadavg`,
+// which looks like `{ 2.10 1.95 1.80 }`.
+func parseLoadAverage(output string) (float64, bool) {
+	fields := strings.Fields(strings.Trim(strings.TrimSpace(output), "{}"))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	return load, err == nil
+}
+
+// throttleReason samples the thermal state and system load and returns why
+// borg should be paused, or "" if it can keep running.
+func (o ThermalOptions) throttleReason() string {
+	if out, err := helperOutput("pmset", "-g", "therm"); err == nil {
+		if reason := thermalPressure(out); reason != "" {
+			return reason
+		}
+	}
+	if o.MaxLoad > 0 {
+		if out, err := helperOutput("sysctl", "-n", "vm.loadavg"); err == nil {
+			if load, ok := parseLoadAverage(out); ok && load > o.MaxLoad {
+				return fmt.Sprintf("load average %.2f above %.2f", load, o.MaxLoad)
+			}
+		}
+	}
+	return ""
+}
+
+// throttle pauses the suspended process for Cooldown whenever a sample shows
+// serious pressure, until done is closed.
+func (o ThermalOptions) throttle(s *suspender, done <-chan struct{}) {
+	ticker := time.NewTicker(o.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		reason := o.throttleReason()
+		if reason == "" {
+			continue
+		}
+		s.log.logf(LevelInfo, "Throttling: %s, pausing borg for %s", reason, o.Cooldown)
+		s.pause(pauseByThermal)
+		select {
+		case <-done:
+			return
+		case <-time.After(o.Cooldown):
+		}
+		s.resume(pauseByThermal)
+	}
+}
@@ -0,0 +1,320 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTMExclusionDepth is how many directory levels below each source
+// -honor-tm-exclusions checks for the sticky exclusion attribute.
+const DefaultTMExclusionDepth = 4
+
+const (
+	// the exclusions shipped with macOS
+	tmStdExclusionsPlist = "/System/Library/CoreServices/backupd.bundle/Contents/Resources/StdExclusions.plist"
+	// the exclusions added with `tmutil addexclusion -p` or System Settings
+	tmPreferencesPlist = "/Library/Preferences/com.apple.TimeMachine.plist"
+	// paths per `tmutil isexcluded`
+	tmIsExcludedBatch = 200
+)
+
+// tmExclusionCacheFile returns where the results of the attribute scan are
+// kept for the repository.
+func tmExclusionCacheFile(repo string) string {
+	return filepath.Join(stateDir, "tm-exclusions-"+repoHash(repo)+".json")
+}
+
+// tmPathExclusion is a path on the live filesystem Time Machine leaves out.
+type tmPathExclusion struct {
+	path         string
+	contentsOnly bool // the directory itself is kept
+}
+
+type tmCacheEntry struct {
+	Depth int      `json:"depth"`
+	Paths []string `json:"paths"` // relative to the mountpoint
+}
+
+// tmExclusions holds what -honor-tm-exclusions found during a run. The
+// results of the attribute scan are cached by snapshot, as a snapshot never
+// changes. Failing to read or save the cache only costs a new scan.
+type tmExclusions struct {
+	cachePath string
+	Entries   map[string]tmCacheEntry `json:"entries"` // keyed by snapshot@source
+	paths     []tmPathExclusion
+	applied   int
+}
+
+func (b BorgBackup) loadTMExclusions(ctx context.Context) *tmExclusions {
+	t := &tmExclusions{cachePath: b.tmExclusionCacheFile, Entries: map[string]tmCacheEntry{}}
+	data, err := ioutil.ReadFile(t.cachePath)
+	if err == nil {
+		err = json.Unmarshal(data, t)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		b.logf(LevelWarn, "Ignoring the Time Machine exclusion cache %s: %v", t.cachePath, err)
+		t.Entries = map[string]tmCacheEntry{}
+	}
+	if t.Entries == nil {
+		t.Entries = map[string]tmCacheEntry{}
+	}
+	t.paths = b.tmPathExclusions(ctx)
+	return t
+}
+
+// store replaces the cached results of source, the older snapshots of a
+// source aren't scanned again.
+func (t *tmExclusions) store(b BorgBackup, source string, snapshot string, entry tmCacheEntry) {
+	for key := range t.Entries {
+		if strings.HasSuffix(key, "@"+source) {
+			delete(t.Entries, key)
+		}
+	}
+	t.Entries[snapshot+"@"+source] = entry
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(t.cachePath, data)
+	}
+	if err != nil {
+		b.logf(LevelWarn, "Could not save the Time Machine exclusion cache: %v", err)
+	}
+}
+
+// readPlistFile reads a property list, which macOS usually stores in the
+// binary format. A missing file is no error and returns nil.
+func (b BorgBackup) readPlistFile(ctx context.Context, path string) (map[string]interface{}, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	stdout, stderr, err := b.run(ctx, "plutil", []string{"-convert", "xml1", "-o", "-", path}, RunOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while converting %s: %s", path, strings.TrimSpace(string(stderr)))
+	}
+	v, err := parsePlist(bytes.NewReader(stdout))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while reading %s", path)
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("error while reading %s: not a dictionary", path)
+	}
+	return dict, nil
+}
+
+// userHomes lists the home directories below /Users.
+func userHomes() []string {
+	entries, err := ioutil.ReadDir("/Users")
+	if err != nil {
+		return nil
+	}
+	var homes []string
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != "Shared" && !strings.HasPrefix(e.Name(), ".") {
+			homes = append(homes, filepath.Join("/Users", e.Name()))
+		}
+	}
+	return homes
+}
+
+// the lists of paths in the exclusion plists, UserPathsExcluded is relative
+// to every home directory
+var tmExclusionKeys = []string{"PathsExcluded", "ContentsExcluded", "FileContentsExcluded", "UserPathsExcluded", "SkipPaths", "ExcludeByPath"}
+
+// tmPathExclusions reads the paths the exclusion lists of Time Machine name.
+// A list that can't be read is skipped with a warning.
+func (b BorgBackup) tmPathExclusions(ctx context.Context) []tmPathExclusion {
+	var exclusions []tmPathExclusion
+	homes := userHomes()
+	for _, plist := range []string{tmStdExclusionsPlist, tmPreferencesPlist} {
+		dict, err := b.readPlistFile(ctx, plist)
+		if err != nil {
+			b.logf(LevelWarn, "Ignoring the Time Machine exclusions in %s: %v", plist, err)
+			continue
+		}
+		for _, key := range tmExclusionKeys {
+			list, _ := dict[key].([]interface{})
+			for _, item := range list {
+				path, ok := item.(string)
+				if !ok || path == "" {
+					continue
+				}
+				switch key {
+				case "PathsExcluded", "FileContentsExcluded", "SkipPaths", "ExcludeByPath":
+					if filepath.IsAbs(path) {
+						exclusions = append(exclusions, tmPathExclusion{path: filepath.Clean(path)})
+					}
+				case "ContentsExcluded":
+					if filepath.IsAbs(path) {
+						exclusions = append(exclusions, tmPathExclusion{path: filepath.Clean(path), contentsOnly: true})
+					}
+				case "UserPathsExcluded":
+					for _, home := range homes {
+						exclusions = append(exclusions, tmPathExclusion{path: filepath.Join(home, path)})
+					}
+				}
+			}
+		}
+	}
+	return exclusions
+}
+
+// sourceTMExclusions returns the --exclude patterns for what Time Machine
+// leaves out of the i-th source, whose snapshot is mounted: the paths of the
+// exclusion lists that exist on it, and what `tmutil isexcluded` reports as
+// excluded up to -tm-exclusion-depth levels below it, which covers the
+// sticky com.apple.metadata:com_apple_backup_excludeItem attribute.
+func (b BorgBackup) sourceTMExclusions(ctx context.Context, i int, snapshot string) []string {
+	t := b.tmExclusions
+	if t == nil {
+		return nil
+	}
+	source := b.sources[i]
+	mountpoint := b.mountpoints[i]
+	var patterns []string
+	excluded := map[string]bool{}
+	for _, e := range t.paths {
+		translated, s, ok := b.mountedPath(e.path)
+		if !ok || s != source {
+			continue
+		}
+		if _, err := os.Lstat(translated); err != nil {
+			continue
+		}
+		b.logf(LevelDebug, "Excluding %s (Time Machine exclusion list) from the archive", e.path)
+		if e.contentsOnly {
+			// borg matches everything below a shell pattern ending in /
+			patterns = append(patterns, "sh:"+translated+"/")
+		} else {
+			patterns = append(patterns, "pf:"+translated)
+			excluded[translated] = true
+		}
+	}
+
+	var found []string
+	key := snapshot + "@" + source
+	if entry, ok := t.Entries[key]; ok && snapshot != "" && entry.Depth == b.tmExclusionDepth {
+		b.sourceLogf(i, "Using the cached Time Machine exclusions of snapshot %s\n", snapshot)
+		for _, rel := range entry.Paths {
+			found = append(found, filepath.Join(mountpoint, rel))
+		}
+	} else if b.tmExclusionDepth > 0 {
+		var err error
+		found, err = b.scanTMExcluded(ctx, i, excluded)
+		if err != nil {
+			b.logEntryf(b.sourceEntry(i, LevelWarn), "Ignoring the Time Machine exclusion attributes on source %s: %v", source, err)
+		} else if snapshot != "" {
+			// the live filesystem changes, so only snapshots are cached
+			entry := tmCacheEntry{Depth: b.tmExclusionDepth, Paths: []string{}}
+			for _, path := range found {
+				if rel, err := filepath.Rel(mountpoint, path); err == nil {
+					entry.Paths = append(entry.Paths, rel)
+				}
+			}
+			t.store(b, source, snapshot, entry)
+		}
+	}
+	for _, path := range found {
+		if excluded[path] {
+			continue
+		}
+		b.logf(LevelDebug, "Excluding %s (Time Machine exclusion attribute) from the archive", path)
+		patterns = append(patterns, "pf:"+path)
+	}
+	if len(patterns) > 0 {
+		b.sourceLogf(i, "Excluding %d paths Time Machine leaves out of source %s\n", len(patterns), source)
+	}
+	t.applied += len(patterns)
+	return patterns
+}
+
+// scanTMExcluded walks the mounted snapshot of the i-th source up to
+// -tm-exclusion-depth levels deep and asks tmutil which of the entries are
+// excluded. The walk stays on the snapshot and doesn't descend into skip or
+// into what is excluded.
+func (b BorgBackup) scanTMExcluded(ctx context.Context, i int, skip map[string]bool) ([]string, error) {
+	var found []string
+	for _, root := range b.borgPaths(i) {
+		// the slashdot form of borgPaths, the walk needs the plain path
+		root = filepath.Clean(root)
+		rootInfo, err := os.Lstat(root)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error while scanning %s", root)
+		}
+		level := []string{root}
+		for depth := 0; depth < b.tmExclusionDepth && len(level) > 0; depth++ {
+			var entries []string
+			for _, dir := range level {
+				infos, err := ioutil.ReadDir(dir)
+				if err != nil {
+					// e.g. permissions on a protected directory
+					continue
+				}
+				for _, info := range infos {
+					path := filepath.Join(dir, info.Name())
+					if !skip[path] {
+						entries = append(entries, path)
+					}
+				}
+			}
+			excluded, err := b.tmIsExcluded(ctx, entries)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, excluded...)
+			isExcluded := map[string]bool{}
+			for _, path := range excluded {
+				isExcluded[path] = true
+			}
+			level = nil
+			for _, path := range entries {
+				info, err := os.Lstat(path)
+				if err != nil || !info.IsDir() || isExcluded[path] || !sameDevice(info, rootInfo) {
+					continue
+				}
+				level = append(level, path)
+			}
+		}
+	}
+	return found, nil
+}
+
+// sameDevice reports whether both files are on the same filesystem.
+func sameDevice(a os.FileInfo, b os.FileInfo) bool {
+	sa, ok := a.Sys().(*syscall.Stat_t)
+	sb, ok2 := b.Sys().(*syscall.Stat_t)
+	return !ok || !ok2 || sa.Dev == sb.Dev
+}
+
+// tmIsExcluded returns the paths tmutil reports as excluded.
+func (b BorgBackup) tmIsExcluded(ctx context.Context, paths []string) ([]string, error) {
+	var excluded []string
+	for len(paths) > 0 {
+		n := len(paths)
+		if n > tmIsExcludedBatch {
+			n = tmIsExcludedBatch
+		}
+		stdout, stderr, err := b.run(ctx, tmUtilCmd, append([]string{"isexcluded"}, paths[:n]...), RunOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error while running tmutil isexcluded: %s", strings.TrimSpace(string(stderr)))
+		}
+		// [Excluded]    /path or [Included]    /path
+		sc := bufio.NewScanner(bytes.NewReader(stdout))
+		for sc.Scan() {
+			line := sc.Text()
+			if strings.HasPrefix(line, "[Excluded]") {
+				excluded = append(excluded, filepath.Clean(strings.TrimSpace(strings.TrimPrefix(line, "[Excluded]"))))
+			}
+		}
+		paths = paths[n:]
+	}
+	return excluded, nil
+}
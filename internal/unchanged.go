@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// heuristics of -change-detection
+const (
+	// borg create --dry-run --list: uses borg's files cache, but doesn't see
+	// deleted files, and the dry run reads the metadata of every file
+	ChangeDetectionDryRun = "borg-dry-run"
+	// sizes and mtimes of the previous run, kept in the state file: sees
+	// deleted files, but not content changed with the mtime restored, and
+	// also counts changes of excluded files
+	ChangeDetectionManifest = "manifest"
+)
+
+// SkippedUnchanged is Report.Skipped when -skip-if-unchanged found nothing
+// to back up.
+const SkippedUnchanged = "skipped, unchanged"
+
+// sourcesUnchanged reports whether nothing changed in the mounted sources
+// since the last archive, with -change-detection. The manifests of the
+// sources are returned to be saved once the archive was created.
+func (b BorgBackup) sourcesUnchanged(ctx context.Context, archiveName string, paths []string, st runState) (bool, map[string]string, error) {
+	var manifests map[string]string
+	if b.changeDetection == ChangeDetectionManifest {
+		var err error
+		manifests, err = b.sourceManifests()
+		if err != nil {
+			return false, nil, err
+		}
+	}
+	if st.LastArchive == "" {
+		b.logf(LevelInfo, "No previous archive, backing up")
+		return false, manifests, nil
+	}
+	for i, source := range b.sources {
+		if b.failures.has(i) {
+			b.logf(LevelInfo, "Source %s failed, backing up the others", source)
+			return false, manifests, nil
+		}
+	}
+	if b.changeDetection == ChangeDetectionManifest {
+		changed := false
+		for _, source := range b.sources {
+			if st.Manifests[source] != manifests[source] {
+				b.logf(LevelInfo, "Source %s changed since archive %s", source, st.LastArchive)
+				changed = true
+			}
+		}
+		return !changed, manifests, nil
+	}
+	changes, err := b.dryRunChanges(ctx, archiveName, paths)
+	if err != nil {
+		return false, nil, err
+	}
+	if changes > 0 {
+		b.logf(LevelInfo, "%d files changed since archive %s", changes, st.LastArchive)
+	}
+	return changes == 0, nil, nil
+}
+
+// dryRunChanges runs borg create --dry-run with the options of the real
+// one and counts the files it would add or modify, or failed to read.
+func (b BorgBackup) dryRunChanges(ctx context.Context, archiveName string, paths []string) (int, error) {
+	args := append([]string{"create", "--dry-run"}, b.borgCommonArgs()...)
+	// a borg that doesn't look at the files cache in dry runs lists every
+	// file as -, which has to count as a change
+	args = append(args, "--list", "--filter=AME-", "--log-json")
+	if b.excludeCaches {
+		args = append(args, "--exclude-caches")
+	}
+	for _, pattern := range b.excludes {
+		args = append(args, "--exclude", pattern)
+	}
+	args = append(args, b.borgArgs...)
+	args = append(append(args, "::"+archiveName), paths...)
+	b.logf(LevelInfo, "borg %v", args)
+	argv := b.wrapIOPolicy("borg", args)
+	opts := RunOptions{Stdout: os.Stderr}
+	closePassphrase, err := b.setBorgEnv(&opts)
+	if err != nil {
+		return 0, err
+	}
+	process, err := b.startReading(argv[0], argv[1:], opts, true)
+	closePassphrase()
+	if err != nil {
+		return 0, errors.Wrap(err, "error while starting borg create --dry-run")
+	}
+	// like borg create, so that it releases the lock
+	defer signalOnCancel(ctx, process, syscall.SIGINT)()
+	changes, unknown := 0, 0
+	sc := bufio.NewScanner(process)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var msg struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Path    string `json:"path"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &msg); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", sc.Bytes())
+			continue
+		}
+		switch msg.Type {
+		case "file_status":
+			changes++
+			if msg.Status == "-" {
+				unknown++
+			} else {
+				b.logf(LevelDebug, "Changed: %s %s", msg.Status, msg.Path)
+			}
+		case "log_message":
+			fmt.Fprintln(os.Stderr, msg.Message)
+		}
+	}
+	err = process.Wait()
+	if ctx.Err() != nil {
+		return 0, errors.Wrap(ctx.Err(), "change detection was interrupted")
+	}
+	if err != nil && !b.isBorgWarning(err) {
+		return 0, borgError(err, "running borg create --dry-run")
+	}
+	if unknown > 0 {
+		b.logf(LevelWarn, "This borg doesn't tell changed files apart in dry runs, so there is always something to back up; use -change-detection %s", ChangeDetectionManifest)
+	}
+	return changes, nil
+}
+
+// sourceManifests hashes the path, type, size and mtime of everything below
+// the paths of each source, by source.
+func (b BorgBackup) sourceManifests() (map[string]string, error) {
+	manifests := map[string]string{}
+	for i, source := range b.sources {
+		if b.failures.has(i) {
+			continue
+		}
+		h := sha256.New()
+		for _, root := range b.borgPaths(i) {
+			if err := writeManifest(h, root); err != nil {
+				return nil, errors.Wrapf(err, "error while listing the files of source %s", source)
+			}
+		}
+		manifests[source] = hex.EncodeToString(h.Sum(nil))
+	}
+	return manifests, nil
+}
+
+// writeManifest writes a line for every file below root to w. Paths are
+// relative to root, as the mountpoints may change between runs. Files that
+// can't be read are listed with the error, which is as stable as they are.
+func writeManifest(w io.Writer, root string) error {
+	root = filepath.Clean(root)
+	fmt.Fprintln(w, "root")
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		rel := strings.TrimPrefix(path, root)
+		if err != nil {
+			if path == root {
+				return err
+			}
+			fmt.Fprintf(w, "%q error %v\n", rel, err)
+			return nil
+		}
+		fmt.Fprintf(w, "%q %v %d %d\n", rel, info.Mode(), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultVerifySample is how many files -verify-after-backup compares.
+const DefaultVerifySample = 20
+
+// VerifyMismatch is a file whose content in the archive differs from the
+// mounted snapshot.
+type VerifyMismatch struct {
+	Path   string
+	Reason string
+}
+
+// VerifyError is returned by Run when files of the new archive don't match
+// the snapshot they were backed up from.
+type VerifyError struct {
+	Archive    string
+	Checked    int
+	Mismatches []VerifyMismatch
+}
+
+func (v *VerifyError) Error() string {
+	lines := make([]string, len(v.Mismatches))
+	for i, m := range v.Mismatches {
+		lines[i] = fmt.Sprintf("  %s: %s", m.Path, m.Reason)
+	}
+	return fmt.Sprintf("%d of %d sampled files in archive %s don't match the snapshot:\n%s", len(v.Mismatches), v.Checked, v.Archive, strings.Join(lines, "\n"))
+}
+
+// archivedFile is a regular file listed by borg list --json-lines.
+type archivedFile struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+}
+
+// snapshotPath returns where a path of the archive is in the mounted
+// snapshots, false for files of sources backed up live, which may have
+// changed since. The innermost source wins, like the Data volume below /.
+func (b BorgBackup) snapshotPath(archived string) (string, bool) {
+	best, bestLen := "", -1
+	for i, source := range b.sources {
+		if source == b.mountpoints[i] {
+			continue
+		}
+		local, length := "/"+archived, len(b.mountpoints[i])
+		if b.storeOriginalPaths {
+			// archived below <base>/./
+			local, length = filepath.Join(b.mountBases[i], archived), len(source)
+		}
+		if isWithin(filepath.Clean(local), filepath.Clean(b.mountpoints[i])) && length > bestLen {
+			best, bestLen = local, length
+		}
+	}
+	return best, bestLen >= 0
+}
+
+// sampleArchive picks up to n regular files of the archive at random. The
+// listing is streamed, as large archives list millions of items.
+func (b BorgBackup) sampleArchive(ctx context.Context, archive string, n int) ([]archivedFile, error) {
+	args := append([]string{"list", "--json-lines"}, b.borgCommonArgs()...)
+	opts := RunOptions{Stderr: os.Stderr}
+	closePassphrase, err := b.setBorgEnv(&opts)
+	if err != nil {
+		return nil, err
+	}
+	process, err := b.startReading("borg", append(args, "::"+archive), opts, false)
+	closePassphrase()
+	if err != nil {
+		return nil, errors.Wrap(err, "error while starting borg list")
+	}
+	defer signalOnCancel(ctx, process, os.Kill)()
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var sample []archivedFile
+	seen := 0
+	sc := bufio.NewScanner(process)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var f archivedFile
+		if err := json.Unmarshal(sc.Bytes(), &f); err != nil {
+			continue
+		}
+		// hard links and everything that isn't a regular file
+		if f.Type != "-" {
+			continue
+		}
+		if _, ok := b.snapshotPath(f.Path); !ok {
+			continue
+		}
+		// reservoir sampling
+		seen++
+		if len(sample) < n {
+			sample = append(sample, f)
+		} else if j := rnd.Intn(seen); j < n {
+			sample[j] = f
+		}
+	}
+	if err := process.Wait(); err != nil {
+		return nil, borgError(err, "listing archive "+archive)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrap(err, "error while reading borg list output")
+	}
+	return sample, nil
+}
+
+// hashReader returns the SHA-256 and the size of what r yields.
+func hashReader(r io.Reader) ([]byte, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	return h.Sum(nil), n, err
+}
+
+// archivedHash extracts path from the archive to stdout and hashes it.
+func (b BorgBackup) archivedHash(ctx context.Context, archive string, path string) ([]byte, int64, error) {
+	args := append([]string{"extract", "--stdout"}, b.borgCommonArgs()...)
+	// pf: only matches the file itself
+	opts := RunOptions{Stderr: os.Stderr}
+	closePassphrase, err := b.setBorgEnv(&opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	process, err := b.startReading("borg", append(args, "::"+archive, "pf:"+path), opts, false)
+	closePassphrase()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "error while starting borg extract")
+	}
+	defer signalOnCancel(ctx, process, os.Kill)()
+	sum, size, hashErr := hashReader(process)
+	if err := process.Wait(); err != nil {
+		return nil, 0, borgError(err, "extracting "+path)
+	}
+	return sum, size, errors.Wrap(hashErr, "error while reading borg extract output")
+}
+
+// verifyArchive compares -verify-sample random files of the archive with
+// the mounted snapshots by size and SHA-256. A snapshot never changes, so
+// every difference is a mismatch. They are returned as *VerifyError.
+func (b BorgBackup) verifyArchive(ctx context.Context, archive string) error {
+	if b.dryRun {
+		b.logf(LevelInfo, "Not verifying, the dry run created no archive")
+		return nil
+	}
+	sample, err := b.sampleArchive(ctx, archive, b.verifySample)
+	if err != nil {
+		return err
+	}
+	b.logf(LevelInfo, "Verifying %d files of archive %s against the snapshots", len(sample), archive)
+	verr := &VerifyError{Archive: archive, Checked: len(sample)}
+	for _, f := range sample {
+		local, _ := b.snapshotPath(f.Path)
+		mismatch := func(format string, args ...interface{}) {
+			reason := fmt.Sprintf(format, args...)
+			b.logf(LevelError, "Verify: %s: %s", f.Path, reason)
+			verr.Mismatches = append(verr.Mismatches, VerifyMismatch{Path: f.Path, Reason: reason})
+		}
+		file, err := os.Open(local)
+		if err != nil {
+			mismatch("can't be read from the snapshot: %v", err)
+			continue
+		}
+		localSum, localSize, err := hashReader(file)
+		file.Close()
+		if err != nil {
+			mismatch("can't be read from the snapshot: %v", err)
+			continue
+		}
+		sum, size, err := b.archivedHash(ctx, archive, f.Path)
+		if ctx.Err() != nil {
+			return errors.Wrap(ctx.Err(), "verifying was interrupted")
+		}
+		if err != nil {
+			mismatch("can't be extracted: %v", err)
+			continue
+		}
+		switch {
+		case size != localSize:
+			mismatch("%d bytes in the archive, %d in the snapshot", size, localSize)
+		case string(sum) != string(localSum):
+			mismatch("content differs (SHA-256 %x in the archive, %x in the snapshot)", sum, localSum)
+		default:
+			b.logf(LevelDebug, "Verify: %s matches", f.Path)
+		}
+	}
+	if len(verr.Mismatches) > 0 {
+		return verr
+	}
+	b.logf(LevelInfo, "All %d sampled files match the snapshots", len(sample))
+	return nil
+}
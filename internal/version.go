@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var borgVersionRegexp = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+// borgVersion is a parsed `borg --version`, e.g. {1, 2, 4}.
+type borgVersion [3]int
+
+func (v borgVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+func (v borgVersion) atLeast(major, minor, patch int) bool {
+	other := borgVersion{major, minor, patch}
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] > other[i]
+		}
+	}
+	return true
+}
+
+func parseBorgVersion(output string) (borgVersion, error) {
+	var v borgVersion
+	m := borgVersionRegexp.FindStringSubmatch(output)
+	if m == nil {
+		return v, errors.Errorf("unrecognized borg version %q", output)
+	}
+	for i := range v {
+		v[i], _ = strconv.Atoi(m[i+1])
+	}
+	return v, nil
+}
+
+func (b BorgBackup) getBorgVersion(ctx context.Context) (borgVersion, error) {
+	out, _, err := b.run(ctx, "borg", []string{"--version"}, RunOptions{})
+	if err != nil {
+		return borgVersion{}, errors.Wrap(err, "error while getting borg version")
+	}
+	return parseBorgVersion(string(out))
+}